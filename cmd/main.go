@@ -1,35 +1,227 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"virtual-file-system/internal/server"
 	"virtual-file-system/internal/services"
+	"virtual-file-system/internal/storage"
 	"virtual-file-system/internal/utils"
+
+	"github.com/peterh/liner"
 )
 
 var (
-	dispatcher *services.Dispatcher
+	dispatcher   *services.Dispatcher
+	store        storage.Store
+	storeKind    = flag.String("store", "memory", "storage backend: memory (journaled to the data file), file (snapshot rewritten on every change) or bolt (embedded database)")
+	dataFile     = flag.String("data-file", defaultDataFile("vfs.json"), "snapshot file loaded at startup and saved on exit, or database file of the bolt store (empty to disable)")
+	compactEvery = flag.Int("compact-every", services.DefaultCompactEvery, "number of journal records folded into a fresh snapshot")
+	output       = flag.String("output", "text", "format of the results and errors: text, json, csv, tsv or table")
+	command      = flag.String("c", "", "run a single command and exit")
+	scriptFile   = flag.String("f", "", "run the commands of a script file and exit")
+	stopOnError  = flag.Bool("stop-on-error", false, "stop at the first failed command instead of going on")
+	historyFile  = flag.String("history", defaultHistoryFile(), "file keeping the history of the commands typed in a terminal (empty to disable)")
+	nameMaxBytes = flag.Int("name-max-bytes", utils.DefaultNamePolicy.MaxBytes, "maximum length of a new name in bytes (0 for no limit)")
+	nameMaxChars = flag.Int("name-max-chars", utils.DefaultNamePolicy.MaxRunes, "maximum length of a new name in characters (0 for no limit)")
+	windowsNames = flag.Bool("windows-names", false, "also reject the names Windows reserves, like CON or nul.txt, and the names ending with a dot")
+	undoDepth    = flag.Int("undo-depth", services.DefaultUndoDepth, "number of commands that can be undone (0 to disable undo)")
+	trashKeep    = flag.Duration("trash-retention", services.DefaultTrashRetention, "how long deleted folders and files stay in the trash (0 to keep them until emptied)")
 )
 
-func init() {
-	dispatcher = services.NewDispatcher()
+func main() {
+	flag.Parse()
+
+	var err error
+	store, err = openStore()
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	dispatcher = services.NewDispatcher(store)
+	dispatcher.SetNamePolicy(namePolicy())
+	dispatcher.SetTrashRetention(*trashKeep)
+	// The bolt database isn't a snapshot, save and load need an explicit path
+	if *storeKind != "bolt" {
+		dispatcher.DataFile = *dataFile
+	}
+	dispatcher.CompactEvery = *compactEvery
+	dispatcher.UndoDepth = *undoDepth
+	dispatcher.Output, err = services.ParseFormat(*output)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	// Restore the previous session and replay its journal
+	if *storeKind == "memory" && dispatcher.DataFile != "" {
+		if err := dispatcher.Open(); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Save the tree when the process is interrupted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	if flag.Arg(0) == "serve" {
+		serve(flag.Args()[1:], signals)
+		return
+	}
+
+	go func() {
+		<-signals
+		fmt.Println()
+		save()
+		os.Exit(0)
+	}()
+
+	failures, err := run()
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	save()
+	if failures > 0 || err != nil {
+		os.Exit(1)
+	}
 }
 
-func main() {
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Print("# ")
-	// Read input from stdin
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		// Split the input into individual arguments
-		args := utils.SplitArguments(line)
-		// Execute the appropriate command using the dispatcher
-		err := dispatcher.Exec(args)
+// run runs the command of -c, the script of -f or the commands read from
+// stdin, and returns the number of failed commands
+func run() (int, error) {
+	options := services.ScriptOptions{StopOnError: *stopOnError}
+	switch {
+	case *command != "":
+		return dispatcher.RunScript(strings.NewReader(*command), options)
+	case *scriptFile != "":
+		file, err := os.Open(*scriptFile)
 		if err != nil {
-			fmt.Println(err.Error())
+			return 0, fmt.Errorf("Error: Cannot open the script: %v", err)
+		}
+		defer file.Close()
+		options.Name, options.Comments = *scriptFile, true
+		return dispatcher.RunScript(file, options)
+	default:
+		// Only prompt a user typing the commands, whose typos aren't failures
+		if interactive() {
+			options.Prompt = "# "
+			if !liner.TerminalSupported() {
+				_, err := dispatcher.RunScript(os.Stdin, options)
+				return 0, err
+			}
+			shell := newShell()
+			_, err := dispatcher.RunScript(shell, options)
+			if err := shell.Close(); err != nil {
+				fmt.Printf("Error: Cannot save the history: %v\n", err)
+			}
+			return 0, err
+		}
+		options.Name, options.Comments = "stdin", true
+		return dispatcher.RunScript(os.Stdin, options)
+	}
+}
+
+// interactive reports whether stdin is a terminal
+func interactive() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// serve runs the REST API until the process is interrupted
+func serve(args []string, signals <-chan os.Signal) {
+	serveFlags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := serveFlags.String("addr", ":8080", "address the REST API listens on")
+	serveFlags.Parse(args)
+
+	// The changes go through the dispatcher to be journaled like the commands
+	handler := server.NewDispatcherServer(dispatcher)
+	httpServer := &http.Server{Addr: *addr, Handler: handler}
+	go func() {
+		<-signals
+		httpServer.Shutdown(context.Background())
+	}()
+
+	fmt.Printf("Serving on %s\n", *addr)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Println(err.Error())
+	}
+	save()
+}
+
+// namePolicy returns the policy of the new names selected by the flags
+func namePolicy() utils.NamePolicy {
+	return utils.NamePolicy{MaxBytes: *nameMaxBytes, MaxRunes: *nameMaxChars, Windows: *windowsNames}
+}
+
+// openStore creates the storage backend selected by the flags
+func openStore() (storage.Store, error) {
+	if !flagSet("data-file") {
+		// The default data file is a JSON snapshot, use a database file instead
+		if *storeKind == "bolt" {
+			*dataFile = defaultDataFile("vfs.db")
+		}
+		// The default directory only exists once something has been saved
+		if *dataFile != "" {
+			if err := os.MkdirAll(filepath.Dir(*dataFile), 0o700); err != nil {
+				return nil, fmt.Errorf("Error: Cannot create the data directory: %v", err)
+			}
+		}
+	}
+
+	switch *storeKind {
+	case "memory":
+		return storage.NewMemoryStore(nil), nil
+	case "file":
+		if *dataFile == "" {
+			return nil, fmt.Errorf("Error: The file store requires a data file.")
+		}
+		return storage.OpenFileStore(*dataFile)
+	case "bolt":
+		if *dataFile == "" {
+			return nil, fmt.Errorf("Error: The bolt store requires a data file.")
+		}
+		return storage.OpenBoltStore(*dataFile)
+	default:
+		return nil, fmt.Errorf("Error: Unknown store %s.", *storeKind)
+	}
+}
+
+// defaultDataFile returns the path of the data file named name in the vfs
+// directory of the user's configuration, like ~/.config/vfs on Linux, or ""
+// to keep the tree in memory only when there is no such directory
+func defaultDataFile(name string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "vfs", name)
+}
+
+// flagSet reports whether the flag was passed on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
-		fmt.Print("# ")
+	})
+	return set
+}
+
+// save folds the journal into the data file if persistence is enabled
+func save() {
+	if err := dispatcher.Close(); err != nil {
+		fmt.Println(err.Error())
+	}
+	if err := store.Close(); err != nil {
+		fmt.Println(err.Error())
 	}
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"virtual-file-system/internal/utils"
+
+	"github.com/peterh/liner"
+)
+
+// shell reads the commands typed in a terminal with line editing, a history
+// searched with Ctrl-R and tab completion. It is the reader of RunScript,
+// which sets the prompt of every line.
+type shell struct {
+	line   *liner.State
+	prompt string
+	// pending is the rest of a line not read yet
+	pending []byte
+}
+
+// newShell starts line editing on the terminal and loads the history
+func newShell() *shell {
+	s := &shell{line: liner.NewLiner()}
+	s.line.SetCtrlCAborts(true)
+	s.line.SetTabCompletionStyle(liner.TabPrints)
+	s.line.SetWordCompleter(complete)
+	if file, err := os.Open(*historyFile); err == nil {
+		s.line.ReadHistory(file)
+		file.Close()
+	}
+	return s
+}
+
+// SetPrompt sets the prompt of the next line
+func (s *shell) SetPrompt(prompt string) {
+	s.prompt = prompt
+}
+
+// Read reads a line from the terminal. Only the commands, which are read
+// with a prompt, are added to the history. Ctrl-C discards the line and
+// Ctrl-D ends the session.
+func (s *shell) Read(p []byte) (int, error) {
+	if len(s.pending) == 0 {
+		text, err := s.line.Prompt(s.prompt)
+		if errors.Is(err, liner.ErrPromptAborted) {
+			text, err = "", nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if s.prompt != "" && text != "" {
+			s.line.AppendHistory(text)
+		}
+		s.pending = []byte(text + "\n")
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Close saves the history and restores the terminal
+func (s *shell) Close() error {
+	defer s.line.Close()
+	if *historyFile == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(*historyFile), 0o755); err != nil {
+		return err
+	}
+	file, err := os.Create(*historyFile)
+	if err != nil {
+		return err
+	}
+	if _, err := s.line.WriteHistory(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// complete completes the argument under the cursor from the command typed
+// before it, quoting the completions that need it
+func complete(line string, pos int) (string, []string, string) {
+	runes := []rune(line)
+	head, tail := string(runes[:pos]), string(runes[pos:])
+	before, args, partial, err := utils.SplitLastArgument(head)
+	if err != nil {
+		return head, nil, tail
+	}
+	completions := dispatcher.Complete(args, partial)
+	for i, completion := range completions {
+		completions[i] = utils.QuoteArgument(completion)
+	}
+	return before, completions, tail
+}
+
+// defaultHistoryFile is the history kept in the home directory, or none
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".vfs_history")
+}
@@ -3,8 +3,13 @@ module virtual-file-system
 go 1.20
 
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/peterh/liner v1.2.2
+	go.etcd.io/bbolt v1.3.8
+	golang.org/x/text v0.13.0
+)
+
+require (
+	github.com/mattn/go-runewidth v0.0.3 // indirect
 	github.com/stretchr/testify v1.8.4 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/sys v0.10.0 // indirect
 )
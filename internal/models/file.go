@@ -2,9 +2,14 @@ package models
 
 import "time"
 
-// File represents a file in the system
+// File represents a file in the system.
+// Content is only carried by whole-tree dumps and restores, the store keeps it
+// apart from the metadata and never returns it along with a file.
 type File struct {
-	Name        string
-	Description string
-	CreatedAt   time.Time
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ModifiedAt  time.Time `json:"modifiedAt"`
+	Content     []byte    `json:"-"`
 }
@@ -2,9 +2,13 @@ package models
 
 import "time"
 
+// Folder represents a folder which contains files and sub-folders.
+// ModifiedAt changes with its name, its description and its entries.
 type Folder struct {
-	Name        string
-	Description string
-	CreatedAt   time.Time
-	Files       map[string]File
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	ModifiedAt  time.Time         `json:"modifiedAt"`
+	Folders     map[string]Folder `json:"folders,omitempty"`
+	Files       map[string]File   `json:"files,omitempty"`
 }
@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// TrashItem is a deleted folder or file kept in the trash of its user until
+// it is restored or purged. Exactly one of Folder and File is set, the folder
+// with its whole subtree and the files with their content.
+type TrashItem struct {
+	ID string `json:"id"`
+	// Path is the slash-separated path of the folder the item was deleted
+	// from, empty for a folder at the root of the user
+	Path      string    `json:"path"`
+	DeletedAt time.Time `json:"deletedAt"`
+	Folder    *Folder   `json:"folder,omitempty"`
+	File      *File     `json:"file,omitempty"`
+}
+
+// Name returns the name of the deleted folder or file
+func (t TrashItem) Name() string {
+	if t.Folder != nil {
+		return t.Folder.Name
+	}
+	return t.File.Name
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// TreeSnapshot is a frozen copy of the folders and files of a user, taken
+// under a label. Root is the hash of the object of its root folder among the
+// objects of the user, which the snapshots of the user share.
+type TreeSnapshot struct {
+	Label     string    `json:"label"`
+	CreatedAt time.Time `json:"createdAt"`
+	Root      string    `json:"root"`
+}
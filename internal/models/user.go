@@ -1,7 +1,18 @@
 package models
 
-// User represents a user in the system
+import "time"
+
+// User represents a user in the system.
+// Trash holds the deleted folders and files of the user by their id, and
+// LastTrashID is the last id handed out there so that none is reused,
+// Snapshots its tree snapshots by the key of their label and Objects the
+// frozen folders and contents of the snapshots by their hash.
 type User struct {
-	Name    string
-	Folders map[string]Folder
+	Name        string                  `json:"name"`
+	CreatedAt   time.Time               `json:"createdAt"`
+	LastTrashID int                     `json:"lastTrashId,omitempty"`
+	Folders     map[string]Folder       `json:"folders,omitempty"`
+	Trash       map[string]TrashItem    `json:"trash,omitempty"`
+	Snapshots   map[string]TreeSnapshot `json:"snapshots,omitempty"`
+	Objects     map[string][]byte       `json:"objects,omitempty"`
 }
@@ -0,0 +1,612 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/services"
+	"virtual-file-system/internal/storage"
+	"virtual-file-system/internal/utils"
+)
+
+// Server serves the services as a JSON REST API:
+//
+//	POST   /users                                       register a user
+//	GET    /users/{u}/folders                           list the folders
+//	POST   /users/{u}/folders                           create a folder
+//	PATCH  /users/{u}/folders/{f}                       rename a folder
+//	DELETE /users/{u}/folders/{f}                       delete a folder
+//	GET    /users/{u}/folders/{f}/files                 list the files
+//	GET    /users/{u}/folders/{f}/files/{name}          get a file
+//	POST   /users/{u}/folders/{f}/files/{name}          create a file
+//	DELETE /users/{u}/folders/{f}/files/{name}          delete a file
+//	GET    /users/{u}/folders/{f}/files/{name}/content  read the content
+//	PUT    /users/{u}/folders/{f}/files/{name}/content  replace the content
+//	GET    /users/{u}/trash                             list the trash
+//	DELETE /users/{u}/trash                             empty the trash
+//	POST   /users/{u}/trash/{id}                        restore an item
+//
+// A folder path is a single path segment with its slashes escaped as %2F.
+// Listings accept ?sort=name|created|modified|size&order=asc|desc, and the folder
+// listing also accepts ?parent= to list the sub-folders of a folder. Both
+// listings accept ?at= to list them as they were in a snapshot. Deleted
+// folders and files go to the trash unless ?permanent=true is given, and a
+// restore accepts ?conflict=fail|overwrite|rename.
+type Server struct {
+	userService   *services.UserService
+	folderService *services.FolderService
+	fileService   *services.FileService
+	// dispatcher journals the changes when the server runs on its services
+	dispatcher *services.Dispatcher
+}
+
+// NewServer creates a new instance of Server on top of the store
+func NewServer(store storage.Store) *Server {
+	userService := services.NewUserService(store)
+	folderService := services.NewFolderService(userService)
+	fileService := services.NewFileService(userService, folderService)
+	return &Server{
+		userService:   userService,
+		folderService: folderService,
+		fileService:   fileService,
+	}
+}
+
+// NewDispatcherServer creates a new instance of Server on top of the services
+// of the dispatcher. Every change is journaled as the command it matches, so
+// it is replayed after a crash like the changes of the commands.
+func NewDispatcherServer(dispatcher *services.Dispatcher) *Server {
+	userService, folderService, fileService := dispatcher.Services()
+	return &Server{
+		userService:   userService,
+		folderService: folderService,
+		fileService:   fileService,
+		dispatcher:    dispatcher,
+	}
+}
+
+// SetNamePolicy sets the policy checking the names of new users, folders and
+// files. It must be called before the server is used.
+func (s *Server) SetNamePolicy(policy utils.NamePolicy) {
+	s.userService.NamePolicy = policy
+}
+
+// SetTrashRetention sets how long deleted folders and files stay in the
+// trash, forever if zero. It must be called before the server is used.
+func (s *Server) SetTrashRetention(retention time.Duration) {
+	s.userService.TrashRetention = retention
+}
+
+// userRequest is the body of POST /users
+type userRequest struct {
+	Name string `json:"name"`
+}
+
+// folderRequest is the body of POST and PATCH on folders. Name is the
+// folder path when creating and the new name when renaming.
+type folderRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parents     bool   `json:"parents"`
+}
+
+// fileRequest is the body of POST on files
+type fileRequest struct {
+	Description string `json:"description"`
+}
+
+// restoreResponse is the body of a successful restore. Path is the path of
+// the restored folder, or of the restored file within its folder.
+type restoreResponse struct {
+	Path string `json:"path"`
+}
+
+// errorResponse is the body of every failed request. Code is the stable
+// code of a service error.
+type errorResponse struct {
+	Error string        `json:"error"`
+	Code  services.Code `json:"code,omitempty"`
+}
+
+// statusCodes maps the codes of the service errors to HTTP statuses
+var statusCodes = map[services.Code]int{
+	services.CodeUserNotFound:      http.StatusNotFound,
+	services.CodeFolderNotFound:    http.StatusNotFound,
+	services.CodeFileNotFound:      http.StatusNotFound,
+	services.CodeUserExists:        http.StatusConflict,
+	services.CodeFolderExists:      http.StatusConflict,
+	services.CodeFileExists:        http.StatusConflict,
+	services.CodeInvalidName:       http.StatusBadRequest,
+	services.CodeInvalidSortFlag:   http.StatusBadRequest,
+	services.CodeInvalidSize:       http.StatusBadRequest,
+	services.CodeMoveIntoItself:    http.StatusBadRequest,
+	services.CodeInvalidOffset:     http.StatusBadRequest,
+	services.CodeUserNotEmpty:      http.StatusConflict,
+	services.CodeTrashItemNotFound: http.StatusNotFound,
+	services.CodeSnapshotNotFound:  http.StatusNotFound,
+	services.CodeSnapshotExists:    http.StatusConflict,
+	services.CodeFileChanged:       http.StatusConflict,
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments, err := splitPath(r.URL.EscapedPath())
+	if err != nil || len(segments) == 0 || segments[0] != "users" {
+		writeError(w, http.StatusNotFound, "Error: Not found.")
+		return
+	}
+
+	switch {
+	case len(segments) == 1:
+		s.handleUsers(w, r)
+	case len(segments) == 3 && segments[2] == "folders":
+		s.handleFolders(w, r, segments[1])
+	case len(segments) == 4 && segments[2] == "folders":
+		s.handleFolder(w, r, segments[1], segments[3])
+	case len(segments) == 5 && segments[2] == "folders" && segments[4] == "files":
+		s.handleFiles(w, r, segments[1], segments[3])
+	case len(segments) == 6 && segments[2] == "folders" && segments[4] == "files":
+		s.handleFile(w, r, segments[1], segments[3], segments[5])
+	case len(segments) == 7 && segments[2] == "folders" && segments[4] == "files" && segments[6] == "content":
+		s.handleContent(w, r, segments[1], segments[3], segments[5])
+	case len(segments) == 3 && segments[2] == "trash":
+		s.handleTrash(w, r, segments[1])
+	case len(segments) == 4 && segments[2] == "trash":
+		s.handleTrashItem(w, r, segments[1], segments[3])
+	default:
+		writeError(w, http.StatusNotFound, "Error: Not found.")
+	}
+}
+
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	var body userRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+	err := s.apply(command("register", nil, body.Name), func() error {
+		return s.userService.Register(body.Name)
+	})
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	s.writeUser(w, http.StatusCreated, body.Name)
+}
+
+func (s *Server) handleFolders(w http.ResponseWriter, r *http.Request, userName string) {
+	switch r.Method {
+	case http.MethodGet:
+		sortFlag, orderFlag, ok := sortFlags(w, r)
+		if !ok {
+			return
+		}
+		query := r.URL.Query()
+		folders, err := s.folderService.GetSubFoldersAt(userName, query.Get("at"), query.Get("parent"), sortFlag, orderFlag)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, folders)
+	case http.MethodPost:
+		var body folderRequest
+		if !readJSON(w, r, &body) {
+			return
+		}
+		flags := []string{}
+		if body.Parents {
+			flags = append(flags, "-p")
+		}
+		err := s.apply(command("create-folder", flags, userName, body.Name, body.Description), func() error {
+			if body.Parents {
+				return s.folderService.CreateFolderAll(userName, body.Name, body.Description)
+			}
+			return s.folderService.CreateFolder(userName, body.Name, body.Description)
+		})
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		s.writeFolder(w, http.StatusCreated, userName, body.Name)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (s *Server) handleFolder(w http.ResponseWriter, r *http.Request, userName, folderName string) {
+	switch r.Method {
+	case http.MethodPatch:
+		var body folderRequest
+		if !readJSON(w, r, &body) {
+			return
+		}
+		err := s.apply(command("rename-folder", nil, userName, folderName, body.Name), func() error {
+			return s.folderService.RenameFolder(userName, folderName, body.Name)
+		})
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		// A new name without a slash stays in the same parent
+		newFolderName := body.Name
+		if !strings.Contains(newFolderName, utils.PathSeparator) {
+			parent, _ := utils.SplitParent(folderName)
+			newFolderName = utils.JoinPath(parent, newFolderName)
+		}
+		s.writeFolder(w, http.StatusOK, userName, newFolderName)
+	case http.MethodDelete:
+		err := s.apply(command("delete-folder", permanentFlags(r), userName, folderName), func() error {
+			return s.folderService.DeleteFolder(userName, folderName, permanent(r))
+		})
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request, userName, folderName string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	sortFlag, orderFlag, ok := sortFlags(w, r)
+	if !ok {
+		return
+	}
+	files, err := s.fileService.GetFilesAt(userName, r.URL.Query().Get("at"), folderName, sortFlag, orderFlag)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, userName, folderName, fileName string) {
+	switch r.Method {
+	case http.MethodGet:
+		s.writeFile(w, http.StatusOK, userName, folderName, fileName)
+	case http.MethodPost:
+		var body fileRequest
+		if !readJSON(w, r, &body) {
+			return
+		}
+		err := s.apply(command("create-file", nil, userName, folderName, fileName, body.Description), func() error {
+			return s.fileService.CreateFile(userName, folderName, fileName, body.Description)
+		})
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		s.writeFile(w, http.StatusCreated, userName, folderName, fileName)
+	case http.MethodDelete:
+		err := s.apply(command("delete-file", permanentFlags(r), userName, folderName, fileName), func() error {
+			return s.fileService.DeleteFile(userName, folderName, fileName, permanent(r))
+		})
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+func (s *Server) handleContent(w http.ResponseWriter, r *http.Request, userName, folderName, fileName string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		file, err := s.findFile(userName, folderName, fileName)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		reader, err := s.fileService.Open(userName, folderName, fileName)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		defer reader.Close()
+		// ServeContent handles range requests through Seek
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, file.Name, file.ModifiedAt, reader)
+	case http.MethodPut:
+		// The journal records the content as an argument, so it is only
+		// streamed when there is no journal
+		var content io.Reader = r.Body
+		var args []string
+		if s.dispatcher != nil {
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("Error: Cannot read the content: %v", err))
+				return
+			}
+			content = bytes.NewReader(data)
+			args = command("write-file", nil, userName, folderName, fileName, string(data))
+		}
+		err := s.apply(args, func() error {
+			writer, err := s.fileService.OpenWriter(userName, folderName, fileName, false)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(writer, content)
+			if closeErr := writer.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		})
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		s.writeFile(w, http.StatusOK, userName, folderName, fileName)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodHead, http.MethodPut)
+	}
+}
+
+func (s *Server) handleTrash(w http.ResponseWriter, r *http.Request, userName string) {
+	switch r.Method {
+	case http.MethodGet:
+		items, err := s.userService.GetTrash(userName)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, items)
+	case http.MethodDelete:
+		err := s.apply(command("empty-trash", nil, userName), func() error {
+			return s.userService.EmptyTrash(userName)
+		})
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func (s *Server) handleTrashItem(w http.ResponseWriter, r *http.Request, userName, id string) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	conflict, ok := conflictPolicy(w, r)
+	if !ok {
+		return
+	}
+	var path string
+	err := s.apply(command("restore", []string{conflictFlag(conflict)}, userName, id), func() error {
+		var err error
+		path, err = s.userService.RestoreTrash(userName, id, conflict)
+		return err
+	})
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, restoreResponse{Path: path})
+}
+
+// writeUser responds with the user as it is stored
+func (s *Server) writeUser(w http.ResponseWriter, status int, userName string) {
+	users, err := s.userService.GetUsers("--sort-name", "asc")
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	for _, user := range users {
+		if utils.NameKey(user.Name) == utils.NameKey(userName) {
+			writeJSON(w, status, user)
+			return
+		}
+	}
+	writeServiceError(w, &services.Error{Code: services.CodeUserNotFound, Name: userName})
+}
+
+// writeFolder responds with the folder at the path
+func (s *Server) writeFolder(w http.ResponseWriter, status int, userName, folderName string) {
+	parent, name := utils.SplitParent(folderName)
+	folders, err := s.folderService.GetSubFolders(userName, parent, "--sort-name", "asc")
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	for _, folder := range folders {
+		if utils.NameKey(folder.Name) == utils.NameKey(name) {
+			writeJSON(w, status, folder)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("Error: The %s doesn't exist.", folderName))
+}
+
+// writeFile responds with the metadata of the file
+func (s *Server) writeFile(w http.ResponseWriter, status int, userName, folderName, fileName string) {
+	file, err := s.findFile(userName, folderName, fileName)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, status, file)
+}
+
+// findFile returns the metadata of the file
+func (s *Server) findFile(userName, folderName, fileName string) (models.File, error) {
+	files, err := s.fileService.GetFiles(userName, folderName, "--sort-name", "asc")
+	if err != nil {
+		return models.File{}, err
+	}
+	for _, file := range files {
+		if utils.NameKey(file.Name) == utils.NameKey(fileName) {
+			return file, nil
+		}
+	}
+	return models.File{}, &services.Error{Code: services.CodeFileNotFound, Name: fileName}
+}
+
+// sortFlags converts the sort and order query parameters to the flags of
+// the services
+func sortFlags(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	query := r.URL.Query()
+	sortFlag, orderFlag := "--sort-name", "asc"
+	switch query.Get("sort") {
+	case "", "name":
+	case "created":
+		sortFlag = "--sort-created"
+	case "modified":
+		sortFlag = "--sort-modified"
+	case "size":
+		sortFlag = "--sort-size"
+	default:
+		writeServiceError(w, &services.Error{Code: services.CodeInvalidSortFlag, Name: query.Get("sort")})
+		return "", "", false
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		orderFlag = "desc"
+	default:
+		writeServiceError(w, &services.Error{Code: services.CodeInvalidSortFlag, Name: query.Get("order")})
+		return "", "", false
+	}
+	return sortFlag, orderFlag, true
+}
+
+// permanent reports whether the permanent query parameter asks a deletion
+// to bypass the trash
+func permanent(r *http.Request) bool {
+	value, _ := strconv.ParseBool(r.URL.Query().Get("permanent"))
+	return value
+}
+
+// permanentFlags returns the flags of the delete commands matching the
+// permanent query parameter
+func permanentFlags(r *http.Request) []string {
+	if permanent(r) {
+		return []string{"--permanent"}
+	}
+	return []string{}
+}
+
+// conflictFlag returns the flag of the commands matching the policy
+func conflictFlag(conflict services.ConflictPolicy) string {
+	switch conflict {
+	case services.ConflictOverwrite:
+		return "--overwrite"
+	case services.ConflictRename:
+		return "--rename"
+	default:
+		return "--fail"
+	}
+}
+
+// command returns the arguments of the command matching a change. The
+// arguments of a command with flags follow -- so that none is taken for a
+// flag, flags is nil for the other commands.
+func command(name string, flags []string, args ...string) []string {
+	line := append([]string{name}, flags...)
+	if flags != nil {
+		line = append(line, "--")
+	}
+	return append(line, args...)
+}
+
+// apply runs the change, journaled as the command of args when the server
+// runs on a dispatcher
+func (s *Server) apply(args []string, change func() error) error {
+	if s.dispatcher == nil {
+		return change()
+	}
+	return s.dispatcher.Apply(args, change)
+}
+
+// conflictPolicy converts the conflict query parameter to the policy of the
+// services
+func conflictPolicy(w http.ResponseWriter, r *http.Request) (services.ConflictPolicy, bool) {
+	switch conflict := r.URL.Query().Get("conflict"); conflict {
+	case "", "fail":
+		return services.ConflictFail, true
+	case "overwrite":
+		return services.ConflictOverwrite, true
+	case "rename":
+		return services.ConflictRename, true
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Error: The conflict policy %s is invalid.", conflict))
+		return 0, false
+	}
+}
+
+// splitPath splits the escaped URL path into its unescaped segments
+func splitPath(path string) ([]string, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil, nil
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = unescaped
+	}
+	return segments, nil
+}
+
+// readJSON decodes the request body into v, responding with an error if it
+// is invalid. An empty body leaves v unchanged.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Error: Invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{Error: message})
+}
+
+// writeServiceError responds with the error of a service and the status
+// matching its code
+func writeServiceError(w http.ResponseWriter, err error) {
+	var serviceErr *services.Error
+	if !errors.As(err, &serviceErr) {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	status, ok := statusCodes[serviceErr.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error(), Code: serviceErr.Code})
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "Error: Method not allowed.")
+}
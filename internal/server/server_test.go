@@ -0,0 +1,403 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/services"
+	"virtual-file-system/internal/storage"
+)
+
+// do sends a request to the server and returns the response with its body
+func do(t *testing.T, server *httptest.Server, method, path, body string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest() has error: %s", err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s has error: %s", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+func TestServer_Requests(t *testing.T) {
+	server := httptest.NewServer(NewServer(storage.NewMemoryStore(nil)))
+	defer server.Close()
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Register a user",
+			method:         http.MethodPost,
+			path:           "/users",
+			body:           `{"name": "Dalaoqi"}`,
+			expectedStatus: http.StatusCreated,
+			expectedBody:   `"name":"Dalaoqi"`,
+		},
+		{
+			name:           "Register a duplicated user",
+			method:         http.MethodPost,
+			path:           "/users",
+			body:           `{"name": "dalaoqi"}`,
+			expectedStatus: http.StatusConflict,
+			expectedBody:   `"error":"Error: The dalaoqi has already existed.","code":2`,
+		},
+		{
+			name:           "Register with an invalid body",
+			method:         http.MethodPost,
+			path:           "/users",
+			body:           `{"username": "dalaoqi"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `Invalid request body`,
+		},
+		{
+			name:           "List the folders of a user without any",
+			method:         http.MethodGet,
+			path:           "/users/dalaoqi/folders",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `[]`,
+		},
+		{
+			name:           "Create a folder",
+			method:         http.MethodPost,
+			path:           "/users/dalaoqi/folders",
+			body:           `{"name": "docs", "description": "the docs"}`,
+			expectedStatus: http.StatusCreated,
+			expectedBody:   `"name":"docs","description":"the docs"`,
+		},
+		{
+			name:           "Create a nested folder with its parents",
+			method:         http.MethodPost,
+			path:           "/users/dalaoqi/folders",
+			body:           `{"name": "projects/2024", "parents": true}`,
+			expectedStatus: http.StatusCreated,
+			expectedBody:   `"name":"2024"`,
+		},
+		{
+			name:           "Create a folder with invalid chars",
+			method:         http.MethodPost,
+			path:           "/users/dalaoqi/folders",
+			body:           `{"name": "bad|name"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `"error":"Error: The bad|name contains the invalid char '|' at position 4."`,
+		},
+		{
+			name:           "Create a folder for a non-existing user",
+			method:         http.MethodPost,
+			path:           "/users/nobody/folders",
+			body:           `{"name": "docs"}`,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `"error":"Error: The nobody doesn't exist."`,
+		},
+		{
+			name:           "List the folders sorted by name in descending order",
+			method:         http.MethodGet,
+			path:           "/users/dalaoqi/folders?sort=name&order=desc",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `[{"name":"projects"`,
+		},
+		{
+			name:           "List the sub-folders of a folder",
+			method:         http.MethodGet,
+			path:           "/users/dalaoqi/folders?parent=projects",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `[{"name":"2024"`,
+		},
+		{
+			name:           "List the folders of a missing snapshot",
+			method:         http.MethodGet,
+			path:           "/users/dalaoqi/folders?at=before",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `"error":"Error: The snapshot before doesn't exist.","code":14`,
+		},
+		{
+			name:           "List the folders with an invalid sort",
+			method:         http.MethodGet,
+			path:           "/users/dalaoqi/folders?sort=color",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `"error":"Error: The sort flag color is invalid.","code":8`,
+		},
+		{
+			name:           "Rename a nested folder",
+			method:         http.MethodPatch,
+			path:           "/users/dalaoqi/folders/projects%2F2024",
+			body:           `{"name": "2025"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"name":"2025"`,
+		},
+		{
+			name:           "Rename a non-existing folder",
+			method:         http.MethodPatch,
+			path:           "/users/dalaoqi/folders/nothing",
+			body:           `{"name": "other"}`,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `"error":"Error: The nothing doesn't exist.","code":3`,
+		},
+		{
+			name:           "Create a file",
+			method:         http.MethodPost,
+			path:           "/users/dalaoqi/folders/docs/files/notes",
+			body:           `{"description": "meeting notes"}`,
+			expectedStatus: http.StatusCreated,
+			expectedBody:   `"name":"notes","description":"meeting notes","size":0`,
+		},
+		{
+			name:           "Create a file without a body",
+			method:         http.MethodPost,
+			path:           "/users/dalaoqi/folders/docs/files/todo",
+			expectedStatus: http.StatusCreated,
+			expectedBody:   `"name":"todo"`,
+		},
+		{
+			name:           "Create a duplicated file",
+			method:         http.MethodPost,
+			path:           "/users/dalaoqi/folders/docs/files/notes",
+			expectedStatus: http.StatusConflict,
+			expectedBody:   `"error":"Error: The notes has already existed in the docs."`,
+		},
+		{
+			name:           "Write the content of a file",
+			method:         http.MethodPut,
+			path:           "/users/dalaoqi/folders/docs/files/notes/content",
+			body:           "hello world",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"size":11`,
+		},
+		{
+			name:           "Read the content of a file",
+			method:         http.MethodGet,
+			path:           "/users/dalaoqi/folders/docs/files/notes/content",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `hello world`,
+		},
+		{
+			name:           "Get a file",
+			method:         http.MethodGet,
+			path:           "/users/dalaoqi/folders/docs/files/notes",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"name":"notes","description":"meeting notes","size":11`,
+		},
+		{
+			name:           "Get a non-existing file",
+			method:         http.MethodGet,
+			path:           "/users/dalaoqi/folders/docs/files/nope",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `"error":"Error: The nope doesn't exist.","code":5`,
+		},
+		{
+			name:           "Read the content of a non-existing file",
+			method:         http.MethodGet,
+			path:           "/users/dalaoqi/folders/docs/files/nope/content",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `"error":"Error: The nope doesn't exist.","code":5`,
+		},
+		{
+			name:           "List the files sorted by size",
+			method:         http.MethodGet,
+			path:           "/users/dalaoqi/folders/docs/files?sort=size&order=desc",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `[{"name":"notes"`,
+		},
+		{
+			name:           "List the files of a non-existing folder",
+			method:         http.MethodGet,
+			path:           "/users/dalaoqi/folders/nothing/files",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `"error":"Error: The nothing doesn't exist."`,
+		},
+		{
+			name:           "Delete a file",
+			method:         http.MethodDelete,
+			path:           "/users/dalaoqi/folders/docs/files/todo",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "Delete a non-existing file",
+			method:         http.MethodDelete,
+			path:           "/users/dalaoqi/folders/docs/files/todo",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `"error":"Error: The todo doesn't exist."`,
+		},
+		{
+			name:           "Delete a folder",
+			method:         http.MethodDelete,
+			path:           "/users/dalaoqi/folders/projects",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "List the trash",
+			method:         http.MethodGet,
+			path:           "/users/dalaoqi/trash",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `[{"id":"1","path":"docs"`,
+		},
+		{
+			name:           "Restore a file from the trash",
+			method:         http.MethodPost,
+			path:           "/users/dalaoqi/trash/1",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"path":"docs/todo"}`,
+		},
+		{
+			name:           "Restore a missing item",
+			method:         http.MethodPost,
+			path:           "/users/dalaoqi/trash/1",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `"error":"Error: The item 1 isn't in the trash.","code":13`,
+		},
+		{
+			name:           "Restore with an invalid conflict policy",
+			method:         http.MethodPost,
+			path:           "/users/dalaoqi/trash/2?conflict=merge",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `"error":"Error: The conflict policy merge is invalid."`,
+		},
+		{
+			name:           "Delete a file permanently",
+			method:         http.MethodDelete,
+			path:           "/users/dalaoqi/folders/docs/files/todo?permanent=true",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "Empty the trash",
+			method:         http.MethodDelete,
+			path:           "/users/dalaoqi/trash",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "List the empty trash",
+			method:         http.MethodGet,
+			path:           "/users/dalaoqi/trash",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `[]`,
+		},
+		{
+			name:           "Unsupported method",
+			method:         http.MethodPut,
+			path:           "/users/dalaoqi/folders",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedBody:   `"error":"Error: Method not allowed."`,
+		},
+		{
+			name:           "Unknown path",
+			method:         http.MethodGet,
+			path:           "/groups",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `"error":"Error: Not found."`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			resp, body := do(t, server, test.method, test.path, test.body)
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("%s %s status = %d, expected: %d (%s)", test.method, test.path, resp.StatusCode, test.expectedStatus, body)
+			}
+			if !strings.Contains(body, test.expectedBody) {
+				t.Errorf("%s %s body = %s, expected to contain: %s", test.method, test.path, body, test.expectedBody)
+			}
+		})
+	}
+}
+
+func TestServer_Register(t *testing.T) {
+	server := httptest.NewServer(NewServer(storage.NewMemoryStore(nil)))
+	defer server.Close()
+
+	// The reply is the stored user, with its name in NFC and its creation date
+	resp, body := do(t, server, http.MethodPost, "/users", `{"name": "Cafe\u0301"}`)
+	var user models.User
+	if err := json.Unmarshal([]byte(body), &user); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Register = %d %s, %v", resp.StatusCode, body, err)
+	}
+	if user.Name != "Caf\u00e9" || user.CreatedAt.IsZero() {
+		t.Errorf("Register = %+v, expected Caf\u00e9 with its creation date", user)
+	}
+}
+
+func TestServer_RangeRequest(t *testing.T) {
+	server := httptest.NewServer(NewServer(storage.NewMemoryStore(nil)))
+	defer server.Close()
+
+	do(t, server, http.MethodPost, "/users", `{"name": "dalaoqi"}`)
+	do(t, server, http.MethodPost, "/users/dalaoqi/folders", `{"name": "docs"}`)
+	do(t, server, http.MethodPost, "/users/dalaoqi/folders/docs/files/notes", "")
+	do(t, server, http.MethodPut, "/users/dalaoqi/folders/docs/files/notes/content", "0123456789")
+
+	resp, body := do(t, server, http.MethodGet, "/users/dalaoqi/folders/docs/files/notes/content", "", "Range", "bytes=2-5")
+	if resp.StatusCode != http.StatusPartialContent || body != "2345" {
+		t.Errorf("Range request = %d %q, expected: 206 \"2345\"", resp.StatusCode, body)
+	}
+
+	resp, body = do(t, server, http.MethodGet, "/users/dalaoqi/folders/docs/files", "")
+	var files []models.File
+	if err := json.Unmarshal([]byte(body), &files); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Listing files = %d %s, %v", resp.StatusCode, body, err)
+	}
+	if len(files) != 1 || files[0].Size != 10 {
+		t.Errorf("Listing files = %v, expected notes with a size of 10", files)
+	}
+}
+
+func TestServer_Journal(t *testing.T) {
+	dataFile := filepath.Join(t.TempDir(), "vfs.json")
+	open := func() *services.Dispatcher {
+		d := services.NewDispatcher(storage.NewMemoryStore(nil))
+		d.DataFile = dataFile
+		if err := d.Open(); err != nil {
+			t.Fatalf("Dispatcher.Open() has error: %s", err)
+		}
+		return d
+	}
+
+	d := open()
+	server := httptest.NewServer(NewDispatcherServer(d))
+	defer server.Close()
+	binary := "\x89PNG\r\n\x00\xff"
+	for _, request := range []struct{ method, path, body string }{
+		{http.MethodPost, "/users", `{"name": "Dalaoqi"}`},
+		{http.MethodPost, "/users/dalaoqi/folders", `{"name": "projects/2024", "description": "--draft", "parents": true}`},
+		{http.MethodPost, "/users/dalaoqi/folders", `{"name": "docs"}`},
+		{http.MethodPost, "/users/dalaoqi/folders/docs/files/image", `{"description": "-p"}`},
+		{http.MethodPut, "/users/dalaoqi/folders/docs/files/image/content", binary},
+		{http.MethodPatch, "/users/dalaoqi/folders/projects%2F2024", `{"name": "2025"}`},
+		{http.MethodDelete, "/users/dalaoqi/folders/docs/files/image", ""},
+		{http.MethodPost, "/users/dalaoqi/trash/1", ""},
+	} {
+		if resp, body := do(t, server, request.method, request.path, request.body); resp.StatusCode >= 300 {
+			t.Fatalf("%s %s status = %d (%s)", request.method, request.path, resp.StatusCode, body)
+		}
+	}
+
+	// Simulate a crash: the journal is never folded into the snapshot
+	restored := open()
+	defer restored.Close()
+	users, folders, files := restored.Services()
+	if names, _ := users.GetUsers("--sort-name", "asc"); len(names) != 1 || names[0].Name != "Dalaoqi" {
+		t.Errorf("Users after replay = %v, expected Dalaoqi", names)
+	}
+	if got, _ := folders.GetSubFolders("dalaoqi", "projects", "--sort-name", "asc"); len(got) != 1 || got[0].Name != "2025" || got[0].Description != "--draft" {
+		t.Errorf("Folders after replay = %v, expected 2025 described as --draft", got)
+	}
+	if content, err := files.ReadFile("dalaoqi", "docs", "image"); err != nil || string(content) != binary {
+		t.Errorf("Content after replay = %q, %v, expected %q", content, err, binary)
+	}
+}
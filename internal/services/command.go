@@ -0,0 +1,235 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Command is a command run by the dispatcher. The dispatcher resolves it by
+// its name or one of its aliases, checks its arguments and flags against the
+// spec, and only runs the handler when they match. The usage and the help of
+// the command are generated from the same spec.
+type Command struct {
+	Name    string
+	Aliases []string
+	// Summary is the one-line description listed by help
+	Summary string
+	// Args are the positional arguments, the optional ones come last
+	Args []Arg
+	// Flags may be given anywhere after the command name. A command without
+	// flags takes every argument as a positional one.
+	Flags []Flag
+	// Examples are shown by help
+	Examples []string
+	// Mutating commands change the tree and are recorded in the journal
+	Mutating bool
+	Run      func(ctx *Context) error
+}
+
+// Arg is a positional argument of a command
+type Arg struct {
+	Name        string
+	Description string
+	Optional    bool
+	// Input arguments are read from the dispatcher's Input until EOFMarker
+	// when they are omitted. Only the last argument may be read from Input.
+	Input bool
+	// Complete returns the completions of the argument from its beginning.
+	// The arguments before it are available from the context.
+	Complete func(ctx *Context, partial string) []string
+}
+
+// Flag is a flag of a command, given as one of its Options and optionally
+// followed by one of its Values, e.g. "--sort-created desc", or by the
+// argument it requires, e.g. "--at before"
+type Flag struct {
+	Name        string
+	Description string
+	Options     []string
+	// Default is the option of a flag that isn't given
+	Default string
+	// Values may follow the option, the first one is the default
+	Values []string
+	// Arg names the argument that must follow the option, none if empty
+	Arg string
+	// Complete returns the completions of the argument of the flag from its
+	// beginning. The positional arguments before the flag are available from
+	// the context.
+	Complete func(ctx *Context, partial string) []string
+}
+
+// Context is given to the handler of a command
+type Context struct {
+	Command *Command
+	Out     io.Writer
+	// Format is the format the results are printed in
+	Format  Format
+	Users   *UserService
+	Folders *FolderService
+	Files   *FileService
+
+	dispatcher *Dispatcher
+	args       map[string]string
+	options    map[string]string
+	values     map[string]string
+}
+
+// Arg returns the positional argument of the name, or "" if it is omitted
+func (c *Context) Arg(name string) string {
+	return c.args[name]
+}
+
+// Has reports whether the positional argument of the name is given
+func (c *Context) Has(name string) bool {
+	_, ok := c.args[name]
+	return ok
+}
+
+// Flag returns the option and the value given for the flag of the name, or
+// their defaults
+func (c *Context) Flag(name string) (string, string) {
+	return c.options[name], c.values[name]
+}
+
+// UsageError returns an error with the reason and the usage of the command
+func (c *Context) UsageError(reason string) error {
+	return c.Command.usageError(reason)
+}
+
+// Usage returns the usage of the command, e.g.
+// "create-folder [username] [folderpath] [description]? [-p]?"
+func (c *Command) Usage() string {
+	usage := []string{c.Name}
+	for _, arg := range c.Args {
+		usage = append(usage, arg.placeholder())
+	}
+	for _, flag := range c.Flags {
+		if flag.Arg != "" {
+			usage = append(usage, "["+strings.Join(flag.Options, "|")+" ["+flag.Arg+"]]?")
+			continue
+		}
+		usage = append(usage, "["+strings.Join(flag.Options, "|")+"]?")
+		if len(flag.Values) > 0 {
+			usage = append(usage, "["+strings.Join(flag.Values, "|")+"]?")
+		}
+	}
+	return strings.Join(usage, " ")
+}
+
+func (a Arg) placeholder() string {
+	if a.Optional || a.Input {
+		return "[" + a.Name + "]?"
+	}
+	return "[" + a.Name + "]"
+}
+
+func (c *Command) usageError(reason string) error {
+	return fmt.Errorf("Error: %s\nUsage: %s", reason, c.Usage())
+}
+
+// flag returns the flag of the option
+func (c *Command) flag(option string) *Flag {
+	for i := range c.Flags {
+		for _, o := range c.Flags[i].Options {
+			if o == option {
+				return &c.Flags[i]
+			}
+		}
+	}
+	return nil
+}
+
+// positionals splits the arguments after the command name into the
+// positional ones and the options and values of the flags. Any other
+// argument starting with "--" is an unknown flag, unless it follows "--".
+func (c *Command) positionals(args []string) ([]string, map[string]string, map[string]string, error) {
+	var positionals []string
+	options := make(map[string]string, len(c.Flags))
+	values := make(map[string]string, len(c.Flags))
+	for _, flag := range c.Flags {
+		options[flag.Name] = flag.Default
+		if len(flag.Values) > 0 {
+			values[flag.Name] = flag.Values[0]
+		}
+	}
+
+	flagsEnded := len(c.Flags) == 0
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !flagsEnded {
+			if arg == "--" {
+				flagsEnded = true
+				continue
+			}
+			if flag := c.flag(arg); flag != nil {
+				options[flag.Name] = arg
+				if flag.Arg != "" {
+					if i+1 >= len(args) {
+						return nil, nil, nil, c.usageError(fmt.Sprintf("Missing %s after %s", flag.Arg, arg))
+					}
+					i++
+					values[flag.Name] = args[i]
+					continue
+				}
+				if i+1 < len(args) && contains(flag.Values, args[i+1]) {
+					i++
+					values[flag.Name] = args[i]
+				}
+				continue
+			}
+			if strings.HasPrefix(arg, "--") {
+				return nil, nil, nil, c.usageError(fmt.Sprintf("Unknown flag %s", arg))
+			}
+		}
+		positionals = append(positionals, arg)
+	}
+	return positionals, options, values, nil
+}
+
+// parse checks the arguments after the command name against the spec and
+// returns the context of the handler with them
+func (c *Command) parse(args []string) (*Context, error) {
+	positionals, options, values, err := c.positionals(args)
+	if err != nil {
+		return nil, err
+	}
+
+	required := 0
+	for _, arg := range c.Args {
+		if !arg.Optional {
+			required++
+		}
+	}
+	if len(positionals) < required {
+		return nil, c.usageError("Insufficient arguments")
+	}
+	if len(positionals) > len(c.Args) {
+		return nil, c.usageError("Too many arguments")
+	}
+
+	named := make(map[string]string, len(positionals))
+	for i, value := range positionals {
+		named[c.Args[i].Name] = value
+	}
+	return &Context{Command: c, args: named, options: options, values: values}, nil
+}
+
+// readsInput reports whether the last argument of the command is missing and
+// must be read from Input
+func (c *Command) readsInput(args []string) bool {
+	if len(c.Args) == 0 || !c.Args[len(c.Args)-1].Input {
+		return false
+	}
+	positionals, _, _, err := c.positionals(args)
+	return err == nil && len(positionals) == len(c.Args)-1
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,291 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"virtual-file-system/internal/storage"
+)
+
+func TestDispatcher_ParseArguments(t *testing.T) {
+	d := NewDispatcher(storage.NewMemoryStore(nil))
+	d.out = &bytes.Buffer{}
+	d.Exec([]string{"register", "dalaoqi"})
+	d.Exec([]string{"create-folder", "dalaoqi", "docs"})
+
+	testCases := []struct {
+		name          string
+		args          []string
+		expectedError string
+	}{
+		{
+			name: "Empty command",
+		},
+		{
+			name:          "Unrecognized command",
+			args:          []string{"remove-user", "dalaoqi"},
+			expectedError: "Error: Unrecognized command",
+		},
+		{
+			name:          "Insufficient arguments",
+			args:          []string{"create-file", "dalaoqi", "docs"},
+			expectedError: "Error: Insufficient arguments\nUsage: create-file [username] [folderpath] [filename] [description]?",
+		},
+		{
+			name:          "Too many arguments",
+			args:          []string{"delete-folder", "dalaoqi", "docs", "tmp"},
+			expectedError: "Error: Too many arguments\nUsage: delete-folder [username] [folderpath] [--permanent]?",
+		},
+		{
+			name:          "Unknown flag",
+			args:          []string{"list-folders", "dalaoqi", "--sort-color"},
+			expectedError: "Error: Unknown flag --sort-color\nUsage: list-folders [username] [folderpath]? [--sort-name|--sort-created|--sort-modified]? [asc|desc]? [--at [snapshot]]?",
+		},
+		{
+			name:          "Invalid sort order",
+			args:          []string{"list-files", "dalaoqi", "docs", "--sort-name", "up"},
+			expectedError: "Error: Too many arguments\nUsage: list-files [username] [folderpath] [--sort-name|--sort-created|--sort-modified|--sort-size]? [asc|desc]? [--at [snapshot]]?",
+		},
+		{
+			name:          "Flag without its argument",
+			args:          []string{"list-folders", "dalaoqi", "--at"},
+			expectedError: "Error: Missing snapshot after --at\nUsage: list-folders [username] [folderpath]? [--sort-name|--sort-created|--sort-modified]? [asc|desc]? [--at [snapshot]]?",
+		},
+		{
+			name: "Flag before the arguments",
+			args: []string{"create-folder", "-p", "dalaoqi", "a/b"},
+		},
+		{
+			name: "Flag after the arguments",
+			args: []string{"create-folder", "dalaoqi", "c/d", "-p"},
+		},
+		{
+			name: "Flags ended by --",
+			args: []string{"create-folder", "dalaoqi", "e", "--", "--the description"},
+		},
+		{
+			name: "Sort flag without its order",
+			args: []string{"list-folders", "dalaoqi", "--sort-created"},
+		},
+		{
+			name: "Flag-like content of a command without flags",
+			args: []string{"create-file", "dalaoqi", "docs", "notes", "--draft"},
+		},
+		{
+			name: "Alias",
+			args: []string{"cat", "dalaoqi", "docs", "notes"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			err := d.Exec(test.args)
+			if (err == nil && test.expectedError != "") || (err != nil && err.Error() != test.expectedError) {
+				t.Errorf("Dispatcher.Exec(%q) has error: %v, expected: %s", test.args, err, test.expectedError)
+			}
+		})
+	}
+}
+
+func TestDispatcher_RegisterCommand(t *testing.T) {
+	dataFile := filepath.Join(t.TempDir(), "vfs.json")
+	var out bytes.Buffer
+	d := newTestDispatcher(t, dataFile)
+	d.out = &out
+
+	touch := &Command{
+		Name:    "touch-file",
+		Aliases: []string{"touch"},
+		Summary: "Create a file, or empty it with --empty.",
+		Args:    []Arg{{Name: "username"}, {Name: "folderpath"}, {Name: "filename"}},
+		Flags:   []Flag{{Name: "empty", Options: []string{"--empty"}}},
+		Run: func(ctx *Context) error {
+			userName, folderName, fileName := ctx.Arg("username"), ctx.Arg("folderpath"), ctx.Arg("filename")
+			err := ctx.Files.CreateFile(userName, folderName, fileName, "")
+			if err != nil && !errors.Is(err, ErrFileExists) {
+				return err
+			}
+			if empty, _ := ctx.Flag("empty"); empty != "" {
+				if err := ctx.Files.TruncateFile(userName, folderName, fileName, 0); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(ctx.Out, "Touch %s.\n", fileName)
+			return nil
+		},
+		Mutating: true,
+	}
+	if err := d.RegisterCommand(touch); err != nil {
+		t.Fatalf("Dispatcher.RegisterCommand() has error: %s", err)
+	}
+
+	// Names and aliases can't be taken twice
+	for _, command := range []*Command{
+		{Name: "touch-file", Run: touch.Run},
+		{Name: "touch-all", Aliases: []string{"touch"}, Run: touch.Run},
+		{Name: "register", Run: touch.Run},
+		{Name: "no-handler"},
+	} {
+		if err := d.RegisterCommand(command); err == nil {
+			t.Errorf("Dispatcher.RegisterCommand(%s) has no error", command.Name)
+		}
+	}
+
+	commands := [][]string{
+		{"register", "dalaoqi"},
+		{"create-folder", "dalaoqi", "docs"},
+		{"touch", "dalaoqi", "docs", "notes"},
+		{"write-file", "dalaoqi", "docs", "notes", "hello"},
+		{"touch-file", "--empty", "dalaoqi", "docs", "notes"},
+	}
+	for _, args := range commands {
+		if err := d.Exec(args); err != nil {
+			t.Fatalf("Dispatcher.Exec(%v) has error: %s", args, err)
+		}
+	}
+	if out.String() != "Add dalaoqi successfully.\nCreate docs successfully.\nTouch notes.\nWrite notes in dalaoqi/docs successfully.\nTouch notes.\n" {
+		t.Errorf("Dispatcher output = %q", out.String())
+	}
+
+	var names []string
+	for _, command := range d.Commands() {
+		names = append(names, command.Name)
+	}
+	if names[0] != "help" || names[len(names)-1] != "touch-file" {
+		t.Errorf("Dispatcher.Commands() = %v, expected the built-in commands then touch-file", names)
+	}
+
+	// The registered command is journaled by its name and replayed
+	expected := dumpTree(t, d)
+	d.journal.Close()
+	journal, records, err := storage.OpenJournal(dataFile + ".journal")
+	if err != nil {
+		t.Fatalf("storage.OpenJournal() has error: %s", err)
+	}
+	journal.Close()
+	if got := records[2].Args; !reflect.DeepEqual(got, []string{"touch-file", "dalaoqi", "docs", "notes"}) {
+		t.Errorf("Journaled command = %q, expected touch-file", got)
+	}
+
+	restored := NewDispatcher(storage.NewMemoryStore(nil))
+	restored.out = &bytes.Buffer{}
+	restored.DataFile = dataFile
+	restored.RegisterCommand(touch)
+	if err := restored.Open(); err != nil {
+		t.Fatalf("Dispatcher.Open() has error: %s", err)
+	}
+	defer restored.Close()
+	assertSameTree(t, dumpTree(t, restored), expected)
+	if expected["dalaoqi"].Folders["docs"].Files["notes"].Size != 0 {
+		t.Errorf("notes isn't empty")
+	}
+}
+
+func TestDispatcher_Help(t *testing.T) {
+	var out bytes.Buffer
+	d := NewDispatcher(storage.NewMemoryStore(nil))
+	d.out = &out
+
+	// Every command is listed with its summary
+	if err := d.Exec([]string{"help"}); err != nil {
+		t.Fatalf("Dispatcher.Exec(help) has error: %s", err)
+	}
+	for _, command := range d.Commands() {
+		if !strings.Contains(out.String(), command.Name) || !strings.Contains(out.String(), command.Summary) {
+			t.Errorf("help doesn't list %s with its summary", command.Name)
+		}
+	}
+
+	// The help of a command is generated from its spec, also for an alias
+	out.Reset()
+	if err := d.Exec([]string{"help", "list-folders"}); err != nil {
+		t.Fatalf("Dispatcher.Exec(help list-folders) has error: %s", err)
+	}
+	expected := `Usage: list-folders [username] [folderpath]? [--sort-name|--sort-created|--sort-modified]? [asc|desc]? [--at [snapshot]]?
+List the folders of a user, or the sub-folders of a folder.
+Arguments:
+  [username]     The name of the user.
+  [folderpath]?  The path of the parent folder, the root of the user by default.
+Flags:
+  --sort-name|--sort-created|--sort-modified [asc|desc]  Sort by name, creation time or modification time, in ascending or descending order. The default is --sort-name asc.
+  --at [snapshot]                                        List them as they were in the snapshot of the user, read-only.
+Examples:
+  list-folders dalaoqi --sort-name asc
+  list-folders dalaoqi projects --sort-created desc
+  list-folders --at before-cleanup dalaoqi
+`
+	if out.String() != expected {
+		t.Errorf("help list-folders = %q, expected: %q", out.String(), expected)
+	}
+	out.Reset()
+	d.Exec([]string{"help", "cat"})
+	if !strings.HasPrefix(out.String(), "Usage: cat-file [username] [folderpath] [filename]\n") || !strings.Contains(out.String(), "Aliases: cat\n") {
+		t.Errorf("help cat = %q, expected the help of cat-file", out.String())
+	}
+
+	// The usage of an error is the one shown by help
+	for _, command := range d.Commands() {
+		if len(command.Args) == 0 || command.Args[0].Optional {
+			continue
+		}
+		err := d.Exec([]string{command.Name})
+		if err == nil || err.Error() != "Error: Insufficient arguments\nUsage: "+command.Usage() {
+			t.Errorf("Dispatcher.Exec(%s) has error: %v, expected its usage", command.Name, err)
+		}
+	}
+}
+
+func TestDispatcher_Suggestions(t *testing.T) {
+	d := NewDispatcher(storage.NewMemoryStore(nil))
+	d.out = &bytes.Buffer{}
+
+	testCases := []struct {
+		name          string
+		args          []string
+		expectedError string
+	}{
+		{
+			name:          "Misspelled command",
+			args:          []string{"regster", "dalaoqi"},
+			expectedError: "Error: Unrecognized command\nDid you mean register?",
+		},
+		{
+			name:          "Missing letter",
+			args:          []string{"list-file", "dalaoqi", "docs"},
+			expectedError: "Error: Unrecognized command\nDid you mean list-files?",
+		},
+		{
+			name:          "Prefix of commands",
+			args:          []string{"list"},
+			expectedError: "Error: Unrecognized command\nDid you mean list-files, list-trash or list-users?",
+		},
+		{
+			name:          "Misspelled alias",
+			args:          []string{"cta"},
+			expectedError: "Error: Unrecognized command\nDid you mean cat?",
+		},
+		{
+			name:          "Unknown command of help",
+			args:          []string{"help", "delete-fle"},
+			expectedError: "Error: Unrecognized command\nDid you mean delete-file?",
+		},
+		{
+			name:          "No close command",
+			args:          []string{"format-disk"},
+			expectedError: "Error: Unrecognized command",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			err := d.Exec(test.args)
+			if err == nil || err.Error() != test.expectedError {
+				t.Errorf("Dispatcher.Exec(%q) has error: %v, expected: %s", test.args, err, test.expectedError)
+			}
+		})
+	}
+}
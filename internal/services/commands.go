@@ -0,0 +1,1091 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// The arguments shared by the commands
+var (
+	userArg   = Arg{Name: "username", Description: "The name of the user.", Complete: completeUsers}
+	folderArg = Arg{Name: "folderpath", Description: "The slash-separated path of the folder, e.g. projects/2024.", Complete: completeFolders}
+	fileArg   = Arg{Name: "filename", Description: "The name of the file.", Complete: completeFiles}
+	// newUserArg is the owner of the destination of a move or a copy
+	newUserArg = Arg{Name: "new-username", Description: "The user receiving the file or folder, the same user by default.", Optional: true, Complete: completeUsers}
+)
+
+// The flags shared by the commands
+var (
+	// conflictFlag decides what a move, a copy or a restore does when the
+	// destination name is taken
+	conflictFlag = Flag{
+		Name:        "conflict",
+		Description: "Fail, replace the existing one or pick a free name like \"notes (1)\" when the destination name is taken.",
+		Options:     []string{"--fail", "--overwrite", "--rename"},
+		Default:     "--fail",
+	}
+	permanentFlag = Flag{Name: "permanent", Description: "Delete it for good instead of moving it to the trash.", Options: []string{"--permanent"}}
+	// atFlag lists the tree of the user as it was in a snapshot
+	atFlag = Flag{
+		Name:        "at",
+		Description: "List them as they were in the snapshot of the user, read-only.",
+		Options:     []string{"--at"},
+		Arg:         "snapshot",
+		Complete:    completeSnapshots,
+	}
+	snapshotArg = Arg{Name: "snapshot", Description: "The label of the snapshot.", Complete: completeSnapshots}
+)
+
+// transferFlags are the flags of the moves and copies, which keep or reset
+// the timestamps by default
+func transferFlags(metadata string) []Flag {
+	return []Flag{
+		conflictFlag,
+		{
+			Name:        "metadata",
+			Description: "Keep the creation and modification times of the source, or reset them to now.",
+			Options:     []string{"--preserve", "--reset"},
+			Default:     metadata,
+		},
+	}
+}
+
+// builtinCommands are the commands every dispatcher starts with
+func builtinCommands() []*Command {
+	return []*Command{
+		{
+			Name:     "help",
+			Summary:  "List the commands, or show the help of a command.",
+			Args:     []Arg{{Name: "command", Description: "The name of a command.", Optional: true, Complete: completeCommands}},
+			Examples: []string{"help", "help create-folder"},
+			Run:      runHelp,
+		},
+		{
+			Name:     "register",
+			Summary:  "Register a user.",
+			Args:     []Arg{userArg},
+			Examples: []string{"register dalaoqi", `register "dalaoqi is awesome"`},
+			Mutating: true,
+			Run:      runRegister,
+		},
+		{
+			Name:    "list-users",
+			Summary: "List the users with their registration time.",
+			Flags: []Flag{{
+				Name:        "sort",
+				Description: "Sort by name or registration time, in ascending or descending order.",
+				Options:     []string{"--sort-name", "--sort-created"},
+				Default:     "--sort-name",
+				Values:      []string{"asc", "desc"},
+			}},
+			Examples: []string{"list-users", "list-users --sort-created desc"},
+			Run:      runListUsers,
+		},
+		{
+			Name:    "rename-user",
+			Summary: "Rename a user, keeping all of its folders and files.",
+			Args: []Arg{
+				userArg,
+				{Name: "new-username", Description: "The new name of the user."},
+			},
+			Examples: []string{"rename-user dalaoqi dalaoqi2"},
+			Mutating: true,
+			Run:      runRenameUser,
+		},
+		{
+			Name:     "unregister",
+			Summary:  "Delete a user, who must not have any folders unless --force is given.",
+			Args:     []Arg{userArg},
+			Flags:    []Flag{{Name: "force", Description: "Delete the user along with all of its folders and files.", Options: []string{"--force"}}},
+			Examples: []string{"unregister dalaoqi", "unregister --force dalaoqi"},
+			Mutating: true,
+			Run:      runUnregister,
+		},
+		{
+			Name:    "create-folder",
+			Summary: "Create a folder for a user.",
+			Args: []Arg{
+				userArg,
+				folderArg,
+				{Name: "description", Description: "The description of the folder.", Optional: true},
+			},
+			Flags:    []Flag{{Name: "parents", Description: "Create the missing parent folders.", Options: []string{"-p"}}},
+			Examples: []string{"create-folder dalaoqi docs description", "create-folder -p dalaoqi projects/2024/q1"},
+			Mutating: true,
+			Run:      runCreateFolder,
+		},
+		{
+			Name:    "list-folders",
+			Summary: "List the folders of a user, or the sub-folders of a folder.",
+			Args: []Arg{
+				userArg,
+				{Name: "folderpath", Description: "The path of the parent folder, the root of the user by default.", Optional: true, Complete: completeFolders},
+			},
+			Flags: []Flag{{
+				Name:        "sort",
+				Description: "Sort by name, creation time or modification time, in ascending or descending order.",
+				Options:     []string{"--sort-name", "--sort-created", "--sort-modified"},
+				Default:     "--sort-name",
+				Values:      []string{"asc", "desc"},
+			}, atFlag},
+			Examples: []string{
+				"list-folders dalaoqi --sort-name asc",
+				"list-folders dalaoqi projects --sort-created desc",
+				"list-folders --at before-cleanup dalaoqi",
+			},
+			Run: runListFolders,
+		},
+		{
+			Name:     "delete-folder",
+			Summary:  "Move a folder with all its sub-folders and files to the trash.",
+			Args:     []Arg{userArg, folderArg},
+			Flags:    []Flag{permanentFlag},
+			Examples: []string{"delete-folder dalaoqi docs", "delete-folder --permanent dalaoqi docs"},
+			Mutating: true,
+			Run:      runDeleteFolder,
+		},
+		{
+			Name:    "rename-folder",
+			Summary: "Rename a folder with its whole subtree, or move it to a new path.",
+			Args: []Arg{
+				userArg,
+				folderArg,
+				{Name: "new-folder-name", Description: "The new name, or the new path if it contains a slash, e.g. /archive."},
+			},
+			Examples: []string{"rename-folder dalaoqi docs documents", "rename-folder dalaoqi projects/2024 /archive"},
+			Mutating: true,
+			Run:      runRenameFolder,
+		},
+		{
+			Name:    "set-folder-description",
+			Summary: "Change the description of a folder.",
+			Args: []Arg{
+				userArg,
+				folderArg,
+				{Name: "description", Description: "The new description, empty when omitted.", Optional: true},
+			},
+			Examples: []string{"set-folder-description dalaoqi docs \"the docs of 2024\""},
+			Mutating: true,
+			Run:      runSetFolderDescription,
+		},
+		{
+			Name:    "copy-folder",
+			Summary: "Copy a folder with its whole subtree to a new path, possibly of another user.",
+			Args: []Arg{
+				userArg,
+				folderArg,
+				{Name: "new-folderpath", Description: "The path of the copy, whose parent must exist.", Complete: completeFolders},
+				newUserArg,
+			},
+			Flags:    transferFlags("--reset"),
+			Examples: []string{"copy-folder dalaoqi projects/2024 archive/2024", "copy-folder --rename dalaoqi docs docs david"},
+			Mutating: true,
+			Run:      runCopyFolder,
+		},
+		{
+			Name:    "create-file",
+			Summary: "Create a file in a folder.",
+			Args: []Arg{
+				userArg,
+				folderArg,
+				fileArg,
+				{Name: "description", Description: "The description of the file.", Optional: true},
+			},
+			Examples: []string{"create-file dalaoqi docs test description"},
+			Mutating: true,
+			Run:      runCreateFile,
+		},
+		{
+			Name:    "list-files",
+			Summary: "List the files of a folder with their size in bytes.",
+			Args:    []Arg{userArg, folderArg},
+			Flags: []Flag{{
+				Name:        "sort",
+				Description: "Sort by name, creation time, modification time or size, in ascending or descending order.",
+				Options:     []string{"--sort-name", "--sort-created", "--sort-modified", "--sort-size"},
+				Default:     "--sort-name",
+				Values:      []string{"asc", "desc"},
+			}, atFlag},
+			Examples: []string{"list-files dalaoqi docs --sort-created desc", "list-files --at before-cleanup dalaoqi docs"},
+			Run:      runListFiles,
+		},
+		{
+			Name:     "delete-file",
+			Summary:  "Move a file of a folder to the trash.",
+			Args:     []Arg{userArg, folderArg, fileArg},
+			Flags:    []Flag{permanentFlag},
+			Examples: []string{"delete-file dalaoqi docs test", "delete-file --permanent dalaoqi docs test"},
+			Mutating: true,
+			Run:      runDeleteFile,
+		},
+		{
+			Name:    "rename-file",
+			Summary: "Rename a file within its folder.",
+			Args: []Arg{
+				userArg,
+				folderArg,
+				fileArg,
+				{Name: "new-file-name", Description: "The new name of the file."},
+			},
+			Examples: []string{"rename-file dalaoqi docs notes minutes"},
+			Mutating: true,
+			Run:      runRenameFile,
+		},
+		{
+			Name:    "set-file-description",
+			Summary: "Change the description of a file.",
+			Args: []Arg{
+				userArg,
+				folderArg,
+				fileArg,
+				{Name: "description", Description: "The new description, empty when omitted.", Optional: true},
+			},
+			Examples: []string{"set-file-description dalaoqi docs notes \"meeting notes\""},
+			Mutating: true,
+			Run:      runSetFileDescription,
+		},
+		{
+			Name:    "move-file",
+			Summary: "Move a file to another folder, possibly of another user.",
+			Args: []Arg{
+				userArg,
+				folderArg,
+				fileArg,
+				{Name: "new-folderpath", Description: "The folder receiving the file.", Complete: completeFolders},
+				newUserArg,
+			},
+			Flags:    transferFlags("--preserve"),
+			Examples: []string{"move-file dalaoqi docs notes archive", "move-file --overwrite dalaoqi docs notes docs david"},
+			Mutating: true,
+			Run:      runMoveFile,
+		},
+		{
+			Name:    "copy-file",
+			Summary: "Copy a file to another folder, possibly of another user.",
+			Args: []Arg{
+				userArg,
+				folderArg,
+				fileArg,
+				{Name: "new-folderpath", Description: "The folder receiving the copy.", Complete: completeFolders},
+				newUserArg,
+			},
+			Flags:    transferFlags("--reset"),
+			Examples: []string{"copy-file dalaoqi docs notes archive", "copy-file --rename --preserve dalaoqi docs notes docs"},
+			Mutating: true,
+			Run:      runCopyFile,
+		},
+		{
+			Name:    "write-file",
+			Summary: "Replace the content of a file.",
+			Args: []Arg{
+				userArg,
+				folderArg,
+				fileArg,
+				{Name: "content", Description: "The new content, read from the following lines until " + EOFMarker + " when omitted.", Input: true},
+			},
+			Examples: []string{`write-file dalaoqi docs test "hello world"`},
+			Mutating: true,
+			Run:      runWriteFile,
+		},
+		{
+			Name:    "append-file",
+			Summary: "Append to the content of a file.",
+			Args: []Arg{
+				userArg,
+				folderArg,
+				fileArg,
+				{Name: "content", Description: "The appended content, read from the following lines until " + EOFMarker + " when omitted.", Input: true},
+			},
+			Examples: []string{`append-file dalaoqi docs test " again"`},
+			Mutating: true,
+			Run:      runAppendFile,
+		},
+		{
+			Name:     "cat-file",
+			Aliases:  []string{"cat"},
+			Summary:  "Print the content of a file.",
+			Args:     []Arg{userArg, folderArg, fileArg},
+			Examples: []string{"cat-file dalaoqi docs test"},
+			Run:      runCatFile,
+		},
+		{
+			Name:    "truncate-file",
+			Summary: "Shrink a file, or extend it with zero bytes.",
+			Args: []Arg{
+				userArg,
+				folderArg,
+				fileArg,
+				{Name: "size", Description: "The new size in bytes, 0 by default.", Optional: true},
+			},
+			Examples: []string{"truncate-file dalaoqi docs test 5"},
+			Mutating: true,
+			Run:      runTruncateFile,
+		},
+		{
+			Name:     "list-trash",
+			Summary:  "List the deleted folders and files of a user with their id.",
+			Args:     []Arg{userArg},
+			Examples: []string{"list-trash dalaoqi"},
+			Run:      runListTrash,
+		},
+		{
+			Name:    "restore",
+			Summary: "Put a deleted folder or file back where it was deleted from.",
+			Args: []Arg{
+				userArg,
+				{Name: "id", Description: "The id of the item, as listed by list-trash.", Complete: completeTrash},
+			},
+			Flags:    []Flag{conflictFlag},
+			Examples: []string{"restore dalaoqi 3", "restore --rename dalaoqi 3"},
+			Mutating: true,
+			Run:      runRestore,
+		},
+		{
+			Name:     "empty-trash",
+			Summary:  "Delete the folders and files in the trash of a user for good.",
+			Args:     []Arg{userArg},
+			Examples: []string{"empty-trash dalaoqi"},
+			Mutating: true,
+			Run:      runEmptyTrash,
+		},
+		{
+			Name:    "snapshot-create",
+			Summary: "Freeze the folders and files of a user under a label.",
+			Args: []Arg{
+				userArg,
+				{Name: "snapshot", Description: "The label of the new snapshot."},
+			},
+			Examples: []string{"snapshot-create dalaoqi before-cleanup"},
+			Mutating: true,
+			Run:      runSnapshotCreate,
+		},
+		{
+			Name:     "snapshot-list",
+			Summary:  "List the snapshots of a user in the order they were created.",
+			Args:     []Arg{userArg},
+			Examples: []string{"snapshot-list dalaoqi"},
+			Run:      runSnapshotList,
+		},
+		{
+			Name:    "snapshot-diff",
+			Summary: "List the folders and files added, removed or modified between two snapshots.",
+			Args: []Arg{
+				userArg,
+				snapshotArg,
+				{Name: "other-snapshot", Description: "The label of the later snapshot.", Complete: completeSnapshots},
+			},
+			Examples: []string{"snapshot-diff dalaoqi before-cleanup after-cleanup"},
+			Run:      runSnapshotDiff,
+		},
+		{
+			Name:     "snapshot-restore",
+			Summary:  "Replace the folders and files of a user with a snapshot.",
+			Args:     []Arg{userArg, snapshotArg},
+			Examples: []string{"snapshot-restore dalaoqi before-cleanup"},
+			Mutating: true,
+			Run:      runSnapshotRestore,
+		},
+		{
+			Name:     "snapshot-delete",
+			Summary:  "Delete a snapshot with the folders and contents only it refers to.",
+			Args:     []Arg{userArg, snapshotArg},
+			Examples: []string{"snapshot-delete dalaoqi before-cleanup"},
+			Mutating: true,
+			Run:      runSnapshotDelete,
+		},
+		{
+			Name:     "undo",
+			Summary:  "Revert the last command that changed the tree.",
+			Examples: []string{"undo"},
+			Run:      runUndo,
+		},
+		{
+			Name:     "redo",
+			Summary:  "Run the last undone command again.",
+			Examples: []string{"redo"},
+			Run:      runRedo,
+		},
+		{
+			Name:     "history",
+			Summary:  "List the commands of the session that can be undone or redone.",
+			Examples: []string{"history"},
+			Run:      runHistory,
+		},
+		{
+			Name:     "save",
+			Summary:  "Save the whole tree to a JSON snapshot.",
+			Args:     []Arg{{Name: "path", Description: "The path of the snapshot, the data file by default.", Optional: true}},
+			Examples: []string{"save", "save backup.json"},
+			Run:      runSave,
+		},
+		{
+			Name:     "load",
+			Summary:  "Replace the whole tree with a JSON snapshot.",
+			Args:     []Arg{{Name: "path", Description: "The path of the snapshot, the data file by default.", Optional: true}},
+			Examples: []string{"load", "load backup.json"},
+			Run:      runLoad,
+		},
+		{
+			Name:    "set",
+			Summary: "Change a setting of the session.",
+			Args: []Arg{
+				{Name: "setting", Description: "The name of the setting: output.", Complete: completeChoices("output")},
+				{Name: "value", Description: "The value of the setting. The output is text, json, csv, tsv or table.", Complete: completeFormats},
+			},
+			Examples: []string{"set output json"},
+			Run:      runSet,
+		},
+	}
+}
+
+func runHelp(ctx *Context) error {
+	d := ctx.dispatcher
+	// The machine-readable formats list the usage and summary of the commands
+	if ctx.Format == FormatJSON || ctx.Format == FormatCSV || ctx.Format == FormatTSV {
+		commands := d.commandList
+		if ctx.Has("command") {
+			command, err := d.lookup(ctx.Arg("command"))
+			if err != nil {
+				return err
+			}
+			commands = []*Command{command}
+		}
+		listing := Listing{Columns: []string{"name", "aliases", "usage", "summary"}}
+		for _, command := range commands {
+			listing.Rows = append(listing.Rows, []any{command.Name, strings.Join(command.Aliases, ","), command.Usage(), command.Summary})
+		}
+		ctx.List(listing)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(ctx.Out, 0, 0, 2, ' ', 0)
+	if !ctx.Has("command") {
+		fmt.Fprintln(w, "Commands:")
+		for _, command := range d.commandList {
+			fmt.Fprintf(w, "  %s\t%s\n", command.Name, command.Summary)
+		}
+		fmt.Fprintln(w, `Run "help [command]" for the usage of a command.`)
+		return w.Flush()
+	}
+
+	command, err := d.lookup(ctx.Arg("command"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Usage: %s\n", command.Usage())
+	if command.Summary != "" {
+		fmt.Fprintln(w, command.Summary)
+	}
+	if len(command.Aliases) > 0 {
+		fmt.Fprintf(w, "Aliases: %s\n", strings.Join(command.Aliases, ", "))
+	}
+	if len(command.Args) > 0 {
+		fmt.Fprintln(w, "Arguments:")
+		for _, arg := range command.Args {
+			fmt.Fprintf(w, "  %s\t%s\n", arg.placeholder(), arg.Description)
+		}
+	}
+	if len(command.Flags) > 0 {
+		fmt.Fprintln(w, "Flags:")
+		for _, flag := range command.Flags {
+			options := strings.Join(flag.Options, "|")
+			if len(flag.Values) > 0 {
+				options += " [" + strings.Join(flag.Values, "|") + "]"
+			}
+			if flag.Arg != "" {
+				options += " [" + flag.Arg + "]"
+			}
+			description := flag.Description
+			if flag.Default != "" {
+				defaultOption := flag.Default
+				if len(flag.Values) > 0 {
+					defaultOption += " " + flag.Values[0]
+				}
+				description += " The default is " + defaultOption + "."
+			}
+			fmt.Fprintf(w, "  %s\t%s\n", options, description)
+		}
+	}
+	if len(command.Examples) > 0 {
+		fmt.Fprintln(w, "Examples:")
+		for _, example := range command.Examples {
+			fmt.Fprintf(w, "  %s\n", example)
+		}
+	}
+	return w.Flush()
+}
+
+func runRegister(ctx *Context) error {
+	userName := ctx.Arg("username")
+
+	// Register a new user using the user service
+	err := ctx.Users.Register(userName)
+	if err != nil {
+		return err
+	}
+
+	ctx.Message("Add %s successfully.", userName)
+	return nil
+}
+
+func runListUsers(ctx *Context) error {
+	sortFlag, sortOrderFlag := ctx.Flag("sort")
+
+	users, err := ctx.Users.GetUsers(sortFlag, sortOrderFlag)
+	if err != nil {
+		return err
+	}
+
+	listing := Listing{
+		Columns: []string{"name", "createdAt"},
+		Empty:   "Warning: There are no users.",
+	}
+	for _, user := range users {
+		listing.Rows = append(listing.Rows, []any{user.Name, user.CreatedAt})
+	}
+	ctx.List(listing)
+	return nil
+}
+
+func runRenameUser(ctx *Context) error {
+	userName := ctx.Arg("username")
+	newUserName := ctx.Arg("new-username")
+
+	err := ctx.Users.RenameUser(userName, newUserName)
+	if err != nil {
+		return err
+	}
+	ctx.Message("Rename %s to %s successfully.", userName, newUserName)
+	return nil
+}
+
+func runUnregister(ctx *Context) error {
+	userName := ctx.Arg("username")
+	force, _ := ctx.Flag("force")
+
+	err := ctx.Users.Unregister(userName, force != "")
+	if errors.Is(err, ErrUserNotEmpty) {
+		return fmt.Errorf("%w\nUse --force to delete them with the user.", err)
+	}
+	if err != nil {
+		return err
+	}
+	ctx.Message("Remove %s successfully.", userName)
+	return nil
+}
+
+func runCreateFolder(ctx *Context) error {
+	userName := ctx.Arg("username")
+	folderName := ctx.Arg("folderpath")
+	description := ctx.Arg("description")
+
+	var err error
+	if parents, _ := ctx.Flag("parents"); parents != "" {
+		err = ctx.Folders.CreateFolderAll(userName, folderName, description)
+	} else {
+		err = ctx.Folders.CreateFolder(userName, folderName, description)
+	}
+	if err != nil {
+		return err
+	}
+	ctx.Message("Create %s successfully.", folderName)
+	return nil
+}
+
+func runListFolders(ctx *Context) error {
+	userName := ctx.Arg("username")
+	folderName := ctx.Arg("folderpath")
+	sortFlag, sortOrderFlag := ctx.Flag("sort")
+
+	_, at := ctx.Flag("at")
+
+	folders, err := ctx.Folders.GetSubFoldersAt(userName, at, folderName, sortFlag, sortOrderFlag)
+	if err != nil {
+		return err
+	}
+
+	parentName := folderName
+	if parentName == "" {
+		parentName = userName
+	}
+	listing := Listing{
+		Columns: []string{"name", "description", "createdAt", "user"},
+		Empty:   fmt.Sprintf("Warning: The %s doesn't have any folders.", parentName),
+	}
+	for _, folder := range folders {
+		listing.Rows = append(listing.Rows, []any{folder.Name, folder.Description, folder.CreatedAt, userName})
+	}
+	ctx.List(listing)
+	return nil
+}
+
+func runDeleteFolder(ctx *Context) error {
+	userName := ctx.Arg("username")
+	folderName := ctx.Arg("folderpath")
+
+	permanent, _ := ctx.Flag("permanent")
+
+	err := ctx.Folders.DeleteFolder(userName, folderName, permanent != "")
+	if err != nil {
+		return err
+	}
+	ctx.Message("Delete %s successfully.", folderName)
+	return nil
+}
+
+func runRenameFolder(ctx *Context) error {
+	userName := ctx.Arg("username")
+	folderName := ctx.Arg("folderpath")
+	newFolderName := ctx.Arg("new-folder-name")
+
+	err := ctx.Folders.RenameFolder(userName, folderName, newFolderName)
+	if err != nil {
+		return err
+	}
+	ctx.Message("Rename %s to %s successfully.", folderName, newFolderName)
+	return nil
+}
+
+func runSetFolderDescription(ctx *Context) error {
+	userName := ctx.Arg("username")
+	folderName := ctx.Arg("folderpath")
+
+	err := ctx.Folders.SetFolderDescription(userName, folderName, ctx.Arg("description"))
+	if err != nil {
+		return err
+	}
+	ctx.Message("Set the description of %s successfully.", folderName)
+	return nil
+}
+
+func runCopyFolder(ctx *Context) error {
+	userName, newUserName := transferUsers(ctx)
+	folderName := ctx.Arg("folderpath")
+
+	newFolderName, err := ctx.Folders.CopyFolder(userName, folderName, newUserName, ctx.Arg("new-folderpath"), transferOptions(ctx))
+	if err != nil {
+		return err
+	}
+	ctx.Message("Copy %s to %s/%s successfully.", folderName, newUserName, newFolderName)
+	return nil
+}
+
+func runCreateFile(ctx *Context) error {
+	userName := ctx.Arg("username")
+	folderName := ctx.Arg("folderpath")
+	fileName := ctx.Arg("filename")
+
+	err := ctx.Files.CreateFile(userName, folderName, fileName, ctx.Arg("description"))
+	if err != nil {
+		return err
+	}
+	ctx.Message("Create %s in %s/%s successfully.", fileName, userName, folderName)
+	return nil
+}
+
+func runListFiles(ctx *Context) error {
+	userName := ctx.Arg("username")
+	folderName := ctx.Arg("folderpath")
+	sortFlag, sortOrderFlag := ctx.Flag("sort")
+
+	_, at := ctx.Flag("at")
+
+	files, err := ctx.Files.GetFilesAt(userName, at, folderName, sortFlag, sortOrderFlag)
+	if err != nil {
+		return err
+	}
+
+	listing := Listing{
+		Columns: []string{"name", "description", "size", "createdAt", "folder", "user"},
+		Empty:   "Warning: The folder is empty.",
+	}
+	for _, file := range files {
+		listing.Rows = append(listing.Rows, []any{file.Name, file.Description, file.Size, file.CreatedAt, folderName, userName})
+	}
+	ctx.List(listing)
+	return nil
+}
+
+func runDeleteFile(ctx *Context) error {
+	userName := ctx.Arg("username")
+	folderName := ctx.Arg("folderpath")
+	fileName := ctx.Arg("filename")
+
+	permanent, _ := ctx.Flag("permanent")
+
+	err := ctx.Files.DeleteFile(userName, folderName, fileName, permanent != "")
+	if err != nil {
+		return err
+	}
+	ctx.Message("Delete %s in %s/%s successfully.", fileName, userName, folderName)
+	return nil
+}
+
+func runRenameFile(ctx *Context) error {
+	userName := ctx.Arg("username")
+	folderName := ctx.Arg("folderpath")
+	fileName := ctx.Arg("filename")
+	newFileName := ctx.Arg("new-file-name")
+
+	err := ctx.Files.RenameFile(userName, folderName, fileName, newFileName)
+	if err != nil {
+		return err
+	}
+	ctx.Message("Rename %s to %s in %s/%s successfully.", fileName, newFileName, userName, folderName)
+	return nil
+}
+
+func runSetFileDescription(ctx *Context) error {
+	userName := ctx.Arg("username")
+	folderName := ctx.Arg("folderpath")
+	fileName := ctx.Arg("filename")
+
+	err := ctx.Files.SetFileDescription(userName, folderName, fileName, ctx.Arg("description"))
+	if err != nil {
+		return err
+	}
+	ctx.Message("Set the description of %s in %s/%s successfully.", fileName, userName, folderName)
+	return nil
+}
+
+func runMoveFile(ctx *Context) error {
+	userName, newUserName := transferUsers(ctx)
+	fileName := ctx.Arg("filename")
+	newFolderName := ctx.Arg("new-folderpath")
+
+	newFileName, err := ctx.Files.MoveFile(userName, ctx.Arg("folderpath"), fileName, newUserName, newFolderName, transferOptions(ctx))
+	if err != nil {
+		return err
+	}
+	ctx.Message("Move %s to %s/%s/%s successfully.", fileName, newUserName, newFolderName, newFileName)
+	return nil
+}
+
+func runCopyFile(ctx *Context) error {
+	userName, newUserName := transferUsers(ctx)
+	fileName := ctx.Arg("filename")
+	newFolderName := ctx.Arg("new-folderpath")
+
+	newFileName, err := ctx.Files.CopyFile(userName, ctx.Arg("folderpath"), fileName, newUserName, newFolderName, transferOptions(ctx))
+	if err != nil {
+		return err
+	}
+	ctx.Message("Copy %s to %s/%s/%s successfully.", fileName, newUserName, newFolderName, newFileName)
+	return nil
+}
+
+// transferUsers returns the source and the destination users of a move or
+// a copy, which stays with the same user by default
+func transferUsers(ctx *Context) (string, string) {
+	userName := ctx.Arg("username")
+	if ctx.Has("new-username") {
+		return userName, ctx.Arg("new-username")
+	}
+	return userName, userName
+}
+
+// transferOptions returns the options given by the flags of a move or a copy
+func transferOptions(ctx *Context) TransferOptions {
+	metadata, _ := ctx.Flag("metadata")
+	return TransferOptions{Conflict: conflictPolicy(ctx), ResetMetadata: metadata == "--reset"}
+}
+
+// conflictPolicy returns the policy given by the conflict flag
+func conflictPolicy(ctx *Context) ConflictPolicy {
+	switch conflict, _ := ctx.Flag("conflict"); conflict {
+	case "--overwrite":
+		return ConflictOverwrite
+	case "--rename":
+		return ConflictRename
+	default:
+		return ConflictFail
+	}
+}
+
+func runWriteFile(ctx *Context) error {
+	userName := ctx.Arg("username")
+	folderName := ctx.Arg("folderpath")
+	fileName := ctx.Arg("filename")
+
+	err := ctx.Files.WriteFile(userName, folderName, fileName, []byte(ctx.Arg("content")))
+	if err != nil {
+		return err
+	}
+	ctx.Message("Write %s in %s/%s successfully.", fileName, userName, folderName)
+	return nil
+}
+
+func runAppendFile(ctx *Context) error {
+	userName := ctx.Arg("username")
+	folderName := ctx.Arg("folderpath")
+	fileName := ctx.Arg("filename")
+
+	err := ctx.Files.AppendFile(userName, folderName, fileName, []byte(ctx.Arg("content")))
+	if err != nil {
+		return err
+	}
+	ctx.Message("Append to %s in %s/%s successfully.", fileName, userName, folderName)
+	return nil
+}
+
+func runCatFile(ctx *Context) error {
+	content, err := ctx.Files.ReadFile(ctx.Arg("username"), ctx.Arg("folderpath"), ctx.Arg("filename"))
+	if err != nil {
+		return err
+	}
+	ctx.Content(content)
+	return nil
+}
+
+func runTruncateFile(ctx *Context) error {
+	userName := ctx.Arg("username")
+	folderName := ctx.Arg("folderpath")
+	fileName := ctx.Arg("filename")
+	size := int64(0)
+	if ctx.Has("size") {
+		var err error
+		size, err = strconv.ParseInt(ctx.Arg("size"), 10, 64)
+		if err != nil {
+			return &Error{Code: CodeInvalidSize, Name: ctx.Arg("size")}
+		}
+	}
+
+	err := ctx.Files.TruncateFile(userName, folderName, fileName, size)
+	if err != nil {
+		return err
+	}
+	ctx.Message("Truncate %s in %s/%s successfully.", fileName, userName, folderName)
+	return nil
+}
+
+func runListTrash(ctx *Context) error {
+	userName := ctx.Arg("username")
+
+	items, err := ctx.Users.GetTrash(userName)
+	if err != nil {
+		return err
+	}
+
+	listing := Listing{
+		Columns: []string{"id", "type", "name", "folder", "deletedAt"},
+		Empty:   fmt.Sprintf("Warning: The trash of %s is empty.", userName),
+	}
+	for _, item := range items {
+		kind := "file"
+		if item.Folder != nil {
+			kind = "folder"
+		}
+		listing.Rows = append(listing.Rows, []any{item.ID, kind, item.Name(), item.Path, item.DeletedAt})
+	}
+	ctx.List(listing)
+	return nil
+}
+
+func runRestore(ctx *Context) error {
+	userName := ctx.Arg("username")
+	id := ctx.Arg("id")
+
+	path, err := ctx.Users.RestoreTrash(userName, id, conflictPolicy(ctx))
+	if err != nil {
+		return err
+	}
+	ctx.Message("Restore %s to %s/%s successfully.", id, userName, path)
+	return nil
+}
+
+func runEmptyTrash(ctx *Context) error {
+	userName := ctx.Arg("username")
+
+	err := ctx.Users.EmptyTrash(userName)
+	if err != nil {
+		return err
+	}
+	ctx.Message("Empty the trash of %s successfully.", userName)
+	return nil
+}
+
+func runSnapshotCreate(ctx *Context) error {
+	userName := ctx.Arg("username")
+	label := ctx.Arg("snapshot")
+
+	err := ctx.Users.CreateSnapshot(userName, label)
+	if err != nil {
+		return err
+	}
+	ctx.Message("Create the snapshot %s of %s successfully.", label, userName)
+	return nil
+}
+
+func runSnapshotList(ctx *Context) error {
+	userName := ctx.Arg("username")
+
+	snapshots, err := ctx.Users.GetSnapshots(userName)
+	if err != nil {
+		return err
+	}
+
+	listing := Listing{
+		Columns: []string{"label", "createdAt"},
+		Empty:   fmt.Sprintf("Warning: The %s doesn't have any snapshots.", userName),
+	}
+	for _, snapshot := range snapshots {
+		listing.Rows = append(listing.Rows, []any{snapshot.Label, snapshot.CreatedAt})
+	}
+	ctx.List(listing)
+	return nil
+}
+
+func runSnapshotDiff(ctx *Context) error {
+	userName := ctx.Arg("username")
+	label := ctx.Arg("snapshot")
+	otherLabel := ctx.Arg("other-snapshot")
+
+	changes, err := ctx.Users.DiffSnapshots(userName, label, otherLabel)
+	if err != nil {
+		return err
+	}
+
+	listing := Listing{
+		Columns: []string{"change", "type", "path"},
+		Empty:   fmt.Sprintf("Warning: The snapshots %s and %s are the same.", label, otherLabel),
+	}
+	for _, change := range changes {
+		kind := "file"
+		if change.Folder {
+			kind = "folder"
+		}
+		listing.Rows = append(listing.Rows, []any{change.Change, kind, change.Path})
+	}
+	ctx.List(listing)
+	return nil
+}
+
+func runSnapshotRestore(ctx *Context) error {
+	userName := ctx.Arg("username")
+	label := ctx.Arg("snapshot")
+
+	err := ctx.Users.RestoreSnapshot(userName, label)
+	if err != nil {
+		return err
+	}
+	ctx.Message("Restore %s to the snapshot %s successfully.", userName, label)
+	return nil
+}
+
+func runSnapshotDelete(ctx *Context) error {
+	userName := ctx.Arg("username")
+	label := ctx.Arg("snapshot")
+
+	err := ctx.Users.DeleteSnapshot(userName, label)
+	if err != nil {
+		return err
+	}
+	ctx.Message("Delete the snapshot %s of %s successfully.", label, userName)
+	return nil
+}
+
+func runUndo(ctx *Context) error {
+	entry, err := ctx.dispatcher.undo()
+	if err != nil {
+		return err
+	}
+	ctx.Message("Undo %s successfully.", entry)
+	return nil
+}
+
+func runRedo(ctx *Context) error {
+	entry, err := ctx.dispatcher.redo()
+	if err != nil {
+		return err
+	}
+	ctx.Message("Redo %s successfully.", entry)
+	return nil
+}
+
+func runHistory(ctx *Context) error {
+	d := ctx.dispatcher
+
+	listing := Listing{
+		Columns: []string{"command", "executedAt", "state"},
+		Empty:   "Warning: There are no commands to undo or redo.",
+	}
+	for _, entry := range d.undoStack {
+		listing.Rows = append(listing.Rows, []any{entry.String(), entry.time, "done"})
+	}
+	// The next command to redo comes first
+	for i := len(d.redoStack) - 1; i >= 0; i-- {
+		entry := d.redoStack[i]
+		listing.Rows = append(listing.Rows, []any{entry.String(), entry.time, "undone"})
+	}
+	ctx.List(listing)
+	return nil
+}
+
+func runSave(ctx *Context) error {
+	d := ctx.dispatcher
+	path := d.DataFile
+	if ctx.Has("path") {
+		path = ctx.Arg("path")
+	}
+	if path == "" {
+		return ctx.UsageError("Insufficient arguments")
+	}
+
+	// Saving to the data file folds the journal into it
+	var err error
+	if path == d.DataFile {
+		err = d.compact()
+	} else {
+		err = ctx.Users.Save(path)
+	}
+	if err != nil {
+		return err
+	}
+	ctx.Message("Save to %s successfully.", path)
+	return nil
+}
+
+func runLoad(ctx *Context) error {
+	d := ctx.dispatcher
+	path := d.DataFile
+	if ctx.Has("path") {
+		path = ctx.Arg("path")
+	}
+	if path == "" {
+		return ctx.UsageError("Insufficient arguments")
+	}
+
+	err := ctx.Users.Load(path)
+	if err != nil {
+		return err
+	}
+	// The loaded tree has nothing to do with the commands run before
+	d.clearHistory()
+	// Persist the loaded tree so that the journal applies on top of it
+	if d.journal != nil {
+		if err := d.compact(); err != nil {
+			return err
+		}
+	}
+	ctx.Message("Load from %s successfully.", path)
+	return nil
+}
+
+func runSet(ctx *Context) error {
+	switch setting := ctx.Arg("setting"); setting {
+	case "output":
+		format, err := ParseFormat(ctx.Arg("value"))
+		if err != nil {
+			return err
+		}
+		ctx.dispatcher.Output = format
+		ctx.Format = format
+		ctx.Message("Set output to %s successfully.", format)
+		return nil
+	default:
+		return fmt.Errorf("Error: The setting %s doesn't exist.", setting)
+	}
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"sort"
+	"strings"
+	"virtual-file-system/internal/storage"
+	"virtual-file-system/internal/utils"
+)
+
+// Complete returns the completions of the argument being typed after the
+// given ones, which start with the command name. partial is the beginning
+// of the argument. The command names are completed first, then the flags,
+// their values and the positional arguments of the command, whose names
+// are read from the store.
+func (d *Dispatcher) Complete(args []string, partial string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(args) == 0 {
+		names := make([]string, 0, len(d.commands))
+		for name := range d.commands {
+			names = append(names, name)
+		}
+		return matching(names, partial)
+	}
+	command, ok := d.commands[args[0]]
+	if !ok {
+		return nil
+	}
+	args = args[1:]
+
+	if len(command.Flags) > 0 && strings.HasPrefix(partial, "-") && !contains(args, "--") {
+		var options []string
+		for _, flag := range command.Flags {
+			options = append(options, flag.Options...)
+		}
+		return matching(options, partial)
+	}
+	if len(args) > 0 && !contains(args, "--") {
+		if flag := command.flag(args[len(args)-1]); flag != nil {
+			if flag.Arg != "" {
+				return d.completeFlag(command, flag, args[:len(args)-1], partial)
+			}
+			if len(flag.Values) > 0 {
+				return matching(flag.Values, partial)
+			}
+		}
+	}
+
+	// The arguments typed so far may still be incomplete, name what is there
+	positionals, _, _, err := command.positionals(args)
+	if err != nil || len(positionals) >= len(command.Args) {
+		return nil
+	}
+	arg := command.Args[len(positionals)]
+	if arg.Complete == nil {
+		return nil
+	}
+	return arg.Complete(d.completionContext(command, positionals), partial)
+}
+
+// completeFlag completes the argument of the flag given after args
+func (d *Dispatcher) completeFlag(command *Command, flag *Flag, args []string, partial string) []string {
+	if flag.Complete == nil {
+		return nil
+	}
+	positionals, _, _, err := command.positionals(args)
+	if err != nil {
+		return nil
+	}
+	return flag.Complete(d.completionContext(command, positionals), partial)
+}
+
+// completionContext returns the context of a completion with the positional
+// arguments typed so far
+func (d *Dispatcher) completionContext(command *Command, positionals []string) *Context {
+	named := make(map[string]string, len(positionals))
+	for i, value := range positionals {
+		if i < len(command.Args) {
+			named[command.Args[i].Name] = value
+		}
+	}
+	return &Context{
+		Command:    command,
+		Users:      d.userService,
+		Folders:    d.folderService,
+		Files:      d.fileService,
+		dispatcher: d,
+		args:       named,
+	}
+}
+
+// matching returns the candidates starting with the partial argument in any
+// case, sorted like the store lists names
+func matching(candidates []string, partial string) []string {
+	var matches []string
+	partial = utils.NameKey(partial)
+	for _, candidate := range candidates {
+		if strings.HasPrefix(utils.NameKey(candidate), partial) {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return utils.NameKey(matches[i]) < utils.NameKey(matches[j])
+	})
+	return matches
+}
+
+// completeUsers completes the names of the users
+func completeUsers(ctx *Context, partial string) []string {
+	var names []string
+	ctx.Users.Store.View(func(tx storage.Tx) error {
+		users, err := tx.ListUsers()
+		for _, user := range users {
+			names = append(names, user.Name)
+		}
+		return err
+	})
+	return matching(names, partial)
+}
+
+// completeFolders completes the last name of a folder path of the user
+func completeFolders(ctx *Context, partial string) []string {
+	parent, name := "", partial
+	if i := strings.LastIndex(partial, "/"); i >= 0 {
+		parent, name = partial[:i+1], partial[i+1:]
+	}
+
+	var names []string
+	ctx.Users.Store.View(func(tx storage.Tx) error {
+		parentKey, _ := folderPath(parent)
+		folders, err := tx.ListFolders(utils.NameKey(ctx.Arg("username")), parentKey)
+		for _, folder := range folders {
+			names = append(names, parent+folder.Name)
+		}
+		return err
+	})
+	return matching(names, parent+name)
+}
+
+// completeFiles completes the names of the files in the folder of the user
+func completeFiles(ctx *Context, partial string) []string {
+	var names []string
+	ctx.Users.Store.View(func(tx storage.Tx) error {
+		folderKey, ok := folderPath(ctx.Arg("folderpath"))
+		if !ok {
+			return nil
+		}
+		files, err := tx.ListFiles(utils.NameKey(ctx.Arg("username")), folderKey)
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+		return err
+	})
+	return matching(names, partial)
+}
+
+// completeTrash completes the ids of the items in the trash of the user
+func completeTrash(ctx *Context, partial string) []string {
+	items, _ := ctx.Users.GetTrash(ctx.Arg("username"))
+	var ids []string
+	for _, item := range items {
+		if strings.HasPrefix(item.ID, partial) {
+			ids = append(ids, item.ID)
+		}
+	}
+	return ids
+}
+
+// completeSnapshots completes the labels of the snapshots of the user
+func completeSnapshots(ctx *Context, partial string) []string {
+	snapshots, _ := ctx.Users.GetSnapshots(ctx.Arg("username"))
+	labels := make([]string, len(snapshots))
+	for i, snapshot := range snapshots {
+		labels[i] = snapshot.Label
+	}
+	return matching(labels, partial)
+}
+
+// completeCommands completes the names of the commands, without the aliases
+func completeCommands(ctx *Context, partial string) []string {
+	var names []string
+	for _, command := range ctx.dispatcher.commandList {
+		names = append(names, command.Name)
+	}
+	return matching(names, partial)
+}
+
+// completeFormats completes the output formats
+func completeFormats(ctx *Context, partial string) []string {
+	names := make([]string, len(Formats))
+	for i, format := range Formats {
+		names[i] = string(format)
+	}
+	return matching(names, partial)
+}
+
+// completeChoices completes one of fixed choices
+func completeChoices(choices ...string) func(ctx *Context, partial string) []string {
+	return func(ctx *Context, partial string) []string {
+		return matching(choices, partial)
+	}
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"virtual-file-system/internal/storage"
+)
+
+func TestDispatcher_Complete(t *testing.T) {
+	d := NewDispatcher(storage.NewMemoryStore(nil))
+	d.out = &bytes.Buffer{}
+	commands := [][]string{
+		{"register", "dalaoqi"},
+		{"register", "david"},
+		{"create-folder", "-p", "dalaoqi", "projects/2024"},
+		{"create-folder", "dalaoqi", "projects/2023"},
+		{"create-folder", "dalaoqi", "photos"},
+		{"create-file", "dalaoqi", "projects", "plan"},
+		{"create-file", "dalaoqi", "projects", "notes"},
+		{"snapshot-create", "dalaoqi", "Before"},
+		{"snapshot-create", "dalaoqi", "beta"},
+	}
+	for _, args := range commands {
+		if err := d.Exec(args); err != nil {
+			t.Fatalf("Dispatcher.Exec(%v) has error: %s", args, err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		args     []string
+		partial  string
+		expected []string
+	}{
+		{
+			name:     "Command names and aliases",
+			partial:  "ca",
+			expected: []string{"cat", "cat-file"},
+		},
+		{
+			name:     "Unknown command",
+			args:     []string{"format-disk"},
+			expected: nil,
+		},
+		{
+			name:     "Users",
+			args:     []string{"list-folders"},
+			partial:  "Da",
+			expected: []string{"dalaoqi", "david"},
+		},
+		{
+			name:     "Root folders",
+			args:     []string{"list-files", "dalaoqi"},
+			partial:  "p",
+			expected: []string{"photos", "projects"},
+		},
+		{
+			name:     "Nested folders",
+			args:     []string{"delete-folder", "dalaoqi"},
+			partial:  "projects/",
+			expected: []string{"projects/2023", "projects/2024"},
+		},
+		{
+			name:     "Files",
+			args:     []string{"cat", "dalaoqi", "projects"},
+			partial:  "",
+			expected: []string{"notes", "plan"},
+		},
+		{
+			name:     "Files of a missing folder",
+			args:     []string{"cat", "dalaoqi", "music"},
+			expected: nil,
+		},
+		{
+			name:     "Flags",
+			args:     []string{"list-files", "dalaoqi", "projects"},
+			partial:  "--sort-",
+			expected: []string{"--sort-created", "--sort-modified", "--sort-name", "--sort-size"},
+		},
+		{
+			name:     "Flag values",
+			args:     []string{"list-files", "dalaoqi", "projects", "--sort-name"},
+			expected: []string{"asc", "desc"},
+		},
+		{
+			name:     "Positional after a flag",
+			args:     []string{"list-folders", "--sort-created", "desc"},
+			partial:  "dav",
+			expected: []string{"david"},
+		},
+		{
+			name:     "Snapshots of a flag",
+			args:     []string{"list-folders", "dalaoqi", "--at"},
+			partial:  "be",
+			expected: []string{"Before", "beta"},
+		},
+		{
+			name:     "Positional after a flag argument",
+			args:     []string{"list-files", "--at", "beta", "dalaoqi"},
+			partial:  "ph",
+			expected: []string{"photos"},
+		},
+		{
+			name:     "Snapshots",
+			args:     []string{"snapshot-diff", "dalaoqi", "Before"},
+			partial:  "B",
+			expected: []string{"Before", "beta"},
+		},
+		{
+			name:     "Too many arguments",
+			args:     []string{"cat", "dalaoqi", "projects", "plan"},
+			expected: nil,
+		},
+		{
+			name:     "Commands of help",
+			args:     []string{"help"},
+			partial:  "rename-f",
+			expected: []string{"rename-file", "rename-folder"},
+		},
+		{
+			name:     "Output formats",
+			args:     []string{"set", "output"},
+			partial:  "t",
+			expected: []string{"table", "text", "tsv"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			got := d.Complete(test.args, test.partial)
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("Dispatcher.Complete(%q, %q) = %q, expected: %q", test.args, test.partial, got, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"virtual-file-system/internal/storage"
+)
+
+// stressStores creates an empty store of every kind
+var stressStores = []struct {
+	name string
+	open func(t *testing.T) storage.Store
+}{
+	{
+		name: "memory",
+		open: func(t *testing.T) storage.Store { return storage.NewMemoryStore(nil) },
+	},
+	{
+		name: "file",
+		open: func(t *testing.T) storage.Store {
+			store, err := storage.OpenFileStore(filepath.Join(t.TempDir(), "vfs.json"))
+			if err != nil {
+				t.Fatalf("OpenFileStore() has error: %s", err)
+			}
+			return store
+		},
+	},
+	{
+		name: "bolt",
+		open: func(t *testing.T) storage.Store {
+			store, err := storage.OpenBoltStore(filepath.Join(t.TempDir(), "vfs.db"))
+			if err != nil {
+				t.Fatalf("OpenBoltStore() has error: %s", err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return store
+		},
+	},
+}
+
+// parallel runs fn on n goroutines and waits for all of them
+func parallel(n int, fn func(worker int)) {
+	var wg sync.WaitGroup
+	for worker := 0; worker < n; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			fn(worker)
+		}(worker)
+	}
+	wg.Wait()
+}
+
+func TestServices_ConcurrentCreate(t *testing.T) {
+	const workers = 16
+	for _, backend := range stressStores {
+		t.Run(backend.name, func(t *testing.T) {
+			userService := NewUserService(backend.open(t))
+			folderService := NewFolderService(userService)
+			fileService := NewFileService(userService, folderService)
+
+			// Exactly one of the concurrent creations of an entity succeeds
+			testCases := []struct {
+				name   string
+				create func() error
+			}{
+				{name: "Register", create: func() error { return userService.Register("dalaoqi") }},
+				{name: "CreateFolder", create: func() error { return folderService.CreateFolder("dalaoqi", "docs", "") }},
+				{name: "CreateFolderAll", create: func() error { return folderService.CreateFolderAll("dalaoqi", "a/b/c", "") }},
+				{name: "CreateFile", create: func() error { return fileService.CreateFile("dalaoqi", "docs", "notes", "") }},
+				{name: "RenameFolder", create: func() error { return folderService.RenameFolder("dalaoqi", "a", "renamed") }},
+				{name: "DeleteFile", create: func() error { return fileService.DeleteFile("dalaoqi", "docs", "notes", false) }},
+				{name: "DeleteFolder", create: func() error { return folderService.DeleteFolder("dalaoqi", "renamed/b", false) }},
+			}
+			for _, test := range testCases {
+				var succeeded atomic.Int32
+				parallel(workers, func(int) {
+					if test.create() == nil {
+						succeeded.Add(1)
+					}
+				})
+				if succeeded.Load() != 1 {
+					t.Errorf("%s succeeded %d times, expected once", test.name, succeeded.Load())
+				}
+			}
+		})
+	}
+}
+
+func TestServices_ConcurrentAppend(t *testing.T) {
+	const (
+		workers = 8
+		appends = 20
+	)
+	for _, backend := range stressStores {
+		t.Run(backend.name, func(t *testing.T) {
+			userService := newStressServices(t, backend.open(t))
+			fileService := NewFileService(userService, NewFolderService(userService))
+			fileService.CreateFile("dalaoqi", "docs", "log", "")
+
+			// Every append reads and extends the content atomically
+			parallel(workers, func(worker int) {
+				line := []byte(fmt.Sprintf("worker %d\n", worker))
+				for i := 0; i < appends; i++ {
+					if err := fileService.AppendFile("dalaoqi", "docs", "log", line); err != nil {
+						t.Errorf("AppendFile() has error: %s", err)
+					}
+				}
+			})
+
+			content, err := fileService.ReadFile("dalaoqi", "docs", "log")
+			if err != nil {
+				t.Fatalf("ReadFile() has error: %s", err)
+			}
+			for worker := 0; worker < workers; worker++ {
+				line := []byte(fmt.Sprintf("worker %d\n", worker))
+				if count := bytes.Count(content, line); count != appends {
+					t.Errorf("Content has %d lines of worker %d, expected %d", count, worker, appends)
+				}
+			}
+			files, _ := fileService.GetFiles("dalaoqi", "docs", "--sort-name", "asc")
+			if len(files) != 1 || files[0].Size != int64(len(content)) {
+				t.Errorf("GetFiles() = %v, expected a size of %d", files, len(content))
+			}
+		})
+	}
+}
+
+func TestServices_ConcurrentMixed(t *testing.T) {
+	const (
+		workers    = 8
+		iterations = 10
+	)
+	for _, backend := range stressStores {
+		t.Run(backend.name, func(t *testing.T) {
+			userService := newStressServices(t, backend.open(t))
+			folderService := NewFolderService(userService)
+			fileService := NewFileService(userService, folderService)
+			fsys := NewFS(userService, "")
+
+			// Workers change their own folders while reading the whole tree,
+			// errors are expected when the others delete what is being read
+			parallel(workers, func(worker int) {
+				folder := fmt.Sprintf("worker%d", worker)
+				for i := 0; i < iterations; i++ {
+					path := fmt.Sprintf("%s/run%d", folder, i)
+					folderService.CreateFolderAll("dalaoqi", path, "")
+					fileService.CreateFile("dalaoqi", path, "data", "")
+					fileService.WriteFile("dalaoqi", path, "data", []byte(path))
+					fileService.AppendFile("dalaoqi", path, "data", []byte("!"))
+					fileService.TruncateFile("dalaoqi", path, "data", 3)
+					if writer, err := fileService.OpenWriter("dalaoqi", path, "data", true); err == nil {
+						writer.Write(make([]byte, 100))
+						writer.Close()
+					}
+					if reader, err := fileService.Open("dalaoqi", path, "data"); err == nil {
+						io.Copy(io.Discard, reader)
+						reader.Close()
+					}
+					fileService.ReadFile("dalaoqi", path, "data")
+					fileService.GetFiles("dalaoqi", path, "--sort-size", "desc")
+					folderService.GetSubFolders("dalaoqi", folder, "--sort-created", "asc")
+					folderService.GetFolders("dalaoqi", "--sort-name", "desc")
+					fs.WalkDir(fsys, ".", func(string, fs.DirEntry, error) error { return nil })
+					folderService.RenameFolder("dalaoqi", path, fmt.Sprintf("moved%d", i))
+					fileService.DeleteFile("dalaoqi", fmt.Sprintf("%s/moved%d", folder, i), "data", false)
+					if i%2 == 0 {
+						folderService.DeleteFolder("dalaoqi", fmt.Sprintf("%s/moved%d", folder, i), false)
+					}
+				}
+			})
+
+			for worker := 0; worker < workers; worker++ {
+				folders, err := folderService.GetSubFolders("dalaoqi", fmt.Sprintf("worker%d", worker), "--sort-name", "asc")
+				if err != nil || len(folders) != iterations/2 {
+					t.Errorf("worker%d has %d folders, %v, expected %d", worker, len(folders), err, iterations/2)
+				}
+			}
+		})
+	}
+}
+
+func TestDispatcher_ConcurrentExec(t *testing.T) {
+	const workers = 8
+	dataFile := filepath.Join(t.TempDir(), "vfs.json")
+	d := newTestDispatcher(t, dataFile)
+	d.CompactEvery = 10
+	d.Exec([]string{"register", "dalaoqi"})
+
+	parallel(workers, func(worker int) {
+		folder := fmt.Sprintf("worker%d", worker)
+		commands := [][]string{
+			{"create-folder", "dalaoqi", folder},
+			{"create-file", "dalaoqi", folder, "notes"},
+			{"write-file", "dalaoqi", folder, "notes", "hello"},
+			{"append-file", "dalaoqi", folder, "notes", " world"},
+			{"list-files", "dalaoqi", folder},
+			{"create-folder", "-p", "dalaoqi", folder + "/a/b"},
+			{"rename-folder", "dalaoqi", folder + "/a", "c"},
+		}
+		for _, args := range commands {
+			if err := d.Exec(args); err != nil {
+				t.Errorf("Dispatcher.Exec(%v) has error: %s", args, err)
+			}
+		}
+	})
+	expected := dumpTree(t, d)
+	d.journal.Close()
+
+	// The journal must replay to the same tree whatever the interleaving
+	restored := newTestDispatcher(t, dataFile)
+	defer restored.Close()
+	assertSameTree(t, dumpTree(t, restored), expected)
+}
+
+// newStressServices creates the services with a user and a folder
+func newStressServices(t *testing.T, store storage.Store) *UserService {
+	t.Helper()
+	userService := NewUserService(store)
+	if err := userService.Register("dalaoqi"); err != nil {
+		t.Fatalf("Register() has error: %s", err)
+	}
+	if err := NewFolderService(userService).CreateFolder("dalaoqi", "docs", ""); err != nil {
+		t.Fatalf("CreateFolder() has error: %s", err)
+	}
+	return userService
+}
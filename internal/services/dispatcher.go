@@ -1,187 +1,458 @@
 package services
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"virtual-file-system/internal/storage"
+	"virtual-file-system/internal/utils"
 )
 
+// DefaultCompactEvery is the number of journal records that triggers a compaction
+const DefaultCompactEvery = 100
+
+// The suggestions of an unrecognized command are the names within
+// maxSuggestionDistance edits, or starting with it, up to maxSuggestions
+const (
+	maxSuggestionDistance = 2
+	maxSuggestions        = 3
+)
+
+// EOFMarker ends the content typed after write-file or append-file
+const EOFMarker = "EOF"
+
+// ErrNotPersisted is returned by Exec and Apply for a change that couldn't be
+// journaled nor reverted. It is in the tree but lost if the process stops
+// before the tree is saved.
+var ErrNotPersisted = errors.New("Error: The change was applied but couldn't be saved.")
+
 type Dispatcher struct {
+	// DataFile is the snapshot path used by save and load.
+	// Its journal is stored next to it with a ".journal" suffix.
+	DataFile string
+	// CompactEvery is the number of journal records folded into a fresh snapshot
+	CompactEvery int
+	// Output is the format the results and errors are printed in
+	Output Format
+	// Input provides the content of write-file and append-file when it isn't
+	// given as an argument, line by line until EOFMarker
+	Input *bufio.Scanner
+	// UndoDepth is the number of mutating commands that can be undone, none
+	// if zero
+	UndoDepth int
+
 	userService   *UserService
 	folderService *FolderService
 	fileService   *FileService
+	// commands resolves the names and aliases of the commands, listed in
+	// their registration order
+	commands    map[string]*Command
+	commandList []*Command
+
+	// mu serializes the commands so that the journal records them in the
+	// order they were applied
+	mu       sync.Mutex
+	out      io.Writer
+	journal  *storage.Journal
+	sequence uint64
+
+	// recorder records the changes of the mutating commands, which are
+	// undone from undoStack and redone from redoStack
+	recorder  *storage.Recorder
+	undoStack []historyEntry
+	redoStack []historyEntry
 }
 
-// NewDispatcher creates a new instance of Dispatcher
-func NewDispatcher() *Dispatcher {
-	userService := NewUserService()
+// NewDispatcher creates a new instance of Dispatcher on top of the store
+func NewDispatcher(store storage.Store) *Dispatcher {
+	recorder := &storage.Recorder{Store: store}
+	userService := NewUserService(recorder)
 	folderService := NewFolderService(userService)
 	fileService := NewFileService(userService, folderService)
-	return &Dispatcher{
+	d := &Dispatcher{
+		CompactEvery:  DefaultCompactEvery,
+		Output:        FormatText,
+		UndoDepth:     DefaultUndoDepth,
 		userService:   userService,
 		folderService: folderService,
 		fileService:   fileService,
+		commands:      make(map[string]*Command),
+		out:           os.Stdout,
+		recorder:      recorder,
 	}
+	for _, command := range builtinCommands() {
+		d.register(command)
+	}
+	return d
 }
 
-// Exec executes the command based on the arguments
-func (d *Dispatcher) Exec(args []string) error {
-	switch args[0] {
-	case "register":
-		if len(args) < 2 {
-			return fmt.Errorf("Error: Insufficient arguments\nUsage: register [username]")
-		}
-		userName := args[1]
+// SetNamePolicy sets the policy checking the names of new users, folders and
+// files. It must be called before the dispatcher is used.
+func (d *Dispatcher) SetNamePolicy(policy utils.NamePolicy) {
+	d.userService.NamePolicy = policy
+}
 
-		// Register a new user using the user service
-		err := d.userService.Register(userName)
-		if err != nil {
-			return err
-		}
+// SetTrashRetention sets how long deleted folders and files stay in the
+// trash, forever if zero. It must be called before the dispatcher is used.
+func (d *Dispatcher) SetTrashRetention(retention time.Duration) {
+	d.userService.TrashRetention = retention
+}
 
-		fmt.Printf("Add %s successfully.\n", userName)
-		return nil
-	case "create-folder":
-		if len(args) < 3 {
-			return fmt.Errorf("Error: Insufficient arguments\nUsage: create-folder [username] [foldername] [description]?")
-		}
-		userName := args[1]
-		folderName := args[2]
-		description := ""
-		if len(args) > 3 {
-			description = args[3]
-		}
+// RegisterCommand adds a command to the dispatcher. Its name and aliases
+// must not be taken by another command.
+func (d *Dispatcher) RegisterCommand(command *Command) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-		err := d.folderService.CreateFolder(userName, folderName, description)
-		if err != nil {
-			return err
+	if command.Name == "" || command.Run == nil {
+		return fmt.Errorf("Error: The command needs a name and a handler.")
+	}
+	for _, name := range append([]string{command.Name}, command.Aliases...) {
+		if _, ok := d.commands[name]; ok {
+			return fmt.Errorf("Error: The command %s has already existed.", name)
 		}
-		fmt.Printf("Create %s successfully.\n", folderName)
+	}
+	d.register(command)
+	return nil
+}
+
+func (d *Dispatcher) register(command *Command) {
+	d.commands[command.Name] = command
+	for _, alias := range command.Aliases {
+		d.commands[alias] = command
+	}
+	d.commandList = append(d.commandList, command)
+}
+
+// Commands returns the registered commands in their registration order
+func (d *Dispatcher) Commands() []*Command {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*Command(nil), d.commandList...)
+}
+
+// Exec executes the command based on the arguments and records it in the
+// journal and the undo history when it mutates the tree. An empty command
+// does nothing. It is safe for concurrent use.
+func (d *Dispatcher) Exec(args []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(args) == 0 {
 		return nil
-	case "list-folders":
-		if len(args) < 2 {
-			return fmt.Errorf("Error: Insufficient arguments\nUsage: list-folders [username] [--sort-name|--sort-created] [asc|desc]")
-		}
-		userName := args[1]
-		sortFlag := "--sort-name"
-		sortOrderFlag := "asc"
+	}
+	command, err := d.lookup(args[0])
+	if err != nil {
+		return err
+	}
 
-		if len(args) > 2 {
-			// Check if the sort flag is provided
-			sortFlag = args[2]
+	// Read the content first so that the journal records it as an argument
+	args, err = d.readContent(args)
+	if err != nil {
+		return err
+	}
 
-			if len(args) > 3 {
-				// Check if the sort order is provided
-				sortOrderFlag = args[3]
+	if !command.Mutating {
+		return d.run(command, args[1:])
+	}
 
-			}
-		}
+	// Journal the name rather than an alias
+	return d.mutate(append([]string{command.Name}, args[1:]...), func() error {
+		return d.run(command, args[1:])
+	})
+}
 
-		folders, err := d.folderService.GetFolders(userName, sortFlag, sortOrderFlag)
-		if err != nil {
-			return err
-		}
+// Apply runs change, which must change the tree like the mutating command of
+// args would, and records that command in the journal and the undo history
+// like Exec does. It lets Go code calling the services of the dispatcher
+// directly, like the REST server, keep its changes across a crash. It is safe
+// for concurrent use.
+func (d *Dispatcher) Apply(args []string, change func() error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-		for _, folder := range folders {
-			createdAt := folder.CreatedAt.Format("2006-01-02 15:04:05")
-			fmt.Printf("%s %s %s %s\n", folder.Name, folder.Description, createdAt, userName)
-		}
+	if len(args) == 0 {
+		return fmt.Errorf("Error: The change needs the command it matches.")
+	}
+	command, err := d.lookup(args[0])
+	if err != nil {
+		return err
+	}
+	if !command.Mutating {
+		return fmt.Errorf("Error: The command %s doesn't change the tree.", command.Name)
+	}
+	return d.mutate(append([]string{command.Name}, args[1:]...), change)
+}
 
-		return nil
-	case "delete-folder":
-		if len(args) < 3 {
-			return fmt.Errorf("Error: Insufficient arguments\nUsage: delete-folder [username] [foldername]")
+// Services returns the services of the dispatcher, whose changes must go
+// through Apply to be journaled
+func (d *Dispatcher) Services() (*UserService, *FolderService, *FileService) {
+	return d.userService, d.folderService, d.fileService
+}
+
+// mutate runs change and records it as the command of args in the journal
+// and the undo history
+func (d *Dispatcher) mutate(args []string, change func() error) error {
+	now := time.Now()
+	if d.journal != nil {
+		// Freeze the clock so that the replayed command gets the same timestamps
+		d.userService.setClock(func() time.Time { return now })
+		defer d.userService.setClock(nil)
+	}
+
+	// The changes are recorded to be undone, or reverted when they can't be
+	// journaled
+	if d.UndoDepth > 0 || d.journal != nil {
+		d.recorder.Changes = &storage.Changes{}
+	}
+	err := change()
+	changes := d.recorder.Changes
+	d.recorder.Changes = nil
+	if err != nil {
+		return err
+	}
+
+	if d.journal != nil {
+		if err := d.record(now, args); err != nil {
+			return d.revert(changes, err)
 		}
-		userName := args[1]
-		folderName := args[2]
+	}
+	if d.UndoDepth > 0 {
+		d.remember(now, args, changes)
+	}
+	return nil
+}
 
-		err := d.folderService.DeleteFolder(userName, folderName)
-		if err != nil {
-			return err
+// revert reverts the changes of a command that couldn't be journaled because
+// of err, so that the tree is the one the journal and the data file hold
+func (d *Dispatcher) revert(changes *storage.Changes, err error) error {
+	if revertErr := d.userService.Store.Update(changes.Revert); revertErr != nil {
+		return fmt.Errorf("%w\n%v\n%v", ErrNotPersisted, err, revertErr)
+	}
+	return fmt.Errorf("Error: The change couldn't be saved and was reverted.\n%v", err)
+}
+
+// exec runs the command without touching the journal
+func (d *Dispatcher) exec(args []string) error {
+	command, err := d.lookup(args[0])
+	if err != nil {
+		return err
+	}
+	return d.run(command, args[1:])
+}
+
+// lookup resolves the command of the name or alias, suggesting the closest
+// names when there is none
+func (d *Dispatcher) lookup(name string) (*Command, error) {
+	if command, ok := d.commands[name]; ok {
+		return command, nil
+	}
+
+	// Suggest the names within a few edits, or starting with the given one
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	var suggestions []suggestion
+	for candidate := range d.commands {
+		distance := utils.EditDistance(name, candidate)
+		if distance <= maxSuggestionDistance || (name != "" && strings.HasPrefix(candidate, name)) {
+			suggestions = append(suggestions, suggestion{candidate, distance})
 		}
-		fmt.Printf("Delete %s successfully.\n", folderName)
-		return nil
-	case "rename-folder":
-		if len(args) < 4 {
-			return fmt.Errorf("Error: Insufficient arguments\nUsage: rename-folder [username] [foldername] [new-folder-name]")
+	}
+	if len(suggestions) == 0 {
+		return nil, fmt.Errorf("Error: Unrecognized command")
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].distance != suggestions[j].distance {
+			return suggestions[i].distance < suggestions[j].distance
 		}
-		userName := args[1]
-		folderName := args[2]
-		newFolderName := args[3]
+		return suggestions[i].name < suggestions[j].name
+	})
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+	names := make([]string, len(suggestions))
+	for i, s := range suggestions {
+		names[i] = s.name
+	}
+	return nil, fmt.Errorf("Error: Unrecognized command\nDid you mean %s?", utils.JoinChoices(names))
+}
+
+// run checks the arguments after the command name and runs the command
+func (d *Dispatcher) run(command *Command, args []string) error {
+	ctx, err := command.parse(args)
+	if err != nil {
+		return err
+	}
+	ctx.Out = d.out
+	ctx.Format = d.Output
+	ctx.Users = d.userService
+	ctx.Folders = d.folderService
+	ctx.Files = d.fileService
+	ctx.dispatcher = d
+	return command.Run(ctx)
+}
+
+// Open restores the tree from DataFile, replays its journal on top of it
+// and starts journaling every mutating command
+func (d *Dispatcher) Open() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-		err := d.folderService.RenameFolder(userName, folderName, newFolderName)
+	users, sequence, err := storage.LoadSnapshot(d.DataFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		err = d.userService.Store.Update(func(tx storage.Tx) error {
+			return storage.Restore(tx, users)
+		})
 		if err != nil {
 			return err
 		}
-		fmt.Printf("Rename %s to %s successfully.\n", folderName, newFolderName)
+	}
+	d.sequence = sequence
+
+	journal, records, err := storage.OpenJournal(d.journalPath())
+	if err != nil {
+		return err
+	}
+	if journal.Torn() {
+		fmt.Fprintln(d.out, "Warning: Discarded a torn record at the end of the journal.")
+	}
+
+	if err := d.replay(records); err != nil {
+		journal.Close()
+		return err
+	}
+	d.journal = journal
+	return nil
+}
+
+// Close folds the journal into DataFile and stops journaling
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.journal == nil {
 		return nil
-	case "create-file":
-		if len(args) < 4 {
-			return fmt.Errorf("Error: Insufficient arguments\nUsage: create-file [username] [foldername] [filename] [description]?")
-		}
-		userName := args[1]
-		folderName := args[2]
-		fileName := args[3]
-		description := ""
-		if len(args) > 4 {
-			description = args[4]
-		}
+	}
+	err := d.compact()
+	if closeErr := d.journal.Close(); err == nil {
+		err = closeErr
+	}
+	d.journal = nil
+	return err
+}
 
-		err := d.fileService.CreateFile(userName, folderName, fileName, description)
-		if err != nil {
-			return err
-		}
-		fmt.Printf("Create %s in %s/%s successfully.\n", fileName, userName, folderName)
+// Compact writes the current tree to DataFile and empties the journal
+func (d *Dispatcher) Compact() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.compact()
+}
+
+func (d *Dispatcher) compact() error {
+	if err := d.userService.save(d.DataFile, d.sequence); err != nil {
+		return err
+	}
+	if d.journal == nil {
 		return nil
-	case "list-files":
-		if len(args) < 3 {
-			return fmt.Errorf("Error: Insufficient arguments\nUsage: list-files [username] [foldername] [--sort-name|--sort-created] [asc|desc]")
-		}
-		userName := args[1]
-		folderName := args[2]
-		sortFlag := "--sort-name"
-		sortOrderFlag := "asc"
-
-		if len(args) > 3 {
-			// Check if the sort flag is provided
-			sortFlag = args[3]
-
-			if len(args) > 4 {
-				// Check if the sort order is provided
-				sortOrderFlag = args[4]
-			}
-		}
+	}
+	return d.journal.Reset()
+}
 
-		files, err := d.fileService.GetFiles(userName, folderName, sortFlag, sortOrderFlag)
-		if err != nil {
-			return err
-		}
+// replay applies the journal records that are newer than the snapshot
+func (d *Dispatcher) replay(records []storage.JournalRecord) error {
+	out := d.out
+	d.out = io.Discard
+	defer func() {
+		d.out = out
+		d.userService.setClock(nil)
+	}()
 
-		if len(files) == 0 {
-			fmt.Println("Warning: The folder is empty.")
-			return nil
+	for _, record := range records {
+		if record.Sequence <= d.sequence {
+			continue
 		}
-
-		for _, file := range files {
-			createdAt := file.CreatedAt.Format("2006-01-02 15:04:05")
-			fmt.Printf("%s %s %s %s %s\n", file.Name, file.Description, createdAt, folderName, userName)
+		recordTime := record.Time
+		d.userService.setClock(func() time.Time { return recordTime })
+		if len(record.Args) == 0 {
+			return fmt.Errorf("Error: Cannot replay journal record %d: empty command", record.Sequence)
 		}
-		return nil
-	case "delete-file":
-		if len(args) < 4 {
-			return fmt.Errorf("Error: Insufficient arguments\nUsage: delete-file [username] [foldername] [filename]")
+		if err := d.exec(record.Args); err != nil {
+			return fmt.Errorf("Error: Cannot replay journal record %d: %v", record.Sequence, err)
 		}
+		d.sequence = record.Sequence
+	}
+	return nil
+}
 
-		userName := args[1]
-		folderName := args[2]
-		fileName := args[3]
-
-		err := d.fileService.DeleteFile(userName, folderName, fileName)
-		if err != nil {
+// record appends a successful mutating command to the journal and compacts
+// the journal once it grows beyond CompactEvery records. A command too large
+// for the journal, like a write of a huge content, is saved by compacting
+// right away. It returns an error when the command isn't saved, while a
+// failed compaction of a journaled command is only a warning.
+func (d *Dispatcher) record(now time.Time, args []string) error {
+	d.sequence++
+	err := d.journal.Append(storage.JournalRecord{Sequence: d.sequence, Time: now, Args: args})
+	switch {
+	case errors.Is(err, storage.ErrRecordTooLarge):
+		// The command is saved with the data file instead
+		if err := d.userService.save(d.DataFile, d.sequence); err != nil {
+			d.sequence--
 			return err
 		}
+		err = d.journal.Reset()
+	case err != nil:
+		d.sequence--
+		return err
+	case d.CompactEvery > 0 && d.journal.Len() >= d.CompactEvery:
+		err = d.compact()
+	}
 
-		fmt.Printf("Delete %s in %s/%s successfully.\n", fileName, userName, folderName)
-		return nil
-	default:
-		return fmt.Errorf("Error: Unrecognized command")
+	// The command is saved, a failed compaction is tried again next time
+	if err != nil {
+		fmt.Fprintf(d.out, "Warning: The journal couldn't be compacted.\n%v\n", err)
+	}
+	return nil
+}
+
+// readContent appends the content read from Input to a command given
+// without its last argument when that argument is read from Input, like the
+// content of write-file or append-file
+func (d *Dispatcher) readContent(args []string) ([]string, error) {
+	command, ok := d.commands[args[0]]
+	if !ok || d.Input == nil || !command.readsInput(args[1:]) {
+		return args, nil
 	}
+
+	var content strings.Builder
+	for {
+		if !d.Input.Scan() {
+			if err := d.Input.Err(); err != nil {
+				return nil, fmt.Errorf("Error: Cannot read the content: %v", err)
+			}
+			return nil, fmt.Errorf("Error: The content isn't terminated by %s.", EOFMarker)
+		}
+		line := d.Input.Text()
+		if line == EOFMarker {
+			break
+		}
+		content.WriteString(line)
+		content.WriteString("\n")
+	}
+	return append(args[:len(args):len(args)], content.String()), nil
+}
+
+func (d *Dispatcher) journalPath() string {
+	return d.DataFile + ".journal"
 }
@@ -0,0 +1,305 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/storage"
+)
+
+// newTestDispatcher creates a dispatcher persisting to dataFile with its output discarded
+func newTestDispatcher(t *testing.T, dataFile string) *Dispatcher {
+	d := NewDispatcher(storage.NewMemoryStore(nil))
+	d.out = io.Discard
+	d.DataFile = dataFile
+	if err := d.Open(); err != nil {
+		t.Fatalf("Dispatcher.Open() has error: %s", err)
+	}
+	return d
+}
+
+func TestDispatcher_JournalReplay(t *testing.T) {
+	dataFile := filepath.Join(t.TempDir(), "vfs.json")
+	commands := [][]string{
+		{"register", "dalaoqi"},
+		{"create-folder", "dalaoqi", "docs", "the docs description"},
+		{"create-folder", "dalaoqi", "tmp"},
+		{"rename-folder", "dalaoqi", "docs", "meeting docs"},
+		{"create-file", "dalaoqi", "meeting docs", "notes", "meeting notes"},
+		{"create-file", "dalaoqi", "meeting docs", "draft"},
+		{"delete-file", "dalaoqi", "meeting docs", "draft"},
+		{"delete-folder", "dalaoqi", "tmp"},
+		{"restore", "dalaoqi", "2"},
+		{"delete-folder", "--permanent", "dalaoqi", "tmp"},
+		{"write-file", "dalaoqi", "meeting docs", "notes"},
+		{"append-file", "dalaoqi", "meeting docs", "notes", "line three"},
+		{"truncate-file", "dalaoqi", "meeting docs", "notes", "22"},
+		{"snapshot-create", "dalaoqi", "Before"},
+		{"set-folder-description", "dalaoqi", "meeting docs", "the meeting docs"},
+		{"copy-folder", "dalaoqi", "meeting docs", "archive"},
+		{"copy-folder", "--rename", "dalaoqi", "meeting docs", "archive"},
+		{"rename-file", "dalaoqi", "archive", "notes", "minutes"},
+		{"set-file-description", "dalaoqi", "archive", "minutes", "the minutes"},
+		{"register", "david"},
+		{"create-folder", "david", "inbox"},
+		{"copy-file", "dalaoqi", "archive", "minutes", "inbox", "david"},
+		{"move-file", "--overwrite", "--reset", "dalaoqi", "archive (1)", "notes", "inbox", "david"},
+		{"register", "tmp"},
+		{"create-folder", "tmp", "scratch"},
+		{"rename-user", "tmp", "temp"},
+		{"unregister", "--force", "temp"},
+		{"rename-user", "david", "dave"},
+		{"snapshot-create", "dalaoqi", "scratch"},
+		{"snapshot-delete", "dalaoqi", "Scratch"},
+		{"snapshot-restore", "dalaoqi", "before"},
+	}
+
+	d := newTestDispatcher(t, dataFile)
+	// The content of write-file is read from the input and must be journaled
+	d.Input = bufio.NewScanner(strings.NewReader("line one\nline two\nEOF\n"))
+	for _, args := range commands {
+		if err := d.Exec(args); err != nil {
+			t.Fatalf("Dispatcher.Exec(%v) has error: %s", args, err)
+		}
+	}
+	// A failed command must not be journaled
+	if err := d.Exec([]string{"register", "dalaoqi"}); err == nil {
+		t.Fatalf("Dispatcher.Exec() registered a duplicated user")
+	}
+	expected := dumpTree(t, d)
+	if content := string(expected["dalaoqi"].Folders["meeting docs"].Files["notes"].Content); content != "line one\nline two\nline" {
+		t.Fatalf("Content = %q, expected the truncated lines", content)
+	}
+
+	// Simulate a crash: the journal is never folded into the snapshot
+	d.journal.Close()
+	if _, err := os.Stat(dataFile); !os.IsNotExist(err) {
+		t.Fatalf("Snapshot exists before compaction: %v", err)
+	}
+
+	restored := newTestDispatcher(t, dataFile)
+	defer restored.Close()
+	assertSameTree(t, dumpTree(t, restored), expected)
+}
+
+func TestDispatcher_Compaction(t *testing.T) {
+	dataFile := filepath.Join(t.TempDir(), "vfs.json")
+
+	d := newTestDispatcher(t, dataFile)
+	d.CompactEvery = 2
+	d.Exec([]string{"register", "dalaoqi"})
+	d.Exec([]string{"create-folder", "dalaoqi", "docs"})
+	if d.journal.Len() != 0 {
+		t.Errorf("Journal length after compaction = %d, expected 0", d.journal.Len())
+	}
+	d.Exec([]string{"create-file", "dalaoqi", "docs", "notes"})
+	expected := dumpTree(t, d)
+	d.journal.Close()
+
+	restored := newTestDispatcher(t, dataFile)
+	assertSameTree(t, dumpTree(t, restored), expected)
+	if err := restored.Close(); err != nil {
+		t.Fatalf("Dispatcher.Close() has error: %s", err)
+	}
+
+	// Records already folded into the snapshot must not be replayed again
+	again := newTestDispatcher(t, dataFile)
+	defer again.Close()
+	assertSameTree(t, dumpTree(t, again), expected)
+}
+
+func TestDispatcher_JournalContent(t *testing.T) {
+	dataFile := filepath.Join(t.TempDir(), "vfs.json")
+	binary := "\x89PNG\r\n\x1a\n\x00\xff\xfe"
+	large := strings.Repeat("0123456789abcdef", 1<<20+1)
+
+	d := newTestDispatcher(t, dataFile)
+	for _, args := range [][]string{
+		{"register", "dalaoqi"},
+		{"create-folder", "dalaoqi", "docs"},
+		{"create-file", "dalaoqi", "docs", "image"},
+		{"write-file", "dalaoqi", "docs", "image", binary},
+		// Too large for the journal, so it is compacted instead
+		{"create-file", "dalaoqi", "docs", "large"},
+		{"write-file", "dalaoqi", "docs", "large", large},
+		{"append-file", "dalaoqi", "docs", "image", "\xc3"},
+	} {
+		if err := d.Exec(args); err != nil {
+			t.Fatalf("Dispatcher.Exec(%q) has error: %s", args[:4], err)
+		}
+	}
+	if d.journal.Len() != 1 {
+		t.Errorf("Journal length = %d, expected only the command after the large write", d.journal.Len())
+	}
+
+	// Simulate a crash: the journal is never folded into the snapshot
+	d.journal.Close()
+	restored := newTestDispatcher(t, dataFile)
+	defer restored.Close()
+	files := dumpTree(t, restored)["dalaoqi"].Folders["docs"].Files
+	if content := string(files["image"].Content); content != binary+"\xc3" {
+		t.Errorf("Binary content after replay = %q, expected %q", content, binary+"\xc3")
+	}
+	if content := string(files["large"].Content); content != large {
+		t.Errorf("Large content after replay has %d bytes, expected %d", len(content), len(large))
+	}
+}
+
+func TestDispatcher_JournalFailure(t *testing.T) {
+	dataDir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dataDir, 0o755); err != nil {
+		t.Fatalf("os.Mkdir() has error: %s", err)
+	}
+	var out bytes.Buffer
+	d := newTestDispatcher(t, filepath.Join(dataDir, "vfs.json"))
+	d.out = &out
+	d.CompactEvery = 2
+	for _, args := range [][]string{
+		{"register", "dalaoqi"},
+		{"create-folder", "dalaoqi", "docs"},
+		{"create-file", "dalaoqi", "docs", "notes"},
+	} {
+		if err := d.Exec(args); err != nil {
+			t.Fatalf("Dispatcher.Exec(%v) has error: %s", args, err)
+		}
+	}
+	// The data file can't be saved anymore, while the journal still can
+	if err := os.RemoveAll(dataDir); err != nil {
+		t.Fatalf("os.RemoveAll() has error: %s", err)
+	}
+
+	// A journaled command only warns that the compaction failed
+	if err := d.Exec([]string{"create-file", "dalaoqi", "docs", "todo"}); err != nil {
+		t.Errorf("Dispatcher.Exec() with a failed compaction has error: %s", err)
+	}
+	if !strings.Contains(out.String(), "Warning: The journal couldn't be compacted.") || !d.fileService.Exist("dalaoqi", "docs", "todo") {
+		t.Errorf("Output = %q, expected the warning and the created file", out.String())
+	}
+
+	// A command too large for the journal can't be saved and is reverted
+	err := d.Exec([]string{"write-file", "dalaoqi", "docs", "notes", strings.Repeat("a", 16<<20)})
+	if err == nil || !strings.HasPrefix(err.Error(), "Error: The change couldn't be saved and was reverted.") {
+		t.Errorf("Dispatcher.Exec() of a large write has error: %v, expected it to be reverted", err)
+	}
+	if content, _ := d.fileService.ReadFile("dalaoqi", "docs", "notes"); len(content) != 0 {
+		t.Errorf("Content after a reverted write has %d bytes, expected none", len(content))
+	}
+
+	// A command the journal can't write is reverted
+	d.journal.Close()
+	err = d.Exec([]string{"register", "david"})
+	if err == nil || !strings.HasPrefix(err.Error(), "Error: The change couldn't be saved and was reverted.") {
+		t.Errorf("Dispatcher.Exec() with a failed journal has error: %v, expected it to be reverted", err)
+	}
+	if d.userService.Exist("david") {
+		t.Errorf("Dispatcher.Exec() with a failed journal kept the user")
+	}
+	if last := d.undoStack[len(d.undoStack)-1]; last.args[0] != "create-file" {
+		t.Errorf("History ends with %v, expected the last saved command", last.args)
+	}
+}
+
+func TestDispatcher_ReadContent(t *testing.T) {
+	testCases := []struct {
+		name          string
+		input         string
+		args          []string
+		expectedArgs  []string
+		expectedError string
+	}{
+		{
+			name:         "Content read until the EOF marker",
+			input:        "hello\n\nworld\nEOF\nnext command\n",
+			args:         []string{"write-file", "dalaoqi", "docs", "notes"},
+			expectedArgs: []string{"write-file", "dalaoqi", "docs", "notes", "hello\n\nworld\n"},
+		},
+		{
+			name:         "Empty content",
+			input:        "EOF\n",
+			args:         []string{"append-file", "dalaoqi", "docs", "notes"},
+			expectedArgs: []string{"append-file", "dalaoqi", "docs", "notes", ""},
+		},
+		{
+			name:         "Content given as an argument",
+			input:        "EOF\n",
+			args:         []string{"write-file", "dalaoqi", "docs", "notes", "hello"},
+			expectedArgs: []string{"write-file", "dalaoqi", "docs", "notes", "hello"},
+		},
+		{
+			name:         "Other commands",
+			input:        "EOF\n",
+			args:         []string{"cat-file", "dalaoqi", "docs", "notes"},
+			expectedArgs: []string{"cat-file", "dalaoqi", "docs", "notes"},
+		},
+		{
+			name:          "Content without the EOF marker",
+			input:         "hello\n",
+			args:          []string{"write-file", "dalaoqi", "docs", "notes"},
+			expectedError: "Error: The content isn't terminated by EOF.",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDispatcher(storage.NewMemoryStore(nil))
+			d.Input = bufio.NewScanner(strings.NewReader(test.input))
+			args, err := d.readContent(test.args)
+			if (err == nil && test.expectedError != "") || (err != nil && err.Error() != test.expectedError) {
+				t.Fatalf("readContent() has error: %v, expected: %s", err, test.expectedError)
+			}
+			if !reflect.DeepEqual(args, test.expectedArgs) {
+				t.Errorf("readContent() = %q, expected: %q", args, test.expectedArgs)
+			}
+		})
+	}
+}
+
+// dumpTree reads the whole tree of the dispatcher's store
+func dumpTree(t *testing.T, d *Dispatcher) map[string]models.User {
+	t.Helper()
+	var users map[string]models.User
+	err := d.userService.Store.View(func(tx storage.Tx) error {
+		var err error
+		users, err = storage.Dump(tx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("storage.Dump() has error: %s", err)
+	}
+	return users
+}
+
+func assertSameTree(t *testing.T, got, expected map[string]models.User) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("Tree has %d users, expected %d", len(got), len(expected))
+	}
+	for userName, user := range expected {
+		gotUser := got[userName]
+		if len(gotUser.Folders) != len(user.Folders) {
+			t.Fatalf("%s has %d folders, expected %d", userName, len(gotUser.Folders), len(user.Folders))
+		}
+		for folderName, folder := range user.Folders {
+			gotFolder := gotUser.Folders[folderName]
+			if gotFolder.Name != folder.Name || gotFolder.Description != folder.Description || !gotFolder.CreatedAt.Equal(folder.CreatedAt) {
+				t.Errorf("Folder = %v, expected %v", gotFolder, folder)
+			}
+			if len(gotFolder.Files) != len(folder.Files) {
+				t.Fatalf("%s has %d files, expected %d", folderName, len(gotFolder.Files), len(folder.Files))
+			}
+			for fileName, file := range folder.Files {
+				gotFile := gotFolder.Files[fileName]
+				if gotFile.Name != file.Name || gotFile.Description != file.Description || !gotFile.CreatedAt.Equal(file.CreatedAt) ||
+					gotFile.Size != file.Size || !gotFile.ModifiedAt.Equal(file.ModifiedAt) || !bytes.Equal(gotFile.Content, file.Content) {
+					t.Errorf("File = %v, expected %v", gotFile, file)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"virtual-file-system/internal/utils"
+)
+
+// Code identifies the kind of an Error. Codes are stable and may be relied
+// upon by callers, new kinds only ever get new codes.
+type Code int
+
+const (
+	CodeUserNotFound      Code = 1
+	CodeUserExists        Code = 2
+	CodeFolderNotFound    Code = 3
+	CodeFolderExists      Code = 4
+	CodeFileNotFound      Code = 5
+	CodeFileExists        Code = 6
+	CodeInvalidName       Code = 7
+	CodeInvalidSortFlag   Code = 8
+	CodeInvalidSize       Code = 9
+	CodeMoveIntoItself    Code = 10
+	CodeInvalidOffset     Code = 11
+	CodeUserNotEmpty      Code = 12
+	CodeTrashItemNotFound Code = 13
+	CodeSnapshotNotFound  Code = 14
+	CodeSnapshotExists    Code = 15
+	CodeFileChanged       Code = 16
+)
+
+// Error is an error returned by the services about an entity
+type Error struct {
+	Code Code
+	// Name is the offending user, folder path, file, flag or value as given
+	// by the caller
+	Name string
+	// Folder is the folder path of an existing file
+	Folder string
+	// Reason tells why an invalid name was rejected, see utils.NameError
+	Reason string
+}
+
+// The errors below match every Error of their code with errors.Is
+var (
+	ErrUserNotFound      = &Error{Code: CodeUserNotFound}
+	ErrUserExists        = &Error{Code: CodeUserExists}
+	ErrFolderNotFound    = &Error{Code: CodeFolderNotFound}
+	ErrFolderExists      = &Error{Code: CodeFolderExists}
+	ErrFileNotFound      = &Error{Code: CodeFileNotFound}
+	ErrFileExists        = &Error{Code: CodeFileExists}
+	ErrInvalidName       = &Error{Code: CodeInvalidName}
+	ErrInvalidSortFlag   = &Error{Code: CodeInvalidSortFlag}
+	ErrInvalidSize       = &Error{Code: CodeInvalidSize}
+	ErrMoveIntoItself    = &Error{Code: CodeMoveIntoItself}
+	ErrInvalidOffset     = &Error{Code: CodeInvalidOffset}
+	ErrUserNotEmpty      = &Error{Code: CodeUserNotEmpty}
+	ErrTrashItemNotFound = &Error{Code: CodeTrashItemNotFound}
+	ErrSnapshotNotFound  = &Error{Code: CodeSnapshotNotFound}
+	ErrSnapshotExists    = &Error{Code: CodeSnapshotExists}
+	ErrFileChanged       = &Error{Code: CodeFileChanged}
+)
+
+func (e *Error) Error() string {
+	switch e.Code {
+	case CodeUserNotFound, CodeFolderNotFound, CodeFileNotFound:
+		return fmt.Sprintf("Error: The %s doesn't exist.", e.Name)
+	case CodeUserExists, CodeFolderExists:
+		return fmt.Sprintf("Error: The %s has already existed.", e.Name)
+	case CodeFileExists:
+		return fmt.Sprintf("Error: The %s has already existed in the %s.", e.Name, e.Folder)
+	case CodeInvalidName:
+		if e.Reason != "" {
+			return fmt.Sprintf("Error: The %s %s.", utils.QuoteName(e.Name), e.Reason)
+		}
+		return fmt.Sprintf("Error: The %s contains invalid chars.", e.Name)
+	case CodeInvalidSortFlag:
+		return fmt.Sprintf("Error: The sort flag %s is invalid.", e.Name)
+	case CodeInvalidSize:
+		return fmt.Sprintf("Error: The size %s is invalid.", e.Name)
+	case CodeMoveIntoItself:
+		return fmt.Sprintf("Error: The %s cannot be moved into itself.", e.Name)
+	case CodeInvalidOffset:
+		return fmt.Sprintf("Error: The offset %s is invalid.", e.Name)
+	case CodeUserNotEmpty:
+		return fmt.Sprintf("Error: The %s still has folders.", e.Name)
+	case CodeTrashItemNotFound:
+		return fmt.Sprintf("Error: The item %s isn't in the trash.", e.Name)
+	case CodeSnapshotNotFound:
+		return fmt.Sprintf("Error: The snapshot %s doesn't exist.", e.Name)
+	case CodeSnapshotExists:
+		return fmt.Sprintf("Error: The snapshot %s has already existed.", e.Name)
+	case CodeFileChanged:
+		return fmt.Sprintf("Error: The %s has been changed by someone else.", e.Name)
+	default:
+		return fmt.Sprintf("Error: Code %d on %s.", e.Code, e.Name)
+	}
+}
+
+// Is reports whether target is an Error of the same code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// invalidName returns the error of a name rejected by a utils.NamePolicy
+func invalidName(name string, err error) *Error {
+	var nameErr *utils.NameError
+	if errors.As(err, &nameErr) {
+		return &Error{Code: CodeInvalidName, Name: name, Reason: nameErr.Reason}
+	}
+	return &Error{Code: CodeInvalidName, Name: name}
+}
+
+// invalidPath returns the error of a folder path which is empty or has an
+// empty folder name
+func invalidPath(folderName string) *Error {
+	if strings.Trim(folderName, utils.PathSeparator) == "" {
+		return &Error{Code: CodeInvalidName, Name: folderName, Reason: "is empty"}
+	}
+	return &Error{Code: CodeInvalidName, Name: folderName, Reason: "contains an empty folder name"}
+}
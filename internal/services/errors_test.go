@@ -0,0 +1,142 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"virtual-file-system/internal/storage"
+)
+
+func TestError_IsAs(t *testing.T) {
+	userService := NewUserService(storage.NewMemoryStore(nil))
+	folderService := NewFolderService(userService)
+	fileService := NewFileService(userService, folderService)
+	userService.Register("dalaoqi")
+	folderService.CreateFolder("dalaoqi", "docs", "")
+	fileService.CreateFile("dalaoqi", "docs", "notes", "")
+
+	testCases := []struct {
+		name         string
+		err          error
+		expectedErr  error
+		expectedCode Code
+		expectedName string
+	}{
+		{
+			name:         "Register a duplicated user",
+			err:          userService.Register("Dalaoqi"),
+			expectedErr:  ErrUserExists,
+			expectedCode: CodeUserExists,
+			expectedName: "Dalaoqi",
+		},
+		{
+			name:         "Register a user with invalid chars",
+			err:          userService.Register("dalaoqi|"),
+			expectedErr:  ErrInvalidName,
+			expectedCode: CodeInvalidName,
+			expectedName: "dalaoqi|",
+		},
+		{
+			name:         "Create a folder for a non-existing user",
+			err:          folderService.CreateFolder("nobody", "docs", ""),
+			expectedErr:  ErrUserNotFound,
+			expectedCode: CodeUserNotFound,
+			expectedName: "nobody",
+		},
+		{
+			name:         "Create a duplicated folder",
+			err:          folderService.CreateFolder("dalaoqi", "docs", ""),
+			expectedErr:  ErrFolderExists,
+			expectedCode: CodeFolderExists,
+			expectedName: "docs",
+		},
+		{
+			name:         "Delete a non-existing folder",
+			err:          folderService.DeleteFolder("dalaoqi", "other", false),
+			expectedErr:  ErrFolderNotFound,
+			expectedCode: CodeFolderNotFound,
+			expectedName: "other",
+		},
+		{
+			name:         "Move a folder into itself",
+			err:          folderService.RenameFolder("dalaoqi", "docs", "docs/sub"),
+			expectedErr:  ErrMoveIntoItself,
+			expectedCode: CodeMoveIntoItself,
+			expectedName: "docs",
+		},
+		{
+			name:         "Create a duplicated file",
+			err:          fileService.CreateFile("dalaoqi", "docs", "notes", ""),
+			expectedErr:  ErrFileExists,
+			expectedCode: CodeFileExists,
+			expectedName: "notes",
+		},
+		{
+			name:         "Delete a non-existing file",
+			err:          fileService.DeleteFile("dalaoqi", "docs", "draft", false),
+			expectedErr:  ErrFileNotFound,
+			expectedCode: CodeFileNotFound,
+			expectedName: "draft",
+		},
+		{
+			name:         "Truncate a file to a negative size",
+			err:          fileService.TruncateFile("dalaoqi", "docs", "notes", -1),
+			expectedErr:  ErrInvalidSize,
+			expectedCode: CodeInvalidSize,
+			expectedName: "-1",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			if !errors.Is(test.err, test.expectedErr) {
+				t.Fatalf("errors.Is(%v, %v) = false, expected: true", test.err, test.expectedErr)
+			}
+			if errors.Is(test.err, ErrInvalidOffset) {
+				t.Errorf("errors.Is(%v, ErrInvalidOffset) = true, expected: false", test.err)
+			}
+			var serviceErr *Error
+			if !errors.As(test.err, &serviceErr) {
+				t.Fatalf("errors.As(%v) = false, expected: true", test.err)
+			}
+			if serviceErr.Code != test.expectedCode || serviceErr.Name != test.expectedName {
+				t.Errorf("Error = %d %s, expected: %d %s", serviceErr.Code, serviceErr.Name, test.expectedCode, test.expectedName)
+			}
+		})
+	}
+}
+
+func TestError_EmptyListings(t *testing.T) {
+	userService := NewUserService(storage.NewMemoryStore(nil))
+	folderService := NewFolderService(userService)
+	fileService := NewFileService(userService, folderService)
+	userService.Register("dalaoqi")
+
+	// An empty listing is a result, not an error
+	folders, err := folderService.GetFolders("dalaoqi", "--sort-name", "asc")
+	if err != nil || len(folders) != 0 {
+		t.Errorf("GetFolders() = %v, %v, expected no folders and no error", folders, err)
+	}
+	folderService.CreateFolder("dalaoqi", "docs", "")
+	files, err := fileService.GetFiles("dalaoqi", "docs", "--sort-name", "asc")
+	if err != nil || len(files) != 0 {
+		t.Errorf("GetFiles() = %v, %v, expected no files and no error", files, err)
+	}
+
+	// The dispatcher presents it as a warning
+	var out bytes.Buffer
+	d := NewDispatcher(storage.NewMemoryStore(nil))
+	d.out = &out
+	d.Exec([]string{"list-users"})
+	d = NewDispatcher(userService.Store)
+	d.out = &out
+	for _, args := range [][]string{{"list-folders", "dalaoqi", "docs"}, {"list-files", "dalaoqi", "docs"}} {
+		if err := d.Exec(args); err != nil {
+			t.Errorf("Dispatcher.Exec(%v) has error: %s", args, err)
+		}
+	}
+	expected := "Warning: There are no users.\nWarning: The docs doesn't have any folders.\nWarning: The folder is empty.\n"
+	if out.String() != expected {
+		t.Errorf("Dispatcher output = %q, expected: %q", out.String(), expected)
+	}
+}
@@ -1,11 +1,10 @@
 package services
 
 import (
-	"fmt"
 	"sort"
-	"strings"
-	"time"
+	"strconv"
 	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/storage"
 	"virtual-file-system/internal/utils"
 )
 
@@ -23,63 +22,79 @@ func NewFileService(userService *UserService, folderService *FolderService) *Fil
 }
 
 func (s *FileService) CreateFile(userName, folderName, fileName, description string) error {
-	lowerUserName := strings.ToLower(userName)
-	lowerFolderName := strings.ToLower(folderName)
-	lowerFileName := strings.ToLower(fileName)
+	userKey := utils.NameKey(userName)
+	fileKey := utils.NameKey(fileName)
 
-	// Check if the user exists
-	if !s.UserService.Exist(lowerUserName) {
-		return fmt.Errorf("Error: The %s doesn't exist.", userName)
-	}
-
-	// Check if the folder exists for the user
-	if !s.FolderService.Exist(lowerUserName, lowerFolderName) {
-		return fmt.Errorf("Error: The %s doesn't exist.", folderName)
-	}
+	return s.UserService.Store.Update(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
 
-	// Check if the file name contains invalid characters
-	if utils.ExistInvalidChars(lowerFileName) {
-		return fmt.Errorf("Error: The %s contains invalid chars.", fileName)
-	}
+		// Check if the folder exists for the user
+		folderKey, ok := folderPath(folderName)
+		if !ok || !folderExist(tx, userKey, folderKey) {
+			return &Error{Code: CodeFolderNotFound, Name: folderName}
+		}
 
-	// Check if the file name already exists in the folder
-	if s.Exist(lowerUserName, lowerFolderName, lowerFileName) {
-		return fmt.Errorf("Error: The %s has already existed in the %s.", fileName, folderName)
-	}
+		// Check if the file name is valid
+		name, err := s.UserService.NamePolicy.Normalize(fileName)
+		if err != nil {
+			return invalidName(fileName, err)
+		}
 
-	// Create the new file
-	folder := s.UserService.Users[lowerUserName].Folders[lowerFolderName]
+		// Check if the file name already exists in the folder
+		if fileExist(tx, userKey, folderKey, fileKey) {
+			return &Error{Code: CodeFileExists, Name: fileName, Folder: folderName}
+		}
 
-	if folder.Files == nil {
-		folder.Files = make(map[string]models.File)
-	}
-	folder.Files[lowerFileName] = models.File{
-		Name:        lowerFileName,
-		Description: description,
-		CreatedAt:   time.Now(),
-	}
-	s.UserService.Users[lowerUserName].Folders[lowerFolderName] = folder
-	return nil
+		// Create the new file
+		now := s.UserService.now()
+		err = tx.PutFile(userKey, folderKey, fileKey, models.File{
+			Name:        name,
+			Description: description,
+			CreatedAt:   now,
+			ModifiedAt:  now,
+		})
+		if err != nil {
+			return err
+		}
+		return touchFolder(tx, userKey, folderKey, now)
+	})
 }
 
+// GetFiles lists the files of the folder
 func (s *FileService) GetFiles(userName, folderName, sortFlag, sortOrderFlag string) ([]models.File, error) {
-	lowerUserName := strings.ToLower(userName)
-	lowerFolderName := strings.ToLower(folderName)
+	return s.GetFilesAt(userName, "", folderName, sortFlag, sortOrderFlag)
+}
 
-	// Check if the user exists
-	if !s.UserService.Exist(lowerUserName) {
-		return []models.File{}, fmt.Errorf("Error: The %s doesn't exist.", userName)
-	}
+// GetFilesAt lists the files of the folder as they were in the snapshot
+// labelled at, or as they are if at is empty
+func (s *FileService) GetFilesAt(userName, at, folderName, sortFlag, sortOrderFlag string) ([]models.File, error) {
+	userKey := utils.NameKey(userName)
 
-	// Check if the folder exists for the user
-	if !s.FolderService.Exist(lowerUserName, lowerFolderName) {
-		return []models.File{}, fmt.Errorf("Error: The %s doesn't exist.", folderName)
-	}
+	var fileList []models.File
+	err := s.UserService.Store.View(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+		tx, err := viewAt(tx, userKey, at)
+		if err != nil {
+			return err
+		}
+
+		// Check if the folder exists for the user
+		folderKey, ok := folderPath(folderName)
+		if !ok || !folderExist(tx, userKey, folderKey) {
+			return &Error{Code: CodeFolderNotFound, Name: folderName}
+		}
 
-	// Convert map to slice for sorting
-	fileList := make([]models.File, 0)
-	for _, file := range s.UserService.Users[lowerUserName].Folders[lowerFolderName].Files {
-		fileList = append(fileList, file)
+		fileList, err = tx.ListFiles(userKey, folderKey)
+		return err
+	})
+	if err != nil {
+		return []models.File{}, err
 	}
 
 	if len(fileList) == 0 {
@@ -89,66 +104,245 @@ func (s *FileService) GetFiles(userName, folderName, sortFlag, sortOrderFlag str
 	// Sort the files based on the provided flags
 	switch sortFlag {
 	case "--sort-name":
+		// The store lists entities in ascending name order already
+		if sortOrderFlag == "desc" {
+			for i, j := 0, len(fileList)-1; i < j; i, j = i+1, j-1 {
+				fileList[i], fileList[j] = fileList[j], fileList[i]
+			}
+		} else if sortOrderFlag != "asc" {
+			return []models.File{}, &Error{Code: CodeInvalidSortFlag, Name: sortOrderFlag}
+		}
+	case "--sort-created":
 		if sortOrderFlag == "asc" {
 			sort.SliceStable(fileList, func(i, j int) bool {
-				return fileList[i].Name < fileList[j].Name
+				return fileList[i].CreatedAt.Before(fileList[j].CreatedAt)
 			})
 		} else if sortOrderFlag == "desc" {
 			sort.SliceStable(fileList, func(i, j int) bool {
-				return fileList[i].Name > fileList[j].Name
+				return fileList[i].CreatedAt.After(fileList[j].CreatedAt)
 			})
 		} else {
-			return []models.File{}, fmt.Errorf("Usage: list-files [username] [foldername] [--sort-name|--sort-created] [asc|desc]")
+			return []models.File{}, &Error{Code: CodeInvalidSortFlag, Name: sortOrderFlag}
 		}
-	case "--sort-created":
+	case "--sort-modified":
 		if sortOrderFlag == "asc" {
 			sort.SliceStable(fileList, func(i, j int) bool {
-				return fileList[i].CreatedAt.Before(fileList[j].CreatedAt)
+				return fileList[i].ModifiedAt.Before(fileList[j].ModifiedAt)
 			})
 		} else if sortOrderFlag == "desc" {
 			sort.SliceStable(fileList, func(i, j int) bool {
-				return fileList[i].CreatedAt.After(fileList[j].CreatedAt)
+				return fileList[i].ModifiedAt.After(fileList[j].ModifiedAt)
+			})
+		} else {
+			return []models.File{}, &Error{Code: CodeInvalidSortFlag, Name: sortOrderFlag}
+		}
+	case "--sort-size":
+		if sortOrderFlag == "asc" {
+			sort.SliceStable(fileList, func(i, j int) bool {
+				return fileList[i].Size < fileList[j].Size
+			})
+		} else if sortOrderFlag == "desc" {
+			sort.SliceStable(fileList, func(i, j int) bool {
+				return fileList[i].Size > fileList[j].Size
 			})
 		} else {
-			return []models.File{}, fmt.Errorf("Usage: list-files [username] [foldername] [--sort-name|--sort-created] [asc|desc]")
+			return []models.File{}, &Error{Code: CodeInvalidSortFlag, Name: sortOrderFlag}
 		}
 	default:
-		return []models.File{}, fmt.Errorf("Usage: list-files [username] [foldername] [--sort-name|--sort-created] [asc|desc]")
+		return []models.File{}, &Error{Code: CodeInvalidSortFlag, Name: sortFlag}
 	}
 
 	return fileList, nil
 }
 
-func (s *FileService) DeleteFile(userName, folderName, fileName string) error {
-	lowerUserName := strings.ToLower(userName)
-	lowerFolderName := strings.ToLower(folderName)
-	lowerFileName := strings.ToLower(fileName)
+// DeleteFile deletes the file from its folder. The file is moved to the
+// trash of the user unless permanent is set.
+func (s *FileService) DeleteFile(userName, folderName, fileName string, permanent bool) error {
+	return s.UserService.Store.Update(func(tx storage.Tx) error {
+		ref, _, err := lookupFile(tx, userName, folderName, fileName)
+		if err != nil {
+			return err
+		}
 
-	// Check if the user exists
-	if !s.UserService.Exist(lowerUserName) {
-		return fmt.Errorf("Error: The %s doesn't exist.", userName)
-	}
+		now := s.UserService.now()
+		if !permanent {
+			if err := s.UserService.trashFile(tx, ref.user, ref.folder, ref.file, now); err != nil {
+				return err
+			}
+		}
 
-	// Check if the folder exists for the user
-	if !s.FolderService.Exist(lowerUserName, lowerFolderName) {
-		return fmt.Errorf("Error: The %s doesn't exist.", folderName)
-	}
+		// Delete the file from the folder
+		if err := tx.DeleteFile(ref.user, ref.folder, ref.file); err != nil {
+			return err
+		}
+		return touchFolder(tx, ref.user, ref.folder, now)
+	})
+}
 
-	// Check if the file exists in the folder
-	if !s.Exist(lowerUserName, lowerFolderName, lowerFileName) {
-		return fmt.Errorf("Error: The %s doesn't exist.", fileName)
+// RenameFile renames the file within its folder, keeping its content. It may
+// be renamed to its own name in another case, like notes to Notes.
+func (s *FileService) RenameFile(userName, folderName, fileName, newFileName string) error {
+	newFileKey := utils.NameKey(newFileName)
+
+	return s.UserService.Store.Update(func(tx storage.Tx) error {
+		ref, file, err := lookupFile(tx, userName, folderName, fileName)
+		if err != nil {
+			return err
+		}
+
+		// Check if the new file name is valid
+		name, err := s.UserService.NamePolicy.Normalize(newFileName)
+		if err != nil {
+			return invalidName(newFileName, err)
+		}
+
+		// Check if the new file name already exists in the folder
+		if newFileKey != ref.file && fileExist(tx, ref.user, ref.folder, newFileKey) {
+			return &Error{Code: CodeFileExists, Name: newFileName, Folder: folderName}
+		}
+
+		// Move the metadata and the content under the new name
+		now := s.UserService.now()
+		file.Name = name
+		file.ModifiedAt = now
+		if err := tx.PutFile(ref.user, ref.folder, newFileKey, file); err != nil {
+			return err
+		}
+		if newFileKey != ref.file {
+			if err := storage.CopyContent(tx, ref.user, ref.folder, ref.file, ref.user, ref.folder, newFileKey); err != nil {
+				return err
+			}
+			if err := tx.DeleteFile(ref.user, ref.folder, ref.file); err != nil {
+				return err
+			}
+		}
+		return touchFolder(tx, ref.user, ref.folder, now)
+	})
+}
+
+// SetFileDescription replaces the description of the file
+func (s *FileService) SetFileDescription(userName, folderName, fileName, description string) error {
+	return s.UserService.Store.Update(func(tx storage.Tx) error {
+		ref, file, err := lookupFile(tx, userName, folderName, fileName)
+		if err != nil {
+			return err
+		}
+		file.Description = description
+		file.ModifiedAt = s.UserService.now()
+		return tx.PutFile(ref.user, ref.folder, ref.file, file)
+	})
+}
+
+// WriteFile replaces the content of the file
+func (s *FileService) WriteFile(userName, folderName, fileName string, content []byte) error {
+	return s.UserService.Store.Update(func(tx storage.Tx) error {
+		ref, file, err := lookupFile(tx, userName, folderName, fileName)
+		if err != nil {
+			return err
+		}
+		if err := storage.WriteContent(tx, ref.user, ref.folder, ref.file, content); err != nil {
+			return err
+		}
+		return s.resize(tx, ref, file, int64(len(content)))
+	})
+}
+
+// AppendFile appends content to the end of the file
+func (s *FileService) AppendFile(userName, folderName, fileName string, content []byte) error {
+	return s.UserService.Store.Update(func(tx storage.Tx) error {
+		ref, file, err := lookupFile(tx, userName, folderName, fileName)
+		if err != nil {
+			return err
+		}
+		if err := storage.AppendContent(tx, ref.user, ref.folder, ref.file, file.Size, content); err != nil {
+			return err
+		}
+		return s.resize(tx, ref, file, file.Size+int64(len(content)))
+	})
+}
+
+// ReadFile returns the content of the file
+func (s *FileService) ReadFile(userName, folderName, fileName string) ([]byte, error) {
+	var content []byte
+	err := s.UserService.Store.View(func(tx storage.Tx) error {
+		ref, _, err := lookupFile(tx, userName, folderName, fileName)
+		if err != nil {
+			return err
+		}
+		content, err = storage.ReadContent(tx, ref.user, ref.folder, ref.file)
+		return err
+	})
+	return content, err
+}
+
+// TruncateFile changes the size of the file. A larger size pads the content
+// with zero bytes.
+func (s *FileService) TruncateFile(userName, folderName, fileName string, size int64) error {
+	if size < 0 {
+		return &Error{Code: CodeInvalidSize, Name: strconv.FormatInt(size, 10)}
 	}
 
-	// Delete the file from the folder
-	delete(s.UserService.Users[lowerUserName].Folders[lowerFolderName].Files, lowerFileName)
+	return s.UserService.Store.Update(func(tx storage.Tx) error {
+		ref, file, err := lookupFile(tx, userName, folderName, fileName)
+		if err != nil {
+			return err
+		}
+		if err := storage.TruncateContent(tx, ref.user, ref.folder, ref.file, file.Size, size); err != nil {
+			return err
+		}
+		return s.resize(tx, ref, file, size)
+	})
+}
 
-	return nil
+// resize updates the size and the modification time of the file after its
+// content changed
+func (s *FileService) resize(tx storage.Tx, ref fileRef, file models.File, size int64) error {
+	file.Size = size
+	file.ModifiedAt = s.UserService.now()
+	return tx.PutFile(ref.user, ref.folder, ref.file, file)
 }
 
 func (s *FileService) Exist(userName, folderName, fileName string) bool {
-	file, exist := s.UserService.Users[userName].Folders[folderName].Files[fileName]
-	if !exist {
-		return false
+	exist := false
+	s.UserService.Store.View(func(tx storage.Tx) error {
+		_, _, err := lookupFile(tx, userName, folderName, fileName)
+		exist = err == nil
+		return nil
+	})
+	return exist
+}
+
+func fileExist(tx storage.Tx, userKey, folderKey, fileKey string) bool {
+	_, err := tx.GetFile(userKey, folderKey, fileKey)
+	return err == nil
+}
+
+// fileRef holds the keys of a file in the store
+type fileRef struct {
+	user, folder, file string
+}
+
+// lookupFile checks that the user, the folder and the file exist and returns
+// the keys of the file along with its metadata
+func lookupFile(tx storage.Tx, userName, folderName, fileName string) (fileRef, models.File, error) {
+	ref := fileRef{user: utils.NameKey(userName), file: utils.NameKey(fileName)}
+
+	// Check if the user exists
+	if !userExist(tx, ref.user) {
+		return ref, models.File{}, &Error{Code: CodeUserNotFound, Name: userName}
+	}
+
+	// Check if the folder exists for the user
+	var ok bool
+	ref.folder, ok = folderPath(folderName)
+	if !ok || !folderExist(tx, ref.user, ref.folder) {
+		return ref, models.File{}, &Error{Code: CodeFolderNotFound, Name: folderName}
+	}
+
+	// Check if the file exists in the folder
+	file, err := tx.GetFile(ref.user, ref.folder, ref.file)
+	if err != nil {
+		return ref, models.File{}, &Error{Code: CodeFileNotFound, Name: fileName}
 	}
-	return file.Name == fileName
+	return ref, file, nil
 }
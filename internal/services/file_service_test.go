@@ -1,10 +1,13 @@
 package services
 
 import (
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/storage"
 )
 
 func TestFileService_Creation(t *testing.T) {
@@ -75,16 +78,14 @@ func TestFileService_Creation(t *testing.T) {
 			targetFolder: "myfolder",
 			targetFile:   "myfile???",
 			description:  "My file description",
-			expectedErr:  "Error: The myfile??? contains invalid chars.",
+			expectedErr:  "Error: The myfile??? contains the invalid char '?' at position 7.",
 			expectedLen:  0,
 			expectedName: "",
 		},
 	}
 	for _, test := range testCases {
 		t.Run(test.name, func(t *testing.T) {
-			userService := &UserService{
-				Users: test.users,
-			}
+			userService := NewUserService(storage.NewMemoryStore(test.users))
 
 			folderService := NewFolderService(userService)
 			fileService := NewFileService(userService, folderService)
@@ -94,17 +95,17 @@ func TestFileService_Creation(t *testing.T) {
 				t.Errorf("fileService.CreateFile() has error: %s, expected: %s", err.Error(), test.expectedErr)
 			}
 
-			if len(fileService.UserService.Users[test.targetUser].Folders[test.targetFolder].Files) != test.expectedLen {
-				t.Errorf("fileService.CreateFile() len = %v, expectedLen %v", len(folderService.UserService.Users[test.targetUser].Folders[test.targetFolder].Files), test.expectedLen)
+			if len(test.users[test.targetUser].Folders[test.targetFolder].Files) != test.expectedLen {
+				t.Errorf("fileService.CreateFile() len = %v, expectedLen %v", len(test.users[test.targetUser].Folders[test.targetFolder].Files), test.expectedLen)
 			}
 
-			if test.expectedName != "" && fileService.UserService.Users[test.targetUser].Folders[test.targetFolder].Files[test.targetFile].Name != test.expectedName {
-				t.Errorf("fileService.CreateFile() name = %s, expectedName %s", folderService.UserService.Users[test.targetUser].Folders[test.targetFolder].Files[test.targetFile].Name, test.expectedName)
+			if test.expectedName != "" && test.users[test.targetUser].Folders[test.targetFolder].Files[test.targetFile].Name != test.expectedName {
+				t.Errorf("fileService.CreateFile() name = %s, expectedName %s", test.users[test.targetUser].Folders[test.targetFolder].Files[test.targetFile].Name, test.expectedName)
 			}
 
 			// Verify the created file's attributes
-			if len(folderService.UserService.Users[test.targetUser].Folders[test.targetFolder].Files) > 0 {
-				file := folderService.UserService.Users[test.targetUser].Folders[test.targetFolder].Files[test.targetFile]
+			if len(test.users[test.targetUser].Folders[test.targetFolder].Files) > 0 {
+				file := test.users[test.targetUser].Folders[test.targetFolder].Files[test.targetFile]
 				if file.Description != test.description {
 					t.Errorf("fileService.CreateFolder() description = %s, expectedDescription %s", file.Description, test.description)
 				}
@@ -128,19 +129,17 @@ func TestFileService_GetFiles(t *testing.T) {
 		CreatedAt: time.Now().Add(-3 * time.Hour),
 	}
 
-	userService := &UserService{
-		Users: map[string]models.User{
-			"dalaoqi": {
-				Name: "dalaoqi",
-				Folders: map[string]models.Folder{
-					"myfolder": {
-						Name:  "myfolder",
-						Files: map[string]models.File{"myfile1": file1, "myfile2": file2, "myfile3": file3},
-					},
+	userService := NewUserService(storage.NewMemoryStore(map[string]models.User{
+		"dalaoqi": {
+			Name: "dalaoqi",
+			Folders: map[string]models.Folder{
+				"myfolder": {
+					Name:  "myfolder",
+					Files: map[string]models.File{"myfile1": file1, "myfile2": file2, "myfile3": file3},
 				},
 			},
 		},
-	}
+	}))
 
 	folderService := &FolderService{
 		UserService: userService,
@@ -203,7 +202,7 @@ func TestFileService_GetFiles(t *testing.T) {
 			sortFlag:       "--sort-invalid",
 			sortOrderFlag:  "asc",
 			expectedResult: []models.File{},
-			expectedError:  "Usage: list-files [username] [foldername] [--sort-name|--sort-created] [asc|desc]",
+			expectedError:  "Error: The sort flag --sort-invalid is invalid.",
 		},
 		{
 			name:           "Sort by name in invalid order",
@@ -212,7 +211,7 @@ func TestFileService_GetFiles(t *testing.T) {
 			sortFlag:       "--sort-name",
 			sortOrderFlag:  "invalid",
 			expectedResult: []models.File{},
-			expectedError:  "Usage: list-files [username] [foldername] [--sort-name|--sort-created] [asc|desc]",
+			expectedError:  "Error: The sort flag invalid is invalid.",
 		},
 		{
 			name:           "User doesn't exist",
@@ -242,7 +241,7 @@ func TestFileService_GetFiles(t *testing.T) {
 			}
 
 			if !reflect.DeepEqual(gotResult, test.expectedResult) {
-				t.Errorf("Result mismatch, Got: %s, Want: %s", gotResult, test.expectedResult)
+				t.Errorf("Result mismatch, Got: %v, Want: %v", gotResult, test.expectedResult)
 			}
 		})
 	}
@@ -264,14 +263,12 @@ func TestFileService_DeleteFile(t *testing.T) {
 		},
 	}
 
-	userService := &UserService{
-		Users: map[string]models.User{
-			"dalaoqi": {
-				Name:    "dalaoqi",
-				Folders: map[string]models.Folder{"myfolder": folder},
-			},
+	userService := NewUserService(storage.NewMemoryStore(map[string]models.User{
+		"dalaoqi": {
+			Name:    "dalaoqi",
+			Folders: map[string]models.Folder{"myfolder": folder},
 		},
-	}
+	}))
 
 	folderService := NewFolderService(userService)
 
@@ -319,7 +316,7 @@ func TestFileService_DeleteFile(t *testing.T) {
 
 	for _, test := range testCases {
 		t.Run(test.name, func(t *testing.T) {
-			err := fileService.DeleteFile(test.userName, test.folderName, test.fileName)
+			err := fileService.DeleteFile(test.userName, test.folderName, test.fileName, false)
 
 			if err != nil && err.Error() != test.expectedError {
 				t.Errorf("Unexpected error: %s", err)
@@ -332,3 +329,243 @@ func TestFileService_DeleteFile(t *testing.T) {
 		})
 	}
 }
+
+func TestFileService_Content(t *testing.T) {
+	userService := NewUserService(storage.NewMemoryStore(map[string]models.User{
+		"dalaoqi": {
+			Name: "dalaoqi",
+			Folders: map[string]models.Folder{"myfolder": {
+				Name:  "myfolder",
+				Files: map[string]models.File{"myfile": {Name: "myfile"}},
+			}},
+		},
+	}))
+	fileService := NewFileService(userService, NewFolderService(userService))
+
+	testCases := []struct {
+		name            string
+		run             func() error
+		expectedContent string
+		expectedError   string
+	}{
+		{
+			name:            "Write a file",
+			run:             func() error { return fileService.WriteFile("dalaoqi", "myfolder", "myfile", []byte("hello")) },
+			expectedContent: "hello",
+		},
+		{
+			name:            "Append to a file",
+			run:             func() error { return fileService.AppendFile("dalaoqi", "myfolder", "MyFile", []byte(" world")) },
+			expectedContent: "hello world",
+		},
+		{
+			name:            "Truncate a file",
+			run:             func() error { return fileService.TruncateFile("dalaoqi", "myfolder", "myfile", 4) },
+			expectedContent: "hell",
+		},
+		{
+			name:            "Extend a file with zero bytes",
+			run:             func() error { return fileService.TruncateFile("dalaoqi", "myfolder", "myfile", 6) },
+			expectedContent: "hell\x00\x00",
+		},
+		{
+			name:            "Truncate a file to a negative size",
+			run:             func() error { return fileService.TruncateFile("dalaoqi", "myfolder", "myfile", -1) },
+			expectedContent: "hell\x00\x00",
+			expectedError:   "Error: The size -1 is invalid.",
+		},
+		{
+			name:            "Write a non-existing file",
+			run:             func() error { return fileService.WriteFile("dalaoqi", "myfolder", "nofile", []byte("hello")) },
+			expectedContent: "hell\x00\x00",
+			expectedError:   "Error: The nofile doesn't exist.",
+		},
+		{
+			name:            "Append to a file in a non-existing folder",
+			run:             func() error { return fileService.AppendFile("dalaoqi", "nofolder", "myfile", []byte("hello")) },
+			expectedContent: "hell\x00\x00",
+			expectedError:   "Error: The nofolder doesn't exist.",
+		},
+		{
+			name:            "Empty a file",
+			run:             func() error { return fileService.TruncateFile("dalaoqi", "myfolder", "myfile", 0) },
+			expectedContent: "",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.run()
+			if (err == nil && test.expectedError != "") || (err != nil && err.Error() != test.expectedError) {
+				t.Errorf("Command has error: %v, expected: %s", err, test.expectedError)
+			}
+
+			content, err := fileService.ReadFile("dalaoqi", "myfolder", "myfile")
+			if err != nil {
+				t.Fatalf("ReadFile() has error: %s", err)
+			}
+			if string(content) != test.expectedContent {
+				t.Errorf("ReadFile() = %q, expected: %q", content, test.expectedContent)
+			}
+
+			files, _ := fileService.GetFiles("dalaoqi", "myfolder", "--sort-name", "asc")
+			if len(files) != 1 || files[0].Size != int64(len(test.expectedContent)) {
+				t.Errorf("GetFiles() = %v, expected a size of %d", files, len(test.expectedContent))
+			}
+		})
+	}
+}
+
+func TestFileService_SortBySize(t *testing.T) {
+	userService := NewUserService(storage.NewMemoryStore(map[string]models.User{
+		"dalaoqi": {
+			Name: "dalaoqi",
+			Folders: map[string]models.Folder{"myfolder": {
+				Name: "myfolder",
+				Files: map[string]models.File{
+					"big":    {Name: "big", Size: 300},
+					"medium": {Name: "medium", Size: 20},
+					"small":  {Name: "small", Size: 1},
+				},
+			}},
+		},
+	}))
+	fileService := NewFileService(userService, NewFolderService(userService))
+
+	testCases := []struct {
+		order    string
+		expected []string
+	}{
+		{order: "asc", expected: []string{"small", "medium", "big"}},
+		{order: "desc", expected: []string{"big", "medium", "small"}},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.order, func(t *testing.T) {
+			files, err := fileService.GetFiles("dalaoqi", "myfolder", "--sort-size", test.order)
+			if err != nil {
+				t.Fatalf("GetFiles() has error: %s", err)
+			}
+			var names []string
+			for _, file := range files {
+				names = append(names, file.Name)
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("GetFiles() = %v, expected: %v", names, test.expected)
+			}
+		})
+	}
+}
+
+func TestFileService_RenameFile(t *testing.T) {
+	testCases := []struct {
+		name          string
+		fileName      string
+		newFileName   string
+		expectedError string
+	}{
+		{
+			name:        "Rename existing file",
+			fileName:    "notes",
+			newFileName: "Minutes",
+		},
+		{
+			name:        "Rename to a new case",
+			fileName:    "notes",
+			newFileName: "Notes",
+		},
+		{
+			name:          "Rename non-existing file",
+			fileName:      "nonexistent",
+			newFileName:   "minutes",
+			expectedError: "Error: The nonexistent doesn't exist.",
+		},
+		{
+			name:          "Rename file with invalid characters",
+			fileName:      "notes",
+			newFileName:   "min?utes",
+			expectedError: "Error: The min?utes contains the invalid char '?' at position 4.",
+		},
+		{
+			name:          "Rename to an existing file name",
+			fileName:      "notes",
+			newFileName:   "todo",
+			expectedError: "Error: The todo has already existed in the myfolder.",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			created := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+			renamed := created.Add(time.Hour)
+			userService := NewUserService(storage.NewMemoryStore(nil))
+			folderService := NewFolderService(userService)
+			fileService := NewFileService(userService, folderService)
+			userService.setClock(func() time.Time { return created })
+			userService.Register("dalaoqi")
+			folderService.CreateFolder("dalaoqi", "myfolder", "")
+			fileService.CreateFile("dalaoqi", "myfolder", "notes", "meeting notes")
+			fileService.CreateFile("dalaoqi", "myfolder", "todo", "")
+			fileService.WriteFile("dalaoqi", "myfolder", "notes", []byte("hello"))
+			userService.setClock(func() time.Time { return renamed })
+
+			err := fileService.RenameFile("dalaoqi", "myfolder", test.fileName, test.newFileName)
+			if (err == nil && test.expectedError != "") || (err != nil && err.Error() != test.expectedError) {
+				t.Fatalf("RenameFile() has error: %v, expected: %s", err, test.expectedError)
+			}
+			if err != nil {
+				return
+			}
+
+			// The file keeps its content and description under the new name
+			if fileService.Exist("dalaoqi", "myfolder", test.fileName) != strings.EqualFold(test.fileName, test.newFileName) {
+				t.Errorf("File %s should not exist", test.fileName)
+			}
+			files, _ := fileService.GetFiles("dalaoqi", "myfolder", "--sort-modified", "desc")
+			file := files[0]
+			if len(files) != 2 || file.Name != test.newFileName || file.Description != "meeting notes" || file.Size != 5 || !file.CreatedAt.Equal(created) || !file.ModifiedAt.Equal(renamed) {
+				t.Errorf("Renamed file = %+v", file)
+			}
+			if content, err := fileService.ReadFile("dalaoqi", "myfolder", test.newFileName); err != nil || string(content) != "hello" {
+				t.Errorf("ReadFile() = %q, %v, expected: hello", content, err)
+			}
+			folders, _ := folderService.GetFolders("dalaoqi", "--sort-name", "asc")
+			if !folders[0].ModifiedAt.Equal(renamed) {
+				t.Errorf("Folder ModifiedAt = %s, expected: %s", folders[0].ModifiedAt, renamed)
+			}
+		})
+	}
+}
+
+func TestFileService_SetFileDescription(t *testing.T) {
+	created := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	modified := created.Add(time.Hour)
+	userService := NewUserService(storage.NewMemoryStore(nil))
+	folderService := NewFolderService(userService)
+	fileService := NewFileService(userService, folderService)
+	userService.setClock(func() time.Time { return created })
+	userService.Register("dalaoqi")
+	folderService.CreateFolder("dalaoqi", "myfolder", "")
+	fileService.CreateFile("dalaoqi", "myfolder", "notes", "draft")
+	fileService.CreateFile("dalaoqi", "myfolder", "todo", "")
+	userService.setClock(func() time.Time { return modified })
+
+	if err := fileService.SetFileDescription("dalaoqi", "myfolder", "nonexistent", "x"); err == nil || err.Error() != "Error: The nonexistent doesn't exist." {
+		t.Errorf("SetFileDescription() of a missing file has error: %v", err)
+	}
+	if err := fileService.SetFileDescription("dalaoqi", "myfolder", "Notes", "meeting notes"); err != nil {
+		t.Fatalf("SetFileDescription() has error: %s", err)
+	}
+
+	// The file modified last comes first
+	files, err := fileService.GetFiles("dalaoqi", "myfolder", "--sort-modified", "desc")
+	if err != nil {
+		t.Fatalf("GetFiles() has error: %s", err)
+	}
+	if files[0].Name != "notes" || files[0].Description != "meeting notes" || !files[0].ModifiedAt.Equal(modified) {
+		t.Errorf("GetFiles() = %+v, expected notes modified first", files)
+	}
+	if _, err := fileService.GetFiles("dalaoqi", "myfolder", "--sort-modified", "up"); !errors.Is(err, ErrInvalidSortFlag) {
+		t.Errorf("GetFiles() with an invalid order has error: %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"virtual-file-system/internal/storage"
+)
+
+// Open opens the file for reading. The content is fetched one chunk at a
+// time, so reading a large file only holds a single chunk in memory.
+func (s *FileService) Open(userName, folderName, fileName string) (io.ReadSeekCloser, error) {
+	reader := &fileReader{store: s.UserService.Store, index: -1}
+	err := s.UserService.Store.View(func(tx storage.Tx) error {
+		ref, file, err := lookupFile(tx, userName, folderName, fileName)
+		reader.ref = ref
+		reader.size = file.Size
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Create creates a new file and opens it for writing
+func (s *FileService) Create(userName, folderName, fileName, description string) (io.WriteCloser, error) {
+	if err := s.CreateFile(userName, folderName, fileName, description); err != nil {
+		return nil, err
+	}
+	return s.OpenWriter(userName, folderName, fileName, false)
+}
+
+// OpenWriter opens the file for writing, emptying it first unless
+// appendContent is set. Written data is buffered and stored one chunk at a
+// time, each in its own transaction, and the last partial chunk is stored
+// by Close. The chunks stored before a failed Write or Close stay in the
+// file, which then holds part of the data. Write and Close fail with
+// ErrFileChanged once the content has been changed by something else since
+// the writer last stored a chunk.
+func (s *FileService) OpenWriter(userName, folderName, fileName string, appendContent bool) (io.WriteCloser, error) {
+	writer := &fileWriter{service: s}
+	err := s.UserService.Store.Update(func(tx storage.Tx) error {
+		ref, file, err := lookupFile(tx, userName, folderName, fileName)
+		if err != nil {
+			return err
+		}
+		writer.ref = ref
+		writer.size = file.Size
+		if appendContent {
+			return nil
+		}
+		writer.size = 0
+		if err := tx.DeleteChunks(ref.user, ref.folder, ref.file, 0); err != nil {
+			return err
+		}
+		return s.resize(tx, ref, file, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// fileReader reads the content of a file chunk by chunk
+type fileReader struct {
+	store  storage.Store
+	ref    fileRef
+	size   int64
+	offset int64
+	closed bool
+
+	// chunk caches the chunk at index
+	chunk []byte
+	index int64
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, fs.ErrClosed
+	}
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	index := r.offset / storage.ChunkSize
+	if index != r.index {
+		err := r.store.View(func(tx storage.Tx) error {
+			var err error
+			r.chunk, err = tx.GetChunk(r.ref.user, r.ref.folder, r.ref.file, index)
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("Error: Cannot read %s: %v", r.ref.file, err)
+		}
+		r.index = index
+	}
+
+	// The file may have been truncated since it was opened
+	start := r.offset % storage.ChunkSize
+	if start >= int64(len(r.chunk)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	end := int64(len(r.chunk))
+	if remaining := r.size - r.offset; end-start > remaining {
+		end = start + remaining
+	}
+	n := copy(p, r.chunk[start:end])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	if r.closed {
+		return 0, fs.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("Error: Invalid whence %d.", whence)
+	}
+	if offset < 0 {
+		return 0, &Error{Code: CodeInvalidOffset, Name: strconv.FormatInt(offset, 10)}
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *fileReader) Close() error {
+	if r.closed {
+		return fs.ErrClosed
+	}
+	r.closed = true
+	r.chunk = nil
+	return nil
+}
+
+// fileWriter appends to the content of a file chunk by chunk
+type fileWriter struct {
+	service *FileService
+	ref     fileRef
+	// size is the size of the content already stored
+	size   int64
+	buf    []byte
+	closed bool
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	written := 0
+	for len(p) > 0 {
+		// Buffer up to the end of the current chunk
+		n := int(storage.ChunkSize - (w.size+int64(len(w.buf)))%storage.ChunkSize)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if (w.size+int64(len(w.buf)))%storage.ChunkSize == 0 {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *fileWriter) Close() error {
+	if w.closed {
+		return fs.ErrClosed
+	}
+	w.closed = true
+	return w.flush()
+}
+
+// flush appends the buffered data to the stored content
+func (w *fileWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.service.UserService.Store.Update(func(tx storage.Tx) error {
+		file, err := tx.GetFile(w.ref.user, w.ref.folder, w.ref.file)
+		if err != nil {
+			return &Error{Code: CodeFileNotFound, Name: w.ref.file}
+		}
+		// Appending at another size would overwrite the new content or
+		// leave a gap before the buffered data
+		if file.Size != w.size {
+			return &Error{Code: CodeFileChanged, Name: w.ref.file}
+		}
+		if err := storage.AppendContent(tx, w.ref.user, w.ref.folder, w.ref.file, w.size, w.buf); err != nil {
+			return err
+		}
+		return w.service.resize(tx, w.ref, file, w.size+int64(len(w.buf)))
+	})
+	if err != nil {
+		return err
+	}
+	w.size += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
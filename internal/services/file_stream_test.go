@@ -0,0 +1,145 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/storage"
+)
+
+func TestFileService_Stream(t *testing.T) {
+	userService := NewUserService(storage.NewMemoryStore(map[string]models.User{
+		"dalaoqi": {
+			Name:    "dalaoqi",
+			Folders: map[string]models.Folder{"myfolder": {Name: "myfolder"}},
+		},
+	}))
+	fileService := NewFileService(userService, NewFolderService(userService))
+
+	data := make([]byte, 3*storage.ChunkSize+123)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	// Write the content through small and large writes
+	writer, err := fileService.Create("dalaoqi", "myfolder", "blob", "a large blob")
+	if err != nil {
+		t.Fatalf("Create() has error: %s", err)
+	}
+	if _, err := writer.Write(data[:10]); err != nil {
+		t.Fatalf("Write() has error: %s", err)
+	}
+	if _, err := io.Copy(writer, bytes.NewReader(data[10:])); err != nil {
+		t.Fatalf("io.Copy() has error: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() has error: %s", err)
+	}
+	if _, err := writer.Write(data); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Write() after Close() has error: %v, expected fs.ErrClosed", err)
+	}
+
+	reader, err := fileService.Open("dalaoqi", "myfolder", "blob")
+	if err != nil {
+		t.Fatalf("Open() has error: %s", err)
+	}
+	var got bytes.Buffer
+	if _, err := io.Copy(&got, reader); err != nil {
+		t.Fatalf("io.Copy() has error: %s", err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("Read %d bytes, expected the %d written bytes", got.Len(), len(data))
+	}
+
+	// Ranged reads across chunk boundaries
+	testCases := []struct {
+		name   string
+		offset int64
+		whence int
+		length int
+		start  int
+	}{
+		{name: "From the start", offset: 5, whence: io.SeekStart, length: 100, start: 5},
+		{name: "Across a chunk boundary", offset: storage.ChunkSize - 50, whence: io.SeekStart, length: 100, start: storage.ChunkSize - 50},
+		{name: "From the current offset", offset: storage.ChunkSize, whence: io.SeekCurrent, length: 10, start: 2*storage.ChunkSize + 50},
+		{name: "From the end", offset: -20, whence: io.SeekEnd, length: 20, start: len(data) - 20},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := reader.Seek(test.offset, test.whence); err != nil {
+				t.Fatalf("Seek() has error: %s", err)
+			}
+			buf := make([]byte, test.length)
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				t.Fatalf("io.ReadFull() has error: %s", err)
+			}
+			if !bytes.Equal(buf, data[test.start:test.start+test.length]) {
+				t.Errorf("Read %v, expected %v", buf, data[test.start:test.start+test.length])
+			}
+		})
+	}
+	if _, err := reader.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() at the end has error: %v, expected io.EOF", err)
+	}
+	if _, err := reader.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("Seek() before the start has no error")
+	}
+	reader.Close()
+
+	// Appending keeps the existing content
+	writer, err = fileService.OpenWriter("dalaoqi", "myfolder", "blob", true)
+	if err != nil {
+		t.Fatalf("OpenWriter() has error: %s", err)
+	}
+	io.Copy(writer, bytes.NewReader(data))
+	writer.Close()
+	content, _ := fileService.ReadFile("dalaoqi", "myfolder", "blob")
+	if !bytes.Equal(content, append(bytes.Clone(data), data...)) {
+		t.Errorf("ReadFile() after appending = %d bytes, expected %d", len(content), 2*len(data))
+	}
+
+	// Writing replaces the content
+	writer, err = fileService.OpenWriter("dalaoqi", "myfolder", "blob", false)
+	if err != nil {
+		t.Fatalf("OpenWriter() has error: %s", err)
+	}
+	writer.Write([]byte("short"))
+	writer.Close()
+	files, _ := fileService.GetFiles("dalaoqi", "myfolder", "--sort-name", "asc")
+	if len(files) != 1 || files[0].Size != 5 {
+		t.Errorf("GetFiles() = %v, expected a size of 5", files)
+	}
+
+	// A writer fails once the content has been changed by something else,
+	// and the chunks it stored before stay
+	writer, err = fileService.OpenWriter("dalaoqi", "myfolder", "blob", true)
+	if err != nil {
+		t.Fatalf("OpenWriter() has error: %s", err)
+	}
+	if _, err := writer.Write(data[:storage.ChunkSize]); err != nil {
+		t.Fatalf("Write() has error: %s", err)
+	}
+	if err := fileService.AppendFile("dalaoqi", "myfolder", "blob", []byte("other")); err != nil {
+		t.Fatalf("AppendFile() has error: %s", err)
+	}
+	writer.Write([]byte("late"))
+	if err := writer.Close(); !errors.Is(err, ErrFileChanged) {
+		t.Errorf("Close() after another change has error: %v, expected: %v", err, ErrFileChanged)
+	}
+	content, _ = fileService.ReadFile("dalaoqi", "myfolder", "blob")
+	// The first chunk was filled up and stored, the rest of the write was
+	// only buffered
+	if expected := append(append([]byte("short"), data[:storage.ChunkSize-5]...), "other"...); !bytes.Equal(content, expected) {
+		t.Errorf("ReadFile() after a failed Close() = %d bytes, expected %d", len(content), len(expected))
+	}
+
+	if _, err := fileService.Create("dalaoqi", "myfolder", "blob", ""); err == nil || err.Error() != "Error: The blob has already existed in the myfolder." {
+		t.Errorf("Create() has error: %v, expected the file to exist", err)
+	}
+	if _, err := fileService.Open("dalaoqi", "myfolder", "nofile"); err == nil || err.Error() != "Error: The nofile doesn't exist." {
+		t.Errorf("Open() has error: %v, expected the file not to exist", err)
+	}
+}
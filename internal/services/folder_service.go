@@ -1,11 +1,11 @@
 package services
 
 import (
-	"fmt"
 	"sort"
 	"strings"
 	"time"
 	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/storage"
 	"virtual-file-system/internal/utils"
 )
 
@@ -20,145 +20,398 @@ func NewFolderService(userService *UserService) *FolderService {
 	}
 }
 
+// CreateFolder creates a folder at the slash-separated path, whose parent must exist
 func (s *FolderService) CreateFolder(userName, folderName, description string) error {
-	lowerUserName := strings.ToLower(userName)
-	lowerFolderName := strings.ToLower(folderName)
+	return s.createFolder(userName, folderName, description, false)
+}
 
-	// Check if the user already exists
-	if !s.UserService.Exist(lowerUserName) {
-		return fmt.Errorf("Error: The %v doesn't exist.", userName)
-	}
+// CreateFolderAll creates a folder at the slash-separated path along with
+// any missing parent
+func (s *FolderService) CreateFolderAll(userName, folderName, description string) error {
+	return s.createFolder(userName, folderName, description, true)
+}
 
-	// Check if the folder name contains invalid characters
-	if utils.ExistInvalidChars(lowerFolderName) {
-		return fmt.Errorf("Error: The %v contains invalid chars.", folderName)
-	}
+func (s *FolderService) createFolder(userName, folderName, description string, parents bool) error {
+	userKey := utils.NameKey(userName)
 
-	// Check if the folder name already exists for the user
-	if s.Exist(lowerUserName, lowerFolderName) {
-		return fmt.Errorf("Error: The %s has already existed.", folderName)
-	}
+	return s.UserService.Store.Update(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
 
-	// Create the new folder
-	user := s.UserService.Users[lowerUserName]
-	if user.Folders == nil {
-		user.Folders = make(map[string]models.Folder)
-	}
-	user.Folders[lowerFolderName] = models.Folder{
-		Name:        lowerFolderName,
-		Description: description,
-		CreatedAt:   time.Now(),
-	}
+		// Check if the folder path and the folder name are valid
+		names := utils.SplitPath(folderName)
+		if names == nil {
+			return invalidPath(folderName)
+		}
+		folderKey := utils.NameKey(utils.JoinPath(names...))
+		name, err := s.UserService.NamePolicy.Normalize(names[len(names)-1])
+		if err != nil {
+			return invalidName(names[len(names)-1], err)
+		}
 
-	s.UserService.Users[lowerUserName] = user
-	return nil
+		// Check if the folder name already exists for the user
+		if folderExist(tx, userKey, folderKey) {
+			return &Error{Code: CodeFolderExists, Name: folderName}
+		}
+
+		// Check if the parent exists, or create the missing ones.
+		// created is the depth of the first created folder.
+		now := s.UserService.now()
+		created := len(names)
+		for i := 1; i < len(names); i++ {
+			parentKey := utils.NameKey(utils.JoinPath(names[:i]...))
+			if folderExist(tx, userKey, parentKey) {
+				continue
+			}
+			if !parents {
+				parentName, _ := utils.SplitParent(folderName)
+				return &Error{Code: CodeFolderNotFound, Name: parentName}
+			}
+			parentName, err := s.UserService.NamePolicy.Normalize(names[i-1])
+			if err != nil {
+				return invalidName(names[i-1], err)
+			}
+			err = tx.PutFolder(userKey, parentKey, models.Folder{Name: parentName, CreatedAt: now, ModifiedAt: now})
+			if err != nil {
+				return err
+			}
+			if i < created {
+				created = i
+			}
+		}
+
+		// Create the new folder
+		err = tx.PutFolder(userKey, folderKey, models.Folder{
+			Name:        name,
+			Description: description,
+			CreatedAt:   now,
+			ModifiedAt:  now,
+		})
+		if err != nil {
+			return err
+		}
+		return touchFolder(tx, userKey, utils.NameKey(utils.JoinPath(names[:created-1]...)), now)
+	})
 }
 
+// GetFolders lists the folders at the root of the user
 func (s *FolderService) GetFolders(userName, sortFlag, sortOrderFlag string) ([]models.Folder, error) {
-	lowerUserName := strings.ToLower(userName)
+	return s.GetSubFolders(userName, "", sortFlag, sortOrderFlag)
+}
 
-	// Check if the user exists
-	if !s.UserService.Exist(lowerUserName) {
-		return []models.Folder{}, fmt.Errorf("Error: The %v doesn't exist.", userName)
-	}
+// GetSubFolders lists the folders right under the slash-separated path,
+// the root of the user if empty
+func (s *FolderService) GetSubFolders(userName, folderName, sortFlag, sortOrderFlag string) ([]models.Folder, error) {
+	return s.GetSubFoldersAt(userName, "", folderName, sortFlag, sortOrderFlag)
+}
+
+// GetSubFoldersAt lists the folders right under the slash-separated path as
+// they were in the snapshot labelled at, or as they are if at is empty
+func (s *FolderService) GetSubFoldersAt(userName, at, folderName, sortFlag, sortOrderFlag string) ([]models.Folder, error) {
+	userKey := utils.NameKey(userName)
+
+	var folderList []models.Folder
+	err := s.UserService.Store.View(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+		tx, err := viewAt(tx, userKey, at)
+		if err != nil {
+			return err
+		}
 
-	// Convert map to slice for sorting
-	folderList := make([]models.Folder, 0)
-	for _, folder := range s.UserService.Users[lowerUserName].Folders {
-		folderList = append(folderList, folder)
+		// Check if the parent folder exists for the user
+		folderKey := ""
+		if folderName != "" {
+			var ok bool
+			folderKey, ok = folderPath(folderName)
+			if !ok || !folderExist(tx, userKey, folderKey) {
+				return &Error{Code: CodeFolderNotFound, Name: folderName}
+			}
+		}
+
+		folderList, err = tx.ListFolders(userKey, folderKey)
+		return err
+	})
+	if err != nil {
+		return []models.Folder{}, err
 	}
 
 	if len(folderList) == 0 {
-		return folderList, fmt.Errorf("Warning: The %s doesn't have any folders.", userName)
+		return folderList, nil
 	}
 
 	// Sort the folders based on the provided flags
 	switch sortFlag {
 	case "--sort-name":
+		// The store lists entities in ascending name order already
+		if sortOrderFlag == "desc" {
+			for i, j := 0, len(folderList)-1; i < j; i, j = i+1, j-1 {
+				folderList[i], folderList[j] = folderList[j], folderList[i]
+			}
+		} else if sortOrderFlag != "asc" {
+			return []models.Folder{}, &Error{Code: CodeInvalidSortFlag, Name: sortOrderFlag}
+		}
+	case "--sort-created":
 		if sortOrderFlag == "asc" {
 			sort.SliceStable(folderList, func(i, j int) bool {
-				return folderList[i].Name < folderList[j].Name
+				return folderList[i].CreatedAt.Before(folderList[j].CreatedAt)
 			})
 		} else if sortOrderFlag == "desc" {
 			sort.SliceStable(folderList, func(i, j int) bool {
-				return folderList[i].Name > folderList[j].Name
+				return folderList[i].CreatedAt.After(folderList[j].CreatedAt)
 			})
 		} else {
-			return []models.Folder{}, fmt.Errorf("Usage: list-folders [username] [--sort-name|--sort-created] [asc|desc]")
+			return []models.Folder{}, &Error{Code: CodeInvalidSortFlag, Name: sortOrderFlag}
 		}
-	case "--sort-created":
+	case "--sort-modified":
 		if sortOrderFlag == "asc" {
 			sort.SliceStable(folderList, func(i, j int) bool {
-				return folderList[i].CreatedAt.Before(folderList[j].CreatedAt)
+				return folderList[i].ModifiedAt.Before(folderList[j].ModifiedAt)
 			})
 		} else if sortOrderFlag == "desc" {
 			sort.SliceStable(folderList, func(i, j int) bool {
-				return folderList[i].CreatedAt.After(folderList[j].CreatedAt)
+				return folderList[i].ModifiedAt.After(folderList[j].ModifiedAt)
 			})
 		} else {
-			return []models.Folder{}, fmt.Errorf("Usage: list-folders [username] [--sort-name|--sort-created] [asc|desc]")
+			return []models.Folder{}, &Error{Code: CodeInvalidSortFlag, Name: sortOrderFlag}
 		}
 	default:
-		return []models.Folder{}, fmt.Errorf("Usage: list-folders [username] [--sort-name|--sort-created] [asc|desc]")
+		return []models.Folder{}, &Error{Code: CodeInvalidSortFlag, Name: sortFlag}
 	}
 
 	return folderList, nil
 }
 
-func (s *FolderService) DeleteFolder(userName, folderName string) error {
-	lowerUserName := strings.ToLower(userName)
-	lowerFolderName := strings.ToLower(folderName)
+// DeleteFolder deletes the folder at the slash-separated path with all of
+// its sub-folders and files. The folder is moved to the trash of the user
+// unless permanent is set.
+func (s *FolderService) DeleteFolder(userName, folderName string, permanent bool) error {
+	userKey := utils.NameKey(userName)
 
-	// Check if the user exists
-	if !s.UserService.Exist(lowerUserName) {
-		return fmt.Errorf("Error: The %v doesn't exist.", userName)
-	}
+	return s.UserService.Store.Update(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
 
-	// Check if the folder exists for the user
-	if !s.Exist(lowerUserName, lowerFolderName) {
-		return fmt.Errorf("Error: The %s doesn't exist", folderName)
-	}
+		// Check if the folder exists for the user
+		folderKey, ok := folderPath(folderName)
+		if !ok || !folderExist(tx, userKey, folderKey) {
+			return &Error{Code: CodeFolderNotFound, Name: folderName}
+		}
 
-	delete(s.UserService.Users[lowerUserName].Folders, lowerFolderName)
-	return nil
+		now := s.UserService.now()
+		parentKey, _ := utils.SplitParent(folderKey)
+		if !permanent {
+			if err := s.UserService.trashFolder(tx, userKey, folderKey, now); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.DeleteFolder(userKey, folderKey); err != nil {
+			return err
+		}
+		return touchFolder(tx, userKey, parentKey, now)
+	})
 }
 
+// RenameFolder renames the folder at the slash-separated path along with its
+// whole subtree. A new name containing a slash is the new path of the folder.
+// A new name that only differs by its case, like docs to Docs, is allowed.
 func (s *FolderService) RenameFolder(userName, folderName, newFolderName string) error {
-	lowerUserName := strings.ToLower(userName)
-	lowerFolderName := strings.ToLower(folderName)
-	lowerNewFolderName := strings.ToLower(newFolderName)
+	userKey := utils.NameKey(userName)
 
-	// Check if the user exists
-	if !s.UserService.Exist(lowerUserName) {
-		return fmt.Errorf("Error: The %v doesn't exist.", userName)
-	}
+	return s.UserService.Store.Update(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+
+		// Check if the folder exists for the user
+		folderKey, ok := folderPath(folderName)
+		if !ok || !folderExist(tx, userKey, folderKey) {
+			return &Error{Code: CodeFolderNotFound, Name: folderName}
+		}
 
-	// Check if the folder exists for the user
-	if !s.Exist(lowerUserName, lowerFolderName) {
-		return fmt.Errorf("Error: The %v doesn't exist", folderName)
+		// Check if the new folder path and the new folder name are valid
+		newFolderKey, ok := folderPath(newFolderName)
+		if !ok {
+			return invalidPath(newFolderName)
+		}
+		if !strings.Contains(newFolderName, utils.PathSeparator) {
+			parentKey, _ := utils.SplitParent(folderKey)
+			newFolderKey = utils.JoinPath(parentKey, newFolderKey)
+		}
+		_, lastName := utils.SplitParent(newFolderName)
+		newName, err := s.UserService.NamePolicy.Normalize(lastName)
+		if err != nil {
+			return invalidName(lastName, err)
+		}
+
+		now := s.UserService.now()
+
+		// A new case of the name keeps the key of the folder
+		if newFolderKey == folderKey {
+			folder, err := tx.GetFolder(userKey, folderKey)
+			if err != nil {
+				return err
+			}
+			folder.Name = newName
+			folder.ModifiedAt = now
+			if err := tx.PutFolder(userKey, folderKey, folder); err != nil {
+				return err
+			}
+			parentKey, _ := utils.SplitParent(folderKey)
+			return touchFolder(tx, userKey, parentKey, now)
+		}
+
+		// Check if the folder exists for the user
+		if folderExist(tx, userKey, newFolderKey) {
+			return &Error{Code: CodeFolderExists, Name: newFolderName}
+		}
+
+		// Check that the new parent exists and isn't inside the folder
+		if strings.HasPrefix(newFolderKey, folderKey+utils.PathSeparator) {
+			return &Error{Code: CodeMoveIntoItself, Name: folderName}
+		}
+		if parentKey, _ := utils.SplitParent(newFolderKey); parentKey != "" && !folderExist(tx, userKey, parentKey) {
+			parentName, _ := utils.SplitParent(newFolderName)
+			return &Error{Code: CodeFolderNotFound, Name: parentName}
+		}
+
+		// Move the folder with its whole subtree under the new name
+		if err := copyFolder(tx, userKey, folderKey, userKey, newFolderKey, newName, time.Time{}); err != nil {
+			return err
+		}
+		if err := tx.DeleteFolder(userKey, folderKey); err != nil {
+			return err
+		}
+
+		// The folder and both of its parents changed
+		parentKey, _ := utils.SplitParent(folderKey)
+		newParentKey, _ := utils.SplitParent(newFolderKey)
+		for _, key := range []string{newFolderKey, parentKey, newParentKey} {
+			if err := touchFolder(tx, userKey, key, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetFolderDescription replaces the description of the folder at the
+// slash-separated path
+func (s *FolderService) SetFolderDescription(userName, folderName, description string) error {
+	userKey := utils.NameKey(userName)
+
+	return s.UserService.Store.Update(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+
+		// Check if the folder exists for the user
+		folderKey, ok := folderPath(folderName)
+		if !ok {
+			return &Error{Code: CodeFolderNotFound, Name: folderName}
+		}
+		folder, err := tx.GetFolder(userKey, folderKey)
+		if err != nil {
+			return &Error{Code: CodeFolderNotFound, Name: folderName}
+		}
+
+		folder.Description = description
+		folder.ModifiedAt = s.UserService.now()
+		return tx.PutFolder(userKey, folderKey, folder)
+	})
+}
+
+func (s *FolderService) Exist(userName, folderName string) bool {
+	exist := false
+	s.UserService.Store.View(func(tx storage.Tx) error {
+		userKey := utils.NameKey(userName)
+		folderKey, ok := folderPath(folderName)
+		exist = ok && folderExist(tx, userKey, folderKey)
+		return nil
+	})
+	return exist
+}
+
+func folderExist(tx storage.Tx, userKey, folderKey string) bool {
+	_, err := tx.GetFolder(userKey, folderKey)
+	return err == nil
+}
+
+// touchFolder sets the modification time of the folder after one of its
+// entries changed. The root of a user has none.
+func touchFolder(tx storage.Tx, userKey, folderKey string, now time.Time) error {
+	if folderKey == "" {
+		return nil
 	}
+	folder, err := tx.GetFolder(userKey, folderKey)
+	if err != nil {
+		return err
+	}
+	folder.ModifiedAt = now
+	return tx.PutFolder(userKey, folderKey, folder)
+}
 
-	// Check if the new folder name contains invalid characters
-	if utils.ExistInvalidChars(lowerNewFolderName) {
-		return fmt.Errorf("Error: The %v contains invalid chars.", newFolderName)
+// folderPath validates a slash-separated folder path and returns its key
+func folderPath(folderName string) (string, bool) {
+	names := utils.SplitPath(folderName)
+	if names == nil {
+		return "", false
 	}
+	return utils.NameKey(utils.JoinPath(names...)), true
+}
 
-	// Check if the folder exists for the user
-	if s.Exist(lowerUserName, lowerNewFolderName) {
-		return fmt.Errorf("Error: The %v has already existed.", newFolderName)
+// copyFolder copies the folder with its whole subtree to a new path, which
+// may belong to another user, where it is named newName. The copies get now
+// as their timestamps, or keep the original ones if now is zero.
+func copyFolder(tx storage.Tx, userKey, folderKey, newUserKey, newFolderKey, newName string, now time.Time) error {
+	folder, err := tx.GetFolder(userKey, folderKey)
+	if err != nil {
+		return err
+	}
+	folder.Name = newName
+	if !now.IsZero() {
+		folder.CreatedAt, folder.ModifiedAt = now, now
+	}
+	if err := tx.PutFolder(newUserKey, newFolderKey, folder); err != nil {
+		return err
 	}
 
-	folder := s.UserService.Users[lowerUserName].Folders[lowerFolderName]
-	folder.Name = lowerNewFolderName
-	s.UserService.Users[lowerUserName].Folders[lowerNewFolderName] = folder
-	delete(s.UserService.Users[lowerUserName].Folders, lowerFolderName)
-	return nil
-}
+	files, err := tx.ListFiles(userKey, folderKey)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		fileKey := utils.NameKey(file.Name)
+		if !now.IsZero() {
+			file.CreatedAt, file.ModifiedAt = now, now
+		}
+		if err := tx.PutFile(newUserKey, newFolderKey, fileKey, file); err != nil {
+			return err
+		}
+		if err := storage.CopyContent(tx, userKey, folderKey, fileKey, newUserKey, newFolderKey, fileKey); err != nil {
+			return err
+		}
+	}
 
-func (s *FolderService) Exist(userName, folderName string) bool {
-	folder, exist := s.UserService.Users[userName].Folders[folderName]
-	if !exist {
-		return false
+	subFolders, err := tx.ListFolders(userKey, folderKey)
+	if err != nil {
+		return err
 	}
-	return folder.Name == folderName
+	for _, subFolder := range subFolders {
+		subFolderKey := utils.NameKey(subFolder.Name)
+		err := copyFolder(tx, userKey, utils.JoinPath(folderKey, subFolderKey), newUserKey, utils.JoinPath(newFolderKey, subFolderKey), subFolder.Name, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -1,10 +1,12 @@
 package services
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 	"time"
 	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/storage"
 )
 
 func TestFolderService_Creation(t *testing.T) {
@@ -44,7 +46,7 @@ func TestFolderService_Creation(t *testing.T) {
 			targetUser:   "dalaoqi",
 			targetFolder: "myfolder??",
 			description:  "My folder description",
-			expectedErr:  "Error: The myfolder?? contains invalid chars.",
+			expectedErr:  "Error: The myfolder?? contains the invalid char '?' at position 9.",
 			expectedLen:  0,
 			expectedName: "",
 		},
@@ -61,9 +63,7 @@ func TestFolderService_Creation(t *testing.T) {
 	}
 	for _, test := range testCases {
 		t.Run(test.name, func(t *testing.T) {
-			userService := &UserService{
-				Users: test.users,
-			}
+			userService := NewUserService(storage.NewMemoryStore(test.users))
 
 			folderService := NewFolderService(userService)
 
@@ -72,17 +72,17 @@ func TestFolderService_Creation(t *testing.T) {
 				t.Errorf("folderService.CreateFolder() has error: %s, expected: %s", err.Error(), test.expectedErr)
 			}
 
-			if len(folderService.UserService.Users[test.targetUser].Folders) != test.expectedLen {
-				t.Errorf("folderService.CreateFolder() len = %v, expectedLen %v", len(folderService.UserService.Users[test.targetUser].Folders), test.expectedLen)
+			if len(test.users[test.targetUser].Folders) != test.expectedLen {
+				t.Errorf("folderService.CreateFolder() len = %v, expectedLen %v", len(test.users[test.targetUser].Folders), test.expectedLen)
 			}
 
-			if test.expectedName != "" && folderService.UserService.Users[test.targetUser].Folders[test.targetFolder].Name != test.expectedName {
-				t.Errorf("folderService.CreateFolder() name = %s, expectedName %s", folderService.UserService.Users[test.targetUser].Folders[test.targetFolder].Name, test.expectedName)
+			if test.expectedName != "" && test.users[test.targetUser].Folders[test.targetFolder].Name != test.expectedName {
+				t.Errorf("folderService.CreateFolder() name = %s, expectedName %s", test.users[test.targetUser].Folders[test.targetFolder].Name, test.expectedName)
 			}
 
 			// Verify the created folder's attributes
-			if len(folderService.UserService.Users[test.targetUser].Folders) > 0 {
-				folder := folderService.UserService.Users[test.targetUser].Folders[test.targetFolder]
+			if len(test.users[test.targetUser].Folders) > 0 {
+				folder := test.users[test.targetUser].Folders[test.targetFolder]
 				if folder.Description != test.description {
 					t.Errorf("folderService.CreateFolder() description = %s, expectedDescription %s", folder.Description, test.description)
 				}
@@ -109,18 +109,16 @@ func TestFolderService_GetFolders(t *testing.T) {
 		CreatedAt:   time.Now().Add(-3 * time.Hour),
 	}
 
-	userService := &UserService{
-		Users: map[string]models.User{
-			"dalaoqi": {
-				Name:    "dalaoqi",
-				Folders: map[string]models.Folder{"folder1": folder1, "folder2": folder2, "folder3": folder3},
-			},
-			"dalaoqiEmpty": {
-				Name:    "dalaoqiEmpty",
-				Folders: nil,
-			},
+	userService := NewUserService(storage.NewMemoryStore(map[string]models.User{
+		"dalaoqi": {
+			Name:    "dalaoqi",
+			Folders: map[string]models.Folder{"folder1": folder1, "folder2": folder2, "folder3": folder3},
 		},
-	}
+		"dalaoqiEmpty": {
+			Name:    "dalaoqiEmpty",
+			Folders: nil,
+		},
+	}))
 
 	folderService := NewFolderService(userService)
 
@@ -169,7 +167,7 @@ func TestFolderService_GetFolders(t *testing.T) {
 			sortFlag:       "--sort-invalid",
 			sortOrderFlag:  "asc",
 			expectedResult: []models.Folder{},
-			expectedError:  "Usage: list-folders [username] [--sort-name|--sort-created] [asc|desc]",
+			expectedError:  "Error: The sort flag --sort-invalid is invalid.",
 		},
 		{
 			name:           "Sort by name in invalid order",
@@ -177,7 +175,7 @@ func TestFolderService_GetFolders(t *testing.T) {
 			sortFlag:       "--sort-name",
 			sortOrderFlag:  "invalid",
 			expectedResult: []models.Folder{},
-			expectedError:  "Usage: list-folders [username] [--sort-name|--sort-created] [asc|desc]",
+			expectedError:  "Error: The sort flag invalid is invalid.",
 		},
 		{
 			name:           "User doesn't exist",
@@ -205,7 +203,7 @@ func TestFolderService_GetFolders(t *testing.T) {
 			}
 
 			if !reflect.DeepEqual(gotResult, test.expectedResult) {
-				t.Errorf("Result mismatch, Got: %s, Want: %s", gotResult, test.expectedResult)
+				t.Errorf("Result mismatch, Got: %v, Want: %v", gotResult, test.expectedResult)
 			}
 		})
 	}
@@ -251,7 +249,7 @@ func TestFolderService_Deletion(t *testing.T) {
 			},
 			targetUser:    "dalaoqi",
 			targetFolder:  "otherfolder",
-			expectedError: "Error: The otherfolder doesn't exist",
+			expectedError: "Error: The otherfolder doesn't exist.",
 		},
 		{
 			name: "Delete a folder for a non-existing user",
@@ -273,14 +271,12 @@ func TestFolderService_Deletion(t *testing.T) {
 	}
 	for _, test := range testCases {
 		t.Run(test.name, func(t *testing.T) {
-			userService := &UserService{
-				Users: test.users,
-			}
+			userService := NewUserService(storage.NewMemoryStore(test.users))
 			folderService := &FolderService{
 				UserService: userService,
 			}
 			// Perform the test by calling FolderService.DeleteFolder() and check the error message
-			folderService.DeleteFolder(test.targetUser, test.targetFolder)
+			folderService.DeleteFolder(test.targetUser, test.targetFolder, false)
 
 			// Check if the folder has been deleted from the folders map
 			if exists := folderService.Exist(test.targetUser, test.targetFolder); exists {
@@ -310,14 +306,14 @@ func TestRenameFolder(t *testing.T) {
 			userName:      "dalaoqi",
 			folderName:    "nonexistent",
 			newFolderName: "newfolder",
-			expectedError: "Error: The nonexistent doesn't exist",
+			expectedError: "Error: The nonexistent doesn't exist.",
 		},
 		{
 			name:          "Rename folder with invalid characters",
 			userName:      "dalaoqi",
 			folderName:    "folder1",
 			newFolderName: "new?folder123",
-			expectedError: "Error: The new?folder123 contains invalid chars.",
+			expectedError: "Error: The new?folder123 contains the invalid char '?' at position 4.",
 		},
 		{
 			name:          "Rename to an existing folder name",
@@ -330,25 +326,24 @@ func TestRenameFolder(t *testing.T) {
 
 	for _, test := range testCases {
 		t.Run(test.name, func(t *testing.T) {
-			userService := &UserService{
-				Users: map[string]models.User{
-					"dalaoqi": {
-						Name: "dalaoqi",
-						Folders: map[string]models.Folder{
-							"folder1": {
-								Name:        "folder1",
-								Description: "Folder 1",
-								CreatedAt:   time.Now(),
-							},
-							"folder2": {
-								Name:        "folder2",
-								Description: "Folder 2",
-								CreatedAt:   time.Now(),
-							},
+			users := map[string]models.User{
+				"dalaoqi": {
+					Name: "dalaoqi",
+					Folders: map[string]models.Folder{
+						"folder1": {
+							Name:        "folder1",
+							Description: "Folder 1",
+							CreatedAt:   time.Now(),
+						},
+						"folder2": {
+							Name:        "folder2",
+							Description: "Folder 2",
+							CreatedAt:   time.Now(),
 						},
 					},
 				},
 			}
+			userService := NewUserService(storage.NewMemoryStore(users))
 
 			folderService := NewFolderService(userService)
 			err := folderService.RenameFolder(test.userName, test.folderName, test.newFolderName)
@@ -365,7 +360,7 @@ func TestRenameFolder(t *testing.T) {
 
 			// Check if the folder was renamed correctly
 			if err == nil {
-				folders := userService.Users[test.userName].Folders
+				folders := users[test.userName].Folders
 				_, exists := folders[test.folderName]
 				if exists {
 					t.Errorf("Folder %s should not exist", test.folderName)
@@ -381,3 +376,193 @@ func TestRenameFolder(t *testing.T) {
 		})
 	}
 }
+
+func TestFolderService_NestedFolders(t *testing.T) {
+	userService := NewUserService(storage.NewMemoryStore(map[string]models.User{"dalaoqi": {Name: "dalaoqi"}}))
+	folderService := NewFolderService(userService)
+	fileService := NewFileService(userService, folderService)
+
+	testCases := []struct {
+		name        string
+		run         func() error
+		expectedErr string
+	}{
+		{
+			name:        "Create a folder under a missing parent",
+			run:         func() error { return folderService.CreateFolder("dalaoqi", "projects/2024/q1", "") },
+			expectedErr: "Error: The projects/2024 doesn't exist.",
+		},
+		{
+			name: "Create a folder with its missing parents",
+			run:  func() error { return folderService.CreateFolderAll("dalaoqi", "Projects/2024/q1", "first quarter") },
+		},
+		{
+			name: "Create a folder under an existing parent",
+			run:  func() error { return folderService.CreateFolder("dalaoqi", "projects/2024/q2", "") },
+		},
+		{
+			name:        "Create a folder with an empty name in the path",
+			run:         func() error { return folderService.CreateFolder("dalaoqi", "projects//q3", "") },
+			expectedErr: "Error: The projects//q3 contains an empty folder name.",
+		},
+		{
+			name: "Create a file in a nested folder",
+			run:  func() error { return fileService.CreateFile("dalaoqi", "projects/2024/q1", "report", "") },
+		},
+		{
+			name:        "Move a folder into itself",
+			run:         func() error { return folderService.RenameFolder("dalaoqi", "projects", "projects/2024/old") },
+			expectedErr: "Error: The projects cannot be moved into itself.",
+		},
+		{
+			name: "Rename a folder with its subtree",
+			run:  func() error { return folderService.RenameFolder("dalaoqi", "projects/2024", "2025") },
+		},
+		{
+			name: "Move a folder to the root",
+			run:  func() error { return folderService.RenameFolder("dalaoqi", "projects/2025/q2", "/archive") },
+		},
+		{
+			name:        "Move a folder under a missing parent",
+			run:         func() error { return folderService.RenameFolder("dalaoqi", "archive", "missing/archive") },
+			expectedErr: "Error: The missing doesn't exist.",
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.run()
+			if test.expectedErr == "" && err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if test.expectedErr != "" && (err == nil || err.Error() != test.expectedErr) {
+				t.Fatalf("Expected error: %s, but got: %v", test.expectedErr, err)
+			}
+		})
+	}
+
+	// The subtree must have followed the renamed folder
+	if !fileService.Exist("dalaoqi", "projects/2025/q1", "report") {
+		t.Errorf("report wasn't moved with its folder")
+	}
+	if folderService.Exist("dalaoqi", "projects/2024") || !folderService.Exist("dalaoqi", "archive") {
+		t.Errorf("Folders weren't renamed")
+	}
+
+	folders, err := folderService.GetSubFolders("dalaoqi", "projects/2025", "--sort-name", "asc")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(folders) != 1 || folders[0].Name != "q1" || folders[0].Description != "first quarter" {
+		t.Errorf("GetSubFolders() = %v, expected q1", folders)
+	}
+
+	// Deleting a folder removes its whole subtree
+	if err := folderService.DeleteFolder("dalaoqi", "projects", false); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if folderService.Exist("dalaoqi", "projects/2025/q1") {
+		t.Errorf("projects/2025/q1 still exists after deleting projects")
+	}
+}
+
+func TestFolderService_CasePreserving(t *testing.T) {
+	userService := NewUserService(storage.NewMemoryStore(nil))
+	folderService := NewFolderService(userService)
+	fileService := NewFileService(userService, folderService)
+	steps := []error{
+		userService.Register("DaLaoqi"),
+		folderService.CreateFolderAll("dalaoqi", "Projects/Q3 Report", ""),
+		folderService.CreateFolder("DALAOQI", "Straße", ""),
+		fileService.CreateFile("dalaoqi", "projects/q3 report", "Budget.xlsx", ""),
+	}
+	for _, err := range steps {
+		if err != nil {
+			t.Fatalf("Setup has error: %s", err)
+		}
+	}
+
+	// Names are displayed as they were given
+	users, _ := userService.GetUsers("--sort-name", "asc")
+	folders, _ := folderService.GetFolders("dalaoqi", "--sort-name", "asc")
+	subFolders, _ := folderService.GetSubFolders("dalaoqi", "PROJECTS", "--sort-name", "asc")
+	files, _ := fileService.GetFiles("dalaoqi", "Projects/Q3 REPORT", "--sort-name", "asc")
+	var names []string
+	for _, user := range users {
+		names = append(names, user.Name)
+	}
+	for _, folder := range append(folders, subFolders...) {
+		names = append(names, folder.Name)
+	}
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	expected := []string{"DaLaoqi", "Projects", "Straße", "Q3 Report", "Budget.xlsx"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Names = %q, expected: %q", names, expected)
+	}
+
+	// Lookups and collisions ignore the case
+	if !userService.Exist("DALAOQI") || !folderService.Exist("dalaoqi", "STRASSE") || !fileService.Exist("Dalaoqi", "projects/Q3 report", "BUDGET.XLSX") {
+		t.Errorf("Exist() is false for a name in another case")
+	}
+	if err := folderService.CreateFolder("dalaoqi", "strasse", ""); !errors.Is(err, ErrFolderExists) {
+		t.Errorf("CreateFolder() has error: %v, expected: %v", err, ErrFolderExists)
+	}
+	if err := fileService.CreateFile("dalaoqi", "projects/q3 report", "budget.XLSX", ""); !errors.Is(err, ErrFileExists) {
+		t.Errorf("CreateFile() has error: %v, expected: %v", err, ErrFileExists)
+	}
+
+	// Renaming to another case of the name keeps the folder and its content
+	if err := folderService.RenameFolder("dalaoqi", "projects/q3 report", "Q3 report"); err != nil {
+		t.Fatalf("RenameFolder() has error: %s", err)
+	}
+	subFolders, _ = folderService.GetSubFolders("dalaoqi", "projects", "--sort-name", "asc")
+	if len(subFolders) != 1 || subFolders[0].Name != "Q3 report" || !fileService.Exist("dalaoqi", "projects/q3 report", "budget.xlsx") {
+		t.Errorf("GetSubFolders() = %+v after renaming to another case", subFolders)
+	}
+}
+
+func TestFolderService_ModifiedAt(t *testing.T) {
+	start := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	userService := NewUserService(storage.NewMemoryStore(nil))
+	userService.setClock(func() time.Time { return now })
+	folderService := NewFolderService(userService)
+	fileService := NewFileService(userService, folderService)
+	userService.Register("dalaoqi")
+
+	// Every step happens an hour after the previous one
+	steps := []func() error{
+		func() error { return folderService.CreateFolder("dalaoqi", "docs", "") },
+		func() error { return folderService.CreateFolder("dalaoqi", "photos", "") },
+		func() error { return folderService.CreateFolder("dalaoqi", "music", "") },
+		func() error { return folderService.SetFolderDescription("dalaoqi", "Docs", "the docs") },
+		func() error { return folderService.CreateFolderAll("dalaoqi", "photos/2024/trip", "") },
+		func() error { return fileService.CreateFile("dalaoqi", "music", "song", "") },
+	}
+	for i, step := range steps {
+		now = start.Add(time.Duration(i) * time.Hour)
+		if err := step(); err != nil {
+			t.Fatalf("Step %d has error: %s", i, err)
+		}
+	}
+
+	folders, err := folderService.GetFolders("dalaoqi", "--sort-modified", "asc")
+	if err != nil {
+		t.Fatalf("GetFolders() has error: %s", err)
+	}
+	var names []string
+	for _, folder := range folders {
+		names = append(names, folder.Name)
+	}
+	if expected := []string{"docs", "photos", "music"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("GetFolders(--sort-modified asc) = %v, expected: %v", names, expected)
+	}
+	if folders[0].Description != "the docs" || !folders[0].CreatedAt.Equal(start) {
+		t.Errorf("docs = %+v, expected its description changed", folders[0])
+	}
+
+	if err := folderService.SetFolderDescription("dalaoqi", "nonexistent", "x"); err == nil || err.Error() != "Error: The nonexistent doesn't exist." {
+		t.Errorf("SetFolderDescription() of a missing folder has error: %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/storage"
+	"virtual-file-system/internal/utils"
+)
+
+// FS exposes the tree of one user, or of the whole system with the users as
+// top-level directories, as a read-only fs.FS.
+//
+// Folders are directories and files are regular files, with their creation
+// time as modification time. Sys returns the models.User, models.Folder or
+// models.File of an entry, so descriptions remain accessible. A file whose
+// name is taken by a sub-folder of the same folder is hidden.
+type FS struct {
+	userService *UserService
+	userName    string
+}
+
+// NewFS creates a file system over the tree of the user, or over every user
+// if userName is empty
+func NewFS(userService *UserService, userName string) *FS {
+	return &FS{
+		userService: userService,
+		userName:    utils.NameKey(userName),
+	}
+}
+
+// Open opens the named file or directory
+func (f *FS) Open(name string) (fs.File, error) {
+	var (
+		entry   fsEntry
+		entries []fs.DirEntry
+	)
+	err := f.view("open", name, func(tx storage.Tx) error {
+		var err error
+		entry, err = f.resolve(tx, name)
+		if err != nil || !entry.info.IsDir() {
+			return err
+		}
+		entries, err = f.readDir(tx, entry)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.info.IsDir() {
+		return &fsDir{info: entry.info, path: name, entries: entries}, nil
+	}
+	reader := &fileReader{store: f.userService.Store, ref: entry.ref, size: entry.info.size, index: -1}
+	return &fsFile{fileReader: reader, info: entry.info}, nil
+}
+
+// ReadDir reads the named directory sorted by name
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	err := f.view("readdir", name, func(tx storage.Tx) error {
+		entry, err := f.resolve(tx, name)
+		if err != nil {
+			return err
+		}
+		if !entry.info.IsDir() {
+			return errNotDir
+		}
+		entries, err = f.readDir(tx, entry)
+		return err
+	})
+	return entries, err
+}
+
+// Stat returns the information of the named file or directory
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	var entry fsEntry
+	err := f.view("stat", name, func(tx storage.Tx) error {
+		var err error
+		entry, err = f.resolve(tx, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry.info, nil
+}
+
+// ReadFile reads the whole content of the named file
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	var content []byte
+	err := f.view("readfile", name, func(tx storage.Tx) error {
+		entry, err := f.resolve(tx, name)
+		if err != nil {
+			return err
+		}
+		if entry.info.IsDir() {
+			return errIsDir
+		}
+		content, err = storage.ReadContent(tx, entry.ref.user, entry.ref.folder, entry.ref.file)
+		return err
+	})
+	return content, err
+}
+
+var (
+	errNotDir = errors.New("not a directory")
+	errIsDir  = errors.New("is a directory")
+)
+
+// view validates the name and runs fn in a read-only transaction, wrapping
+// its error in an fs.PathError
+func (f *FS) view(op, name string, fn func(tx storage.Tx) error) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	err := f.userService.Store.View(fn)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		err = fs.ErrNotExist
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// fsEntry is a file or directory resolved from a path
+type fsEntry struct {
+	info fsInfo
+	// ref holds the keys of the entry, the file key being empty for a
+	// directory, the folder key for a user and the user key for the root
+	// of the system
+	ref fileRef
+}
+
+// resolve walks the tree along the slash-separated name
+func (f *FS) resolve(tx storage.Tx, name string) (fsEntry, error) {
+	entry := fsEntry{info: fsInfo{name: ".", mode: fs.ModeDir | 0o555}, ref: fileRef{user: f.userName}}
+	if f.userName != "" {
+		user, err := tx.GetUser(f.userName)
+		if err != nil {
+			return entry, err
+		}
+		entry.info.sys = user
+	}
+	if name == "." {
+		return entry, nil
+	}
+
+	for _, elem := range strings.Split(name, "/") {
+		key := utils.NameKey(elem)
+		switch {
+		case entry.ref.file != "":
+			return entry, errNotDir
+		case entry.ref.user == "":
+			user, err := tx.GetUser(key)
+			if err != nil {
+				return entry, err
+			}
+			entry.ref.user = key
+			entry.info = userInfo(user)
+		default:
+			folderKey := utils.JoinPath(entry.ref.folder, key)
+			if folder, err := tx.GetFolder(entry.ref.user, folderKey); err == nil {
+				entry.ref.folder = folderKey
+				entry.info = folderInfo(folder)
+				continue
+			} else if !errors.Is(err, storage.ErrNotFound) {
+				return entry, err
+			}
+			// Files are only found inside folders
+			if entry.ref.folder == "" {
+				return entry, fs.ErrNotExist
+			}
+			file, err := tx.GetFile(entry.ref.user, entry.ref.folder, key)
+			if err != nil {
+				return entry, err
+			}
+			entry.ref.file = key
+			entry.info = fileInfo(file)
+		}
+	}
+	return entry, nil
+}
+
+// readDir lists the directory sorted by name
+func (f *FS) readDir(tx storage.Tx, dir fsEntry) ([]fs.DirEntry, error) {
+	var infos []fsInfo
+	if dir.ref.user == "" {
+		users, err := tx.ListUsers()
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			infos = append(infos, userInfo(user))
+		}
+	} else {
+		folders, err := tx.ListFolders(dir.ref.user, dir.ref.folder)
+		if err != nil {
+			return nil, err
+		}
+		names := make(map[string]bool, len(folders))
+		for _, folder := range folders {
+			names[utils.NameKey(folder.Name)] = true
+			infos = append(infos, folderInfo(folder))
+		}
+		if dir.ref.folder != "" {
+			files, err := tx.ListFiles(dir.ref.user, dir.ref.folder)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range files {
+				if !names[utils.NameKey(file.Name)] {
+					infos = append(infos, fileInfo(file))
+				}
+			}
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].name < infos[j].name })
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+// fsInfo describes a user, folder or file as an fs.FileInfo
+type fsInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	sys     any
+}
+
+func userInfo(user models.User) fsInfo {
+	return fsInfo{name: user.Name, mode: fs.ModeDir | 0o555, sys: user}
+}
+
+func folderInfo(folder models.Folder) fsInfo {
+	return fsInfo{name: folder.Name, mode: fs.ModeDir | 0o555, modTime: folder.CreatedAt, sys: folder}
+}
+
+func fileInfo(file models.File) fsInfo {
+	return fsInfo{name: file.Name, size: file.Size, mode: 0o444, modTime: file.CreatedAt, sys: file}
+}
+
+func (i fsInfo) Name() string       { return i.name }
+func (i fsInfo) Size() int64        { return i.size }
+func (i fsInfo) Mode() fs.FileMode  { return i.mode }
+func (i fsInfo) ModTime() time.Time { return i.modTime }
+func (i fsInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i fsInfo) Sys() any           { return i.sys }
+
+// fsFile is an opened file, read chunk by chunk
+type fsFile struct {
+	*fileReader
+	info fsInfo
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// fsDir is an opened directory, listed when it was opened
+type fsDir struct {
+	info    fsInfo
+	path    string
+	entries []fs.DirEntry
+	offset  int
+	closed  bool
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: errIsDir}
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: d.path, Err: fs.ErrClosed}
+	}
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
+
+func (d *fsDir) Close() error {
+	if d.closed {
+		return fs.ErrClosed
+	}
+	d.closed = true
+	return nil
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/storage"
+)
+
+// newTestFSServices builds a tree with nested folders and file content
+func newTestFSServices(t *testing.T) *UserService {
+	t.Helper()
+	userService := NewUserService(storage.NewMemoryStore(nil))
+	folderService := NewFolderService(userService)
+	fileService := NewFileService(userService, folderService)
+
+	steps := []func() error{
+		func() error { return userService.Register("dalaoqi") },
+		func() error { return userService.Register("other") },
+		func() error { return folderService.CreateFolder("dalaoqi", "docs", "the docs") },
+		func() error { return folderService.CreateFolderAll("dalaoqi", "projects/2024/q1", "") },
+		func() error { return folderService.CreateFolder("dalaoqi", "empty", "") },
+		func() error { return fileService.CreateFile("dalaoqi", "docs", "notes", "meeting notes") },
+		func() error { return fileService.WriteFile("dalaoqi", "docs", "notes", []byte("hello world\n")) },
+		func() error { return fileService.CreateFile("dalaoqi", "docs", "empty file", "") },
+		func() error { return fileService.CreateFile("dalaoqi", "projects/2024/q1", "report", "") },
+		func() error {
+			return fileService.WriteFile("dalaoqi", "projects/2024/q1", "report", make([]byte, storage.ChunkSize+10))
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("Building the tree has error: %s", err)
+		}
+	}
+	return userService
+}
+
+func TestFS_TestFS(t *testing.T) {
+	userService := newTestFSServices(t)
+
+	testCases := []struct {
+		name     string
+		fsys     fs.FS
+		expected []string
+	}{
+		{
+			name:     "User",
+			fsys:     NewFS(userService, "dalaoqi"),
+			expected: []string{"docs/notes", "docs/empty file", "empty", "projects/2024/q1/report"},
+		},
+		{
+			name:     "System",
+			fsys:     NewFS(userService, ""),
+			expected: []string{"dalaoqi/docs/notes", "dalaoqi/projects/2024/q1/report", "other"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			if err := fstest.TestFS(test.fsys, test.expected...); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestFS_Entries(t *testing.T) {
+	fsys := NewFS(newTestFSServices(t), "dalaoqi")
+
+	content, err := fs.ReadFile(fsys, "docs/notes")
+	if err != nil || string(content) != "hello world\n" {
+		t.Errorf("fs.ReadFile() = %q, %v, expected hello world", content, err)
+	}
+
+	info, err := fs.Stat(fsys, "docs/notes")
+	if err != nil {
+		t.Fatalf("fs.Stat() has error: %s", err)
+	}
+	file, ok := info.Sys().(models.File)
+	if !ok || file.Description != "meeting notes" || info.Size() != 12 || !info.ModTime().Equal(file.CreatedAt) {
+		t.Errorf("fs.Stat() = %v, expected the notes with their description", info.Sys())
+	}
+
+	info, err = fs.Stat(fsys, "docs")
+	if err != nil {
+		t.Fatalf("fs.Stat() has error: %s", err)
+	}
+	if folder, ok := info.Sys().(models.Folder); !ok || !info.IsDir() || folder.Description != "the docs" {
+		t.Errorf("fs.Stat() = %v, expected the docs folder", info.Sys())
+	}
+
+	matches, err := fs.Glob(fsys, "*/*")
+	if err != nil || len(matches) != 3 || matches[0] != "docs/empty file" || matches[1] != "docs/notes" || matches[2] != "projects/2024" {
+		t.Errorf("fs.Glob() = %v, %v, expected the entries of the folders", matches, err)
+	}
+
+	testCases := []struct {
+		name     string
+		path     string
+		expected error
+	}{
+		{name: "Missing folder", path: "nothing", expected: fs.ErrNotExist},
+		{name: "Missing file", path: "docs/nothing", expected: fs.ErrNotExist},
+		{name: "Invalid path", path: "/docs", expected: fs.ErrInvalid},
+		{name: "Path through a file", path: "docs/notes/more", expected: errNotDir},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := fsys.Open(test.path); !errors.Is(err, test.expected) {
+				t.Errorf("Open(%q) has error: %v, expected: %v", test.path, err, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"virtual-file-system/internal/storage"
+	"virtual-file-system/internal/utils"
+)
+
+// DefaultUndoDepth is the number of mutating commands that can be undone
+const DefaultUndoDepth = 100
+
+// historyEntry is a mutating command run by the dispatcher with the changes
+// it made to the tree
+type historyEntry struct {
+	args    []string
+	time    time.Time
+	changes *storage.Changes
+}
+
+// String returns the command line of the entry
+func (e historyEntry) String() string {
+	quoted := make([]string, len(e.args))
+	for i, arg := range e.args {
+		quoted[i] = utils.QuoteArgument(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// remember pushes a command that succeeded onto the undo history, dropping
+// the oldest one beyond UndoDepth and the commands that were undone
+func (d *Dispatcher) remember(now time.Time, args []string, changes *storage.Changes) {
+	d.undoStack = append(d.undoStack, historyEntry{args: args, time: now, changes: changes})
+	if extra := len(d.undoStack) - d.UndoDepth; extra > 0 {
+		d.undoStack = append(d.undoStack[:0:0], d.undoStack[extra:]...)
+	}
+	d.redoStack = nil
+}
+
+// clearHistory forgets the commands to undo and redo
+func (d *Dispatcher) clearHistory() {
+	d.undoStack = nil
+	d.redoStack = nil
+}
+
+// undo reverts the last command that wasn't undone and returns it
+func (d *Dispatcher) undo() (historyEntry, error) {
+	if len(d.undoStack) == 0 {
+		return historyEntry{}, fmt.Errorf("Error: There is nothing to undo.")
+	}
+	entry := d.undoStack[len(d.undoStack)-1]
+	err := d.userService.Store.Update(entry.changes.Revert)
+	if err != nil && !errors.Is(err, storage.ErrDiverged) {
+		return entry, err
+	}
+	d.undoStack = d.undoStack[:len(d.undoStack)-1]
+	if err != nil {
+		return entry, fmt.Errorf("Error: Cannot undo %s, the tree has changed since.\nIt is removed from the history.", entry)
+	}
+	d.redoStack = append(d.redoStack, entry)
+	return entry, d.persistHistory()
+}
+
+// redo applies the last command that was undone again and returns it
+func (d *Dispatcher) redo() (historyEntry, error) {
+	if len(d.redoStack) == 0 {
+		return historyEntry{}, fmt.Errorf("Error: There is nothing to redo.")
+	}
+	entry := d.redoStack[len(d.redoStack)-1]
+	err := d.userService.Store.Update(entry.changes.Apply)
+	if err != nil && !errors.Is(err, storage.ErrDiverged) {
+		return entry, err
+	}
+	d.redoStack = d.redoStack[:len(d.redoStack)-1]
+	if err != nil {
+		return entry, fmt.Errorf("Error: Cannot redo %s, the tree has changed since.\nIt is removed from the history.", entry)
+	}
+	d.undoStack = append(d.undoStack, entry)
+	return entry, d.persistHistory()
+}
+
+// persistHistory folds an undo or a redo into DataFile, as the journal only
+// replays commands and cannot replay them
+func (d *Dispatcher) persistHistory() error {
+	if d.journal == nil {
+		return nil
+	}
+	return d.compact()
+}
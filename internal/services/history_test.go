@@ -0,0 +1,180 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"virtual-file-system/internal/storage"
+)
+
+func TestDispatcher_UndoRedo(t *testing.T) {
+	setup := [][]string{
+		{"register", "dalaoqi"},
+		{"register", "david"},
+		{"create-folder", "david", "inbox"},
+		{"create-folder", "-p", "dalaoqi", "projects/2024/q1"},
+		{"create-folder", "dalaoqi", "docs", "the docs"},
+		{"snapshot-create", "dalaoqi", "initial"},
+		{"create-file", "dalaoqi", "docs", "notes", "meeting notes"},
+		{"write-file", "dalaoqi", "docs", "notes", "hello world"},
+		{"create-file", "dalaoqi", "projects/2024/q1", "report"},
+		{"delete-file", "dalaoqi", "projects/2024/q1", "report"},
+	}
+	testCases := []struct {
+		name string
+		args []string
+	}{
+		{name: "Register", args: []string{"register", "other"}},
+		{name: "Rename a user", args: []string{"rename-user", "dalaoqi", "laoqi"}},
+		{name: "Unregister with force", args: []string{"unregister", "--force", "dalaoqi"}},
+		{name: "Create nested folders", args: []string{"create-folder", "-p", "dalaoqi", "archive/2023/q4"}},
+		{name: "Rename a folder", args: []string{"rename-folder", "dalaoqi", "projects/2024", "/2024"}},
+		{name: "Describe a folder", args: []string{"set-folder-description", "dalaoqi", "docs"}},
+		{name: "Copy a folder to another user", args: []string{"copy-folder", "dalaoqi", "projects", "projects", "david"}},
+		{name: "Delete a folder", args: []string{"delete-folder", "dalaoqi", "projects"}},
+		{name: "Delete a folder permanently", args: []string{"delete-folder", "--permanent", "dalaoqi", "docs"}},
+		{name: "Create a file", args: []string{"create-file", "dalaoqi", "docs", "todo"}},
+		{name: "Rename a file", args: []string{"rename-file", "dalaoqi", "docs", "notes", "minutes"}},
+		{name: "Move a file to another user", args: []string{"move-file", "dalaoqi", "docs", "notes", "inbox", "david"}},
+		{name: "Copy a file over another one", args: []string{"copy-file", "--overwrite", "dalaoqi", "docs", "notes", "projects/2024/q1"}},
+		{name: "Delete a file", args: []string{"delete-file", "dalaoqi", "docs", "notes"}},
+		{name: "Write a file", args: []string{"write-file", "dalaoqi", "docs", "notes", strings.Repeat("long content ", 10000)}},
+		{name: "Append to a file", args: []string{"append-file", "dalaoqi", "docs", "notes", "!"}},
+		{name: "Truncate a file", args: []string{"truncate-file", "dalaoqi", "docs", "notes", "5"}},
+		{name: "Restore from the trash", args: []string{"restore", "dalaoqi", "1"}},
+		{name: "Empty the trash", args: []string{"empty-trash", "dalaoqi"}},
+		{name: "Create a snapshot", args: []string{"snapshot-create", "dalaoqi", "later"}},
+		{name: "Restore a snapshot", args: []string{"snapshot-restore", "dalaoqi", "initial"}},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDispatcher(storage.NewMemoryStore(nil))
+			d.out = io.Discard
+			for _, args := range setup {
+				if err := d.Exec(args); err != nil {
+					t.Fatalf("Exec(%q) has error: %s", args, err)
+				}
+			}
+			before := dumpTree(t, d)
+			if err := d.Exec(test.args); err != nil {
+				t.Fatalf("Exec(%q) has error: %s", test.args, err)
+			}
+			after := dumpTree(t, d)
+
+			if err := d.Exec([]string{"undo"}); err != nil {
+				t.Fatalf("undo has error: %s", err)
+			}
+			if tree := dumpTree(t, d); !reflect.DeepEqual(tree, before) {
+				t.Errorf("Tree after undo = %v, expected %v", tree, before)
+			}
+			if err := d.Exec([]string{"redo"}); err != nil {
+				t.Fatalf("redo has error: %s", err)
+			}
+			if tree := dumpTree(t, d); !reflect.DeepEqual(tree, after) {
+				t.Errorf("Tree after redo = %v, expected %v", tree, after)
+			}
+		})
+	}
+}
+
+func TestDispatcher_History(t *testing.T) {
+	d := NewDispatcher(storage.NewMemoryStore(nil))
+	var out bytes.Buffer
+	d.out = &out
+	d.UndoDepth = 3
+
+	steps := []struct {
+		args          []string
+		expectedOut   string
+		expectedError string
+	}{
+		{args: []string{"undo"}, expectedError: "Error: There is nothing to undo."},
+		{args: []string{"register", "dalaoqi"}},
+		{args: []string{"create-folder", "dalaoqi", "docs"}},
+		{args: []string{"create-file", "dalaoqi", "docs", "meeting notes"}},
+		{args: []string{"rename-folder", "dalaoqi", "docs", "Docs"}},
+		{args: []string{"undo"}, expectedOut: "Undo rename-folder dalaoqi docs Docs successfully.\n"},
+		{args: []string{"undo"}, expectedOut: "Undo create-file dalaoqi docs \"meeting notes\" successfully.\n"},
+		{args: []string{"history"}, expectedOut: "create-folder dalaoqi docs"},
+		{args: []string{"history"}, expectedOut: "create-file dalaoqi docs \"meeting notes\""},
+		{args: []string{"undo"}, expectedOut: "Undo create-folder dalaoqi docs successfully.\n"},
+		// The register is beyond the depth
+		{args: []string{"undo"}, expectedError: "Error: There is nothing to undo."},
+		{args: []string{"redo"}, expectedOut: "Redo create-folder dalaoqi docs successfully.\n"},
+		// A new command drops the commands to redo
+		{args: []string{"create-folder", "dalaoqi", "tmp"}},
+		{args: []string{"redo"}, expectedError: "Error: There is nothing to redo."},
+		{args: []string{"rename-folder", "dalaoqi", "tmp", "temp"}},
+	}
+	for _, step := range steps {
+		out.Reset()
+		err := d.Exec(step.args)
+		if (err == nil && step.expectedError != "") || (err != nil && err.Error() != step.expectedError) {
+			t.Fatalf("Exec(%q) has error: %v, expected: %s", step.args, err, step.expectedError)
+		}
+		if !strings.Contains(out.String(), step.expectedOut) {
+			t.Errorf("Exec(%q) printed %q, expected to contain: %q", step.args, out.String(), step.expectedOut)
+		}
+	}
+
+	// A change made since blocks the undo of the command, but not of the
+	// older commands it doesn't touch
+	if err := d.folderService.RenameFolder("dalaoqi", "temp", "other"); err != nil {
+		t.Fatalf("RenameFolder() has error: %s", err)
+	}
+	expected := "Error: Cannot undo rename-folder dalaoqi tmp temp, the tree has changed since.\nIt is removed from the history."
+	if err := d.Exec([]string{"undo"}); err == nil || err.Error() != expected {
+		t.Errorf("undo has error: %v, expected: %s", err, expected)
+	}
+	if err := d.Exec([]string{"undo"}); err == nil || !strings.Contains(err.Error(), "Cannot undo create-folder dalaoqi tmp") {
+		t.Errorf("undo has error: %v, expected the tree to have changed", err)
+	}
+	if err := d.Exec([]string{"undo"}); err != nil {
+		t.Errorf("undo has error: %s", err)
+	}
+	if d.folderService.Exist("dalaoqi", "docs") || !d.folderService.Exist("dalaoqi", "other") {
+		t.Errorf("undo didn't revert create-folder dalaoqi docs alone")
+	}
+
+	// Loading a snapshot starts a new history
+	path := filepath.Join(t.TempDir(), "backup.json")
+	for _, args := range [][]string{{"create-folder", "dalaoqi", "docs"}, {"save", path}, {"load", path}} {
+		if err := d.Exec(args); err != nil {
+			t.Fatalf("Exec(%q) has error: %s", args, err)
+		}
+	}
+	out.Reset()
+	if err := d.Exec([]string{"history"}); err != nil || out.String() != "Warning: There are no commands to undo or redo.\n" {
+		t.Errorf("history after load = %q, %v, expected no commands", out.String(), err)
+	}
+}
+
+func TestDispatcher_UndoJournal(t *testing.T) {
+	dataFile := filepath.Join(t.TempDir(), "vfs.json")
+	d := newTestDispatcher(t, dataFile)
+	for _, args := range [][]string{
+		{"register", "dalaoqi"},
+		{"create-folder", "dalaoqi", "docs"},
+		{"create-folder", "dalaoqi", "tmp"},
+		{"undo"},
+		{"rename-folder", "dalaoqi", "docs", "documents"},
+	} {
+		if err := d.Exec(args); err != nil {
+			t.Fatalf("Exec(%q) has error: %s", args, err)
+		}
+	}
+	expected := dumpTree(t, d)
+
+	// Reopen the data file and its journal without closing the dispatcher
+	// as if the process was killed
+	reopened := newTestDispatcher(t, dataFile)
+	defer reopened.Close()
+	assertSameTree(t, dumpTree(t, reopened), expected)
+	if reopened.folderService.Exist("dalaoqi", "tmp") {
+		t.Errorf("The undone folder tmp is back after the replay")
+	}
+}
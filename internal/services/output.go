@@ -0,0 +1,205 @@
+package services
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Format is the output format of the command results
+type Format string
+
+const (
+	// FormatText prints the results as space-separated fields
+	FormatText Format = "text"
+	// FormatJSON prints every result as a single line of JSON
+	FormatJSON Format = "json"
+	// FormatCSV and FormatTSV print the results as comma or tab separated
+	// values with a header
+	FormatCSV Format = "csv"
+	FormatTSV Format = "tsv"
+	// FormatTable prints the results as aligned columns with a header
+	FormatTable Format = "table"
+)
+
+// Formats are the supported output formats
+var Formats = []Format{FormatText, FormatJSON, FormatCSV, FormatTSV, FormatTable}
+
+// ParseFormat returns the format of the name
+func ParseFormat(name string) (Format, error) {
+	for _, format := range Formats {
+		if string(format) == name {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("Error: The output format %s is invalid.", name)
+}
+
+// textTime is the layout of the timestamps in the text and table formats.
+// The other formats use RFC 3339.
+const textTime = "2006-01-02 15:04:05"
+
+// Listing is the result of a listing command. Its values are strings,
+// int64 or time.Time.
+type Listing struct {
+	Columns []string
+	Rows    [][]any
+	// Empty is printed instead of an empty listing in the text format
+	Empty string
+}
+
+// Message prints the confirmation of a successful command
+func (c *Context) Message(format string, a ...any) {
+	c.print([]string{"message"}, []any{fmt.Sprintf(format, a...)})
+}
+
+// Content prints the content of a file
+func (c *Context) Content(content []byte) {
+	switch c.Format {
+	case FormatText, FormatTable:
+		c.Out.Write(content)
+		// Keep the prompt on its own line
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			fmt.Fprintln(c.Out)
+		}
+	default:
+		c.print([]string{"content"}, []any{string(content)})
+	}
+}
+
+// List prints a listing
+func (c *Context) List(listing Listing) {
+	switch c.Format {
+	case FormatText:
+		if len(listing.Rows) == 0 && listing.Empty != "" {
+			fmt.Fprintln(c.Out, listing.Empty)
+			return
+		}
+		for _, row := range listing.Rows {
+			fields := make([]string, len(row))
+			for i, value := range row {
+				fields[i] = textValue(value)
+			}
+			fmt.Fprintln(c.Out, strings.Join(fields, " "))
+		}
+	case FormatJSON:
+		var b bytes.Buffer
+		b.WriteByte('[')
+		for i, row := range listing.Rows {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSONObject(&b, listing.Columns, row)
+		}
+		b.WriteString("]\n")
+		c.Out.Write(b.Bytes())
+	default:
+		c.table(listing.Columns, listing.Rows)
+	}
+}
+
+// print prints a single record, as a line in the text and table formats
+func (c *Context) print(columns []string, row []any) {
+	switch c.Format {
+	case FormatText, FormatTable:
+		fmt.Fprintln(c.Out, textValue(row[0]))
+	case FormatJSON:
+		var b bytes.Buffer
+		writeJSONObject(&b, columns, row)
+		b.WriteByte('\n')
+		c.Out.Write(b.Bytes())
+	default:
+		c.table(columns, [][]any{row})
+	}
+}
+
+// table prints rows with a header in the CSV, TSV or table format
+func (c *Context) table(columns []string, rows [][]any) {
+	if c.Format == FormatTable {
+		w := tabwriter.NewWriter(c.Out, 0, 0, 2, ' ', 0)
+		header := make([]string, len(columns))
+		for i, column := range columns {
+			header[i] = strings.ToUpper(column)
+		}
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fields := make([]string, len(row))
+			for i, value := range row {
+				// Keep every row on a single line
+				fields[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(textValue(value))
+			}
+			fmt.Fprintln(w, strings.Join(fields, "\t"))
+		}
+		w.Flush()
+		return
+	}
+
+	w := csv.NewWriter(c.Out)
+	if c.Format == FormatTSV {
+		w.Comma = '\t'
+	}
+	w.Write(columns)
+	for _, row := range rows {
+		fields := make([]string, len(row))
+		for i, value := range row {
+			fields[i] = formattedValue(value)
+		}
+		w.Write(fields)
+	}
+	w.Flush()
+}
+
+// PrintError prints the error of a command in the output format. The JSON,
+// CSV and TSV formats include the code of a service error.
+func (d *Dispatcher) PrintError(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ctx := &Context{Out: d.out, Format: d.Output}
+	columns, row := []string{"error"}, []any{err.Error()}
+	var serviceErr *Error
+	if errors.As(err, &serviceErr) {
+		columns, row = append(columns, "code"), append(row, int64(serviceErr.Code))
+	}
+	ctx.print(columns, row)
+}
+
+// writeJSONObject writes the values as a JSON object keyed by the columns
+// in their order
+func writeJSONObject(b *bytes.Buffer, columns []string, row []any) {
+	b.WriteByte('{')
+	for i, column := range columns {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(column)
+		b.Write(key)
+		b.WriteByte(':')
+		value := row[i]
+		if t, ok := value.(time.Time); ok {
+			value = t.Format(time.RFC3339)
+		}
+		data, _ := json.Marshal(value)
+		b.Write(data)
+	}
+	b.WriteByte('}')
+}
+
+func textValue(value any) string {
+	if t, ok := value.(time.Time); ok {
+		return t.Format(textTime)
+	}
+	return fmt.Sprint(value)
+}
+
+func formattedValue(value any) string {
+	if t, ok := value.(time.Time); ok {
+		return t.Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"virtual-file-system/internal/storage"
+)
+
+func TestDispatcher_Output(t *testing.T) {
+	createdAt := time.Date(2023, 7, 1, 8, 30, 0, 0, time.UTC)
+	commands := [][]string{
+		{"register", "dalaoqi"},
+		{"create-folder", "dalaoqi", "docs", "the docs, \"drafts\""},
+		{"create-file", "dalaoqi", "docs", "notes", "meeting notes"},
+		{"write-file", "dalaoqi", "docs", "notes", "hello"},
+		{"list-files", "dalaoqi", "docs"},
+		{"list-folders", "dalaoqi"},
+		{"list-folders", "dalaoqi", "docs"},
+		{"cat-file", "dalaoqi", "docs", "notes"},
+		{"create-folder", "dalaoqi", "docs"},
+	}
+
+	testCases := []struct {
+		format   Format
+		expected string
+	}{
+		{
+			format: FormatText,
+			expected: "Add dalaoqi successfully.\n" +
+				"Create docs successfully.\n" +
+				"Create notes in dalaoqi/docs successfully.\n" +
+				"Write notes in dalaoqi/docs successfully.\n" +
+				"notes meeting notes 5 2023-07-01 08:30:00 docs dalaoqi\n" +
+				"docs the docs, \"drafts\" 2023-07-01 08:30:00 dalaoqi\n" +
+				"Warning: The docs doesn't have any folders.\n" +
+				"hello\n" +
+				"Error: The docs has already existed.\n",
+		},
+		{
+			format: FormatJSON,
+			expected: `{"message":"Add dalaoqi successfully."}` + "\n" +
+				`{"message":"Create docs successfully."}` + "\n" +
+				`{"message":"Create notes in dalaoqi/docs successfully."}` + "\n" +
+				`{"message":"Write notes in dalaoqi/docs successfully."}` + "\n" +
+				`[{"name":"notes","description":"meeting notes","size":5,"createdAt":"2023-07-01T08:30:00Z","folder":"docs","user":"dalaoqi"}]` + "\n" +
+				`[{"name":"docs","description":"the docs, \"drafts\"","createdAt":"2023-07-01T08:30:00Z","user":"dalaoqi"}]` + "\n" +
+				`[]` + "\n" +
+				`{"content":"hello"}` + "\n" +
+				`{"error":"Error: The docs has already existed.","code":4}` + "\n",
+		},
+		{
+			format: FormatCSV,
+			expected: "message\nAdd dalaoqi successfully.\n" +
+				"message\nCreate docs successfully.\n" +
+				"message\nCreate notes in dalaoqi/docs successfully.\n" +
+				"message\nWrite notes in dalaoqi/docs successfully.\n" +
+				"name,description,size,createdAt,folder,user\nnotes,meeting notes,5,2023-07-01T08:30:00Z,docs,dalaoqi\n" +
+				"name,description,createdAt,user\ndocs,\"the docs, \"\"drafts\"\"\",2023-07-01T08:30:00Z,dalaoqi\n" +
+				"name,description,createdAt,user\n" +
+				"content\nhello\n" +
+				"error,code\nError: The docs has already existed.,4\n",
+		},
+		{
+			format: FormatTSV,
+			expected: "message\nAdd dalaoqi successfully.\n" +
+				"message\nCreate docs successfully.\n" +
+				"message\nCreate notes in dalaoqi/docs successfully.\n" +
+				"message\nWrite notes in dalaoqi/docs successfully.\n" +
+				"name\tdescription\tsize\tcreatedAt\tfolder\tuser\nnotes\tmeeting notes\t5\t2023-07-01T08:30:00Z\tdocs\tdalaoqi\n" +
+				"name\tdescription\tcreatedAt\tuser\ndocs\t\"the docs, \"\"drafts\"\"\"\t2023-07-01T08:30:00Z\tdalaoqi\n" +
+				"name\tdescription\tcreatedAt\tuser\n" +
+				"content\nhello\n" +
+				"error\tcode\nError: The docs has already existed.\t4\n",
+		},
+		{
+			format: FormatTable,
+			expected: "Add dalaoqi successfully.\n" +
+				"Create docs successfully.\n" +
+				"Create notes in dalaoqi/docs successfully.\n" +
+				"Write notes in dalaoqi/docs successfully.\n" +
+				"NAME   DESCRIPTION    SIZE  CREATEDAT            FOLDER  USER\n" +
+				"notes  meeting notes  5     2023-07-01 08:30:00  docs    dalaoqi\n" +
+				"NAME  DESCRIPTION         CREATEDAT            USER\n" +
+				"docs  the docs, \"drafts\"  2023-07-01 08:30:00  dalaoqi\n" +
+				"NAME  DESCRIPTION  CREATEDAT  USER\n" +
+				"hello\n" +
+				"Error: The docs has already existed.\n",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(string(test.format), func(t *testing.T) {
+			var out bytes.Buffer
+			d := NewDispatcher(storage.NewMemoryStore(nil))
+			d.out = &out
+			d.Output = test.format
+			d.userService.setClock(func() time.Time { return createdAt })
+			for _, args := range commands {
+				if err := d.Exec(args); err != nil {
+					d.PrintError(err)
+				}
+			}
+			if out.String() != test.expected {
+				t.Errorf("Output = %q, expected: %q", out.String(), test.expected)
+			}
+		})
+	}
+}
+
+func TestDispatcher_SetOutput(t *testing.T) {
+	var out bytes.Buffer
+	d := NewDispatcher(storage.NewMemoryStore(nil))
+	d.out = &out
+
+	testCases := []struct {
+		args          []string
+		expectedError string
+		expected      Format
+	}{
+		{args: []string{"set", "output", "json"}, expected: FormatJSON},
+		{args: []string{"set", "output", "xml"}, expectedError: "Error: The output format xml is invalid.", expected: FormatJSON},
+		{args: []string{"set", "color", "on"}, expectedError: "Error: The setting color doesn't exist.", expected: FormatJSON},
+		{args: []string{"set", "output", "table"}, expected: FormatTable},
+	}
+	for _, test := range testCases {
+		err := d.Exec(test.args)
+		if (err == nil && test.expectedError != "") || (err != nil && err.Error() != test.expectedError) {
+			t.Errorf("Dispatcher.Exec(%q) has error: %v, expected: %s", test.args, err, test.expectedError)
+		}
+		if d.Output != test.expected {
+			t.Errorf("Output after %q = %s, expected: %s", test.args, d.Output, test.expected)
+		}
+	}
+	// The confirmation is printed in the new format
+	if !strings.HasPrefix(out.String(), `{"message":"Set output to json successfully."}`+"\n") {
+		t.Errorf("Output = %q, expected the confirmation in JSON", out.String())
+	}
+}
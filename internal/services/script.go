@@ -0,0 +1,109 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"virtual-file-system/internal/utils"
+)
+
+// maxScriptLineSize is the longest line RunScript reads, so that a command
+// or a content line given inline may be much longer than the 64 KiB of
+// bufio.Scanner by default
+const maxScriptLineSize = 64 << 20
+
+// ScriptOptions controls how RunScript runs the commands it reads
+type ScriptOptions struct {
+	// Name prefixes the errors with the name and the line of the failed
+	// command, e.g. "setup.vfs:3: ". Errors aren't prefixed without a name.
+	Name string
+	// Prompt is printed before reading every command
+	Prompt string
+	// StopOnError stops at the first failed command instead of going on
+	StopOnError bool
+	// Comments strips a # starting an argument outside of quotes and the
+	// rest of the line, like in a shell script. Without it, only the lines
+	// starting with # are comments.
+	Comments bool
+}
+
+// Prompter is implemented by the readers of RunScript that show the prompt
+// themselves, like a line editor. RunScript sets the prompt before reading a
+// command and clears it before reading the lines continuing the command or
+// giving its content.
+type Prompter interface {
+	SetPrompt(prompt string)
+}
+
+// RunScript runs the commands read from r, one per line, and prints their
+// errors. Blank lines and lines starting with # are skipped, see Comments for
+// the comments ending a line, and a line ending with a backslash is continued
+// on the next line. The content of write-file and append-file is read from
+// the following lines. It returns the number of failed commands.
+func (d *Dispatcher) RunScript(r io.Reader, options ScriptOptions) (int, error) {
+	// line is the number of the last line read, the content lines included
+	line := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxScriptLineSize)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			line++
+		}
+		return advance, token, err
+	})
+	d.mu.Lock()
+	d.Input = scanner
+	d.mu.Unlock()
+
+	prompter, _ := r.(Prompter)
+	failures := 0
+	for {
+		if prompter != nil {
+			prompter.SetPrompt(options.Prompt)
+		} else {
+			fmt.Fprint(d.out, options.Prompt)
+		}
+		if !scanner.Scan() {
+			break
+		}
+		if prompter != nil {
+			prompter.SetPrompt("")
+		}
+		start := line
+		text := scanner.Text()
+		for continued(text) && scanner.Scan() {
+			text = text[:len(text)-1] + scanner.Text()
+		}
+		if strings.HasPrefix(strings.TrimSpace(text), "#") {
+			continue
+		}
+		if options.Comments {
+			text = utils.StripComment(text)
+		}
+		args, err := utils.SplitArguments(text)
+		if err == nil {
+			err = d.Exec(args)
+		}
+		if err == nil {
+			continue
+		}
+		failures++
+		if options.Name != "" {
+			err = fmt.Errorf("%s:%d: %w", options.Name, start, err)
+		}
+		d.PrintError(err)
+		if options.StopOnError {
+			break
+		}
+	}
+	return failures, scanner.Err()
+}
+
+// continued reports whether the line ends with a backslash that isn't
+// escaped by another one
+func continued(line string) bool {
+	backslashes := len(line) - len(strings.TrimRight(line, `\`))
+	return backslashes%2 == 1
+}
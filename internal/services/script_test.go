@@ -0,0 +1,199 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"virtual-file-system/internal/storage"
+)
+
+func TestDispatcher_RunScript(t *testing.T) {
+	script := `# Set up the docs
+register dalaoqi
+
+create-folder dalaoqi docs \
+  "the docs"
+  # An indented comment
+create-file dalaoqi docs notes
+write-file dalaoqi docs notes
+hello
+EOF
+register dalaoqi
+create-file dalaoqi docs "notes
+cat-file dalaoqi docs notes
+`
+	testCases := []struct {
+		name             string
+		options          ScriptOptions
+		expectedFailures int
+		expectedOutput   string
+	}{
+		{
+			name:             "Go on after errors",
+			options:          ScriptOptions{Name: "setup.vfs"},
+			expectedFailures: 2,
+			expectedOutput: "Add dalaoqi successfully.\n" +
+				"Create docs successfully.\n" +
+				"Create notes in dalaoqi/docs successfully.\n" +
+				"Write notes in dalaoqi/docs successfully.\n" +
+				"setup.vfs:11: Error: The dalaoqi has already existed.\n" +
+				"setup.vfs:12: Error: The arguments have an unterminated quote.\n" +
+				"hello\n",
+		},
+		{
+			name:             "Stop on error",
+			options:          ScriptOptions{Name: "setup.vfs", StopOnError: true},
+			expectedFailures: 1,
+			expectedOutput: "Add dalaoqi successfully.\n" +
+				"Create docs successfully.\n" +
+				"Create notes in dalaoqi/docs successfully.\n" +
+				"Write notes in dalaoqi/docs successfully.\n" +
+				"setup.vfs:11: Error: The dalaoqi has already existed.\n",
+		},
+		{
+			name:             "Prompt without a name",
+			options:          ScriptOptions{Prompt: "# "},
+			expectedFailures: 2,
+			expectedOutput: "# # Add dalaoqi successfully.\n" +
+				"# # Create docs successfully.\n" +
+				"# # Create notes in dalaoqi/docs successfully.\n" +
+				"# Write notes in dalaoqi/docs successfully.\n" +
+				"# Error: The dalaoqi has already existed.\n" +
+				"# Error: The arguments have an unterminated quote.\n" +
+				"# hello\n" +
+				"# ",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			d := NewDispatcher(storage.NewMemoryStore(nil))
+			d.out = &out
+			failures, err := d.RunScript(strings.NewReader(script), test.options)
+			if err != nil {
+				t.Fatalf("Dispatcher.RunScript() has error: %s", err)
+			}
+			if failures != test.expectedFailures {
+				t.Errorf("Dispatcher.RunScript() = %d failures, expected: %d", failures, test.expectedFailures)
+			}
+			if out.String() != test.expectedOutput {
+				t.Errorf("Output = %q, expected: %q", out.String(), test.expectedOutput)
+			}
+		})
+	}
+}
+
+func TestDispatcher_RunScriptComments(t *testing.T) {
+	script := "register dalaoqi  # the owner\n" +
+		"create-folder dalaoqi docs#1 \"#1\"\n"
+	testCases := []struct {
+		name           string
+		options        ScriptOptions
+		expectedOutput string
+	}{
+		{
+			name:    "Comments",
+			options: ScriptOptions{Comments: true},
+			expectedOutput: "Add dalaoqi successfully.\n" +
+				"Create docs#1 successfully.\n",
+		},
+		{
+			name:    "Without comments",
+			options: ScriptOptions{},
+			expectedOutput: "Error: Too many arguments\n" +
+				"Usage: register [username]\n" +
+				"Error: The dalaoqi doesn't exist.\n",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			d := NewDispatcher(storage.NewMemoryStore(nil))
+			d.out = &out
+			if _, err := d.RunScript(strings.NewReader(script), test.options); err != nil {
+				t.Fatalf("Dispatcher.RunScript() has error: %s", err)
+			}
+			if out.String() != test.expectedOutput {
+				t.Errorf("Output = %q, expected: %q", out.String(), test.expectedOutput)
+			}
+		})
+	}
+}
+
+func TestDispatcher_RunScriptLongLines(t *testing.T) {
+	inline := strings.Repeat("a", 100<<10)
+	lines := strings.Repeat("b", 100<<10)
+	script := "register dalaoqi\n" +
+		"create-folder dalaoqi docs\n" +
+		"create-file dalaoqi docs inline\n" +
+		"write-file dalaoqi docs inline " + inline + "\n" +
+		"create-file dalaoqi docs lines\n" +
+		"write-file dalaoqi docs lines\n" + lines + "\n" + EOFMarker + "\n"
+
+	d := NewDispatcher(storage.NewMemoryStore(nil))
+	d.out = io.Discard
+	failures, err := d.RunScript(strings.NewReader(script), ScriptOptions{})
+	if err != nil || failures != 0 {
+		t.Fatalf("Dispatcher.RunScript() = %d failures, %v, expected none", failures, err)
+	}
+	for name, expected := range map[string]string{"inline": inline, "lines": lines + "\n"} {
+		content, err := d.fileService.ReadFile("dalaoqi", "docs", name)
+		if err != nil || string(content) != expected {
+			t.Errorf("ReadFile(%s) has %d bytes, %v, expected %d", name, len(content), err, len(expected))
+		}
+	}
+}
+
+// promptedReader returns one line per read and records the prompt it was
+// read with, like a line editor
+type promptedReader struct {
+	lines   []string
+	prompt  string
+	prompts []string
+}
+
+func (r *promptedReader) SetPrompt(prompt string) {
+	r.prompt = prompt
+}
+
+func (r *promptedReader) Read(p []byte) (int, error) {
+	if len(r.lines) == 0 {
+		return 0, io.EOF
+	}
+	r.prompts = append(r.prompts, r.prompt)
+	n := copy(p, r.lines[0]+"\n")
+	r.lines = r.lines[1:]
+	return n, nil
+}
+
+func TestDispatcher_RunScriptPrompter(t *testing.T) {
+	var out bytes.Buffer
+	d := NewDispatcher(storage.NewMemoryStore(nil))
+	d.out = &out
+	r := &promptedReader{lines: []string{
+		"register dalaoqi",
+		`create-folder dalaoqi \`,
+		"docs",
+		"create-file dalaoqi docs notes",
+		"write-file dalaoqi docs notes",
+		"hello",
+		EOFMarker,
+		"cat dalaoqi docs notes",
+	}}
+	if _, err := d.RunScript(r, ScriptOptions{Prompt: "# "}); err != nil {
+		t.Fatalf("Dispatcher.RunScript() has error: %s", err)
+	}
+
+	// The reader shows the prompt of the commands instead of the output
+	expected := []string{"# ", "# ", "", "# ", "# ", "", "", "# "}
+	if !reflect.DeepEqual(r.prompts, expected) {
+		t.Errorf("Prompts = %q, expected: %q", r.prompts, expected)
+	}
+	if strings.Contains(out.String(), "# ") {
+		t.Errorf("Output = %q, expected no prompt", out.String())
+	}
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"sort"
+	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/storage"
+	"virtual-file-system/internal/utils"
+)
+
+// CreateSnapshot freezes the folders and files of the user under the label.
+// The snapshot shares every folder and content that didn't change with the
+// snapshots before it, and only the files changed since the latest one are
+// read, see storage.FreezeTree.
+func (s *UserService) CreateSnapshot(userName, label string) error {
+	userKey := utils.NameKey(userName)
+	labelKey := utils.NameKey(label)
+
+	return s.Store.Update(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+
+		// Check if the label is valid and free
+		name, err := s.NamePolicy.Normalize(label)
+		if err != nil {
+			return invalidName(label, err)
+		}
+		if _, err := tx.GetTreeSnapshot(userKey, labelKey); err == nil {
+			return &Error{Code: CodeSnapshotExists, Name: label}
+		}
+
+		snapshots, err := tx.ListTreeSnapshots(userKey)
+		if err != nil {
+			return err
+		}
+		// Only read the files changed since the latest snapshot
+		var latest models.TreeSnapshot
+		for _, snapshot := range snapshots {
+			if latest.Root == "" || snapshot.CreatedAt.After(latest.CreatedAt) {
+				latest = snapshot
+			}
+		}
+		root, err := storage.FreezeTree(tx, userKey, latest.Root)
+		if err != nil {
+			return err
+		}
+		return tx.PutTreeSnapshot(userKey, labelKey, models.TreeSnapshot{Label: name, CreatedAt: s.now(), Root: root})
+	})
+}
+
+// GetSnapshots lists the snapshots of the user in the order they were
+// created
+func (s *UserService) GetSnapshots(userName string) ([]models.TreeSnapshot, error) {
+	userKey := utils.NameKey(userName)
+
+	var snapshots []models.TreeSnapshot
+	err := s.Store.View(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+
+		var err error
+		snapshots, err = tx.ListTreeSnapshots(userKey)
+		return err
+	})
+	if err != nil {
+		return []models.TreeSnapshot{}, err
+	}
+
+	// The store lists the snapshots by label
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+// DiffSnapshots lists the folders and files added, removed or modified from
+// the snapshot labelled label to the one labelled otherLabel
+func (s *UserService) DiffSnapshots(userName, label, otherLabel string) ([]storage.TreeChange, error) {
+	userKey := utils.NameKey(userName)
+
+	var changes []storage.TreeChange
+	err := s.Store.View(func(tx storage.Tx) error {
+		// Check if the user and both snapshots exist
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+		from, err := getSnapshot(tx, userKey, label)
+		if err != nil {
+			return err
+		}
+		to, err := getSnapshot(tx, userKey, otherLabel)
+		if err != nil {
+			return err
+		}
+
+		changes, err = storage.DiffTrees(tx, userKey, from.Root, to.Root)
+		return err
+	})
+	if err != nil {
+		return []storage.TreeChange{}, err
+	}
+	return changes, nil
+}
+
+// RestoreSnapshot replaces the folders and files of the user with the ones
+// frozen in the snapshot. The trash and the snapshots are kept as they are.
+func (s *UserService) RestoreSnapshot(userName, label string) error {
+	userKey := utils.NameKey(userName)
+
+	return s.Store.Update(func(tx storage.Tx) error {
+		// Check if the user and the snapshot exist
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+		snapshot, err := getSnapshot(tx, userKey, label)
+		if err != nil {
+			return err
+		}
+		return storage.ThawTree(tx, userKey, snapshot.Root)
+	})
+}
+
+// DeleteSnapshot deletes the snapshot along with the folders and contents no
+// other snapshot of the user shares
+func (s *UserService) DeleteSnapshot(userName, label string) error {
+	userKey := utils.NameKey(userName)
+
+	return s.Store.Update(func(tx storage.Tx) error {
+		// Check if the user and the snapshot exist
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+		if _, err := getSnapshot(tx, userKey, label); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteTreeSnapshot(userKey, utils.NameKey(label)); err != nil {
+			return err
+		}
+		return storage.CollectObjects(tx, userKey)
+	})
+}
+
+// getSnapshot returns the snapshot of the user labelled label
+func getSnapshot(tx storage.Tx, userKey, label string) (models.TreeSnapshot, error) {
+	snapshot, err := tx.GetTreeSnapshot(userKey, utils.NameKey(label))
+	if err != nil {
+		return models.TreeSnapshot{}, &Error{Code: CodeSnapshotNotFound, Name: label}
+	}
+	return snapshot, nil
+}
+
+// viewAt returns tx, or a read-only view of the folders and files of the
+// user as they were in the snapshot labelled at unless it is empty
+func viewAt(tx storage.Tx, userKey, at string) (storage.Tx, error) {
+	if at == "" {
+		return tx, nil
+	}
+	snapshot, err := getSnapshot(tx, userKey, at)
+	if err != nil {
+		return nil, err
+	}
+	return storage.TreeView(tx, userKey, snapshot.Root), nil
+}
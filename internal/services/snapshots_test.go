@@ -0,0 +1,165 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+	"virtual-file-system/internal/storage"
+)
+
+func TestUserService_Snapshots(t *testing.T) {
+	now := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	userService := NewUserService(storage.NewMemoryStore(nil))
+	userService.Clock = func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	folderService := NewFolderService(userService)
+	fileService := NewFileService(userService, folderService)
+
+	for _, step := range []func() error{
+		func() error { return userService.Register("dalaoqi") },
+		func() error { return folderService.CreateFolderAll("dalaoqi", "projects/2024", "") },
+		func() error { return folderService.CreateFolder("dalaoqi", "docs", "the docs") },
+		func() error { return fileService.CreateFile("dalaoqi", "docs", "notes", "") },
+		func() error { return fileService.WriteFile("dalaoqi", "docs", "notes", []byte("hello")) },
+		func() error { return userService.CreateSnapshot("dalaoqi", "Before") },
+		func() error { return fileService.AppendFile("dalaoqi", "docs", "notes", []byte(" world")) },
+		func() error { return fileService.CreateFile("dalaoqi", "docs", "todo", "") },
+		func() error { return folderService.DeleteFolder("dalaoqi", "projects", false) },
+		func() error { return userService.CreateSnapshot("dalaoqi", "after") },
+	} {
+		if err := step(); err != nil {
+			t.Fatalf("Setup has error: %s", err)
+		}
+	}
+
+	testCases := []struct {
+		name          string
+		err           error
+		expectedError string
+	}{
+		{
+			name:          "Create a duplicated snapshot",
+			err:           userService.CreateSnapshot("dalaoqi", "BEFORE"),
+			expectedError: "Error: The snapshot BEFORE has already existed.",
+		},
+		{
+			name:          "Create a snapshot with invalid chars",
+			err:           userService.CreateSnapshot("dalaoqi", "a/b"),
+			expectedError: "Error: The a/b contains the invalid char '/' at position 2.",
+		},
+		{
+			name:          "Create a snapshot for a non-existing user",
+			err:           userService.CreateSnapshot("nobody", "before"),
+			expectedError: "Error: The nobody doesn't exist.",
+		},
+		{
+			name:          "Restore a missing snapshot",
+			err:           userService.RestoreSnapshot("dalaoqi", "missing"),
+			expectedError: "Error: The snapshot missing doesn't exist.",
+		},
+		{
+			name: "List the folders of a missing snapshot",
+			err: func() error {
+				_, err := folderService.GetSubFoldersAt("dalaoqi", "missing", "", "--sort-name", "asc")
+				return err
+			}(),
+			expectedError: "Error: The snapshot missing doesn't exist.",
+		},
+		{
+			name: "List the files of a folder missing from the snapshot",
+			err: func() error {
+				_, err := fileService.GetFilesAt("dalaoqi", "after", "projects", "--sort-name", "asc")
+				return err
+			}(),
+			expectedError: "Error: The projects doesn't exist.",
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			if test.err == nil || test.err.Error() != test.expectedError {
+				t.Errorf("Error = %v, expected: %s", test.err, test.expectedError)
+			}
+		})
+	}
+	if err := userService.RestoreSnapshot("dalaoqi", "missing"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("RestoreSnapshot() has error: %v, expected ErrSnapshotNotFound", err)
+	}
+
+	snapshots, err := userService.GetSnapshots("dalaoqi")
+	if err != nil || len(snapshots) != 2 || snapshots[0].Label != "Before" || snapshots[1].Label != "after" {
+		t.Errorf("GetSnapshots() = %v, %v, expected Before and after", snapshots, err)
+	}
+
+	// The snapshots are listed as they were, the tree as it is
+	folders, err := folderService.GetSubFoldersAt("dalaoqi", "before", "", "--sort-name", "asc")
+	if err != nil || len(folders) != 2 || folders[1].Name != "projects" {
+		t.Errorf("GetSubFoldersAt() = %v, %v, expected docs and projects", folders, err)
+	}
+	folders, _ = folderService.GetSubFolders("dalaoqi", "", "--sort-name", "asc")
+	if len(folders) != 1 || folders[0].Name != "docs" {
+		t.Errorf("GetSubFolders() = %v, expected docs", folders)
+	}
+	files, err := fileService.GetFilesAt("dalaoqi", "Before", "docs", "--sort-size", "desc")
+	if err != nil || len(files) != 1 || files[0].Name != "notes" || files[0].Size != 5 {
+		t.Errorf("GetFilesAt() = %v, %v, expected notes of 5 bytes", files, err)
+	}
+
+	changes, err := userService.DiffSnapshots("dalaoqi", "before", "after")
+	expected := []storage.TreeChange{
+		{Change: storage.TreeModified, Path: "docs/notes"},
+		{Change: storage.TreeAdded, Path: "docs/todo"},
+		{Change: storage.TreeRemoved, Path: "projects", Folder: true},
+	}
+	if err != nil || !reflect.DeepEqual(changes, expected) {
+		t.Errorf("DiffSnapshots() = %v, %v, expected %v", changes, err, expected)
+	}
+
+	// Restoring keeps the trash and the snapshots
+	if err := userService.RestoreSnapshot("dalaoqi", "before"); err != nil {
+		t.Fatalf("RestoreSnapshot() has error: %s", err)
+	}
+	content, err := fileService.ReadFile("dalaoqi", "docs", "notes")
+	if err != nil || string(content) != "hello" {
+		t.Errorf("ReadFile() after RestoreSnapshot() = %q, %v, expected hello", content, err)
+	}
+	if fileService.Exist("dalaoqi", "docs", "todo") || !folderService.Exist("dalaoqi", "projects/2024") {
+		t.Errorf("RestoreSnapshot() didn't bring the tree back to the snapshot")
+	}
+	if items, _ := userService.GetTrash("dalaoqi"); len(items) != 1 {
+		t.Errorf("GetTrash() after RestoreSnapshot() = %v, expected the deleted projects", items)
+	}
+
+	// The snapshots follow a renamed user
+	if err := userService.RenameUser("dalaoqi", "laoqi"); err != nil {
+		t.Fatalf("RenameUser() has error: %s", err)
+	}
+	if changes, err := userService.DiffSnapshots("laoqi", "before", "after"); err != nil || len(changes) != 3 {
+		t.Errorf("DiffSnapshots() after RenameUser() = %v, %v, expected 3 changes", changes, err)
+	}
+
+	// Deleting the snapshots frees the objects only they refer to
+	objects := func() int {
+		var hashes []string
+		userService.Store.View(func(tx storage.Tx) error {
+			hashes, _ = tx.ListObjects("laoqi")
+			return nil
+		})
+		return len(hashes)
+	}
+	frozen := objects()
+	if err := userService.DeleteSnapshot("laoqi", "after"); err != nil {
+		t.Fatalf("DeleteSnapshot() has error: %s", err)
+	}
+	if left := objects(); left == 0 || left >= frozen {
+		t.Errorf("DeleteSnapshot() kept %d of %d objects, expected the ones of before", left, frozen)
+	}
+	if err := userService.DeleteSnapshot("laoqi", "after"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("DeleteSnapshot() has error: %v, expected ErrSnapshotNotFound", err)
+	}
+	if err := userService.DeleteSnapshot("laoqi", "before"); err != nil || objects() != 0 {
+		t.Errorf("DeleteSnapshot() of the last snapshot kept %d objects, %v, expected none", objects(), err)
+	}
+}
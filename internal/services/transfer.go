@@ -0,0 +1,247 @@
+package services
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+	"virtual-file-system/internal/storage"
+	"virtual-file-system/internal/utils"
+)
+
+// ConflictPolicy decides what a move or a copy does when the destination
+// name is already taken
+type ConflictPolicy int
+
+const (
+	// ConflictFail fails with ErrFileExists or ErrFolderExists
+	ConflictFail ConflictPolicy = iota
+	// ConflictOverwrite moves the existing file or folder to the trash of its
+	// user and replaces it
+	ConflictOverwrite
+	// ConflictRename picks the first free name like "notes (1).txt"
+	ConflictRename
+)
+
+// TransferOptions controls how files and folders are moved or copied
+type TransferOptions struct {
+	Conflict ConflictPolicy
+	// ResetMetadata gives the destination new creation and modification
+	// times instead of the ones of the source. The description is kept.
+	ResetMetadata bool
+}
+
+// MoveFile moves the file to another folder, which may belong to another
+// user, and returns its name there. The source is only removed along with
+// the write of the destination, in the same transaction.
+func (s *FileService) MoveFile(userName, folderName, fileName, newUserName, newFolderName string, options TransferOptions) (string, error) {
+	return s.transferFile(userName, folderName, fileName, newUserName, newFolderName, options, true)
+}
+
+// CopyFile copies the file to another folder, which may belong to another
+// user, and returns the name of the copy
+func (s *FileService) CopyFile(userName, folderName, fileName, newUserName, newFolderName string, options TransferOptions) (string, error) {
+	return s.transferFile(userName, folderName, fileName, newUserName, newFolderName, options, false)
+}
+
+func (s *FileService) transferFile(userName, folderName, fileName, newUserName, newFolderName string, options TransferOptions, move bool) (string, error) {
+	newUserKey := utils.NameKey(newUserName)
+
+	var newFileName string
+	err := s.UserService.Store.Update(func(tx storage.Tx) error {
+		ref, file, err := lookupFile(tx, userName, folderName, fileName)
+		if err != nil {
+			return err
+		}
+
+		// Check if the destination user and folder exist
+		if !userExist(tx, newUserKey) {
+			return &Error{Code: CodeUserNotFound, Name: newUserName}
+		}
+		newFolderKey, ok := folderPath(newFolderName)
+		if !ok || !folderExist(tx, newUserKey, newFolderKey) {
+			return &Error{Code: CodeFolderNotFound, Name: newFolderName}
+		}
+
+		// Resolve a name conflict in the destination folder, the replaced file
+		// going to the trash of its user
+		now := s.UserService.now()
+		newFileName = file.Name
+		newFileKey := ref.file
+		if fileExist(tx, newUserKey, newFolderKey, newFileKey) {
+			switch options.Conflict {
+			case ConflictOverwrite:
+				// Overwriting the file with itself leaves it as it is
+				if newUserKey == ref.user && newFolderKey == ref.folder {
+					return nil
+				}
+				// The metadata and the content are replaced below
+				if err := s.UserService.trashFile(tx, newUserKey, newFolderKey, newFileKey, now); err != nil {
+					return err
+				}
+			case ConflictRename:
+				newFileName, err = freeName(s.UserService.NamePolicy, newFileName, func(name string) bool {
+					return fileExist(tx, newUserKey, newFolderKey, utils.NameKey(name))
+				})
+				if err != nil {
+					return err
+				}
+				newFileKey = utils.NameKey(newFileName)
+			default:
+				return &Error{Code: CodeFileExists, Name: fileName, Folder: newFolderName}
+			}
+		}
+
+		// Write the destination before removing the source
+		file.Name = newFileName
+		if options.ResetMetadata {
+			file.CreatedAt, file.ModifiedAt = now, now
+		}
+		if err := tx.PutFile(newUserKey, newFolderKey, newFileKey, file); err != nil {
+			return err
+		}
+		if err := storage.CopyContent(tx, ref.user, ref.folder, ref.file, newUserKey, newFolderKey, newFileKey); err != nil {
+			return err
+		}
+		if err := touchFolder(tx, newUserKey, newFolderKey, now); err != nil {
+			return err
+		}
+		if !move {
+			return nil
+		}
+		if err := tx.DeleteFile(ref.user, ref.folder, ref.file); err != nil {
+			return err
+		}
+		return touchFolder(tx, ref.user, ref.folder, now)
+	})
+	if err != nil {
+		return "", err
+	}
+	return newFileName, nil
+}
+
+// CopyFolder copies the folder at the slash-separated path with its whole
+// subtree to a new path, which may belong to another user, and returns the
+// path of the copy. The parent of the new path must exist.
+func (s *FolderService) CopyFolder(userName, folderName, newUserName, newFolderName string, options TransferOptions) (string, error) {
+	userKey := utils.NameKey(userName)
+	newUserKey := utils.NameKey(newUserName)
+
+	var newFolderPath string
+	err := s.UserService.Store.Update(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+
+		// Check if the folder exists for the user
+		folderKey, ok := folderPath(folderName)
+		if !ok || !folderExist(tx, userKey, folderKey) {
+			return &Error{Code: CodeFolderNotFound, Name: folderName}
+		}
+
+		// Check if the destination user and the parent of the new path exist
+		if !userExist(tx, newUserKey) {
+			return &Error{Code: CodeUserNotFound, Name: newUserName}
+		}
+		newFolderKey, ok := folderPath(newFolderName)
+		if !ok {
+			return invalidPath(newFolderName)
+		}
+		newParentKey, _ := utils.SplitParent(newFolderKey)
+		newParentName, lastName := utils.SplitParent(newFolderName)
+		newName, err := s.UserService.NamePolicy.Normalize(lastName)
+		if err != nil {
+			return invalidName(lastName, err)
+		}
+		if newParentKey != "" && !folderExist(tx, newUserKey, newParentKey) {
+			return &Error{Code: CodeFolderNotFound, Name: newParentName}
+		}
+
+		// The copy can't be made inside the folder, nor replace one of its
+		// parents
+		if newUserKey == userKey {
+			if strings.HasPrefix(newFolderKey, folderKey+utils.PathSeparator) {
+				return &Error{Code: CodeMoveIntoItself, Name: folderName}
+			}
+			if options.Conflict == ConflictOverwrite && strings.HasPrefix(folderKey, newFolderKey+utils.PathSeparator) {
+				return &Error{Code: CodeMoveIntoItself, Name: folderName}
+			}
+		}
+
+		// Resolve a name conflict in the destination parent, the replaced
+		// folder going to the trash of its user
+		now := s.UserService.now()
+		if folderExist(tx, newUserKey, newFolderKey) {
+			switch options.Conflict {
+			case ConflictOverwrite:
+				// Overwriting the folder with itself leaves it as it is
+				if newUserKey == userKey && newFolderKey == folderKey {
+					newFolderPath = utils.JoinPath(newParentName, newName)
+					return nil
+				}
+				if err := s.UserService.trashFolder(tx, newUserKey, newFolderKey, now); err != nil {
+					return err
+				}
+				if err := tx.DeleteFolder(newUserKey, newFolderKey); err != nil {
+					return err
+				}
+			case ConflictRename:
+				newName, err = freeName(s.UserService.NamePolicy, newName, func(name string) bool {
+					return folderExist(tx, newUserKey, utils.JoinPath(newParentKey, utils.NameKey(name)))
+				})
+				if err != nil {
+					return err
+				}
+				newFolderKey = utils.JoinPath(newParentKey, utils.NameKey(newName))
+			default:
+				return &Error{Code: CodeFolderExists, Name: newFolderName}
+			}
+		}
+
+		stamp := time.Time{}
+		if options.ResetMetadata {
+			stamp = now
+		}
+		newFolderPath = utils.JoinPath(newParentName, newName)
+		if err := copyFolder(tx, userKey, folderKey, newUserKey, newFolderKey, newName, stamp); err != nil {
+			return err
+		}
+		return touchFolder(tx, newUserKey, newParentKey, now)
+	})
+	if err != nil {
+		return "", err
+	}
+	return newFolderPath, nil
+}
+
+// freeName returns the name, or the first one like "notes (1).txt" that
+// isn't taken. The extension of the name is kept last, and the base name is
+// shortened when the new name would be too long for the policy. It fails
+// when even the shortest base name leaves the new name invalid.
+func freeName(policy utils.NamePolicy, name string, taken func(name string) bool) (string, error) {
+	if !taken(name) {
+		return name, nil
+	}
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	base := []rune(strings.TrimSuffix(name, ext))
+	for i := 1; ; i++ {
+		suffix := fmt.Sprintf(" (%d)%s", i, ext)
+		short := base
+		for len(short) > 1 && !policy.Fits(string(short)+suffix) {
+			short = short[:len(short)-1]
+		}
+		candidate := strings.TrimRightFunc(string(short), unicode.IsSpace) + suffix
+		normalized, err := policy.Normalize(candidate)
+		if err != nil {
+			return "", invalidName(candidate, err)
+		}
+		if !taken(normalized) {
+			return normalized, nil
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"virtual-file-system/internal/storage"
+	"virtual-file-system/internal/utils"
+)
+
+// newTransferServices returns services with dalaoqi's docs/notes and
+// archive/notes, and david's docs, all created at created
+func newTransferServices(t *testing.T, store storage.Store, created time.Time) (*UserService, *FolderService, *FileService) {
+	t.Helper()
+	userService := NewUserService(store)
+	folderService := NewFolderService(userService)
+	fileService := NewFileService(userService, folderService)
+	userService.setClock(func() time.Time { return created })
+	steps := []error{
+		userService.Register("dalaoqi"),
+		userService.Register("david"),
+		folderService.CreateFolderAll("dalaoqi", "docs/2024", "the docs"),
+		folderService.CreateFolder("dalaoqi", "archive", ""),
+		folderService.CreateFolder("david", "docs", ""),
+		fileService.CreateFile("dalaoqi", "docs", "notes", "meeting notes"),
+		fileService.WriteFile("dalaoqi", "docs", "notes", []byte("hello")),
+		fileService.CreateFile("dalaoqi", "docs/2024", "plan", ""),
+		fileService.CreateFile("dalaoqi", "archive", "notes", "old notes"),
+	}
+	for _, err := range steps {
+		if err != nil {
+			t.Fatalf("Setup has error: %s", err)
+		}
+	}
+	return userService, folderService, fileService
+}
+
+func TestFileService_Transfer(t *testing.T) {
+	created := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	moved := created.Add(time.Hour)
+
+	testCases := []struct {
+		name            string
+		move            bool
+		newUserName     string
+		newFolderName   string
+		options         TransferOptions
+		expectedName    string
+		expectedError   string
+		expectedCreated time.Time
+		expectedTrash   int
+	}{
+		{
+			name:            "Move within the user",
+			move:            true,
+			newUserName:     "dalaoqi",
+			newFolderName:   "docs/2024",
+			expectedName:    "notes",
+			expectedCreated: created,
+		},
+		{
+			name:            "Move to another user",
+			move:            true,
+			newUserName:     "David",
+			newFolderName:   "docs",
+			expectedName:    "notes",
+			expectedCreated: created,
+		},
+		{
+			name:            "Copy with new timestamps",
+			newUserName:     "david",
+			newFolderName:   "docs",
+			options:         TransferOptions{ResetMetadata: true},
+			expectedName:    "notes",
+			expectedCreated: moved,
+		},
+		{
+			name:          "Move onto an existing file",
+			move:          true,
+			newUserName:   "dalaoqi",
+			newFolderName: "archive",
+			expectedError: "Error: The notes has already existed in the archive.",
+		},
+		{
+			name:            "Move over an existing file",
+			move:            true,
+			newUserName:     "dalaoqi",
+			newFolderName:   "archive",
+			options:         TransferOptions{Conflict: ConflictOverwrite},
+			expectedName:    "notes",
+			expectedCreated: created,
+			expectedTrash:   1,
+		},
+		{
+			name:            "Copy next to an existing file",
+			newUserName:     "dalaoqi",
+			newFolderName:   "archive",
+			options:         TransferOptions{Conflict: ConflictRename},
+			expectedName:    "notes (1)",
+			expectedCreated: created,
+		},
+		{
+			name:            "Copy in the same folder",
+			newUserName:     "dalaoqi",
+			newFolderName:   "docs",
+			options:         TransferOptions{Conflict: ConflictRename},
+			expectedName:    "notes (1)",
+			expectedCreated: created,
+		},
+		{
+			name:          "Move to a missing user",
+			move:          true,
+			newUserName:   "nobody",
+			newFolderName: "docs",
+			expectedError: "Error: The nobody doesn't exist.",
+		},
+		{
+			name:          "Copy to a missing folder",
+			newUserName:   "david",
+			newFolderName: "music",
+			expectedError: "Error: The music doesn't exist.",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			userService, _, fileService := newTransferServices(t, storage.NewMemoryStore(nil), created)
+			userService.setClock(func() time.Time { return moved })
+
+			transfer := fileService.CopyFile
+			if test.move {
+				transfer = fileService.MoveFile
+			}
+			name, err := transfer("dalaoqi", "docs", "notes", test.newUserName, test.newFolderName, test.options)
+			if (err == nil && test.expectedError != "") || (err != nil && err.Error() != test.expectedError) {
+				t.Fatalf("Transfer has error: %v, expected: %s", err, test.expectedError)
+			}
+
+			// A failed transfer leaves the source as it was
+			sourceExists := fileService.Exist("dalaoqi", "docs", "notes")
+			if sourceExists != (err != nil || !test.move || (test.newUserName == "dalaoqi" && test.newFolderName == "docs")) {
+				t.Errorf("Source exists = %v after the transfer", sourceExists)
+			}
+			if err != nil {
+				return
+			}
+
+			if name != test.expectedName {
+				t.Errorf("Transfer = %s, expected: %s", name, test.expectedName)
+			}
+			content, err := fileService.ReadFile(test.newUserName, test.newFolderName, name)
+			if err != nil || string(content) != "hello" {
+				t.Errorf("ReadFile() = %q, %v, expected: hello", content, err)
+			}
+			files, _ := fileService.GetFiles(test.newUserName, test.newFolderName, "--sort-name", "asc")
+			for _, file := range files {
+				if file.Name == name && (file.Description != "meeting notes" || !file.CreatedAt.Equal(test.expectedCreated)) {
+					t.Errorf("Destination file = %+v, expected created at %s", file, test.expectedCreated)
+				}
+			}
+
+			// An overwritten file goes to the trash
+			items, _ := userService.GetTrash(test.newUserName)
+			if len(items) != test.expectedTrash || (len(items) == 1 && items[0].File.Description != "old notes") {
+				t.Errorf("GetTrash() = %+v, expected %d items", items, test.expectedTrash)
+			}
+		})
+	}
+}
+
+// faultyStore fails every write of a content chunk for the user
+type faultyStore struct {
+	storage.Store
+	userKey string
+}
+
+func (s faultyStore) Update(fn func(tx storage.Tx) error) error {
+	return s.Store.Update(func(tx storage.Tx) error {
+		return fn(faultyTx{Tx: tx, userKey: s.userKey})
+	})
+}
+
+type faultyTx struct {
+	storage.Tx
+	userKey string
+}
+
+func (tx faultyTx) PutChunk(userKey, folderKey, fileKey string, index int64, data []byte) error {
+	if userKey == tx.userKey {
+		return errors.New("disk full")
+	}
+	return tx.Tx.PutChunk(userKey, folderKey, fileKey, index, data)
+}
+
+func TestFileService_MoveFileAtomic(t *testing.T) {
+	store := &faultyStore{Store: storage.NewMemoryStore(nil)}
+	_, _, fileService := newTransferServices(t, store, time.Now())
+
+	// The source stays when the content can't be written to the destination
+	store.userKey = "david"
+	_, err := fileService.MoveFile("dalaoqi", "docs", "notes", "david", "docs", TransferOptions{})
+	if err == nil || err.Error() != "disk full" {
+		t.Fatalf("MoveFile() has error: %v, expected: disk full", err)
+	}
+	if content, err := fileService.ReadFile("dalaoqi", "docs", "notes"); err != nil || string(content) != "hello" {
+		t.Errorf("ReadFile() of the source = %q, %v, expected: hello", content, err)
+	}
+	if fileService.Exist("david", "docs", "notes") {
+		t.Errorf("The destination exists after a failed move")
+	}
+}
+
+func TestFolderService_CopyFolder(t *testing.T) {
+	created := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	copied := created.Add(time.Hour)
+
+	testCases := []struct {
+		name            string
+		folderName      string
+		newUserName     string
+		newFolderName   string
+		options         TransferOptions
+		expectedPath    string
+		expectedError   string
+		expectedCreated time.Time
+		expectedTrash   int
+	}{
+		{
+			name:            "Copy within the user",
+			folderName:      "docs",
+			newUserName:     "dalaoqi",
+			newFolderName:   "archive/docs",
+			expectedPath:    "archive/docs",
+			expectedCreated: created,
+		},
+		{
+			name:            "Copy to another user with new timestamps",
+			folderName:      "docs",
+			newUserName:     "david",
+			newFolderName:   "backup",
+			options:         TransferOptions{ResetMetadata: true},
+			expectedPath:    "backup",
+			expectedCreated: copied,
+		},
+		{
+			name:          "Copy onto an existing folder",
+			folderName:    "docs",
+			newUserName:   "david",
+			newFolderName: "docs",
+			expectedError: "Error: The docs has already existed.",
+		},
+		{
+			name:            "Copy over an existing folder",
+			folderName:      "docs",
+			newUserName:     "david",
+			newFolderName:   "docs",
+			options:         TransferOptions{Conflict: ConflictOverwrite},
+			expectedPath:    "docs",
+			expectedCreated: created,
+			expectedTrash:   1,
+		},
+		{
+			name:            "Copy next to an existing folder",
+			folderName:      "docs",
+			newUserName:     "dalaoqi",
+			newFolderName:   "docs",
+			options:         TransferOptions{Conflict: ConflictRename},
+			expectedPath:    "docs (1)",
+			expectedCreated: created,
+		},
+		{
+			name:          "Copy into itself",
+			folderName:    "docs",
+			newUserName:   "dalaoqi",
+			newFolderName: "docs/2024/docs",
+			expectedError: "Error: The docs cannot be moved into itself.",
+		},
+		{
+			name:          "Copy over one of its parents",
+			folderName:    "docs/2024",
+			newUserName:   "dalaoqi",
+			newFolderName: "docs",
+			options:       TransferOptions{Conflict: ConflictOverwrite},
+			expectedError: "Error: The docs/2024 cannot be moved into itself.",
+		},
+		{
+			name:          "Copy under a missing parent",
+			folderName:    "docs",
+			newUserName:   "david",
+			newFolderName: "music/docs",
+			expectedError: "Error: The music doesn't exist.",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			userService, folderService, fileService := newTransferServices(t, storage.NewMemoryStore(nil), created)
+			userService.setClock(func() time.Time { return copied })
+
+			path, err := folderService.CopyFolder("dalaoqi", test.folderName, test.newUserName, test.newFolderName, test.options)
+			if (err == nil && test.expectedError != "") || (err != nil && err.Error() != test.expectedError) {
+				t.Fatalf("CopyFolder() has error: %v, expected: %s", err, test.expectedError)
+			}
+			if !fileService.Exist("dalaoqi", "docs", "notes") || !fileService.Exist("dalaoqi", "docs/2024", "plan") {
+				t.Errorf("The source changed")
+			}
+			if err != nil {
+				return
+			}
+
+			// The copy has the whole subtree with its content
+			if path != test.expectedPath {
+				t.Errorf("CopyFolder() = %s, expected: %s", path, test.expectedPath)
+			}
+			if content, err := fileService.ReadFile(test.newUserName, path, "notes"); err != nil || string(content) != "hello" {
+				t.Errorf("ReadFile() = %q, %v, expected: hello", content, err)
+			}
+			files, err := fileService.GetFiles(test.newUserName, path+"/2024", "--sort-name", "asc")
+			if err != nil || len(files) != 1 || files[0].Name != "plan" || !files[0].CreatedAt.Equal(test.expectedCreated) {
+				t.Errorf("GetFiles() of the copied sub-folder = %+v, %v", files, err)
+			}
+
+			// An overwritten folder goes to the trash
+			if items, _ := userService.GetTrash(test.newUserName); len(items) != test.expectedTrash {
+				t.Errorf("GetTrash() = %+v, expected %d items", items, test.expectedTrash)
+			}
+		})
+	}
+}
+
+func TestFreeName(t *testing.T) {
+	testCases := []struct {
+		name          string
+		policy        utils.NamePolicy
+		taken         []string
+		expectedName  string
+		expectedError string
+	}{
+		{
+			name:         "notes.txt",
+			expectedName: "notes.txt",
+		},
+		{
+			name:         "notes.txt",
+			taken:        []string{"notes.txt", "notes (1).txt"},
+			expectedName: "notes (2).txt",
+		},
+		{
+			name:         "notes.txt",
+			policy:       utils.NamePolicy{MaxBytes: 12},
+			taken:        []string{"notes.txt"},
+			expectedName: "note (1).txt",
+		},
+		{
+			name:         "my notes.txt",
+			policy:       utils.NamePolicy{MaxRunes: 11},
+			taken:        []string{"my notes.txt"},
+			expectedName: "my (1).txt",
+		},
+		{
+			name:         "café",
+			policy:       utils.NamePolicy{MaxBytes: 8},
+			taken:        []string{"café", "caf (1)"},
+			expectedName: "caf (2)",
+		},
+		{
+			name:          "a.markdown",
+			policy:        utils.NamePolicy{MaxBytes: 12},
+			taken:         []string{"a.markdown"},
+			expectedError: "Error: The a (1).markdown is 14 bytes long, more than 12.",
+		},
+	}
+
+	for _, test := range testCases {
+		taken := func(name string) bool {
+			for _, other := range test.taken {
+				if name == other {
+					return true
+				}
+			}
+			return false
+		}
+		name, err := freeName(test.policy, test.name, taken)
+		if (err == nil && test.expectedError != "") || (err != nil && err.Error() != test.expectedError) {
+			t.Errorf("freeName(%s) has error: %v, expected: %s", test.name, err, test.expectedError)
+		} else if name != test.expectedName {
+			t.Errorf("freeName(%s) = %s, expected: %s", test.name, name, test.expectedName)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package services
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/storage"
+	"virtual-file-system/internal/utils"
+)
+
+// DefaultTrashRetention is how long deleted folders and files stay in the
+// trash by default
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// GetTrash lists the items in the trash of the user in the order they were
+// deleted, with the metadata of their folder or file only
+func (s *UserService) GetTrash(userName string) ([]models.TrashItem, error) {
+	userKey := utils.NameKey(userName)
+
+	var items []models.TrashItem
+	err := s.Store.View(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+
+		var err error
+		items, err = s.listTrash(tx, userKey, s.now())
+		return err
+	})
+	if err != nil {
+		return []models.TrashItem{}, err
+	}
+	return items, nil
+}
+
+// RestoreTrash puts the item of the trash back where it was deleted from and
+// returns its path there, which may differ from the original one when the
+// conflict policy picks a free name. The folder it was deleted from must
+// exist.
+func (s *UserService) RestoreTrash(userName, id string, conflict ConflictPolicy) (string, error) {
+	userKey := utils.NameKey(userName)
+
+	var restoredPath string
+	err := s.Store.Update(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+
+		// Check if the item is still in the trash
+		now := s.now()
+		if err := s.purgeTrash(tx, userKey, now); err != nil {
+			return err
+		}
+		item, err := tx.GetTrash(userKey, id)
+		if err != nil {
+			return &Error{Code: CodeTrashItemNotFound, Name: id}
+		}
+
+		// Check if the folder it was deleted from exists
+		parentKey := ""
+		if item.Path != "" || item.File != nil {
+			var ok bool
+			parentKey, ok = folderPath(item.Path)
+			if !ok || !folderExist(tx, userKey, parentKey) {
+				return &Error{Code: CodeFolderNotFound, Name: item.Path}
+			}
+		}
+
+		if item.File != nil {
+			restoredPath, err = s.restoreTrashFile(tx, userKey, parentKey, item, conflict, now)
+		} else {
+			restoredPath, err = s.restoreTrashFolder(tx, userKey, parentKey, item, conflict, now)
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteTrash(userKey, id); err != nil {
+			return err
+		}
+		return touchFolder(tx, userKey, parentKey, now)
+	})
+	if err != nil {
+		return "", err
+	}
+	return restoredPath, nil
+}
+
+// EmptyTrash deletes every item in the trash of the user for good
+func (s *UserService) EmptyTrash(userName string) error {
+	userKey := utils.NameKey(userName)
+
+	return s.Store.Update(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+
+		items, err := tx.ListTrash(userKey)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := tx.DeleteTrash(userKey, item.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// restoreTrashFile writes the file of the item back into the folder stored
+// at parentKey and returns its path. A file it overwrites goes to the trash.
+func (s *UserService) restoreTrashFile(tx storage.Tx, userKey, parentKey string, item models.TrashItem, conflict ConflictPolicy, now time.Time) (string, error) {
+	file := *item.File
+	fileKey := utils.NameKey(file.Name)
+	if fileExist(tx, userKey, parentKey, fileKey) {
+		switch conflict {
+		case ConflictOverwrite:
+			// The metadata and the content are replaced below
+			if err := s.trashFile(tx, userKey, parentKey, fileKey, now); err != nil {
+				return "", err
+			}
+		case ConflictRename:
+			var err error
+			file.Name, err = freeName(s.NamePolicy, file.Name, func(name string) bool {
+				return fileExist(tx, userKey, parentKey, utils.NameKey(name))
+			})
+			if err != nil {
+				return "", err
+			}
+			fileKey = utils.NameKey(file.Name)
+		default:
+			return "", &Error{Code: CodeFileExists, Name: file.Name, Folder: item.Path}
+		}
+	}
+
+	if err := tx.PutFile(userKey, parentKey, fileKey, file); err != nil {
+		return "", err
+	}
+	if err := storage.WriteContent(tx, userKey, parentKey, fileKey, file.Content); err != nil {
+		return "", err
+	}
+	return utils.JoinPath(item.Path, file.Name), nil
+}
+
+// restoreTrashFolder writes the folder of the item back under the folder
+// stored at parentKey, the root if empty, and returns its path. A folder it
+// overwrites goes to the trash.
+func (s *UserService) restoreTrashFolder(tx storage.Tx, userKey, parentKey string, item models.TrashItem, conflict ConflictPolicy, now time.Time) (string, error) {
+	folder := *item.Folder
+	folderKey := utils.JoinPath(parentKey, utils.NameKey(folder.Name))
+	if folderExist(tx, userKey, folderKey) {
+		switch conflict {
+		case ConflictOverwrite:
+			if err := s.trashFolder(tx, userKey, folderKey, now); err != nil {
+				return "", err
+			}
+			if err := tx.DeleteFolder(userKey, folderKey); err != nil {
+				return "", err
+			}
+		case ConflictRename:
+			var err error
+			folder.Name, err = freeName(s.NamePolicy, folder.Name, func(name string) bool {
+				return folderExist(tx, userKey, utils.JoinPath(parentKey, utils.NameKey(name)))
+			})
+			if err != nil {
+				return "", err
+			}
+			folderKey = utils.JoinPath(parentKey, utils.NameKey(folder.Name))
+		default:
+			return "", &Error{Code: CodeFolderExists, Name: utils.JoinPath(item.Path, folder.Name)}
+		}
+	}
+
+	if err := storage.RestoreFolder(tx, userKey, folderKey, folder); err != nil {
+		return "", err
+	}
+	return utils.JoinPath(item.Path, folder.Name), nil
+}
+
+// moveToTrash puts the deleted folder or file of the item in the trash of
+// the user under an id it has never had. The folder or file itself is left to the caller
+// to delete.
+func (s *UserService) moveToTrash(tx storage.Tx, userKey string, item models.TrashItem, now time.Time) error {
+	if err := s.purgeTrash(tx, userKey, now); err != nil {
+		return err
+	}
+	user, err := tx.GetUser(userKey)
+	if err != nil {
+		return err
+	}
+	items, err := tx.ListTrash(userKey)
+	if err != nil {
+		return err
+	}
+
+	// Ids are numbers following the last one handed out, even if its item
+	// has been restored or purged since. The items of the data files written
+	// before the counter was kept are checked too.
+	next := user.LastTrashID + 1
+	for _, other := range items {
+		if n, err := strconv.Atoi(other.ID); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	user.LastTrashID = next
+	if err := tx.PutUser(userKey, user); err != nil {
+		return err
+	}
+	item.DeletedAt = now
+	return tx.PutTrash(userKey, strconv.Itoa(next), item)
+}
+
+// trashFile moves the file stored at fileKey to the trash of the user along
+// with its content. The file itself is left to the caller to delete.
+func (s *UserService) trashFile(tx storage.Tx, userKey, folderKey, fileKey string, now time.Time) error {
+	file, err := tx.GetFile(userKey, folderKey, fileKey)
+	if err != nil {
+		return err
+	}
+	if file.Content, err = storage.ReadContent(tx, userKey, folderKey, fileKey); err != nil {
+		return err
+	}
+	parentPath, err := displayPath(tx, userKey, folderKey)
+	if err != nil {
+		return err
+	}
+	return s.moveToTrash(tx, userKey, models.TrashItem{Path: parentPath, File: &file}, now)
+}
+
+// trashFolder moves the folder stored at folderKey to the trash of the user
+// along with its whole subtree. The folder itself is left to the caller to
+// delete.
+func (s *UserService) trashFolder(tx storage.Tx, userKey, folderKey string, now time.Time) error {
+	folder, err := storage.DumpFolder(tx, userKey, folderKey)
+	if err != nil {
+		return err
+	}
+	parentKey, _ := utils.SplitParent(folderKey)
+	parentPath, err := displayPath(tx, userKey, parentKey)
+	if err != nil {
+		return err
+	}
+	return s.moveToTrash(tx, userKey, models.TrashItem{Path: parentPath, Folder: &folder}, now)
+}
+
+// purgeTrash deletes the items of the trash kept for longer than the
+// retention of the service
+func (s *UserService) purgeTrash(tx storage.Tx, userKey string, now time.Time) error {
+	if s.TrashRetention <= 0 {
+		return nil
+	}
+	items, err := tx.ListTrash(userKey)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if s.expired(item, now) {
+			if err := tx.DeleteTrash(userKey, item.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// listTrash returns the items of the trash which haven't expired yet, by
+// their id in numerical order
+func (s *UserService) listTrash(tx storage.Tx, userKey string, now time.Time) ([]models.TrashItem, error) {
+	items, err := tx.ListTrash(userKey)
+	if err != nil {
+		return nil, err
+	}
+	kept := items[:0]
+	for _, item := range items {
+		if !s.expired(item, now) {
+			kept = append(kept, item)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		if len(kept[i].ID) != len(kept[j].ID) {
+			return len(kept[i].ID) < len(kept[j].ID)
+		}
+		return kept[i].ID < kept[j].ID
+	})
+	return kept, nil
+}
+
+// expired reports whether the item has been in the trash for longer than
+// the retention of the service
+func (s *UserService) expired(item models.TrashItem, now time.Time) bool {
+	return s.TrashRetention > 0 && !now.Before(item.DeletedAt.Add(s.TrashRetention))
+}
+
+// displayPath returns the path of the folder stored at folderKey made of
+// the names of the folders as they are displayed
+func displayPath(tx storage.Tx, userKey, folderKey string) (string, error) {
+	if folderKey == "" {
+		return "", nil
+	}
+	var names []string
+	walked := ""
+	for _, key := range strings.Split(folderKey, utils.PathSeparator) {
+		walked = utils.JoinPath(walked, key)
+		folder, err := tx.GetFolder(userKey, walked)
+		if err != nil {
+			return "", err
+		}
+		names = append(names, folder.Name)
+	}
+	return utils.JoinPath(names...), nil
+}
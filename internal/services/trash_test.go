@@ -0,0 +1,225 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"virtual-file-system/internal/storage"
+)
+
+func TestUserService_RestoreTrash(t *testing.T) {
+	created := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	deleted := created.Add(time.Hour)
+
+	testCases := []struct {
+		name         string
+		id           string
+		setup        func(folderService *FolderService, fileService *FileService) error
+		conflict     ConflictPolicy
+		expectedPath string
+		// expectedTrash is the number of items left in the trash, with the
+		// overwritten ones
+		expectedTrash int
+		expectedError string
+	}{
+		{
+			name:          "Restore a file",
+			id:            "1",
+			expectedPath:  "Docs/notes",
+			expectedTrash: 1,
+		},
+		{
+			name:          "Restore a folder",
+			id:            "2",
+			expectedPath:  "Docs/2024",
+			expectedTrash: 1,
+		},
+		{
+			name: "Restore onto an existing file",
+			id:   "1",
+			setup: func(_ *FolderService, fileService *FileService) error {
+				return fileService.CreateFile("dalaoqi", "docs", "NOTES", "")
+			},
+			expectedError: "Error: The notes has already existed in the Docs.",
+		},
+		{
+			name: "Restore over an existing file",
+			id:   "1",
+			setup: func(_ *FolderService, fileService *FileService) error {
+				return fileService.CreateFile("dalaoqi", "docs", "notes", "")
+			},
+			conflict:      ConflictOverwrite,
+			expectedPath:  "Docs/notes",
+			expectedTrash: 2,
+		},
+		{
+			name: "Restore next to an existing folder",
+			id:   "2",
+			setup: func(folderService *FolderService, _ *FileService) error {
+				return folderService.CreateFolder("dalaoqi", "docs/2024", "")
+			},
+			conflict:      ConflictRename,
+			expectedPath:  "Docs/2024 (1)",
+			expectedTrash: 1,
+		},
+		{
+			name: "Restore over an existing folder",
+			id:   "2",
+			setup: func(folderService *FolderService, _ *FileService) error {
+				return folderService.CreateFolder("dalaoqi", "docs/2024", "")
+			},
+			conflict:      ConflictOverwrite,
+			expectedPath:  "Docs/2024",
+			expectedTrash: 2,
+		},
+		{
+			name: "Restore into a deleted folder",
+			id:   "1",
+			setup: func(folderService *FolderService, _ *FileService) error {
+				return folderService.DeleteFolder("dalaoqi", "docs", true)
+			},
+			expectedError: "Error: The Docs doesn't exist.",
+		},
+		{
+			name:          "Restore a missing item",
+			id:            "3",
+			expectedError: "Error: The item 3 isn't in the trash.",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			userService, folderService, fileService := newTransferServices(t, storage.NewMemoryStore(nil), created)
+			userService.setClock(func() time.Time { return deleted })
+			if err := folderService.RenameFolder("dalaoqi", "docs", "Docs"); err != nil {
+				t.Fatalf("RenameFolder() has error: %s", err)
+			}
+			if err := fileService.DeleteFile("dalaoqi", "docs", "notes", false); err != nil {
+				t.Fatalf("DeleteFile() has error: %s", err)
+			}
+			if err := folderService.DeleteFolder("dalaoqi", "DOCS/2024", false); err != nil {
+				t.Fatalf("DeleteFolder() has error: %s", err)
+			}
+			if test.setup != nil {
+				if err := test.setup(folderService, fileService); err != nil {
+					t.Fatalf("Setup has error: %s", err)
+				}
+			}
+
+			path, err := userService.RestoreTrash("dalaoqi", test.id, test.conflict)
+			if (err == nil && test.expectedError != "") || (err != nil && err.Error() != test.expectedError) {
+				t.Fatalf("RestoreTrash() has error: %v, expected: %s", err, test.expectedError)
+			}
+			items, _ := userService.GetTrash("dalaoqi")
+			if err != nil {
+				if len(items) != 2 {
+					t.Errorf("GetTrash() after a failed restore = %+v, expected both items", items)
+				}
+				return
+			}
+			if path != test.expectedPath {
+				t.Errorf("RestoreTrash() = %s, expected: %s", path, test.expectedPath)
+			}
+			if len(items) != test.expectedTrash || items[0].ID == test.id {
+				t.Errorf("GetTrash() after the restore = %+v, expected %d items without %s", items, test.expectedTrash, test.id)
+			}
+
+			// The item comes back with its content and timestamps
+			if test.id == "1" {
+				content, err := fileService.ReadFile("dalaoqi", "docs", "notes")
+				if err != nil || string(content) != "hello" {
+					t.Errorf("ReadFile() = %q, %v, expected: hello", content, err)
+				}
+				return
+			}
+			files, err := fileService.GetFiles("dalaoqi", path, "--sort-name", "asc")
+			if err != nil || len(files) != 1 || files[0].Name != "plan" || !files[0].CreatedAt.Equal(created) {
+				t.Errorf("GetFiles() of the restored folder = %+v, %v, expected plan", files, err)
+			}
+		})
+	}
+}
+
+func TestUserService_Trash(t *testing.T) {
+	created := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	userService, folderService, fileService := newTransferServices(t, storage.NewMemoryStore(nil), created)
+	userService.TrashRetention = 24 * time.Hour
+	clock := func(at time.Time) { userService.setClock(func() time.Time { return at }) }
+
+	// Deleted items are listed with their location in the order they were deleted
+	clock(created.Add(time.Hour))
+	steps := []error{
+		fileService.DeleteFile("dalaoqi", "docs", "notes", false),
+		folderService.DeleteFolder("dalaoqi", "docs/2024", false),
+		fileService.DeleteFile("dalaoqi", "archive", "notes", true),
+	}
+	clock(created.Add(2 * time.Hour))
+	steps = append(steps, folderService.DeleteFolder("dalaoqi", "archive", false))
+	for _, err := range steps {
+		if err != nil {
+			t.Fatalf("Deletion has error: %s", err)
+		}
+	}
+	items, err := userService.GetTrash("DALAOQI")
+	if err != nil || len(items) != 3 {
+		t.Fatalf("GetTrash() = %+v, %v, expected 3 items", items, err)
+	}
+	expected := []struct{ id, name, path string }{{"1", "notes", "docs"}, {"2", "2024", "docs"}, {"3", "archive", ""}}
+	for i, item := range items {
+		if item.ID != expected[i].id || item.Name() != expected[i].name || item.Path != expected[i].path {
+			t.Errorf("GetTrash()[%d] = %+v, expected %v", i, item, expected[i])
+		}
+	}
+	if !items[0].DeletedAt.Equal(created.Add(time.Hour)) {
+		t.Errorf("DeletedAt = %s, expected the time of the deletion", items[0].DeletedAt)
+	}
+	// The permanently deleted file isn't in the restored folder
+	if _, err := userService.RestoreTrash("dalaoqi", "3", ConflictFail); err != nil {
+		t.Fatalf("RestoreTrash() has error: %s", err)
+	}
+	if fileService.Exist("dalaoqi", "archive", "notes") {
+		t.Errorf("The file deleted with permanent was restored")
+	}
+
+	// The trash follows the user when it is renamed
+	if err := userService.RenameUser("dalaoqi", "laoqi"); err != nil {
+		t.Fatalf("RenameUser() has error: %s", err)
+	}
+	if items, _ := userService.GetTrash("laoqi"); len(items) != 2 {
+		t.Errorf("GetTrash() after RenameUser() = %+v, expected 2 items", items)
+	}
+
+	// Items are purged once the retention is over, and their ids never reused
+	clock(created.Add(25 * time.Hour))
+	if items, _ := userService.GetTrash("laoqi"); len(items) != 0 {
+		t.Errorf("GetTrash() after the retention = %+v, expected none", items)
+	}
+	if _, err := userService.RestoreTrash("laoqi", "1", ConflictFail); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Errorf("RestoreTrash() of a purged item has error: %v, expected: %v", err, ErrTrashItemNotFound)
+	}
+	if err := folderService.DeleteFolder("laoqi", "archive", false); err != nil {
+		t.Fatalf("DeleteFolder() has error: %s", err)
+	}
+	items, _ = userService.GetTrash("laoqi")
+	if len(items) != 1 || items[0].ID != "4" || items[0].Name() != "archive" {
+		t.Errorf("GetTrash() after the purge = %+v, expected archive with the id 4", items)
+	}
+
+	// Emptying the trash deletes everything for good
+	if err := userService.EmptyTrash("laoqi"); err != nil {
+		t.Fatalf("EmptyTrash() has error: %s", err)
+	}
+	if items, _ := userService.GetTrash("laoqi"); len(items) != 0 {
+		t.Errorf("GetTrash() after EmptyTrash() = %+v, expected none", items)
+	}
+	if err := folderService.DeleteFolder("laoqi", "docs", false); err != nil {
+		t.Fatalf("DeleteFolder() has error: %s", err)
+	}
+	items, _ = userService.GetTrash("laoqi")
+	if len(items) != 1 || items[0].ID != "5" {
+		t.Errorf("GetTrash() after EmptyTrash() and a deletion = %+v, expected the id 5", items)
+	}
+	if _, err := userService.GetTrash("nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetTrash() of a missing user has error: %v, expected: %v", err, ErrUserNotFound)
+	}
+}
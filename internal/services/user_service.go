@@ -1,42 +1,268 @@
 package services
 
 import (
-	"fmt"
-	"strings"
+	"sort"
+	"sync"
+	"time"
 	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/storage"
 	"virtual-file-system/internal/utils"
 )
 
-// UserService handles user-related operations
+// UserService handles user-related operations.
+// The services are safe for concurrent use: every operation checks and
+// changes the tree within a single store transaction.
 type UserService struct {
-	Users map[string]models.User
+	Store storage.Store
+	// Clock returns the time stamped on created entities, time.Now if nil.
+	// It must be set before the service is used, see setClock afterwards.
+	Clock func() time.Time
+	// NamePolicy checks the names of new users, folders and files, which are
+	// stored normalized. It must be set before the service is used.
+	NamePolicy utils.NamePolicy
+	// TrashRetention is how long deleted folders and files stay in the trash
+	// before they are purged, forever if zero. It must be set before the
+	// service is used.
+	TrashRetention time.Duration
+
+	clockMu sync.RWMutex
 }
 
 // NewUserService creates a new instance of UserService
-func NewUserService() *UserService {
+func NewUserService(store storage.Store) *UserService {
 	return &UserService{
-		Users: make(map[string]models.User),
+		Store:          store,
+		NamePolicy:     utils.DefaultNamePolicy,
+		TrashRetention: DefaultTrashRetention,
 	}
 }
 
 // Register registers a new user
 func (s *UserService) Register(userName string) error {
-	userName = strings.ToLower(userName)
-	// Check if the user already exists
-	if s.Exist(userName) {
-		return fmt.Errorf("Error: The %s has already existed.", userName)
+	userKey := utils.NameKey(userName)
+	return s.Store.Update(func(tx storage.Tx) error {
+		// Check if the user already exists
+		if userExist(tx, userKey) {
+			return &Error{Code: CodeUserExists, Name: userName}
+		}
+
+		// Check if the name is valid
+		name, err := s.NamePolicy.Normalize(userName)
+		if err != nil {
+			return invalidName(userName, err)
+		}
+
+		return tx.PutUser(userKey, models.User{Name: name, CreatedAt: s.now()})
+	})
+}
+
+// GetUsers lists the users
+func (s *UserService) GetUsers(sortFlag, sortOrderFlag string) ([]models.User, error) {
+	var userList []models.User
+	err := s.Store.View(func(tx storage.Tx) error {
+		var err error
+		userList, err = tx.ListUsers()
+		return err
+	})
+	if err != nil {
+		return []models.User{}, err
 	}
 
-	// Check if the name contains invalid characters
-	if utils.ExistInvalidChars(userName) {
-		return fmt.Errorf("Error: The %s contains invalid chars.", userName)
+	// Sort the users based on the provided flags
+	switch sortFlag {
+	case "--sort-name":
+		// The store lists entities in ascending name order already
+		if sortOrderFlag == "desc" {
+			for i, j := 0, len(userList)-1; i < j; i, j = i+1, j-1 {
+				userList[i], userList[j] = userList[j], userList[i]
+			}
+		} else if sortOrderFlag != "asc" {
+			return []models.User{}, &Error{Code: CodeInvalidSortFlag, Name: sortOrderFlag}
+		}
+	case "--sort-created":
+		if sortOrderFlag == "asc" {
+			sort.SliceStable(userList, func(i, j int) bool {
+				return userList[i].CreatedAt.Before(userList[j].CreatedAt)
+			})
+		} else if sortOrderFlag == "desc" {
+			sort.SliceStable(userList, func(i, j int) bool {
+				return userList[i].CreatedAt.After(userList[j].CreatedAt)
+			})
+		} else {
+			return []models.User{}, &Error{Code: CodeInvalidSortFlag, Name: sortOrderFlag}
+		}
+	default:
+		return []models.User{}, &Error{Code: CodeInvalidSortFlag, Name: sortFlag}
 	}
 
-	s.Users[userName] = models.User{Name: userName, Folders: nil}
-	return nil
+	return userList, nil
+}
+
+// RenameUser renames the user, moving all of its folders, files, trash and
+// snapshots under the new name. Renaming it to another case of its name, like
+// dalaoqi to Dalaoqi, is allowed and only changes its case.
+func (s *UserService) RenameUser(userName, newUserName string) error {
+	userKey := utils.NameKey(userName)
+	newUserKey := utils.NameKey(newUserName)
+
+	return s.Store.Update(func(tx storage.Tx) error {
+		// Check if the user exists
+		user, err := tx.GetUser(userKey)
+		if err != nil {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+
+		// Check if the new name is valid
+		user.Name, err = s.NamePolicy.Normalize(newUserName)
+		if err != nil {
+			return invalidName(newUserName, err)
+		}
+
+		// A new case of the name keeps the key of the user
+		if newUserKey == userKey {
+			return tx.PutUser(userKey, user)
+		}
+
+		// Check if the new name is taken
+		if userExist(tx, newUserKey) {
+			return &Error{Code: CodeUserExists, Name: newUserName}
+		}
+
+		// Re-key the user with its whole tree
+		if err := tx.PutUser(newUserKey, user); err != nil {
+			return err
+		}
+		folders, err := tx.ListFolders(userKey, "")
+		if err != nil {
+			return err
+		}
+		for _, folder := range folders {
+			folderKey := utils.NameKey(folder.Name)
+			if err := copyFolder(tx, userKey, folderKey, newUserKey, folderKey, folder.Name, time.Time{}); err != nil {
+				return err
+			}
+		}
+		items, err := tx.ListTrash(userKey)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if item, err = tx.GetTrash(userKey, item.ID); err != nil {
+				return err
+			}
+			if err := tx.PutTrash(newUserKey, item.ID, item); err != nil {
+				return err
+			}
+		}
+		hashes, err := tx.ListObjects(userKey)
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			data, err := tx.GetObject(userKey, hash)
+			if err != nil {
+				return err
+			}
+			if err := tx.PutObject(newUserKey, hash, data); err != nil {
+				return err
+			}
+		}
+		snapshots, err := tx.ListTreeSnapshots(userKey)
+		if err != nil {
+			return err
+		}
+		for _, snapshot := range snapshots {
+			if err := tx.PutTreeSnapshot(newUserKey, utils.NameKey(snapshot.Label), snapshot); err != nil {
+				return err
+			}
+		}
+		return tx.DeleteUser(userKey)
+	})
+}
+
+// Unregister deletes the user along with its trash. A user who still has
+// folders is only deleted with force, along with all of its folders and
+// files.
+func (s *UserService) Unregister(userName string, force bool) error {
+	userKey := utils.NameKey(userName)
+
+	return s.Store.Update(func(tx storage.Tx) error {
+		// Check if the user exists
+		if !userExist(tx, userKey) {
+			return &Error{Code: CodeUserNotFound, Name: userName}
+		}
+
+		if !force {
+			folders, err := tx.ListFolders(userKey, "")
+			if err != nil {
+				return err
+			}
+			if len(folders) > 0 {
+				return &Error{Code: CodeUserNotEmpty, Name: userName}
+			}
+		}
+		return tx.DeleteUser(userKey)
+	})
 }
 
 func (s *UserService) Exist(name string) bool {
-	_, exist := s.Users[name]
+	exist := false
+	s.Store.View(func(tx storage.Tx) error {
+		exist = userExist(tx, utils.NameKey(name))
+		return nil
+	})
 	return exist
 }
+
+// Save writes the whole user tree to the snapshot file at path
+func (s *UserService) Save(path string) error {
+	return s.save(path, 0)
+}
+
+// Load replaces the whole user tree with the snapshot stored at path
+func (s *UserService) Load(path string) error {
+	users, _, err := storage.LoadSnapshot(path)
+	if err != nil {
+		return err
+	}
+	return s.Store.Update(func(tx storage.Tx) error {
+		return storage.Restore(tx, users)
+	})
+}
+
+// save writes the whole user tree along with the journal sequence it includes
+func (s *UserService) save(path string, sequence uint64) error {
+	var users map[string]models.User
+	err := s.Store.View(func(tx storage.Tx) error {
+		var err error
+		users, err = storage.Dump(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return storage.SaveSnapshot(path, users, sequence)
+}
+
+// now returns the current time of the service clock
+func (s *UserService) now() time.Time {
+	s.clockMu.RLock()
+	clock := s.Clock
+	s.clockMu.RUnlock()
+	if clock != nil {
+		return clock()
+	}
+	return time.Now()
+}
+
+// setClock replaces the service clock while the service is in use
+func (s *UserService) setClock(clock func() time.Time) {
+	s.clockMu.Lock()
+	defer s.clockMu.Unlock()
+	s.Clock = clock
+}
+
+func userExist(tx storage.Tx, userKey string) bool {
+	_, err := tx.GetUser(userKey)
+	return err == nil
+}
@@ -1,8 +1,13 @@
 package services
 
 import (
+	"errors"
+	"reflect"
 	"testing"
+	"time"
 	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/storage"
+	"virtual-file-system/internal/utils"
 )
 
 func TestUserRegister(t *testing.T) {
@@ -32,20 +37,18 @@ func TestUserRegister(t *testing.T) {
 				"dalaoqi": {Name: "dalaoqi"},
 			},
 			targetName: "DALAOQI",
-			expected:   "Error: The dalaoqi has already existed.",
+			expected:   "Error: The DALAOQI has already existed.",
 		},
 		{
 			name:       "Add a user with invalid chars",
 			users:      map[string]models.User{},
 			targetName: "dalaoqi&^%$?#.",
-			expected:   "Error: The dalaoqi&^%$?#. contains invalid chars.",
+			expected:   "Error: The dalaoqi&^%$?#. contains the invalid char '?' at position 12.",
 		},
 	}
 	for _, test := range testCases {
 		t.Run(test.name, func(t *testing.T) {
-			UserService := &UserService{
-				Users: test.users,
-			}
+			UserService := NewUserService(storage.NewMemoryStore(test.users))
 			// Perform the test by calling UserService.Register() and check the error message
 			if err := UserService.Register(test.targetName); err != nil && err.Error() != test.expected {
 				t.Errorf("UserService.Register() has error: %s, expected: %s", err.Error(), test.expected)
@@ -53,3 +56,228 @@ func TestUserRegister(t *testing.T) {
 		})
 	}
 }
+
+// failingStore is a fake store whose transactions always fail
+type failingStore struct {
+	err error
+}
+
+func (s failingStore) View(fn func(tx storage.Tx) error) error   { return s.err }
+func (s failingStore) Update(fn func(tx storage.Tx) error) error { return s.err }
+func (s failingStore) Close() error                              { return nil }
+
+func TestUserRegister_StoreError(t *testing.T) {
+	expected := errors.New("disk full")
+	userService := NewUserService(failingStore{err: expected})
+
+	if err := userService.Register("dalaoqi"); !errors.Is(err, expected) {
+		t.Errorf("UserService.Register() has error: %v, expected: %v", err, expected)
+	}
+	if userService.Exist("dalaoqi") {
+		t.Errorf("UserService.Exist() = true, expected false")
+	}
+}
+
+func TestUserService_GetUsers(t *testing.T) {
+	start := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	userService := NewUserService(storage.NewMemoryStore(nil))
+	for i, name := range []string{"david", "amy", "dalaoqi"} {
+		userService.setClock(func() time.Time { return start.Add(time.Duration(i) * time.Hour) })
+		userService.Register(name)
+	}
+
+	testCases := []struct {
+		sortFlag      string
+		sortOrderFlag string
+		expected      []string
+		expectedError string
+	}{
+		{sortFlag: "--sort-name", sortOrderFlag: "asc", expected: []string{"amy", "dalaoqi", "david"}},
+		{sortFlag: "--sort-name", sortOrderFlag: "desc", expected: []string{"david", "dalaoqi", "amy"}},
+		{sortFlag: "--sort-created", sortOrderFlag: "asc", expected: []string{"david", "amy", "dalaoqi"}},
+		{sortFlag: "--sort-created", sortOrderFlag: "desc", expected: []string{"dalaoqi", "amy", "david"}},
+		{sortFlag: "--sort-size", sortOrderFlag: "asc", expectedError: "Error: The sort flag --sort-size is invalid."},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.sortFlag+" "+test.sortOrderFlag, func(t *testing.T) {
+			users, err := userService.GetUsers(test.sortFlag, test.sortOrderFlag)
+			if (err == nil && test.expectedError != "") || (err != nil && err.Error() != test.expectedError) {
+				t.Fatalf("GetUsers() has error: %v, expected: %s", err, test.expectedError)
+			}
+			var names []string
+			for _, user := range users {
+				names = append(names, user.Name)
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("GetUsers() = %v, expected: %v", names, test.expected)
+			}
+		})
+	}
+}
+
+func TestUserService_RenameUser(t *testing.T) {
+	testCases := []struct {
+		name          string
+		userName      string
+		newUserName   string
+		expectedError string
+	}{
+		{
+			name:        "Rename existing user",
+			userName:    "Dalaoqi",
+			newUserName: "Laoqi",
+		},
+		{
+			name:        "Rename to a new case",
+			userName:    "dalaoqi",
+			newUserName: "DaLaoqi",
+		},
+		{
+			name:          "Rename non-existing user",
+			userName:      "nobody",
+			newUserName:   "laoqi",
+			expectedError: "Error: The nobody doesn't exist.",
+		},
+		{
+			name:          "Rename user with invalid characters",
+			userName:      "dalaoqi",
+			newUserName:   "lao|qi",
+			expectedError: "Error: The lao|qi contains the invalid char '|' at position 4.",
+		},
+		{
+			name:          "Rename to an existing user name",
+			userName:      "dalaoqi",
+			newUserName:   "David",
+			expectedError: "Error: The David has already existed.",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			created := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+			userService := NewUserService(storage.NewMemoryStore(nil))
+			userService.setClock(func() time.Time { return created })
+			folderService := NewFolderService(userService)
+			fileService := NewFileService(userService, folderService)
+			userService.Register("dalaoqi")
+			userService.Register("david")
+			folderService.CreateFolderAll("dalaoqi", "projects/2024", "")
+			fileService.CreateFile("dalaoqi", "projects/2024", "plan", "")
+			fileService.WriteFile("dalaoqi", "projects/2024", "plan", []byte("hello"))
+			userService.setClock(nil)
+
+			err := userService.RenameUser(test.userName, test.newUserName)
+			if (err == nil && test.expectedError != "") || (err != nil && err.Error() != test.expectedError) {
+				t.Fatalf("RenameUser() has error: %v, expected: %s", err, test.expectedError)
+			}
+			if err != nil {
+				if !userService.Exist("dalaoqi") {
+					t.Errorf("dalaoqi doesn't exist after a failed rename")
+				}
+				return
+			}
+
+			// The tree and the registration time move to the new name
+			if userService.Exist("dalaoqi") != (utils.NameKey(test.newUserName) == "dalaoqi") {
+				t.Errorf("dalaoqi exists = %v after the rename", userService.Exist("dalaoqi"))
+			}
+			content, err := fileService.ReadFile(test.newUserName, "projects/2024", "plan")
+			if err != nil || string(content) != "hello" {
+				t.Errorf("ReadFile() = %q, %v, expected: hello", content, err)
+			}
+			users, _ := userService.GetUsers("--sort-name", "asc")
+			renamed := users[0]
+			if users[0].Name == "david" {
+				renamed = users[1]
+			}
+			if len(users) != 2 || renamed.Name != test.newUserName || !renamed.CreatedAt.Equal(created) {
+				t.Errorf("GetUsers() = %+v, expected %s created at %s", users, test.newUserName, created)
+			}
+		})
+	}
+}
+
+func TestUserService_Unregister(t *testing.T) {
+	userService := NewUserService(storage.NewMemoryStore(nil))
+	folderService := NewFolderService(userService)
+	userService.Register("dalaoqi")
+	userService.Register("david")
+	folderService.CreateFolder("dalaoqi", "docs", "")
+
+	// A user with folders is only deleted with force
+	if err := userService.Unregister("Dalaoqi", false); !errors.Is(err, ErrUserNotEmpty) || err.Error() != "Error: The Dalaoqi still has folders." {
+		t.Errorf("Unregister() has error: %v, expected: %v", err, ErrUserNotEmpty)
+	}
+	if err := userService.Unregister("dalaoqi", true); err != nil {
+		t.Errorf("Unregister(force) has error: %s", err)
+	}
+	if err := userService.Unregister("david", false); err != nil {
+		t.Errorf("Unregister() of a user without folders has error: %s", err)
+	}
+	if err := userService.Unregister("david", false); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Unregister() of a missing user has error: %v, expected: %v", err, ErrUserNotFound)
+	}
+
+	// The name is free again, without the folders of the previous user
+	userService.Register("dalaoqi")
+	if folderService.Exist("dalaoqi", "docs") {
+		t.Errorf("The folders of the deleted user came back")
+	}
+}
+
+func TestUserService_NamePolicy(t *testing.T) {
+	userService := NewUserService(storage.NewMemoryStore(nil))
+	userService.NamePolicy = utils.NamePolicy{MaxRunes: 9, Windows: true}
+	folderService := NewFolderService(userService)
+	fileService := NewFileService(userService, folderService)
+
+	testCases := []struct {
+		name          string
+		err           error
+		expectedError string
+	}{
+		{name: "Non-ASCII first letter", err: userService.Register("Ärger")},
+		{name: "Decomposed name", err: folderService.CreateFolder("ärger", "U\u0308bersicht", "")},
+		{name: "CJK name", err: fileService.CreateFile("ärger", "übersicht", "資料", "")},
+		{
+			name:          "Too long",
+			err:           userService.Register("dalaoqi2024"),
+			expectedError: "Error: The dalaoqi2024 is 11 characters long, more than 9.",
+		},
+		{
+			name:          "Reserved by Windows",
+			err:           folderService.CreateFolderAll("ärger", "backup/aux", ""),
+			expectedError: "Error: The aux is reserved by Windows.",
+		},
+		{
+			name:          "Invisible character",
+			err:           fileService.RenameFile("ärger", "übersicht", "資料", "資\u200b料"),
+			expectedError: `Error: The "資\u200b料" contains the invisible character U+200B ZERO WIDTH SPACE at position 2.`,
+		},
+		{
+			name:          "Parent created with -p",
+			err:           folderService.CreateFolderAll("ärger", "nul/docs", ""),
+			expectedError: "Error: The nul is reserved by Windows.",
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			if (test.err == nil && test.expectedError != "") || (test.err != nil && test.err.Error() != test.expectedError) {
+				t.Errorf("Error = %v, expected: %s", test.err, test.expectedError)
+			}
+		})
+	}
+
+	// Names are stored normalized, and found in any form
+	folders, _ := folderService.GetFolders("ÄRGER", "--sort-name", "asc")
+	if len(folders) != 1 || folders[0].Name != "Übersicht" {
+		t.Errorf("GetFolders() = %+v, expected: Übersicht in NFC", folders)
+	}
+	if !fileService.Exist("a\u0308rger", "Übersicht", "資料") {
+		t.Errorf("The file isn't found by the decomposed name of its user")
+	}
+	if folderService.Exist("ärger", "backup") || folderService.Exist("ärger", "nul") {
+		t.Errorf("A rejected path created some of its folders")
+	}
+}
@@ -0,0 +1,633 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"virtual-file-system/internal/models"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	usersBucket     = []byte("users")
+	foldersBucket   = []byte("folders")
+	filesBucket     = []byte("files")
+	chunksBucket    = []byte("chunks")
+	trashBucket     = []byte("trash")
+	snapshotsBucket = []byte("snapshots")
+	objectsBucket   = []byte("objects")
+	metaKey         = []byte("meta")
+)
+
+// BoltStore keeps the user tree in an embedded bbolt database.
+//
+// Every user is a bucket under "users" holding its JSON metadata in "meta"
+// and its folders under "folders"; every folder is laid out the same way,
+// with its sub-folders under "folders", its files stored as JSON values
+// under "files" and their content under "chunks", one bucket per file keyed
+// by the big-endian chunk index. Listings are ordered cursor scans and
+// nothing is loaded into memory at startup. The trash of a user is stored
+// under "trash", every item as a JSON value holding its whole subtree and
+// content, its tree snapshots as JSON values under "snapshots" and its
+// objects as raw values under "objects".
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens or creates the database at path
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Error: Cannot open %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(usersBucket); err != nil {
+			return err
+		}
+		// Databases written before names kept their case are keyed by the
+		// lower-cased names
+		return Rekey(&boltTx{tx: tx})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error: Cannot open %s: %v", path, err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// View runs fn in a read-only transaction
+func (s *BoltStore) View(fn func(tx Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+// Update runs fn in a read-write transaction
+func (s *BoltStore) Update(fn func(tx Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+// Close closes the database
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (tx *boltTx) GetUser(userKey string) (models.User, error) {
+	var user models.User
+	bucket, err := tx.user(userKey)
+	if err != nil {
+		return user, err
+	}
+	return user, getMeta(bucket, &user)
+}
+
+func (tx *boltTx) PutUser(userKey string, user models.User) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	bucket, err := tx.tx.Bucket(usersBucket).CreateBucketIfNotExists([]byte(userKey))
+	if err != nil {
+		return err
+	}
+	if _, err := bucket.CreateBucketIfNotExists(foldersBucket); err != nil {
+		return err
+	}
+	for _, name := range [][]byte{trashBucket, snapshotsBucket, objectsBucket} {
+		if _, err := bucket.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	user.Folders = nil
+	user.Trash = nil
+	user.Snapshots = nil
+	user.Objects = nil
+	return putMeta(bucket, user)
+}
+
+func (tx *boltTx) DeleteUser(userKey string) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	if _, err := tx.user(userKey); err != nil {
+		return err
+	}
+	return tx.tx.Bucket(usersBucket).DeleteBucket([]byte(userKey))
+}
+
+func (tx *boltTx) ListUsers() ([]models.User, error) {
+	users := make([]models.User, 0)
+	err := forEachBucket(tx.tx.Bucket(usersBucket), func(bucket *bolt.Bucket) error {
+		var user models.User
+		if err := getMeta(bucket, &user); err != nil {
+			return err
+		}
+		users = append(users, user)
+		return nil
+	})
+	return users, err
+}
+
+func (tx *boltTx) GetFolder(userKey, folderKey string) (models.Folder, error) {
+	var folder models.Folder
+	bucket, err := tx.folder(userKey, folderKey)
+	if err != nil {
+		return folder, err
+	}
+	return folder, getMeta(bucket, &folder)
+}
+
+func (tx *boltTx) PutFolder(userKey, folderKey string, folder models.Folder) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	parentKey, name := splitKey(folderKey)
+	parent, err := tx.folders(userKey, parentKey)
+	if err != nil {
+		return err
+	}
+	bucket, err := parent.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return err
+	}
+	if _, err := bucket.CreateBucketIfNotExists(foldersBucket); err != nil {
+		return err
+	}
+	if _, err := bucket.CreateBucketIfNotExists(filesBucket); err != nil {
+		return err
+	}
+	if _, err := bucket.CreateBucketIfNotExists(chunksBucket); err != nil {
+		return err
+	}
+	folder.Folders = nil
+	folder.Files = nil
+	return putMeta(bucket, folder)
+}
+
+func (tx *boltTx) DeleteFolder(userKey, folderKey string) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	if _, err := tx.folder(userKey, folderKey); err != nil {
+		return err
+	}
+	parentKey, name := splitKey(folderKey)
+	parent, _ := tx.folders(userKey, parentKey)
+	return parent.DeleteBucket([]byte(name))
+}
+
+func (tx *boltTx) ListFolders(userKey, parentKey string) ([]models.Folder, error) {
+	parent, err := tx.folders(userKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	folders := make([]models.Folder, 0)
+	err = forEachBucket(parent, func(bucket *bolt.Bucket) error {
+		var folder models.Folder
+		if err := getMeta(bucket, &folder); err != nil {
+			return err
+		}
+		folders = append(folders, folder)
+		return nil
+	})
+	return folders, err
+}
+
+func (tx *boltTx) GetFile(userKey, folderKey, fileKey string) (models.File, error) {
+	var file models.File
+	folder, err := tx.folder(userKey, folderKey)
+	if err != nil {
+		return file, err
+	}
+	value := folder.Bucket(filesBucket).Get([]byte(fileKey))
+	if value == nil {
+		return file, fmt.Errorf("file %s/%s/%s: %w", userKey, folderKey, fileKey, ErrNotFound)
+	}
+	return file, json.Unmarshal(value, &file)
+}
+
+func (tx *boltTx) PutFile(userKey, folderKey, fileKey string, file models.File) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	folder, err := tx.folder(userKey, folderKey)
+	if err != nil {
+		return err
+	}
+	file.Content = nil
+	value, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return folder.Bucket(filesBucket).Put([]byte(fileKey), value)
+}
+
+func (tx *boltTx) DeleteFile(userKey, folderKey, fileKey string) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	if _, err := tx.GetFile(userKey, folderKey, fileKey); err != nil {
+		return err
+	}
+	folder, _ := tx.folder(userKey, folderKey)
+	chunks, err := tx.chunks(folder)
+	if err != nil {
+		return err
+	}
+	if chunks.Bucket([]byte(fileKey)) != nil {
+		if err := chunks.DeleteBucket([]byte(fileKey)); err != nil {
+			return err
+		}
+	}
+	return folder.Bucket(filesBucket).Delete([]byte(fileKey))
+}
+
+func (tx *boltTx) ListFiles(userKey, folderKey string) ([]models.File, error) {
+	folder, err := tx.folder(userKey, folderKey)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]models.File, 0)
+	err = folder.Bucket(filesBucket).ForEach(func(_, value []byte) error {
+		var file models.File
+		if err := json.Unmarshal(value, &file); err != nil {
+			return err
+		}
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+func (tx *boltTx) GetChunk(userKey, folderKey, fileKey string, index int64) ([]byte, error) {
+	bucket, err := tx.fileChunks(userKey, folderKey, fileKey)
+	if err != nil || bucket == nil {
+		return nil, err
+	}
+	// The value is only valid during the transaction
+	return bytes.Clone(bucket.Get(chunkKey(index))), nil
+}
+
+func (tx *boltTx) PutChunk(userKey, folderKey, fileKey string, index int64, chunk []byte) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	bucket, err := tx.fileChunks(userKey, folderKey, fileKey)
+	if err != nil {
+		return err
+	}
+	if index > 0 && bucket.Get(chunkKey(index-1)) == nil {
+		return fmt.Errorf("file %s/%s/%s: chunk %d is past the end of the content", userKey, folderKey, fileKey, index)
+	}
+	return bucket.Put(chunkKey(index), chunk)
+}
+
+func (tx *boltTx) DeleteChunks(userKey, folderKey, fileKey string, from int64) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	bucket, err := tx.fileChunks(userKey, folderKey, fileKey)
+	if err != nil {
+		return err
+	}
+	// Deleting while iterating makes the cursor skip keys, collect them first
+	var keys [][]byte
+	cursor := bucket.Cursor()
+	for key, _ := cursor.Seek(chunkKey(from)); key != nil; key, _ = cursor.Next() {
+		keys = append(keys, bytes.Clone(key))
+	}
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *boltTx) GetTrash(userKey, id string) (models.TrashItem, error) {
+	trash, err := tx.userBucket(userKey, trashBucket)
+	if err != nil {
+		return models.TrashItem{}, err
+	}
+	var value []byte
+	if trash != nil {
+		value = trash.Get([]byte(id))
+	}
+	if value == nil {
+		return models.TrashItem{}, fmt.Errorf("trash item %s/%s: %w", userKey, id, ErrNotFound)
+	}
+	return decodeTrashItem(value)
+}
+
+func (tx *boltTx) PutTrash(userKey, id string, item models.TrashItem) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	trash, err := tx.userBucket(userKey, trashBucket)
+	if err != nil {
+		return err
+	}
+	item.ID = id
+	value, err := json.Marshal(toSnapshotTrashItem(item))
+	if err != nil {
+		return err
+	}
+	return trash.Put([]byte(id), value)
+}
+
+func (tx *boltTx) DeleteTrash(userKey, id string) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	if _, err := tx.GetTrash(userKey, id); err != nil {
+		return err
+	}
+	trash, _ := tx.userBucket(userKey, trashBucket)
+	return trash.Delete([]byte(id))
+}
+
+func (tx *boltTx) ListTrash(userKey string) ([]models.TrashItem, error) {
+	trash, err := tx.userBucket(userKey, trashBucket)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]models.TrashItem, 0)
+	if trash == nil {
+		return items, nil
+	}
+	err = trash.ForEach(func(_, value []byte) error {
+		item, err := decodeTrashItem(value)
+		if err != nil {
+			return err
+		}
+		items = append(items, trashMeta(item))
+		return nil
+	})
+	return items, err
+}
+
+func (tx *boltTx) GetTreeSnapshot(userKey, labelKey string) (models.TreeSnapshot, error) {
+	var snapshot models.TreeSnapshot
+	snapshots, err := tx.userBucket(userKey, snapshotsBucket)
+	if err != nil {
+		return snapshot, err
+	}
+	var value []byte
+	if snapshots != nil {
+		value = snapshots.Get([]byte(labelKey))
+	}
+	if value == nil {
+		return snapshot, fmt.Errorf("snapshot %s/%s: %w", userKey, labelKey, ErrNotFound)
+	}
+	return snapshot, json.Unmarshal(value, &snapshot)
+}
+
+func (tx *boltTx) PutTreeSnapshot(userKey, labelKey string, snapshot models.TreeSnapshot) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	snapshots, err := tx.userBucket(userKey, snapshotsBucket)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return snapshots.Put([]byte(labelKey), value)
+}
+
+func (tx *boltTx) DeleteTreeSnapshot(userKey, labelKey string) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	if _, err := tx.GetTreeSnapshot(userKey, labelKey); err != nil {
+		return err
+	}
+	snapshots, _ := tx.userBucket(userKey, snapshotsBucket)
+	return snapshots.Delete([]byte(labelKey))
+}
+
+func (tx *boltTx) ListTreeSnapshots(userKey string) ([]models.TreeSnapshot, error) {
+	snapshots, err := tx.userBucket(userKey, snapshotsBucket)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]models.TreeSnapshot, 0)
+	if snapshots == nil {
+		return list, nil
+	}
+	err = snapshots.ForEach(func(_, value []byte) error {
+		var snapshot models.TreeSnapshot
+		if err := json.Unmarshal(value, &snapshot); err != nil {
+			return err
+		}
+		list = append(list, snapshot)
+		return nil
+	})
+	return list, err
+}
+
+func (tx *boltTx) GetObject(userKey, hash string) ([]byte, error) {
+	objects, err := tx.userBucket(userKey, objectsBucket)
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	if objects != nil {
+		value = objects.Get([]byte(hash))
+	}
+	if value == nil {
+		return nil, fmt.Errorf("object %s/%s: %w", userKey, hash, ErrNotFound)
+	}
+	// Values are only valid for the life of the transaction
+	return bytes.Clone(value), nil
+}
+
+func (tx *boltTx) PutObject(userKey, hash string, data []byte) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	objects, err := tx.userBucket(userKey, objectsBucket)
+	if err != nil {
+		return err
+	}
+	// bbolt doesn't store nil values
+	if data == nil {
+		data = []byte{}
+	}
+	return objects.Put([]byte(hash), data)
+}
+
+func (tx *boltTx) DeleteObject(userKey, hash string) error {
+	if !tx.tx.Writable() {
+		return ErrReadOnly
+	}
+	if _, err := tx.GetObject(userKey, hash); err != nil {
+		return err
+	}
+	objects, _ := tx.userBucket(userKey, objectsBucket)
+	return objects.Delete([]byte(hash))
+}
+
+func (tx *boltTx) ListObjects(userKey string) ([]string, error) {
+	objects, err := tx.userBucket(userKey, objectsBucket)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0)
+	if objects == nil {
+		return hashes, nil
+	}
+	err = objects.ForEach(func(key, _ []byte) error {
+		hashes = append(hashes, string(key))
+		return nil
+	})
+	return hashes, err
+}
+
+// user returns the bucket of the user
+func (tx *boltTx) user(userKey string) (*bolt.Bucket, error) {
+	bucket := tx.tx.Bucket(usersBucket).Bucket([]byte(userKey))
+	if bucket == nil {
+		return nil, fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	return bucket, nil
+}
+
+// folders returns the bucket holding the folders right under parentKey,
+// the user's root if empty. Folders written before sub-folders existed have
+// no such bucket, it is created in writable transactions and nil otherwise.
+func (tx *boltTx) folders(userKey, parentKey string) (*bolt.Bucket, error) {
+	var (
+		parent *bolt.Bucket
+		err    error
+	)
+	if parentKey == "" {
+		parent, err = tx.user(userKey)
+	} else {
+		parent, err = tx.folder(userKey, parentKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tx.tx.Writable() {
+		return parent.CreateBucketIfNotExists(foldersBucket)
+	}
+	return parent.Bucket(foldersBucket), nil
+}
+
+// folder returns the bucket of the user's folder
+func (tx *boltTx) folder(userKey, folderKey string) (*bolt.Bucket, error) {
+	bucket, err := tx.user(userKey)
+	if err != nil {
+		return nil, err
+	}
+	walked := ""
+	for _, name := range strings.Split(folderKey, "/") {
+		walked = joinKey(walked, name)
+		if children := bucket.Bucket(foldersBucket); children != nil {
+			bucket = children.Bucket([]byte(name))
+		} else {
+			bucket = nil
+		}
+		if bucket == nil {
+			return nil, fmt.Errorf("folder %s/%s: %w", userKey, walked, ErrNotFound)
+		}
+	}
+	return bucket, nil
+}
+
+// userBucket returns the bucket of the user called name, such as its trash.
+// Users written before the bucket existed have no such bucket, it is created
+// in writable transactions and nil otherwise.
+func (tx *boltTx) userBucket(userKey string, name []byte) (*bolt.Bucket, error) {
+	user, err := tx.user(userKey)
+	if err != nil {
+		return nil, err
+	}
+	if tx.tx.Writable() {
+		return user.CreateBucketIfNotExists(name)
+	}
+	return user.Bucket(name), nil
+}
+
+// chunks returns the bucket holding the chunks of the folder's files.
+// Folders written before files had content have no such bucket, it is
+// created in writable transactions and nil otherwise.
+func (tx *boltTx) chunks(folder *bolt.Bucket) (*bolt.Bucket, error) {
+	if tx.tx.Writable() {
+		return folder.CreateBucketIfNotExists(chunksBucket)
+	}
+	return folder.Bucket(chunksBucket), nil
+}
+
+// fileChunks returns the bucket holding the chunks of the file, created in
+// writable transactions and nil if the file has no content otherwise
+func (tx *boltTx) fileChunks(userKey, folderKey, fileKey string) (*bolt.Bucket, error) {
+	if _, err := tx.GetFile(userKey, folderKey, fileKey); err != nil {
+		return nil, err
+	}
+	folder, _ := tx.folder(userKey, folderKey)
+	chunks, err := tx.chunks(folder)
+	if err != nil || chunks == nil {
+		return nil, err
+	}
+	if tx.tx.Writable() {
+		return chunks.CreateBucketIfNotExists([]byte(fileKey))
+	}
+	return chunks.Bucket([]byte(fileKey)), nil
+}
+
+// chunkKey encodes a chunk index so that keys sort in index order
+func chunkKey(index int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(index))
+}
+
+// forEachBucket calls fn for every nested bucket in key order
+func forEachBucket(parent *bolt.Bucket, fn func(bucket *bolt.Bucket) error) error {
+	if parent == nil {
+		return nil
+	}
+	cursor := parent.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		// Nested buckets have a nil value
+		if value != nil {
+			continue
+		}
+		if err := fn(parent.Bucket(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeTrashItem decodes an item of the trash stored in the snapshot layout
+func decodeTrashItem(value []byte) (models.TrashItem, error) {
+	var snapItem snapshotTrashItem
+	if err := json.Unmarshal(value, &snapItem); err != nil {
+		return models.TrashItem{}, err
+	}
+	return readSnapshotTrashItem(snapItem)
+}
+
+func getMeta(bucket *bolt.Bucket, v any) error {
+	return json.Unmarshal(bucket.Get(metaKey), v)
+}
+
+func putMeta(bucket *bolt.Bucket, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(metaKey, value)
+}
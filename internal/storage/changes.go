@@ -0,0 +1,491 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"virtual-file-system/internal/models"
+)
+
+// ErrDiverged is returned when an entity doesn't hold the value a Changes
+// expects anymore, because it was changed by something else since
+var ErrDiverged = errors.New("changed since")
+
+// Changes are the writes made through the transactions of a Recorder. They
+// can be reverted, and applied again once reverted, in another transaction.
+//
+// Every write is recorded as the state of the entity it changed, before and
+// after: a Put records the metadata of its entity, or the entity with its
+// children when it creates it, while a Delete records the entity with all
+// of its children. Revert and Apply check that every entity holds the state
+// they start from, so that they never overwrite a change made since, and
+// fail with ErrDiverged otherwise.
+type Changes struct {
+	changes []change
+}
+
+// change is a write to an entity, whose states are nil when it doesn't exist
+type change struct {
+	entity        entity
+	before, after *state
+}
+
+// state is the value of an entity, deep when it holds all of its children
+type state struct {
+	value any
+	deep  bool
+}
+
+// Empty reports whether nothing was written
+func (c *Changes) Empty() bool {
+	return len(c.changes) == 0
+}
+
+// Revert restores the entities written to their state before the changes
+func (c *Changes) Revert(tx Tx) error {
+	for i := len(c.changes) - 1; i >= 0; i-- {
+		change := c.changes[i]
+		if err := change.set(tx, change.after, change.before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply writes the changes again after Revert
+func (c *Changes) Apply(tx Tx) error {
+	for _, change := range c.changes {
+		if err := change.set(tx, change.before, change.after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set checks that the entity is in the state from and changes it to the
+// state to
+func (c change) set(tx Tx, from, to *state) error {
+	current, err := capture(tx, c.entity, from != nil && from.deep)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(current, from) {
+		return fmt.Errorf("%s: %w", c.entity, ErrDiverged)
+	}
+
+	switch {
+	case to == nil && from == nil:
+		return nil
+	case to == nil:
+		return c.entity.delete(tx)
+	case to.deep:
+		return c.entity.restore(tx, to.value)
+	default:
+		return c.entity.put(tx, to.value)
+	}
+}
+
+// capture reads the state of the entity, nil if it doesn't exist
+func capture(tx Tx, e entity, deep bool) (*state, error) {
+	read := e.get
+	if deep {
+		read = e.dump
+	}
+	value, err := read(tx)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return &state{value: value, deep: deep}, nil
+}
+
+// Recorder is a Store recording the writes of its committed read-write
+// transactions into Changes, unless it is nil. Changes must not be replaced
+// during an update.
+type Recorder struct {
+	Store
+	Changes *Changes
+}
+
+// Update runs fn in a read-write transaction of the store and records its
+// writes once it is committed
+func (r *Recorder) Update(fn func(tx Tx) error) error {
+	if r.Changes == nil {
+		return r.Store.Update(fn)
+	}
+
+	var changes Changes
+	err := r.Store.Update(func(tx Tx) error {
+		changes = Changes{}
+		return fn(&recordingTx{Tx: tx, changes: &changes})
+	})
+	if err != nil {
+		return err
+	}
+	r.Changes.changes = append(r.Changes.changes, changes.changes...)
+	return nil
+}
+
+// recordingTx records the writes made through it into changes
+type recordingTx struct {
+	Tx
+	changes *Changes
+}
+
+func (tx *recordingTx) PutUser(userKey string, user models.User) error {
+	return tx.put(userEntity{userKey}, func() error { return tx.Tx.PutUser(userKey, user) })
+}
+
+func (tx *recordingTx) DeleteUser(userKey string) error {
+	return tx.delete(userEntity{userKey}, func() error { return tx.Tx.DeleteUser(userKey) })
+}
+
+func (tx *recordingTx) PutFolder(userKey, folderKey string, folder models.Folder) error {
+	return tx.put(folderEntity{userKey, folderKey}, func() error { return tx.Tx.PutFolder(userKey, folderKey, folder) })
+}
+
+func (tx *recordingTx) DeleteFolder(userKey, folderKey string) error {
+	return tx.delete(folderEntity{userKey, folderKey}, func() error { return tx.Tx.DeleteFolder(userKey, folderKey) })
+}
+
+func (tx *recordingTx) PutFile(userKey, folderKey, fileKey string, file models.File) error {
+	return tx.put(fileEntity{userKey, folderKey, fileKey}, func() error { return tx.Tx.PutFile(userKey, folderKey, fileKey, file) })
+}
+
+func (tx *recordingTx) DeleteFile(userKey, folderKey, fileKey string) error {
+	return tx.delete(fileEntity{userKey, folderKey, fileKey}, func() error { return tx.Tx.DeleteFile(userKey, folderKey, fileKey) })
+}
+
+func (tx *recordingTx) PutChunk(userKey, folderKey, fileKey string, index int64, chunk []byte) error {
+	return tx.put(chunkEntity{userKey, folderKey, fileKey, index}, func() error {
+		return tx.Tx.PutChunk(userKey, folderKey, fileKey, index, chunk)
+	})
+}
+
+func (tx *recordingTx) DeleteChunks(userKey, folderKey, fileKey string, from int64) error {
+	return tx.delete(chunkEntity{userKey, folderKey, fileKey, from}, func() error {
+		return tx.Tx.DeleteChunks(userKey, folderKey, fileKey, from)
+	})
+}
+
+func (tx *recordingTx) PutTrash(userKey, id string, item models.TrashItem) error {
+	return tx.put(trashEntity{userKey, id}, func() error { return tx.Tx.PutTrash(userKey, id, item) })
+}
+
+func (tx *recordingTx) DeleteTrash(userKey, id string) error {
+	return tx.delete(trashEntity{userKey, id}, func() error { return tx.Tx.DeleteTrash(userKey, id) })
+}
+
+func (tx *recordingTx) PutTreeSnapshot(userKey, labelKey string, snapshot models.TreeSnapshot) error {
+	return tx.put(treeSnapshotEntity{userKey, labelKey}, func() error {
+		return tx.Tx.PutTreeSnapshot(userKey, labelKey, snapshot)
+	})
+}
+
+func (tx *recordingTx) DeleteTreeSnapshot(userKey, labelKey string) error {
+	return tx.delete(treeSnapshotEntity{userKey, labelKey}, func() error {
+		return tx.Tx.DeleteTreeSnapshot(userKey, labelKey)
+	})
+}
+
+func (tx *recordingTx) PutObject(userKey, hash string, data []byte) error {
+	return tx.put(objectEntity{userKey, hash}, func() error { return tx.Tx.PutObject(userKey, hash, data) })
+}
+
+func (tx *recordingTx) DeleteObject(userKey, hash string) error {
+	return tx.delete(objectEntity{userKey, hash}, func() error { return tx.Tx.DeleteObject(userKey, hash) })
+}
+
+// put records a write of the entity without its children. A new entity is
+// recorded with its children, so that reverting its creation checks that it
+// didn't get any since.
+func (tx *recordingTx) put(e entity, write func() error) error {
+	before, err := capture(tx.Tx, e, false)
+	if err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	after, err := capture(tx.Tx, e, before == nil)
+	if err != nil {
+		return err
+	}
+	tx.changes.changes = append(tx.changes.changes, change{entity: e, before: before, after: after})
+	return nil
+}
+
+// delete records the deletion of the entity with all of its children
+func (tx *recordingTx) delete(e entity, write func() error) error {
+	before, err := capture(tx.Tx, e, true)
+	if err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	if before != nil {
+		tx.changes.changes = append(tx.changes.changes, change{entity: e, before: before})
+	}
+	return nil
+}
+
+// entity is a user, folder, file, chunk, trash item, tree snapshot or object
+// addressed by its keys.
+// get reads the entity without its children and dump with all of them, nil
+// if it doesn't exist. put writes a value read by get and restore one read
+// by dump.
+type entity interface {
+	get(tx Tx) (any, error)
+	dump(tx Tx) (any, error)
+	put(tx Tx, value any) error
+	restore(tx Tx, value any) error
+	delete(tx Tx) error
+	String() string
+}
+
+type userEntity struct {
+	userKey string
+}
+
+func (e userEntity) get(tx Tx) (any, error) {
+	return tx.GetUser(e.userKey)
+}
+
+func (e userEntity) dump(tx Tx) (any, error) {
+	user, err := tx.GetUser(e.userKey)
+	if err != nil {
+		return nil, err
+	}
+	return dumpUser(tx, nameKey, e.userKey, user)
+}
+
+func (e userEntity) put(tx Tx, value any) error {
+	return tx.PutUser(e.userKey, value.(models.User))
+}
+
+func (e userEntity) restore(tx Tx, value any) error {
+	return restoreUser(tx, e.userKey, value.(models.User))
+}
+
+func (e userEntity) delete(tx Tx) error {
+	return tx.DeleteUser(e.userKey)
+}
+
+func (e userEntity) String() string {
+	return "user " + e.userKey
+}
+
+type folderEntity struct {
+	userKey, folderKey string
+}
+
+func (e folderEntity) get(tx Tx) (any, error) {
+	return tx.GetFolder(e.userKey, e.folderKey)
+}
+
+func (e folderEntity) dump(tx Tx) (any, error) {
+	return DumpFolder(tx, e.userKey, e.folderKey)
+}
+
+func (e folderEntity) put(tx Tx, value any) error {
+	return tx.PutFolder(e.userKey, e.folderKey, value.(models.Folder))
+}
+
+func (e folderEntity) restore(tx Tx, value any) error {
+	return RestoreFolder(tx, e.userKey, e.folderKey, value.(models.Folder))
+}
+
+func (e folderEntity) delete(tx Tx) error {
+	return tx.DeleteFolder(e.userKey, e.folderKey)
+}
+
+func (e folderEntity) String() string {
+	return fmt.Sprintf("folder %s/%s", e.userKey, e.folderKey)
+}
+
+type fileEntity struct {
+	userKey, folderKey, fileKey string
+}
+
+func (e fileEntity) get(tx Tx) (any, error) {
+	return tx.GetFile(e.userKey, e.folderKey, e.fileKey)
+}
+
+func (e fileEntity) dump(tx Tx) (any, error) {
+	file, err := tx.GetFile(e.userKey, e.folderKey, e.fileKey)
+	if err != nil {
+		return nil, err
+	}
+	file.Content, err = ReadContent(tx, e.userKey, e.folderKey, e.fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (e fileEntity) put(tx Tx, value any) error {
+	return tx.PutFile(e.userKey, e.folderKey, e.fileKey, value.(models.File))
+}
+
+func (e fileEntity) restore(tx Tx, value any) error {
+	file := value.(models.File)
+	if err := tx.PutFile(e.userKey, e.folderKey, e.fileKey, file); err != nil {
+		return err
+	}
+	if len(file.Content) == 0 {
+		return nil
+	}
+	return WriteContent(tx, e.userKey, e.folderKey, e.fileKey, file.Content)
+}
+
+func (e fileEntity) delete(tx Tx) error {
+	return tx.DeleteFile(e.userKey, e.folderKey, e.fileKey)
+}
+
+func (e fileEntity) String() string {
+	return fmt.Sprintf("file %s/%s/%s", e.userKey, e.folderKey, e.fileKey)
+}
+
+// chunkEntity is a chunk of the content of a file, whose children are the
+// chunks after it
+type chunkEntity struct {
+	userKey, folderKey, fileKey string
+	index                       int64
+}
+
+func (e chunkEntity) get(tx Tx) (any, error) {
+	chunk, err := tx.GetChunk(e.userKey, e.folderKey, e.fileKey, e.index)
+	if err != nil || chunk == nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+func (e chunkEntity) dump(tx Tx) (any, error) {
+	var chunks [][]byte
+	for index := e.index; ; index++ {
+		chunk, err := tx.GetChunk(e.userKey, e.folderKey, e.fileKey, index)
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			break
+		}
+		chunks = append(chunks, chunk)
+	}
+	if chunks == nil {
+		return nil, nil
+	}
+	return chunks, nil
+}
+
+func (e chunkEntity) put(tx Tx, value any) error {
+	return tx.PutChunk(e.userKey, e.folderKey, e.fileKey, e.index, value.([]byte))
+}
+
+func (e chunkEntity) restore(tx Tx, value any) error {
+	for i, chunk := range value.([][]byte) {
+		if err := tx.PutChunk(e.userKey, e.folderKey, e.fileKey, e.index+int64(i), chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e chunkEntity) delete(tx Tx) error {
+	return tx.DeleteChunks(e.userKey, e.folderKey, e.fileKey, e.index)
+}
+
+func (e chunkEntity) String() string {
+	return fmt.Sprintf("chunk %d of file %s/%s/%s", e.index, e.userKey, e.folderKey, e.fileKey)
+}
+
+// trashEntity is an item of a trash, which is always read whole
+type trashEntity struct {
+	userKey, id string
+}
+
+func (e trashEntity) get(tx Tx) (any, error) {
+	return tx.GetTrash(e.userKey, e.id)
+}
+
+func (e trashEntity) dump(tx Tx) (any, error) {
+	return e.get(tx)
+}
+
+func (e trashEntity) put(tx Tx, value any) error {
+	return tx.PutTrash(e.userKey, e.id, value.(models.TrashItem))
+}
+
+func (e trashEntity) restore(tx Tx, value any) error {
+	return e.put(tx, value)
+}
+
+func (e trashEntity) delete(tx Tx) error {
+	return tx.DeleteTrash(e.userKey, e.id)
+}
+
+func (e trashEntity) String() string {
+	return fmt.Sprintf("trash item %s/%s", e.userKey, e.id)
+}
+
+// treeSnapshotEntity is a tree snapshot, which has no children
+type treeSnapshotEntity struct {
+	userKey, labelKey string
+}
+
+func (e treeSnapshotEntity) get(tx Tx) (any, error) {
+	return tx.GetTreeSnapshot(e.userKey, e.labelKey)
+}
+
+func (e treeSnapshotEntity) dump(tx Tx) (any, error) {
+	return e.get(tx)
+}
+
+func (e treeSnapshotEntity) put(tx Tx, value any) error {
+	return tx.PutTreeSnapshot(e.userKey, e.labelKey, value.(models.TreeSnapshot))
+}
+
+func (e treeSnapshotEntity) restore(tx Tx, value any) error {
+	return e.put(tx, value)
+}
+
+func (e treeSnapshotEntity) delete(tx Tx) error {
+	return tx.DeleteTreeSnapshot(e.userKey, e.labelKey)
+}
+
+func (e treeSnapshotEntity) String() string {
+	return fmt.Sprintf("snapshot %s/%s", e.userKey, e.labelKey)
+}
+
+// objectEntity is an object, which has no children
+type objectEntity struct {
+	userKey, hash string
+}
+
+func (e objectEntity) get(tx Tx) (any, error) {
+	return tx.GetObject(e.userKey, e.hash)
+}
+
+func (e objectEntity) dump(tx Tx) (any, error) {
+	return e.get(tx)
+}
+
+func (e objectEntity) put(tx Tx, value any) error {
+	return tx.PutObject(e.userKey, e.hash, value.([]byte))
+}
+
+func (e objectEntity) restore(tx Tx, value any) error {
+	return e.put(tx, value)
+}
+
+func (e objectEntity) delete(tx Tx) error {
+	return tx.DeleteObject(e.userKey, e.hash)
+}
+
+func (e objectEntity) String() string {
+	return fmt.Sprintf("object %s/%s", e.userKey, e.hash)
+}
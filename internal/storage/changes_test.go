@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"virtual-file-system/internal/models"
+)
+
+func TestChanges_RevertApply(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			recorder := &Recorder{Store: backend.open(t)}
+			seed(t, recorder)
+			before, _ := dump(recorder)
+
+			// A failed update isn't recorded
+			recorder.Changes = &Changes{}
+			failure := errors.New("failure")
+			err := recorder.Update(func(tx Tx) error {
+				tx.DeleteUser("dalaoqi")
+				return failure
+			})
+			if !errors.Is(err, failure) || !recorder.Changes.Empty() {
+				t.Fatalf("Recorder.Update() has error: %v, recorded: %v", err, !recorder.Changes.Empty())
+			}
+
+			long := bytes.Repeat([]byte("0123456789"), ChunkSize/5)
+			err = recorder.Update(func(tx Tx) error {
+				for _, write := range []func() error{
+					func() error { return tx.PutUser("new", models.User{Name: "new"}) },
+					func() error { return tx.PutFolder("new", "inbox", models.Folder{Name: "inbox"}) },
+					func() error {
+						return tx.PutFile("dalaoqi", "docs", "notes", models.File{Name: "notes", Description: "changed"})
+					},
+					func() error { return WriteContent(tx, "dalaoqi", "docs", "notes", long) },
+					func() error { return AppendContent(tx, "dalaoqi", "docs", "notes", int64(len(long)), []byte("more")) },
+					func() error { return TruncateContent(tx, "dalaoqi", "docs", "notes", int64(len(long))+4, ChunkSize+1) },
+					func() error { return WriteContent(tx, "dalaoqi", "docs", "todo", []byte("new content")) },
+					func() error { return tx.DeleteFile("dalaoqi", "docs", "todo") },
+					func() error { return tx.PutFolder("dalaoqi", "projects/2024/q2", models.Folder{Name: "q2"}) },
+					func() error { return tx.DeleteFolder("dalaoqi", "projects/2024") },
+					func() error { return tx.PutTrash("other", "3", models.TrashItem{File: &models.File{Name: "new"}}) },
+					func() error { return tx.DeleteTrash("other", "1") },
+					func() error {
+						root, err := FreezeTree(tx, "dalaoqi", "")
+						if err != nil {
+							return err
+						}
+						return tx.PutTreeSnapshot("dalaoqi", "before", models.TreeSnapshot{Label: "before", Root: root})
+					},
+					func() error { return tx.DeleteTreeSnapshot("other", "empty") },
+				} {
+					if err := write(); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Recorder.Update() has error: %s", err)
+			}
+			err = recorder.Update(func(tx Tx) error {
+				return tx.DeleteUser("other")
+			})
+			if err != nil {
+				t.Fatalf("Recorder.Update() has error: %s", err)
+			}
+			changes := recorder.Changes
+			recorder.Changes = nil
+			after, _ := dump(recorder)
+
+			if err := recorder.Update(changes.Revert); err != nil {
+				t.Fatalf("Changes.Revert() has error: %s", err)
+			}
+			if reverted, _ := dump(recorder); !reflect.DeepEqual(reverted, before) {
+				t.Errorf("Changes.Revert() = %v, expected %v", reverted, before)
+			}
+			if err := recorder.Update(changes.Apply); err != nil {
+				t.Fatalf("Changes.Apply() has error: %s", err)
+			}
+			if applied, _ := dump(recorder); !reflect.DeepEqual(applied, after) {
+				t.Errorf("Changes.Apply() = %v, expected %v", applied, after)
+			}
+		})
+	}
+}
+
+func TestChanges_Diverged(t *testing.T) {
+	testCases := []struct {
+		name   string
+		change func(tx Tx) error
+	}{
+		{
+			name: "Changed metadata",
+			change: func(tx Tx) error {
+				return tx.PutFolder("dalaoqi", "docs", models.Folder{Name: "docs", Description: "other"})
+			},
+		},
+		{
+			name:   "Child of a new folder",
+			change: func(tx Tx) error { return tx.PutFile("dalaoqi", "new", "draft", models.File{Name: "draft"}) },
+		},
+		{
+			name:   "Changed content",
+			change: func(tx Tx) error { return AppendContent(tx, "dalaoqi", "docs", "notes", 7, []byte("!")) },
+		},
+		{
+			name:   "Recreated folder",
+			change: func(tx Tx) error { return tx.PutFolder("dalaoqi", "empty", models.Folder{Name: "empty"}) },
+		},
+	}
+
+	for _, backend := range backends {
+		for _, test := range testCases {
+			t.Run(backend.name+"/"+test.name, func(t *testing.T) {
+				recorder := &Recorder{Store: backend.open(t), Changes: &Changes{}}
+				seed(t, recorder)
+				err := recorder.Update(func(tx Tx) error {
+					if err := tx.PutFolder("dalaoqi", "docs", models.Folder{Name: "docs", Description: "changed"}); err != nil {
+						return err
+					}
+					if err := tx.PutFolder("dalaoqi", "new", models.Folder{Name: "new"}); err != nil {
+						return err
+					}
+					if err := WriteContent(tx, "dalaoqi", "docs", "notes", []byte("changed")); err != nil {
+						return err
+					}
+					return tx.DeleteFolder("dalaoqi", "empty")
+				})
+				if err != nil {
+					t.Fatalf("Recorder.Update() has error: %s", err)
+				}
+				changes := recorder.Changes
+				recorder.Changes = nil
+
+				if err := recorder.Update(test.change); err != nil {
+					t.Fatalf("Store.Update() has error: %s", err)
+				}
+				diverged, _ := dump(recorder)
+				if err := recorder.Update(changes.Revert); !errors.Is(err, ErrDiverged) {
+					t.Errorf("Changes.Revert() has error: %v, expected %v", err, ErrDiverged)
+				}
+				if after, _ := dump(recorder); !reflect.DeepEqual(after, diverged) {
+					t.Errorf("Changes.Revert() changed the tree: %v, expected %v", after, diverged)
+				}
+			})
+		}
+	}
+}
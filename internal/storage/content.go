@@ -0,0 +1,116 @@
+package storage
+
+import "fmt"
+
+// ChunkSize is the size of the chunks the content of a file is stored in.
+// Chunks are numbered from 0 and every chunk but the last one is full.
+const ChunkSize = 64 * 1024
+
+// ReadContent reads the whole content of the file
+func ReadContent(tx Tx, userKey, folderKey, fileKey string) ([]byte, error) {
+	var content []byte
+	for index := int64(0); ; index++ {
+		chunk, err := tx.GetChunk(userKey, folderKey, fileKey, index)
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			return content, nil
+		}
+		content = append(content, chunk...)
+	}
+}
+
+// WriteContent replaces the content of the file
+func WriteContent(tx Tx, userKey, folderKey, fileKey string, content []byte) error {
+	if err := tx.DeleteChunks(userKey, folderKey, fileKey, 0); err != nil {
+		return err
+	}
+	return putChunks(tx, userKey, folderKey, fileKey, 0, content)
+}
+
+// AppendContent appends data to the content of the file, whose current
+// size is given
+func AppendContent(tx Tx, userKey, folderKey, fileKey string, size int64, data []byte) error {
+	index := size / ChunkSize
+	// Complete the last chunk before starting new ones
+	if offset := size % ChunkSize; offset > 0 {
+		last, err := tx.GetChunk(userKey, folderKey, fileKey, index)
+		if err != nil {
+			return err
+		}
+		if int64(len(last)) < offset {
+			return fmt.Errorf("file %s/%s/%s: content is shorter than %d bytes", userKey, folderKey, fileKey, size)
+		}
+		data = append(last[:offset], data...)
+	}
+	return putChunks(tx, userKey, folderKey, fileKey, index, data)
+}
+
+// TruncateContent changes the size of the content of the file from size to
+// newSize, padding it with zero bytes when it grows
+func TruncateContent(tx Tx, userKey, folderKey, fileKey string, size, newSize int64) error {
+	// Grow the content one chunk at a time
+	for size < newSize {
+		n := ChunkSize - size%ChunkSize
+		if n > newSize-size {
+			n = newSize - size
+		}
+		if err := AppendContent(tx, userKey, folderKey, fileKey, size, make([]byte, n)); err != nil {
+			return err
+		}
+		size += n
+	}
+	if newSize == size {
+		return nil
+	}
+
+	index := newSize / ChunkSize
+	offset := newSize % ChunkSize
+	if offset == 0 {
+		return tx.DeleteChunks(userKey, folderKey, fileKey, index)
+	}
+	last, err := tx.GetChunk(userKey, folderKey, fileKey, index)
+	if err != nil {
+		return err
+	}
+	if int64(len(last)) > offset {
+		last = last[:offset]
+	}
+	if err := tx.DeleteChunks(userKey, folderKey, fileKey, index+1); err != nil {
+		return err
+	}
+	return tx.PutChunk(userKey, folderKey, fileKey, index, last)
+}
+
+// CopyContent copies the content of a file to another one chunk by chunk
+func CopyContent(tx Tx, userKey, folderKey, fileKey, newUserKey, newFolderKey, newFileKey string) error {
+	if err := tx.DeleteChunks(newUserKey, newFolderKey, newFileKey, 0); err != nil {
+		return err
+	}
+	for index := int64(0); ; index++ {
+		chunk, err := tx.GetChunk(userKey, folderKey, fileKey, index)
+		if err != nil || chunk == nil {
+			return err
+		}
+		if err := tx.PutChunk(newUserKey, newFolderKey, newFileKey, index, chunk); err != nil {
+			return err
+		}
+	}
+}
+
+// putChunks writes data as the chunks starting at index
+func putChunks(tx Tx, userKey, folderKey, fileKey string, index int64, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > ChunkSize {
+			n = ChunkSize
+		}
+		if err := tx.PutChunk(userKey, folderKey, fileKey, index, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+		index++
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// FileStore keeps the user tree in memory and rewrites its JSON snapshot
+// file after every committed update
+type FileStore struct {
+	path   string
+	memory *MemoryStore
+}
+
+// OpenFileStore loads the snapshot at path, starting from an empty tree if
+// the file doesn't exist yet
+func OpenFileStore(path string) (*FileStore, error) {
+	users, _, err := LoadSnapshot(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return &FileStore{path: path, memory: NewMemoryStore(users)}, nil
+}
+
+// View runs fn in a read-only transaction
+func (s *FileStore) View(fn func(tx Tx) error) error {
+	return s.memory.View(fn)
+}
+
+// Update runs fn in a read-write transaction. The changes are rolled back
+// if the snapshot cannot be written.
+func (s *FileStore) Update(fn func(tx Tx) error) error {
+	return s.memory.Update(func(tx Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return SaveSnapshot(s.path, s.memory.users, 0)
+	})
+}
+
+// Close does nothing as every update is already on disk
+func (s *FileStore) Close() error {
+	return nil
+}
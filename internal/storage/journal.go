@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+// journalHeaderSize is the size of the length and checksum preceding every record
+const journalHeaderSize = 8
+
+// maxJournalRecordSize guards against allocating huge buffers for a corrupt
+// length. Append refuses the larger records.
+const maxJournalRecordSize = 16 << 20
+
+// ErrRecordTooLarge is returned by Append for a record that wouldn't be read
+// back. The change it records has to be saved in a snapshot instead.
+var ErrRecordTooLarge = errors.New("Error: The journal record is too large.")
+
+// JournalRecord is one successful mutating command
+type JournalRecord struct {
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Args     []string  `json:"args"`
+}
+
+// journalRecordJSON is the encoding of a JournalRecord. A JSON string would
+// replace the bytes of an argument that isn't valid UTF-8, like a binary
+// content, so the arguments of such a record are encoded as base64 in RawArgs.
+type journalRecordJSON struct {
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Args     []string  `json:"args,omitempty"`
+	RawArgs  [][]byte  `json:"rawArgs,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (r JournalRecord) MarshalJSON() ([]byte, error) {
+	encoded := journalRecordJSON{Sequence: r.Sequence, Time: r.Time, Args: r.Args}
+	for _, arg := range r.Args {
+		if !utf8.ValidString(arg) {
+			encoded.Args = nil
+			encoded.RawArgs = make([][]byte, len(r.Args))
+			for i, arg := range r.Args {
+				encoded.RawArgs[i] = []byte(arg)
+			}
+			break
+		}
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (r *JournalRecord) UnmarshalJSON(data []byte) error {
+	var encoded journalRecordJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	*r = JournalRecord{Sequence: encoded.Sequence, Time: encoded.Time, Args: encoded.Args}
+	if encoded.RawArgs != nil {
+		r.Args = make([]string, len(encoded.RawArgs))
+		for i, arg := range encoded.RawArgs {
+			r.Args[i] = string(arg)
+		}
+	}
+	return nil
+}
+
+// Journal is an append-only log of mutating commands.
+// Every record is framed as a big-endian payload length, a CRC-32 of the
+// payload and the JSON encoded payload, and is fsync'd before Append returns.
+type Journal struct {
+	file    *os.File
+	records int
+	// size is the size of the valid records, where a failed Append is cut
+	size int64
+	torn bool
+}
+
+// OpenJournal opens the journal at path, creating it if needed, and returns
+// the valid records it contains. A torn or corrupt tail is truncated away.
+func OpenJournal(path string) (*Journal, []JournalRecord, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error: Cannot open journal %s: %v", path, err)
+	}
+
+	records, valid, err := readJournal(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("Error: Cannot read journal %s: %v", path, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("Error: Cannot read journal %s: %v", path, err)
+	}
+	journal := &Journal{file: file, records: len(records), size: valid}
+
+	// Drop everything after the last valid record
+	if info.Size() > valid {
+		journal.torn = true
+		if err := file.Truncate(valid); err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("Error: Cannot repair journal %s: %v", path, err)
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("Error: Cannot repair journal %s: %v", path, err)
+		}
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("Error: Cannot open journal %s: %v", path, err)
+	}
+	return journal, records, nil
+}
+
+// readJournal decodes records until the end of the file or the first
+// invalid record, returning the offset right after the last valid one
+func readJournal(r io.Reader) ([]JournalRecord, int64, error) {
+	var (
+		records []JournalRecord
+		offset  int64
+		header  [journalHeaderSize]byte
+	)
+	reader := bufio.NewReader(r)
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return records, offset, nil
+			}
+			return nil, 0, err
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if size > maxJournalRecordSize {
+			return records, offset, nil
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return records, offset, nil
+			}
+			return nil, 0, err
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return records, offset, nil
+		}
+
+		var record JournalRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return records, offset, nil
+		}
+		records = append(records, record)
+		offset += journalHeaderSize + int64(size)
+	}
+}
+
+// Append writes the record to the journal and syncs it to disk. A record
+// larger than maxJournalRecordSize is not written and ErrRecordTooLarge is
+// returned.
+func (j *Journal) Append(record JournalRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Error: Cannot write journal: %v", err)
+	}
+	if len(payload) > maxJournalRecordSize {
+		return ErrRecordTooLarge
+	}
+
+	buf := make([]byte, journalHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[journalHeaderSize:], payload)
+
+	if _, err := j.file.Write(buf); err != nil {
+		j.cut()
+		return fmt.Errorf("Error: Cannot write journal: %v", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		j.cut()
+		return fmt.Errorf("Error: Cannot write journal: %v", err)
+	}
+	j.records++
+	j.size += int64(len(buf))
+	return nil
+}
+
+// cut drops what a failed Append may have written after the valid records,
+// so that the next records aren't lost behind a torn one
+func (j *Journal) cut() {
+	if j.file.Truncate(j.size) == nil {
+		j.file.Seek(j.size, io.SeekStart)
+	}
+}
+
+// Reset empties the journal once its records are folded into a snapshot
+func (j *Journal) Reset() error {
+	if err := j.file.Truncate(0); err != nil {
+		return fmt.Errorf("Error: Cannot reset journal: %v", err)
+	}
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("Error: Cannot reset journal: %v", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("Error: Cannot reset journal: %v", err)
+	}
+	j.records = 0
+	j.size = 0
+	return nil
+}
+
+// Len returns the number of records in the journal
+func (j *Journal) Len() int {
+	return j.records
+}
+
+// Torn reports whether a torn tail was dropped when opening the journal
+func (j *Journal) Torn() bool {
+	return j.torn
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
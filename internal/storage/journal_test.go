@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournal_AppendAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vfs.json.journal")
+	records := []JournalRecord{
+		{Sequence: 1, Time: time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC), Args: []string{"register", "dalaoqi"}},
+		{Sequence: 2, Time: time.Date(2023, 7, 1, 0, 0, 1, 0, time.UTC), Args: []string{"create-folder", "dalaoqi", "meeting docs", ""}},
+		// Binary content must survive as it is
+		{Sequence: 3, Time: time.Date(2023, 7, 1, 0, 0, 2, 0, time.UTC), Args: []string{"write-file", "dalaoqi", "meeting docs", "image", "\x89PNG\xff\xfe\x00"}},
+	}
+
+	journal, existing, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("OpenJournal() has error: %s", err)
+	}
+	if len(existing) != 0 {
+		t.Errorf("OpenJournal() returned %d records, expected 0", len(existing))
+	}
+	for _, record := range records {
+		if err := journal.Append(record); err != nil {
+			t.Fatalf("Journal.Append() has error: %s", err)
+		}
+	}
+	journal.Close()
+
+	journal, existing, err = OpenJournal(path)
+	if err != nil {
+		t.Fatalf("OpenJournal() has error: %s", err)
+	}
+	defer journal.Close()
+	if !reflect.DeepEqual(existing, records) {
+		t.Errorf("OpenJournal() = %v, expected %v", existing, records)
+	}
+	if journal.Len() != len(records) || journal.Torn() {
+		t.Errorf("Journal.Len() = %d, Journal.Torn() = %v, expected %d and false", journal.Len(), journal.Torn(), len(records))
+	}
+
+	if err := journal.Reset(); err != nil {
+		t.Fatalf("Journal.Reset() has error: %s", err)
+	}
+	if info, _ := os.Stat(path); info.Size() != 0 {
+		t.Errorf("Journal size after Reset() = %d, expected 0", info.Size())
+	}
+}
+
+func TestJournal_RecordTooLarge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vfs.json.journal")
+	journal, _, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("OpenJournal() has error: %s", err)
+	}
+	defer journal.Close()
+
+	content := strings.Repeat("a", maxJournalRecordSize)
+	err = journal.Append(JournalRecord{Sequence: 1, Args: []string{"write-file", "dalaoqi", "docs", "notes", content}})
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("Journal.Append() has error: %v, expected ErrRecordTooLarge", err)
+	}
+	if info, _ := os.Stat(path); info.Size() != 0 || journal.Len() != 0 {
+		t.Errorf("Journal size after a too large record = %d, expected 0", info.Size())
+	}
+}
+
+func TestJournal_TornTail(t *testing.T) {
+	testCases := []struct {
+		name    string
+		corrupt func(data []byte, firstSize int) []byte
+	}{
+		{
+			name:    "Truncated header",
+			corrupt: func(data []byte, firstSize int) []byte { return data[:firstSize+journalHeaderSize/2] },
+		},
+		{
+			name:    "Truncated payload",
+			corrupt: func(data []byte, firstSize int) []byte { return data[:len(data)-3] },
+		},
+		{
+			name: "Checksum mismatch",
+			corrupt: func(data []byte, firstSize int) []byte {
+				data[len(data)-2] ^= 0xff
+				return data
+			},
+		},
+		{
+			name: "Garbage after the last record",
+			corrupt: func(data []byte, firstSize int) []byte {
+				return append(data, 0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 1, '{')
+			},
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "vfs.json.journal")
+			journal, _, err := OpenJournal(path)
+			if err != nil {
+				t.Fatalf("OpenJournal() has error: %s", err)
+			}
+			first := JournalRecord{Sequence: 1, Time: time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC), Args: []string{"register", "dalaoqi"}}
+			journal.Append(first)
+			info, _ := os.Stat(path)
+			journal.Append(JournalRecord{Sequence: 2, Time: time.Date(2023, 7, 1, 0, 0, 1, 0, time.UTC), Args: []string{"register", "other"}})
+			journal.Close()
+
+			data, _ := os.ReadFile(path)
+			os.WriteFile(path, test.corrupt(data, int(info.Size())), 0o644)
+
+			journal, records, err := OpenJournal(path)
+			if err != nil {
+				t.Fatalf("OpenJournal() has error: %s", err)
+			}
+			defer journal.Close()
+			if !journal.Torn() {
+				t.Errorf("Journal.Torn() = false, expected true")
+			}
+			if len(records) == 0 || !reflect.DeepEqual(records[0], first) {
+				t.Fatalf("OpenJournal() = %v, expected the first record to survive", records)
+			}
+
+			// Appending after the repair must produce a readable journal
+			third := JournalRecord{Sequence: 3, Time: time.Date(2023, 7, 1, 0, 0, 2, 0, time.UTC), Args: []string{"register", "third"}}
+			if err := journal.Append(third); err != nil {
+				t.Fatalf("Journal.Append() has error: %s", err)
+			}
+			journal.Close()
+			_, reopened, err := OpenJournal(path)
+			if err != nil {
+				t.Fatalf("OpenJournal() has error: %s", err)
+			}
+			if !reflect.DeepEqual(reopened[len(reopened)-1], third) {
+				t.Errorf("OpenJournal() last record = %v, expected %v", reopened[len(reopened)-1], third)
+			}
+		})
+	}
+}
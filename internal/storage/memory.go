@@ -0,0 +1,615 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"virtual-file-system/internal/models"
+)
+
+// MemoryStore keeps the user tree in nested Go maps
+type MemoryStore struct {
+	mu    sync.RWMutex
+	users map[string]models.User
+}
+
+// NewMemoryStore creates a store backed by users, which may be nil.
+// The map is modified in place by every update.
+func NewMemoryStore(users map[string]models.User) *MemoryStore {
+	if users == nil {
+		users = make(map[string]models.User)
+	}
+	return &MemoryStore{users: users}
+}
+
+// View runs fn in a read-only transaction
+func (s *MemoryStore) View(fn func(tx Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn(&memoryTx{users: s.users})
+}
+
+// Update runs fn in a read-write transaction, undoing its changes on error
+func (s *MemoryStore) Update(fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{users: s.users, writable: true}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// Close does nothing for the in-memory store
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// memoryTx mutates the maps directly and keeps a log to undo its changes
+type memoryTx struct {
+	users    map[string]models.User
+	writable bool
+	undo     []func()
+}
+
+func (tx *memoryTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+}
+
+func (tx *memoryTx) GetUser(userKey string) (models.User, error) {
+	user, exist := tx.users[userKey]
+	if !exist {
+		return models.User{}, fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	user.Folders = nil
+	user.Trash = nil
+	user.Snapshots = nil
+	user.Objects = nil
+	return user, nil
+}
+
+func (tx *memoryTx) PutUser(userKey string, user models.User) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	previous, exist := tx.users[userKey]
+	user.Folders = previous.Folders
+	user.Trash = previous.Trash
+	user.Snapshots = previous.Snapshots
+	user.Objects = previous.Objects
+	tx.users[userKey] = user
+	tx.undo = append(tx.undo, func() {
+		if exist {
+			tx.users[userKey] = previous
+		} else {
+			delete(tx.users, userKey)
+		}
+	})
+	return nil
+}
+
+func (tx *memoryTx) DeleteUser(userKey string) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	previous, exist := tx.users[userKey]
+	if !exist {
+		return fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	delete(tx.users, userKey)
+	tx.undo = append(tx.undo, func() { tx.users[userKey] = previous })
+	return nil
+}
+
+func (tx *memoryTx) ListUsers() ([]models.User, error) {
+	users := make([]models.User, 0, len(tx.users))
+	for _, userKey := range sortedKeys(tx.users) {
+		user := tx.users[userKey]
+		user.Folders = nil
+		user.Trash = nil
+		user.Snapshots = nil
+		user.Objects = nil
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (tx *memoryTx) GetFolder(userKey, folderKey string) (models.Folder, error) {
+	_, folder, err := tx.folder(userKey, folderKey)
+	if err != nil {
+		return models.Folder{}, err
+	}
+	folder.Folders = nil
+	folder.Files = nil
+	return folder, nil
+}
+
+func (tx *memoryTx) PutFolder(userKey, folderKey string, folder models.Folder) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	parentKey, name := splitKey(folderKey)
+	folders, err := tx.folders(userKey, parentKey, true)
+	if err != nil {
+		return err
+	}
+
+	previous, exist := folders[name]
+	folder.Folders = previous.Folders
+	folder.Files = previous.Files
+	folders[name] = folder
+	tx.undo = append(tx.undo, func() {
+		if exist {
+			folders[name] = previous
+		} else {
+			delete(folders, name)
+		}
+	})
+	return nil
+}
+
+func (tx *memoryTx) DeleteFolder(userKey, folderKey string) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	folders, previous, err := tx.folder(userKey, folderKey)
+	if err != nil {
+		return err
+	}
+	_, name := splitKey(folderKey)
+	delete(folders, name)
+	tx.undo = append(tx.undo, func() { folders[name] = previous })
+	return nil
+}
+
+func (tx *memoryTx) ListFolders(userKey, parentKey string) ([]models.Folder, error) {
+	folders, err := tx.folders(userKey, parentKey, false)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]models.Folder, 0, len(folders))
+	for _, name := range sortedKeys(folders) {
+		folder := folders[name]
+		folder.Folders = nil
+		folder.Files = nil
+		list = append(list, folder)
+	}
+	return list, nil
+}
+
+func (tx *memoryTx) GetFile(userKey, folderKey, fileKey string) (models.File, error) {
+	_, folder, err := tx.folder(userKey, folderKey)
+	if err != nil {
+		return models.File{}, err
+	}
+	file, exist := folder.Files[fileKey]
+	if !exist {
+		return models.File{}, fmt.Errorf("file %s/%s/%s: %w", userKey, folderKey, fileKey, ErrNotFound)
+	}
+	file.Content = nil
+	return file, nil
+}
+
+func (tx *memoryTx) PutFile(userKey, folderKey, fileKey string, file models.File) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	folders, folder, err := tx.folder(userKey, folderKey)
+	if err != nil {
+		return err
+	}
+	if folder.Files == nil {
+		_, name := splitKey(folderKey)
+		folder.Files = make(map[string]models.File)
+		folders[name] = folder
+	}
+
+	files := folder.Files
+	previous, exist := files[fileKey]
+	file.Content = previous.Content
+	files[fileKey] = file
+	tx.undo = append(tx.undo, func() {
+		if exist {
+			files[fileKey] = previous
+		} else {
+			delete(files, fileKey)
+		}
+	})
+	return nil
+}
+
+func (tx *memoryTx) DeleteFile(userKey, folderKey, fileKey string) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	_, folder, err := tx.folder(userKey, folderKey)
+	if err != nil {
+		return err
+	}
+	files := folder.Files
+	previous, exist := files[fileKey]
+	if !exist {
+		return fmt.Errorf("file %s/%s/%s: %w", userKey, folderKey, fileKey, ErrNotFound)
+	}
+	delete(files, fileKey)
+	tx.undo = append(tx.undo, func() { files[fileKey] = previous })
+	return nil
+}
+
+func (tx *memoryTx) ListFiles(userKey, folderKey string) ([]models.File, error) {
+	_, folder, err := tx.folder(userKey, folderKey)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]models.File, 0, len(folder.Files))
+	for _, fileKey := range sortedKeys(folder.Files) {
+		file := folder.Files[fileKey]
+		file.Content = nil
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// The memory store keeps the content of a file as a single slice in its
+// Content and slices chunks out of it. A slice is never modified once stored
+// since the undo log may still refer to it, only appended to past its end.
+
+func (tx *memoryTx) GetChunk(userKey, folderKey, fileKey string, index int64) ([]byte, error) {
+	_, file, err := tx.file(userKey, folderKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	offset := index * ChunkSize
+	if offset >= int64(len(file.Content)) {
+		return nil, nil
+	}
+	end := offset + ChunkSize
+	if end > int64(len(file.Content)) {
+		end = int64(len(file.Content))
+	}
+	return bytes.Clone(file.Content[offset:end]), nil
+}
+
+func (tx *memoryTx) PutChunk(userKey, folderKey, fileKey string, index int64, chunk []byte) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	files, previous, err := tx.file(userKey, folderKey, fileKey)
+	if err != nil {
+		return err
+	}
+	content := previous.Content
+	offset := index * ChunkSize
+	if offset > int64(len(content)) {
+		return fmt.Errorf("file %s/%s/%s: chunk %d is past the end of the content", userKey, folderKey, fileKey, index)
+	}
+
+	file := previous
+	if offset == int64(len(content)) {
+		// Appending only writes past the end of the previous slice
+		file.Content = append(content, chunk...)
+	} else {
+		file.Content = make([]byte, 0, len(content)+len(chunk))
+		file.Content = append(file.Content, content[:offset]...)
+		file.Content = append(file.Content, chunk...)
+		if end := offset + ChunkSize; end < int64(len(content)) {
+			file.Content = append(file.Content, content[end:]...)
+		}
+	}
+	files[fileKey] = file
+	tx.undo = append(tx.undo, func() { files[fileKey] = previous })
+	return nil
+}
+
+func (tx *memoryTx) DeleteChunks(userKey, folderKey, fileKey string, from int64) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	files, previous, err := tx.file(userKey, folderKey, fileKey)
+	if err != nil {
+		return err
+	}
+	offset := from * ChunkSize
+	if offset >= int64(len(previous.Content)) {
+		return nil
+	}
+
+	file := previous
+	// Cap the slice so that appending to it doesn't overwrite previous
+	file.Content = previous.Content[:offset:offset]
+	if offset == 0 {
+		file.Content = nil
+	}
+	files[fileKey] = file
+	tx.undo = append(tx.undo, func() { files[fileKey] = previous })
+	return nil
+}
+
+func (tx *memoryTx) GetTrash(userKey, id string) (models.TrashItem, error) {
+	user, exist := tx.users[userKey]
+	if !exist {
+		return models.TrashItem{}, fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	item, exist := user.Trash[id]
+	if !exist {
+		return models.TrashItem{}, fmt.Errorf("trash item %s/%s: %w", userKey, id, ErrNotFound)
+	}
+	// The children of an item are never modified once stored, only the
+	// metadata needs a copy
+	if item.Folder != nil {
+		folder := *item.Folder
+		item.Folder = &folder
+	}
+	if item.File != nil {
+		file := *item.File
+		item.File = &file
+	}
+	return item, nil
+}
+
+func (tx *memoryTx) PutTrash(userKey, id string, item models.TrashItem) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	user, exist := tx.users[userKey]
+	if !exist {
+		return fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	if user.Trash == nil {
+		user.Trash = make(map[string]models.TrashItem)
+		tx.users[userKey] = user
+	}
+
+	trash := user.Trash
+	previous, exist := trash[id]
+	item.ID = id
+	trash[id] = item
+	tx.undo = append(tx.undo, func() {
+		if exist {
+			trash[id] = previous
+		} else {
+			delete(trash, id)
+		}
+	})
+	return nil
+}
+
+func (tx *memoryTx) DeleteTrash(userKey, id string) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	if _, err := tx.GetTrash(userKey, id); err != nil {
+		return err
+	}
+	trash := tx.users[userKey].Trash
+	previous := trash[id]
+	delete(trash, id)
+	tx.undo = append(tx.undo, func() { trash[id] = previous })
+	return nil
+}
+
+func (tx *memoryTx) ListTrash(userKey string) ([]models.TrashItem, error) {
+	user, exist := tx.users[userKey]
+	if !exist {
+		return nil, fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	items := make([]models.TrashItem, 0, len(user.Trash))
+	for _, id := range sortedKeys(user.Trash) {
+		items = append(items, trashMeta(user.Trash[id]))
+	}
+	return items, nil
+}
+
+func (tx *memoryTx) GetTreeSnapshot(userKey, labelKey string) (models.TreeSnapshot, error) {
+	user, exist := tx.users[userKey]
+	if !exist {
+		return models.TreeSnapshot{}, fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	snapshot, exist := user.Snapshots[labelKey]
+	if !exist {
+		return models.TreeSnapshot{}, fmt.Errorf("snapshot %s/%s: %w", userKey, labelKey, ErrNotFound)
+	}
+	return snapshot, nil
+}
+
+func (tx *memoryTx) PutTreeSnapshot(userKey, labelKey string, snapshot models.TreeSnapshot) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	user, exist := tx.users[userKey]
+	if !exist {
+		return fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	if user.Snapshots == nil {
+		user.Snapshots = make(map[string]models.TreeSnapshot)
+		tx.users[userKey] = user
+	}
+
+	snapshots := user.Snapshots
+	previous, exist := snapshots[labelKey]
+	snapshots[labelKey] = snapshot
+	tx.undo = append(tx.undo, func() {
+		if exist {
+			snapshots[labelKey] = previous
+		} else {
+			delete(snapshots, labelKey)
+		}
+	})
+	return nil
+}
+
+func (tx *memoryTx) DeleteTreeSnapshot(userKey, labelKey string) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	previous, err := tx.GetTreeSnapshot(userKey, labelKey)
+	if err != nil {
+		return err
+	}
+	snapshots := tx.users[userKey].Snapshots
+	delete(snapshots, labelKey)
+	tx.undo = append(tx.undo, func() { snapshots[labelKey] = previous })
+	return nil
+}
+
+func (tx *memoryTx) ListTreeSnapshots(userKey string) ([]models.TreeSnapshot, error) {
+	user, exist := tx.users[userKey]
+	if !exist {
+		return nil, fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	snapshots := make([]models.TreeSnapshot, 0, len(user.Snapshots))
+	for _, labelKey := range sortedKeys(user.Snapshots) {
+		snapshots = append(snapshots, user.Snapshots[labelKey])
+	}
+	return snapshots, nil
+}
+
+// Objects are never modified once stored, only copied in and out
+
+func (tx *memoryTx) GetObject(userKey, hash string) ([]byte, error) {
+	user, exist := tx.users[userKey]
+	if !exist {
+		return nil, fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	data, exist := user.Objects[hash]
+	if !exist {
+		return nil, fmt.Errorf("object %s/%s: %w", userKey, hash, ErrNotFound)
+	}
+	return bytes.Clone(data), nil
+}
+
+func (tx *memoryTx) PutObject(userKey, hash string, data []byte) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	user, exist := tx.users[userKey]
+	if !exist {
+		return fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	if user.Objects == nil {
+		user.Objects = make(map[string][]byte)
+		tx.users[userKey] = user
+	}
+
+	objects := user.Objects
+	previous, exist := objects[hash]
+	objects[hash] = bytes.Clone(data)
+	tx.undo = append(tx.undo, func() {
+		if exist {
+			objects[hash] = previous
+		} else {
+			delete(objects, hash)
+		}
+	})
+	return nil
+}
+
+func (tx *memoryTx) DeleteObject(userKey, hash string) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	user, exist := tx.users[userKey]
+	if !exist {
+		return fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	objects := user.Objects
+	previous, exist := objects[hash]
+	if !exist {
+		return fmt.Errorf("object %s/%s: %w", userKey, hash, ErrNotFound)
+	}
+	delete(objects, hash)
+	tx.undo = append(tx.undo, func() { objects[hash] = previous })
+	return nil
+}
+
+func (tx *memoryTx) ListObjects(userKey string) ([]string, error) {
+	user, exist := tx.users[userKey]
+	if !exist {
+		return nil, fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	return sortedKeys(user.Objects), nil
+}
+
+// file returns the file with its content along with the map holding it
+func (tx *memoryTx) file(userKey, folderKey, fileKey string) (map[string]models.File, models.File, error) {
+	_, folder, err := tx.folder(userKey, folderKey)
+	if err != nil {
+		return nil, models.File{}, err
+	}
+	file, exist := folder.Files[fileKey]
+	if !exist {
+		return nil, models.File{}, fmt.Errorf("file %s/%s/%s: %w", userKey, folderKey, fileKey, ErrNotFound)
+	}
+	return folder.Files, file, nil
+}
+
+// folders returns the map holding the folders right under parentKey, the
+// user's root if empty. With create set, a missing map is created and linked
+// into the tree so that it can be written to.
+func (tx *memoryTx) folders(userKey, parentKey string, create bool) (map[string]models.Folder, error) {
+	user, exist := tx.users[userKey]
+	if !exist {
+		return nil, fmt.Errorf("user %s: %w", userKey, ErrNotFound)
+	}
+	if user.Folders == nil && create {
+		user.Folders = make(map[string]models.Folder)
+		tx.users[userKey] = user
+	}
+
+	folders := user.Folders
+	if parentKey == "" {
+		return folders, nil
+	}
+	walked := ""
+	for _, name := range strings.Split(parentKey, "/") {
+		walked = joinKey(walked, name)
+		folder, exist := folders[name]
+		if !exist {
+			return nil, fmt.Errorf("folder %s/%s: %w", userKey, walked, ErrNotFound)
+		}
+		if folder.Folders == nil && create {
+			folder.Folders = make(map[string]models.Folder)
+			folders[name] = folder
+		}
+		folders = folder.Folders
+	}
+	return folders, nil
+}
+
+// folder returns the folder with its children along with the map holding it
+func (tx *memoryTx) folder(userKey, folderKey string) (map[string]models.Folder, models.Folder, error) {
+	parentKey, name := splitKey(folderKey)
+	folders, err := tx.folders(userKey, parentKey, false)
+	if err != nil {
+		return nil, models.Folder{}, err
+	}
+	folder, exist := folders[name]
+	if !exist {
+		return nil, models.Folder{}, fmt.Errorf("folder %s/%s: %w", userKey, folderKey, ErrNotFound)
+	}
+	return folders, folder, nil
+}
+
+// sortedKeys returns the keys of m in ascending order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,418 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/utils"
+)
+
+// SnapshotVersion is the version written into every snapshot
+const SnapshotVersion = 1
+
+// snapshot is the on-disk representation of the whole user tree.
+// Users, folders and files are stored as sorted lists instead of maps so
+// that duplicated entries can be detected when loading.
+type snapshot struct {
+	Version  int            `json:"version"`
+	Sequence uint64         `json:"sequence,omitempty"`
+	Users    []snapshotUser `json:"users"`
+}
+
+// snapshotUser is a user with its tree. Its tree snapshots are stored as a
+// list sorted by label and its objects by their hash.
+type snapshotUser struct {
+	Name        string                `json:"name"`
+	CreatedAt   time.Time             `json:"createdAt"`
+	LastTrashID int                   `json:"lastTrashId,omitempty"`
+	Folders     []snapshotFolder      `json:"folders,omitempty"`
+	Trash       []snapshotTrashItem   `json:"trash,omitempty"`
+	Snapshots   []models.TreeSnapshot `json:"snapshots,omitempty"`
+	Objects     map[string][]byte     `json:"objects,omitempty"`
+}
+
+type snapshotFolder struct {
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	CreatedAt   time.Time        `json:"createdAt"`
+	ModifiedAt  time.Time        `json:"modifiedAt"`
+	Folders     []snapshotFolder `json:"folders,omitempty"`
+	Files       []snapshotFile   `json:"files,omitempty"`
+}
+
+type snapshotFile struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ModifiedAt  time.Time `json:"modifiedAt"`
+	Content     []byte    `json:"content,omitempty"`
+}
+
+// snapshotTrashItem is a deleted folder or file, also stored by the bolt
+// store in this layout
+type snapshotTrashItem struct {
+	ID        string          `json:"id"`
+	Path      string          `json:"path"`
+	DeletedAt time.Time       `json:"deletedAt"`
+	Folder    *snapshotFolder `json:"folder,omitempty"`
+	File      *snapshotFile   `json:"file,omitempty"`
+}
+
+// WriteSnapshot serializes the given users to w as JSON.
+// sequence is the last journal record folded into the snapshot.
+func WriteSnapshot(w io.Writer, users map[string]models.User, sequence uint64) error {
+	snap := snapshot{Version: SnapshotVersion, Sequence: sequence, Users: make([]snapshotUser, 0, len(users))}
+	for _, userName := range sortedKeys(users) {
+		user := users[userName]
+		snap.Users = append(snap.Users, snapshotUser{
+			Name:        user.Name,
+			CreatedAt:   user.CreatedAt,
+			LastTrashID: user.LastTrashID,
+			Folders:     snapshotFolders(user.Folders),
+			Trash:       snapshotTrash(user.Trash),
+			Snapshots:   snapshotTreeSnapshots(user.Snapshots),
+			Objects:     user.Objects,
+		})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snap)
+}
+
+// snapshotFolders converts folders and their children to sorted lists
+func snapshotFolders(folders map[string]models.Folder) []snapshotFolder {
+	var snapFolders []snapshotFolder
+	for _, folderName := range sortedKeys(folders) {
+		snapFolders = append(snapFolders, toSnapshotFolder(folders[folderName]))
+	}
+	return snapFolders
+}
+
+// toSnapshotFolder converts the folder and its children
+func toSnapshotFolder(folder models.Folder) snapshotFolder {
+	snapFolder := snapshotFolder{
+		Name:        folder.Name,
+		Description: folder.Description,
+		CreatedAt:   folder.CreatedAt,
+		ModifiedAt:  folder.ModifiedAt,
+		Folders:     snapshotFolders(folder.Folders),
+	}
+	for _, fileName := range sortedKeys(folder.Files) {
+		snapFolder.Files = append(snapFolder.Files, toSnapshotFile(folder.Files[fileName]))
+	}
+	return snapFolder
+}
+
+func toSnapshotFile(file models.File) snapshotFile {
+	return snapshotFile{
+		Name:        file.Name,
+		Description: file.Description,
+		CreatedAt:   file.CreatedAt,
+		ModifiedAt:  file.ModifiedAt,
+		Content:     file.Content,
+	}
+}
+
+// snapshotTrash converts the items of a trash to a list sorted by id
+func snapshotTrash(trash map[string]models.TrashItem) []snapshotTrashItem {
+	var snapItems []snapshotTrashItem
+	for _, id := range sortedKeys(trash) {
+		snapItems = append(snapItems, toSnapshotTrashItem(trash[id]))
+	}
+	return snapItems
+}
+
+// snapshotTreeSnapshots converts tree snapshots to a list sorted by the key
+// of their label
+func snapshotTreeSnapshots(snapshots map[string]models.TreeSnapshot) []models.TreeSnapshot {
+	var list []models.TreeSnapshot
+	for _, labelKey := range sortedKeys(snapshots) {
+		list = append(list, snapshots[labelKey])
+	}
+	return list
+}
+
+func toSnapshotTrashItem(item models.TrashItem) snapshotTrashItem {
+	snapItem := snapshotTrashItem{ID: item.ID, Path: item.Path, DeletedAt: item.DeletedAt}
+	if item.Folder != nil {
+		snapFolder := toSnapshotFolder(*item.Folder)
+		snapItem.Folder = &snapFolder
+	}
+	if item.File != nil {
+		snapFile := toSnapshotFile(*item.File)
+		snapItem.File = &snapFile
+	}
+	return snapItem
+}
+
+// ReadSnapshot parses a snapshot from r and rebuilds the user tree along with
+// its journal sequence, keyed by the keys of the names. Every name is
+// validated and entries whose names have the same key are rejected.
+func ReadSnapshot(r io.Reader) (map[string]models.User, uint64, error) {
+	var snap snapshot
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&snap); err != nil {
+		return nil, 0, fmt.Errorf("Error: Invalid snapshot: %v", err)
+	}
+	if snap.Version != SnapshotVersion {
+		return nil, 0, fmt.Errorf("Error: Invalid snapshot: unsupported version %d", snap.Version)
+	}
+
+	users := make(map[string]models.User, len(snap.Users))
+	for _, snapUser := range snap.Users {
+		userKey, err := snapshotName("user", snapUser.Name)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, exist := users[userKey]; exist {
+			return nil, 0, fmt.Errorf("Error: Invalid snapshot: user %q is duplicated.", snapUser.Name)
+		}
+
+		folders, err := readSnapshotFolders(snapUser.Name, snapUser.Folders)
+		if err != nil {
+			return nil, 0, err
+		}
+		trash, err := readSnapshotTrash(snapUser.Name, snapUser.Trash)
+		if err != nil {
+			return nil, 0, err
+		}
+		objects, err := readSnapshotObjects(snapUser.Name, snapUser.Objects)
+		if err != nil {
+			return nil, 0, err
+		}
+		snapshots, err := readSnapshotTreeSnapshots(snapUser.Name, snapUser.Snapshots, objects)
+		if err != nil {
+			return nil, 0, err
+		}
+		users[userKey] = models.User{
+			Name:        snapUser.Name,
+			CreatedAt:   snapUser.CreatedAt,
+			LastTrashID: snapUser.LastTrashID,
+			Folders:     folders,
+			Trash:       trash,
+			Snapshots:   snapshots,
+			Objects:     objects,
+		}
+	}
+	return users, snap.Sequence, nil
+}
+
+// readSnapshotFolders rebuilds the folders found under the given parent path
+func readSnapshotFolders(parent string, snapFolders []snapshotFolder) (map[string]models.Folder, error) {
+	if len(snapFolders) == 0 {
+		return nil, nil
+	}
+
+	folders := make(map[string]models.Folder, len(snapFolders))
+	for _, snapFolder := range snapFolders {
+		folderKey, err := snapshotName("folder", snapFolder.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, exist := folders[folderKey]; exist {
+			return nil, fmt.Errorf("Error: Invalid snapshot: folder %q of %s is duplicated.", snapFolder.Name, parent)
+		}
+		folders[folderKey], err = readSnapshotFolder(parent+"/"+snapFolder.Name, snapFolder)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return folders, nil
+}
+
+// readSnapshotFolder rebuilds the folder found at the given path with its
+// children
+func readSnapshotFolder(path string, snapFolder snapshotFolder) (models.Folder, error) {
+	folder := models.Folder{
+		Name:        snapFolder.Name,
+		Description: snapFolder.Description,
+		CreatedAt:   snapFolder.CreatedAt,
+		ModifiedAt:  snapFolder.ModifiedAt,
+	}
+	for _, snapFile := range snapFolder.Files {
+		fileKey, err := snapshotName("file", snapFile.Name)
+		if err != nil {
+			return models.Folder{}, err
+		}
+		if folder.Files == nil {
+			folder.Files = make(map[string]models.File)
+		}
+		if _, exist := folder.Files[fileKey]; exist {
+			return models.Folder{}, fmt.Errorf("Error: Invalid snapshot: file %q in %s is duplicated.", snapFile.Name, path)
+		}
+		folder.Files[fileKey] = readSnapshotFile(snapFile)
+	}
+	var err error
+	folder.Folders, err = readSnapshotFolders(path, snapFolder.Folders)
+	if err != nil {
+		return models.Folder{}, err
+	}
+	return folder, nil
+}
+
+func readSnapshotFile(snapFile snapshotFile) models.File {
+	return models.File{
+		Name:        snapFile.Name,
+		Description: snapFile.Description,
+		Size:        int64(len(snapFile.Content)),
+		CreatedAt:   snapFile.CreatedAt,
+		ModifiedAt:  snapFile.ModifiedAt,
+		Content:     snapFile.Content,
+	}
+}
+
+// readSnapshotTrash rebuilds the trash of the user by the ids of its items
+func readSnapshotTrash(userName string, snapItems []snapshotTrashItem) (map[string]models.TrashItem, error) {
+	if len(snapItems) == 0 {
+		return nil, nil
+	}
+
+	trash := make(map[string]models.TrashItem, len(snapItems))
+	for _, snapItem := range snapItems {
+		if snapItem.ID == "" {
+			return nil, fmt.Errorf("Error: Invalid snapshot: trash item of %s with an empty id.", userName)
+		}
+		if _, exist := trash[snapItem.ID]; exist {
+			return nil, fmt.Errorf("Error: Invalid snapshot: trash item %q of %s is duplicated.", snapItem.ID, userName)
+		}
+		item, err := readSnapshotTrashItem(snapItem)
+		if err != nil {
+			return nil, err
+		}
+		trash[snapItem.ID] = item
+	}
+	return trash, nil
+}
+
+// readSnapshotTrashItem rebuilds a deleted folder or file
+func readSnapshotTrashItem(snapItem snapshotTrashItem) (models.TrashItem, error) {
+	item := models.TrashItem{ID: snapItem.ID, Path: snapItem.Path, DeletedAt: snapItem.DeletedAt}
+	switch {
+	case snapItem.Folder != nil && snapItem.File == nil:
+		if _, err := snapshotName("folder", snapItem.Folder.Name); err != nil {
+			return models.TrashItem{}, err
+		}
+		folder, err := readSnapshotFolder("trash/"+snapItem.ID, *snapItem.Folder)
+		if err != nil {
+			return models.TrashItem{}, err
+		}
+		item.Folder = &folder
+	case snapItem.File != nil && snapItem.Folder == nil:
+		if _, err := snapshotName("file", snapItem.File.Name); err != nil {
+			return models.TrashItem{}, err
+		}
+		file := readSnapshotFile(*snapItem.File)
+		item.File = &file
+	default:
+		return models.TrashItem{}, fmt.Errorf("Error: Invalid snapshot: trash item %q needs either a folder or a file.", snapItem.ID)
+	}
+	return item, nil
+}
+
+// readSnapshotObjects checks that every object of the user is stored under
+// the hash of its data
+func readSnapshotObjects(userName string, objects map[string][]byte) (map[string][]byte, error) {
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	for hash, data := range objects {
+		if ObjectHash(data) != hash {
+			return nil, fmt.Errorf("Error: Invalid snapshot: object %q of %s doesn't match its hash.", hash, userName)
+		}
+	}
+	return objects, nil
+}
+
+// readSnapshotTreeSnapshots rebuilds the tree snapshots of the user by the
+// key of their label, whose root must be among its objects
+func readSnapshotTreeSnapshots(userName string, list []models.TreeSnapshot, objects map[string][]byte) (map[string]models.TreeSnapshot, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	snapshots := make(map[string]models.TreeSnapshot, len(list))
+	for _, snapshot := range list {
+		labelKey, err := snapshotName("snapshot", snapshot.Label)
+		if err != nil {
+			return nil, err
+		}
+		if _, exist := snapshots[labelKey]; exist {
+			return nil, fmt.Errorf("Error: Invalid snapshot: snapshot %q of %s is duplicated.", snapshot.Label, userName)
+		}
+		if _, exist := objects[snapshot.Root]; !exist {
+			return nil, fmt.Errorf("Error: Invalid snapshot: snapshot %q of %s has a missing root.", snapshot.Label, userName)
+		}
+		snapshots[labelKey] = snapshot
+	}
+	return snapshots, nil
+}
+
+// SaveSnapshot atomically writes the users to the file at path, keeping its
+// mode if it exists
+func SaveSnapshot(path string, users map[string]models.User, sequence uint64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("Error: Cannot save %s: %v", path, err)
+	}
+	// Remove the temporary file if anything below fails
+	defer os.Remove(tmp.Name())
+
+	// The temporary file is private, keep the mode of the file it replaces
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error: Cannot save %s: %v", path, err)
+	}
+
+	if err := WriteSnapshot(tmp, users, sequence); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error: Cannot save %s: %v", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error: Cannot save %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error: Cannot save %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Error: Cannot save %s: %v", path, err)
+	}
+	return nil
+}
+
+// LoadSnapshot reads the snapshot stored in the file at path.
+// The returned error wraps fs.ErrNotExist when the file is missing.
+func LoadSnapshot(path string) (map[string]models.User, uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error: Cannot load %s: %w", path, err)
+	}
+	defer f.Close()
+	return ReadSnapshot(f)
+}
+
+// snapshotName validates a name read from a snapshot and returns its key.
+// Snapshots written before names kept their case hold the lower-cased names,
+// which are kept as they are.
+func snapshotName(kind, name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("Error: Invalid snapshot: %s with an empty name.", kind)
+	}
+	// Names are checked without the length limits of the current policy
+	var nameErr *utils.NameError
+	if _, err := (utils.NamePolicy{}).Normalize(name); errors.As(err, &nameErr) {
+		return "", fmt.Errorf("Error: Invalid snapshot: %s %q %s.", kind, name, nameErr.Reason)
+	}
+	return utils.NameKey(name), nil
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"virtual-file-system/internal/models"
+)
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	createdAt := time.Date(2023, 7, 1, 12, 30, 45, 123456789, time.UTC)
+	users := map[string]models.User{
+		"dalaoqi": {
+			Name: "dalaoqi",
+			Folders: map[string]models.Folder{
+				// Names keep their case under the key of the name
+				"docs": {
+					Name:        "Docs",
+					Description: "the docs description",
+					CreatedAt:   createdAt,
+					Files: map[string]models.File{
+						"test file": {Name: "Test File", Description: "test file description", CreatedAt: createdAt.Add(time.Minute)},
+					},
+				},
+				"empty": {Name: "empty", CreatedAt: createdAt.Add(time.Hour)},
+				"projects": {Name: "projects", CreatedAt: createdAt, Folders: map[string]models.Folder{
+					"2024": {Name: "2024", CreatedAt: createdAt, Folders: map[string]models.Folder{
+						"q1": {Name: "q1", CreatedAt: createdAt, Files: map[string]models.File{
+							"report": {Name: "report", CreatedAt: createdAt},
+						}},
+					}},
+				}},
+			},
+		},
+		"nobody": {
+			Name: "nobody",
+			Trash: map[string]models.TrashItem{
+				"1": {ID: "1", DeletedAt: createdAt, Folder: &models.Folder{Name: "Old", CreatedAt: createdAt, Files: map[string]models.File{
+					"draft": {Name: "draft", Size: 5, CreatedAt: createdAt, Content: []byte("hello")},
+				}}},
+				"2": {ID: "2", Path: "Old", DeletedAt: createdAt.Add(time.Hour), File: &models.File{Name: "memo", CreatedAt: createdAt}},
+			},
+			Snapshots: map[string]models.TreeSnapshot{
+				"before": {Label: "Before", CreatedAt: createdAt, Root: ObjectHash([]byte("{}"))},
+			},
+			Objects: map[string][]byte{ObjectHash([]byte("{}")): []byte("{}")},
+		},
+	}
+
+	var first bytes.Buffer
+	if err := WriteSnapshot(&first, users, 7); err != nil {
+		t.Fatalf("WriteSnapshot() has error: %s", err)
+	}
+	restored, sequence, err := ReadSnapshot(bytes.NewReader(first.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadSnapshot() has error: %s", err)
+	}
+	if sequence != 7 {
+		t.Errorf("ReadSnapshot() sequence = %d, expected 7", sequence)
+	}
+	if !reflect.DeepEqual(restored, users) {
+		t.Errorf("ReadSnapshot() = %v, expected %v", restored, users)
+	}
+
+	var second bytes.Buffer
+	if err := WriteSnapshot(&second, restored, sequence); err != nil {
+		t.Fatalf("WriteSnapshot() has error: %s", err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Errorf("Snapshot changed after a round trip:\n%s\n%s", first.String(), second.String())
+	}
+}
+
+func TestSnapshot_Invalid(t *testing.T) {
+	testCases := []struct {
+		name        string
+		data        string
+		expectedErr string
+	}{
+		{
+			name:        "Corrupt JSON",
+			data:        `{"version":1,"users":[`,
+			expectedErr: "Error: Invalid snapshot: unexpected EOF",
+		},
+		{
+			name:        "Unsupported version",
+			data:        `{"version":99,"users":[]}`,
+			expectedErr: "Error: Invalid snapshot: unsupported version 99",
+		},
+		{
+			name:        "Duplicated user",
+			data:        `{"version":1,"users":[{"name":"dalaoqi"},{"name":"DALAOQI"}]}`,
+			expectedErr: `Error: Invalid snapshot: user "DALAOQI" is duplicated.`,
+		},
+		{
+			name:        "User with invalid chars",
+			data:        `{"version":1,"users":[{"name":"dalaoqi?"}]}`,
+			expectedErr: `Error: Invalid snapshot: user "dalaoqi?" contains the invalid char '?' at position 8.`,
+		},
+		{
+			name:        "Duplicated folder",
+			data:        `{"version":1,"users":[{"name":"dalaoqi","folders":[{"name":"docs"},{"name":"docs"}]}]}`,
+			expectedErr: `Error: Invalid snapshot: folder "docs" of dalaoqi is duplicated.`,
+		},
+		{
+			name:        "Duplicated sub-folder",
+			data:        `{"version":1,"users":[{"name":"dalaoqi","folders":[{"name":"docs","folders":[{"name":"a"},{"name":"a"}]}]}]}`,
+			expectedErr: `Error: Invalid snapshot: folder "a" of dalaoqi/docs is duplicated.`,
+		},
+		{
+			name:        "Sub-folder with invalid chars",
+			data:        `{"version":1,"users":[{"name":"dalaoqi","folders":[{"name":"docs","folders":[{"name":"a/b"}]}]}]}`,
+			expectedErr: `Error: Invalid snapshot: folder "a/b" contains the invalid char '/' at position 2.`,
+		},
+		{
+			name:        "File with an empty name",
+			data:        `{"version":1,"users":[{"name":"dalaoqi","folders":[{"name":"docs","files":[{"name":""}]}]}]}`,
+			expectedErr: "Error: Invalid snapshot: file with an empty name.",
+		},
+		{
+			name:        "Duplicated file",
+			data:        `{"version":1,"users":[{"name":"dalaoqi","folders":[{"name":"docs","files":[{"name":"a"},{"name":"A"}]}]}]}`,
+			expectedErr: `Error: Invalid snapshot: file "A" in dalaoqi/docs is duplicated.`,
+		},
+		{
+			name:        "Duplicated trash item",
+			data:        `{"version":1,"users":[{"name":"dalaoqi","trash":[{"id":"1","file":{"name":"a"}},{"id":"1","file":{"name":"b"}}]}]}`,
+			expectedErr: `Error: Invalid snapshot: trash item "1" of dalaoqi is duplicated.`,
+		},
+		{
+			name:        "Trash item without a folder nor a file",
+			data:        `{"version":1,"users":[{"name":"dalaoqi","trash":[{"id":"1"}]}]}`,
+			expectedErr: `Error: Invalid snapshot: trash item "1" needs either a folder or a file.`,
+		},
+		{
+			name:        "Trash item with invalid chars",
+			data:        `{"version":1,"users":[{"name":"dalaoqi","trash":[{"id":"1","folder":{"name":"docs","files":[{"name":"a|b"}]}}]}]}`,
+			expectedErr: `Error: Invalid snapshot: file "a|b" contains the invalid char '|' at position 2.`,
+		},
+		{
+			name:        "Object not matching its hash",
+			data:        `{"version":1,"users":[{"name":"dalaoqi","objects":{"00":"aGk="}}]}`,
+			expectedErr: `Error: Invalid snapshot: object "00" of dalaoqi doesn't match its hash.`,
+		},
+		{
+			name:        "Snapshot with a missing root",
+			data:        `{"version":1,"users":[{"name":"dalaoqi","snapshots":[{"label":"before","root":"00"}]}]}`,
+			expectedErr: `Error: Invalid snapshot: snapshot "before" of dalaoqi has a missing root.`,
+		},
+		{
+			name: "Duplicated snapshot",
+			data: `{"version":1,"users":[{"name":"dalaoqi","objects":{"8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4":"aGk="},` +
+				`"snapshots":[{"label":"before","root":"8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4"},` +
+				`{"label":"Before","root":"8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4"}]}]}`,
+			expectedErr: `Error: Invalid snapshot: snapshot "Before" of dalaoqi is duplicated.`,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := ReadSnapshot(strings.NewReader(test.data))
+			if err == nil {
+				t.Fatalf("ReadSnapshot() has no error, expected: %s", test.expectedErr)
+			}
+			if err.Error() != test.expectedErr {
+				t.Errorf("ReadSnapshot() has error: %s, expected: %s", err.Error(), test.expectedErr)
+			}
+		})
+	}
+}
+
+func TestSnapshot_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vfs.json")
+
+	if _, _, err := LoadSnapshot(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("LoadSnapshot() has error: %v, expected fs.ErrNotExist", err)
+	}
+
+	users := map[string]models.User{"dalaoqi": {Name: "dalaoqi"}}
+	if err := SaveSnapshot(path, users, 0); err != nil {
+		t.Fatalf("SaveSnapshot() has error: %s", err)
+	}
+	restored, _, err := LoadSnapshot(path)
+	if err != nil {
+		t.Fatalf("LoadSnapshot() has error: %s", err)
+	}
+	if !reflect.DeepEqual(restored, users) {
+		t.Errorf("LoadSnapshot() = %v, expected %v", restored, users)
+	}
+
+	// A new file is readable by everyone, and a saved one keeps its mode
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o644 {
+		t.Errorf("SaveSnapshot() mode = %v, expected -rw-r--r--", info.Mode().Perm())
+	}
+	if err := os.Chmod(path, 0o640); err != nil {
+		t.Fatalf("os.Chmod() has error: %s", err)
+	}
+	if err := SaveSnapshot(path, users, 1); err != nil {
+		t.Fatalf("SaveSnapshot() has error: %s", err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o640 {
+		t.Errorf("SaveSnapshot() mode = %v, expected -rw-r-----", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,458 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/utils"
+
+	"golang.org/x/text/cases"
+)
+
+var (
+	// ErrNotFound is returned when a user, folder or file doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrReadOnly is returned when a read-only transaction is asked to write
+	ErrReadOnly = errors.New("read-only transaction")
+	// ErrSameKey is returned when two entities of a tree have names with the
+	// same key
+	ErrSameKey = errors.New("names with the same key")
+)
+
+// Tx gives access to users, folders and files within a transaction.
+//
+// Entities are addressed by keys chosen by the caller. A folder key is the
+// slash-separated path of folder keys from the user's root, so "a/b" is the
+// folder "b" inside the folder "a", and ListFolders lists the folders right
+// under a parent, "" being the root. Get and List return metadata only: the
+// Folders of a user or folder and the Files of a folder are never populated,
+// use ListFolders and ListFiles instead. Put stores metadata only
+// and keeps the children of an existing entity, while Delete removes the
+// entity with all of its children. List methods return entities in ascending
+// key order. The content of a file is stored apart from its metadata in
+// chunks of ChunkSize bytes: GetChunk returns nil past the last chunk,
+// PutChunk replaces a chunk, DeleteChunks removes the chunks from an index on,
+// PutFile keeps them and DeleteFile removes them. The trash of a user holds
+// its deleted folders and files by their id: GetTrash returns an item with
+// its whole subtree and content, while ListTrash returns the items with the
+// metadata of their folder or file only. The tree snapshots of a user are
+// stored by the key of their label and refer to the objects of the user,
+// immutable values stored by the hex SHA-256 hash of their data, see
+// FreezeTree. Every method returns an error wrapping ErrNotFound when the
+// entity or one of its parents doesn't exist.
+type Tx interface {
+	GetUser(userKey string) (models.User, error)
+	PutUser(userKey string, user models.User) error
+	DeleteUser(userKey string) error
+	ListUsers() ([]models.User, error)
+
+	GetFolder(userKey, folderKey string) (models.Folder, error)
+	PutFolder(userKey, folderKey string, folder models.Folder) error
+	DeleteFolder(userKey, folderKey string) error
+	ListFolders(userKey, parentKey string) ([]models.Folder, error)
+
+	GetFile(userKey, folderKey, fileKey string) (models.File, error)
+	PutFile(userKey, folderKey, fileKey string, file models.File) error
+	DeleteFile(userKey, folderKey, fileKey string) error
+	ListFiles(userKey, folderKey string) ([]models.File, error)
+
+	GetChunk(userKey, folderKey, fileKey string, index int64) ([]byte, error)
+	PutChunk(userKey, folderKey, fileKey string, index int64, chunk []byte) error
+	DeleteChunks(userKey, folderKey, fileKey string, from int64) error
+
+	GetTrash(userKey, id string) (models.TrashItem, error)
+	PutTrash(userKey, id string, item models.TrashItem) error
+	DeleteTrash(userKey, id string) error
+	ListTrash(userKey string) ([]models.TrashItem, error)
+
+	GetTreeSnapshot(userKey, labelKey string) (models.TreeSnapshot, error)
+	PutTreeSnapshot(userKey, labelKey string, snapshot models.TreeSnapshot) error
+	DeleteTreeSnapshot(userKey, labelKey string) error
+	ListTreeSnapshots(userKey string) ([]models.TreeSnapshot, error)
+
+	GetObject(userKey, hash string) ([]byte, error)
+	PutObject(userKey, hash string, data []byte) error
+	DeleteObject(userKey, hash string) error
+	ListObjects(userKey string) ([]string, error)
+}
+
+// Store is a storage backend for the user tree.
+// Update runs fn in a read-write transaction which is committed if fn
+// returns nil and rolled back otherwise; View runs fn in a read-only one.
+type Store interface {
+	View(fn func(tx Tx) error) error
+	Update(fn func(tx Tx) error) error
+	Close() error
+}
+
+// Dump reads the whole user tree from tx. Every entity is stored under the
+// key of its name, see utils.NameKey, and so are the maps of the tree.
+func Dump(tx Tx) (map[string]models.User, error) {
+	return dumpKeyed(tx, nameKey)
+}
+
+// DumpFolder reads the folder stored at folderKey with its whole subtree and
+// the content of its files
+func DumpFolder(tx Tx, userKey, folderKey string) (models.Folder, error) {
+	folder, err := tx.GetFolder(userKey, folderKey)
+	if err != nil {
+		return models.Folder{}, err
+	}
+	return dumpFolder(tx, nameKey, userKey, folderKey, folder)
+}
+
+// keyFunc returns the key the entity named name is stored under. stored
+// reports whether that entity is stored under a key.
+type keyFunc func(name string, stored func(key string) bool) string
+
+// nameKey is the keyFunc of a tree stored under the keys of the names
+func nameKey(name string, _ func(key string) bool) string {
+	return utils.NameKey(name)
+}
+
+// dumpKeyed reads the whole user tree from tx, where every entity is stored
+// under the key returned by key, into maps keyed by the key of the names
+func dumpKeyed(tx Tx, key keyFunc) (map[string]models.User, error) {
+	users, err := tx.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	tree := make(map[string]models.User, len(users))
+	for _, user := range users {
+		if other, exist := tree[utils.NameKey(user.Name)]; exist {
+			return nil, fmt.Errorf("users %s and %s: %w", other.Name, user.Name, ErrSameKey)
+		}
+		userKey := key(user.Name, func(candidate string) bool {
+			stored, err := tx.GetUser(candidate)
+			return err == nil && stored.Name == user.Name
+		})
+		user, err = dumpUser(tx, key, userKey, user)
+		if err != nil {
+			return nil, err
+		}
+		tree[utils.NameKey(user.Name)] = user
+	}
+	return tree, nil
+}
+
+// dumpUser reads the folders, the trash, the tree snapshots and the objects
+// of the user stored at userKey
+func dumpUser(tx Tx, key keyFunc, userKey string, user models.User) (models.User, error) {
+	var err error
+	if user.Folders, err = dumpFolders(tx, key, userKey, ""); err != nil {
+		return models.User{}, err
+	}
+	if user.Trash, err = dumpTrash(tx, userKey); err != nil {
+		return models.User{}, err
+	}
+	if user.Snapshots, err = dumpTreeSnapshots(tx, userKey); err != nil {
+		return models.User{}, err
+	}
+	if user.Objects, err = dumpObjects(tx, userKey); err != nil {
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+// dumpFolders reads the folders under parentKey with all of their children
+func dumpFolders(tx Tx, key keyFunc, userKey, parentKey string) (map[string]models.Folder, error) {
+	folders, err := tx.ListFolders(userKey, parentKey)
+	if err != nil || len(folders) == 0 {
+		return nil, err
+	}
+
+	tree := make(map[string]models.Folder, len(folders))
+	for _, folder := range folders {
+		if other, exist := tree[utils.NameKey(folder.Name)]; exist {
+			return nil, fmt.Errorf("folders %s/%s and %s/%s: %w", parentKey, other.Name, parentKey, folder.Name, ErrSameKey)
+		}
+		folderKey := joinKey(parentKey, key(folder.Name, func(candidate string) bool {
+			stored, err := tx.GetFolder(userKey, joinKey(parentKey, candidate))
+			return err == nil && stored.Name == folder.Name
+		}))
+		folder, err = dumpFolder(tx, key, userKey, folderKey, folder)
+		if err != nil {
+			return nil, err
+		}
+		tree[utils.NameKey(folder.Name)] = folder
+	}
+	return tree, nil
+}
+
+// dumpFolder reads the files and the sub-folders of the folder stored at
+// folderKey
+func dumpFolder(tx Tx, key keyFunc, userKey, folderKey string, folder models.Folder) (models.Folder, error) {
+	files, err := tx.ListFiles(userKey, folderKey)
+	if err != nil {
+		return models.Folder{}, err
+	}
+	for _, file := range files {
+		if folder.Files == nil {
+			folder.Files = make(map[string]models.File)
+		}
+		if other, exist := folder.Files[utils.NameKey(file.Name)]; exist {
+			return models.Folder{}, fmt.Errorf("files %s/%s and %s/%s: %w", folderKey, other.Name, folderKey, file.Name, ErrSameKey)
+		}
+		fileKey := key(file.Name, func(candidate string) bool {
+			stored, err := tx.GetFile(userKey, folderKey, candidate)
+			return err == nil && stored.Name == file.Name
+		})
+		file.Content, err = ReadContent(tx, userKey, folderKey, fileKey)
+		if err != nil {
+			return models.Folder{}, err
+		}
+		folder.Files[utils.NameKey(file.Name)] = file
+	}
+	folder.Folders, err = dumpFolders(tx, key, userKey, folderKey)
+	if err != nil {
+		return models.Folder{}, err
+	}
+	return folder, nil
+}
+
+// dumpTrash reads the items in the trash of the user by their id
+func dumpTrash(tx Tx, userKey string) (map[string]models.TrashItem, error) {
+	items, err := tx.ListTrash(userKey)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+
+	trash := make(map[string]models.TrashItem, len(items))
+	for _, item := range items {
+		trash[item.ID], err = tx.GetTrash(userKey, item.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return trash, nil
+}
+
+// dumpTreeSnapshots reads the tree snapshots of the user by the key of their
+// label
+func dumpTreeSnapshots(tx Tx, userKey string) (map[string]models.TreeSnapshot, error) {
+	snapshots, err := tx.ListTreeSnapshots(userKey)
+	if err != nil || len(snapshots) == 0 {
+		return nil, err
+	}
+
+	tree := make(map[string]models.TreeSnapshot, len(snapshots))
+	for _, snapshot := range snapshots {
+		tree[utils.NameKey(snapshot.Label)] = snapshot
+	}
+	return tree, nil
+}
+
+// dumpObjects reads the objects of the user by their hash
+func dumpObjects(tx Tx, userKey string) (map[string][]byte, error) {
+	hashes, err := tx.ListObjects(userKey)
+	if err != nil || len(hashes) == 0 {
+		return nil, err
+	}
+
+	objects := make(map[string][]byte, len(hashes))
+	for _, hash := range hashes {
+		if objects[hash], err = tx.GetObject(userKey, hash); err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+// Restore replaces the whole user tree in tx with users
+func Restore(tx Tx, users map[string]models.User) error {
+	existing, err := tx.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range existing {
+		if err := tx.DeleteUser(utils.NameKey(user.Name)); err != nil {
+			return err
+		}
+	}
+
+	for userKey, user := range users {
+		if err := restoreUser(tx, userKey, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreUser writes the user at userKey with its folders, its trash, its
+// tree snapshots and its objects
+func restoreUser(tx Tx, userKey string, user models.User) error {
+	if err := tx.PutUser(userKey, user); err != nil {
+		return err
+	}
+	if err := restoreFolders(tx, userKey, "", user.Folders); err != nil {
+		return err
+	}
+	for id, item := range user.Trash {
+		if err := tx.PutTrash(userKey, id, item); err != nil {
+			return err
+		}
+	}
+	for hash, data := range user.Objects {
+		if err := tx.PutObject(userKey, hash, data); err != nil {
+			return err
+		}
+	}
+	for labelKey, snapshot := range user.Snapshots {
+		if err := tx.PutTreeSnapshot(userKey, labelKey, snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rekey moves the tree in tx under the keys of the names, see utils.NameKey,
+// if older versions wrote it under other keys: the lower-cased names, which
+// were the names themselves, or their case folding without normalization.
+// It changes nothing in a tree keyed by the names already, and fails with
+// ErrSameKey if two names of the tree have the same key.
+func Rekey(tx Tx) error {
+	stale, err := staleUsers(tx)
+	if err != nil || !stale {
+		return err
+	}
+
+	tree, err := dumpKeyed(tx, legacyKey)
+	if err != nil {
+		return err
+	}
+	users, err := tx.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		userKey := legacyKey(user.Name, func(candidate string) bool {
+			stored, err := tx.GetUser(candidate)
+			return err == nil && stored.Name == user.Name
+		})
+		if err := tx.DeleteUser(userKey); err != nil {
+			return err
+		}
+	}
+	return Restore(tx, tree)
+}
+
+// legacyKey returns the key the entity named name is stored under by the
+// current or an older version
+func legacyKey(name string, stored func(key string) bool) string {
+	for _, key := range []string{utils.NameKey(name), cases.Fold().String(name)} {
+		if stored(key) {
+			return key
+		}
+	}
+	return name
+}
+
+// staleUsers reports whether a user of the tree, or one of its folders or
+// files, isn't stored under the key of its name
+func staleUsers(tx Tx) (bool, error) {
+	users, err := tx.ListUsers()
+	if err != nil {
+		return false, err
+	}
+	for _, user := range users {
+		userKey := utils.NameKey(user.Name)
+		if stored, err := tx.GetUser(userKey); err != nil || stored.Name != user.Name {
+			return true, nil
+		}
+		if stale, err := staleFolders(tx, userKey, ""); err != nil || stale {
+			return stale, err
+		}
+	}
+	return false, nil
+}
+
+// staleFolders reports whether a folder under parentKey, or one of their
+// children, isn't stored under the key of its name
+func staleFolders(tx Tx, userKey, parentKey string) (bool, error) {
+	folders, err := tx.ListFolders(userKey, parentKey)
+	if err != nil {
+		return false, err
+	}
+	for _, folder := range folders {
+		folderKey := joinKey(parentKey, utils.NameKey(folder.Name))
+		if stored, err := tx.GetFolder(userKey, folderKey); err != nil || stored.Name != folder.Name {
+			return true, nil
+		}
+		files, err := tx.ListFiles(userKey, folderKey)
+		if err != nil {
+			return false, err
+		}
+		for _, file := range files {
+			if stored, err := tx.GetFile(userKey, folderKey, utils.NameKey(file.Name)); err != nil || stored.Name != file.Name {
+				return true, nil
+			}
+		}
+		if stale, err := staleFolders(tx, userKey, folderKey); err != nil || stale {
+			return stale, err
+		}
+	}
+	return false, nil
+}
+
+// RestoreFolder writes the folder at folderKey with its whole subtree and
+// the content of its files, as read by DumpFolder
+func RestoreFolder(tx Tx, userKey, folderKey string, folder models.Folder) error {
+	if err := tx.PutFolder(userKey, folderKey, folder); err != nil {
+		return err
+	}
+	for fileKey, file := range folder.Files {
+		if err := tx.PutFile(userKey, folderKey, fileKey, file); err != nil {
+			return err
+		}
+		if len(file.Content) > 0 {
+			if err := WriteContent(tx, userKey, folderKey, fileKey, file.Content); err != nil {
+				return err
+			}
+		}
+	}
+	return restoreFolders(tx, userKey, folderKey, folder.Folders)
+}
+
+// restoreFolders writes the folders under parentKey with all of their children
+func restoreFolders(tx Tx, userKey, parentKey string, folders map[string]models.Folder) error {
+	for key, folder := range folders {
+		if err := RestoreFolder(tx, userKey, joinKey(parentKey, key), folder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trashMeta returns the item with the metadata of its folder or file only
+func trashMeta(item models.TrashItem) models.TrashItem {
+	if item.Folder != nil {
+		folder := *item.Folder
+		folder.Folders, folder.Files = nil, nil
+		item.Folder = &folder
+	}
+	if item.File != nil {
+		file := *item.File
+		file.Content = nil
+		item.File = &file
+	}
+	return item
+}
+
+// joinKey appends a folder key to the key of its parent
+func joinKey(parentKey, key string) string {
+	if parentKey == "" {
+		return key
+	}
+	return parentKey + "/" + key
+}
+
+// splitKey splits a folder key into the key of its parent and its own name
+func splitKey(folderKey string) (string, string) {
+	i := strings.LastIndex(folderKey, "/")
+	if i < 0 {
+		return "", folderKey
+	}
+	return folderKey[:i], folderKey[i+1:]
+}
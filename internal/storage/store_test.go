@@ -0,0 +1,573 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"virtual-file-system/internal/models"
+)
+
+// backends creates an empty store of every kind
+var backends = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{
+		name: "memory",
+		open: func(t *testing.T) Store { return NewMemoryStore(nil) },
+	},
+	{
+		name: "file",
+		open: func(t *testing.T) Store {
+			store, err := OpenFileStore(filepath.Join(t.TempDir(), "vfs.json"))
+			if err != nil {
+				t.Fatalf("OpenFileStore() has error: %s", err)
+			}
+			return store
+		},
+	},
+	{
+		name: "bolt",
+		open: func(t *testing.T) Store {
+			store, err := OpenBoltStore(filepath.Join(t.TempDir(), "vfs.db"))
+			if err != nil {
+				t.Fatalf("OpenBoltStore() has error: %s", err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return store
+		},
+	},
+}
+
+// seed fills the store with users and returns the tree as written
+func seed(t *testing.T, store Store) map[string]models.User {
+	t.Helper()
+	createdAt := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	users := map[string]models.User{
+		"dalaoqi": {
+			Name: "dalaoqi",
+			Folders: map[string]models.Folder{
+				"docs": {Name: "docs", Description: "the docs", CreatedAt: createdAt, Files: map[string]models.File{
+					"notes": {Name: "notes", Description: "meeting notes", Size: 5, CreatedAt: createdAt, ModifiedAt: createdAt, Content: []byte("hello")},
+					"todo":  {Name: "todo", CreatedAt: createdAt.Add(time.Minute)},
+				}},
+				"empty": {Name: "empty", CreatedAt: createdAt},
+				"projects": {Name: "projects", CreatedAt: createdAt, Folders: map[string]models.Folder{
+					"2024": {Name: "2024", CreatedAt: createdAt, Folders: map[string]models.Folder{
+						"q1": {Name: "q1", CreatedAt: createdAt, Files: map[string]models.File{
+							"report": {Name: "report", CreatedAt: createdAt},
+						}},
+					}},
+				}},
+			},
+		},
+		"other": {
+			Name:        "other",
+			LastTrashID: 3,
+			Trash: map[string]models.TrashItem{
+				"1": {ID: "1", DeletedAt: createdAt, Folder: &models.Folder{Name: "old", CreatedAt: createdAt, Files: map[string]models.File{
+					"draft": {Name: "draft", Size: 3, CreatedAt: createdAt, Content: []byte("abc")},
+				}}},
+				"2": {ID: "2", Path: "old", DeletedAt: createdAt, File: &models.File{Name: "memo", Size: 2, CreatedAt: createdAt, Content: []byte("hi")}},
+			},
+			Snapshots: map[string]models.TreeSnapshot{
+				"empty": {Label: "Empty", CreatedAt: createdAt, Root: ObjectHash([]byte("{}"))},
+			},
+			Objects: map[string][]byte{ObjectHash([]byte("{}")): []byte("{}")},
+		},
+	}
+	err := store.Update(func(tx Tx) error {
+		return Restore(tx, users)
+	})
+	if err != nil {
+		t.Fatalf("Restore() has error: %s", err)
+	}
+	return users
+}
+
+func TestStore_CRUD(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			users := seed(t, store)
+
+			got, err := dump(store)
+			if err != nil {
+				t.Fatalf("Dump() has error: %s", err)
+			}
+			if !reflect.DeepEqual(got, users) {
+				t.Errorf("Dump() = %v, expected %v", got, users)
+			}
+
+			// Putting metadata must keep the children
+			err = store.Update(func(tx Tx) error {
+				return tx.PutFolder("dalaoqi", "docs", models.Folder{Name: "docs", Description: "updated"})
+			})
+			if err != nil {
+				t.Fatalf("Store.Update() has error: %s", err)
+			}
+
+			store.View(func(tx Tx) error {
+				folder, _ := tx.GetFolder("dalaoqi", "docs")
+				if folder.Description != "updated" || folder.Files != nil {
+					t.Errorf("Tx.GetFolder() = %v, expected the updated metadata only", folder)
+				}
+				files, _ := tx.ListFiles("dalaoqi", "docs")
+				if len(files) != 2 || files[0].Name != "notes" || files[1].Name != "todo" {
+					t.Errorf("Tx.ListFiles() = %v, expected notes and todo", files)
+				}
+				folders, _ := tx.ListFolders("dalaoqi", "")
+				if len(folders) != 3 || folders[0].Name != "docs" || folders[1].Name != "empty" || folders[2].Name != "projects" {
+					t.Errorf("Tx.ListFolders() = %v, expected docs, empty and projects", folders)
+				}
+				folders, _ = tx.ListFolders("dalaoqi", "projects/2024")
+				if len(folders) != 1 || folders[0].Name != "q1" || folders[0].Folders != nil || folders[0].Files != nil {
+					t.Errorf("Tx.ListFolders() = %v, expected q1 without children", folders)
+				}
+				file, err := tx.GetFile("dalaoqi", "projects/2024/q1", "report")
+				if err != nil || file.Name != "report" {
+					t.Errorf("Tx.GetFile() = %v, %v, expected report", file, err)
+				}
+				if file, _ := tx.GetFile("dalaoqi", "docs", "notes"); file.Size != 5 || file.Content != nil {
+					t.Errorf("Tx.GetFile() = %v, expected the metadata without content", file)
+				}
+				content, err := ReadContent(tx, "dalaoqi", "docs", "notes")
+				if err != nil || string(content) != "hello" {
+					t.Errorf("ReadContent() = %q, %v, expected hello", content, err)
+				}
+				if err := WriteContent(tx, "dalaoqi", "docs", "notes", nil); !errors.Is(err, ErrReadOnly) {
+					t.Errorf("WriteContent() in View has error: %v, expected ErrReadOnly", err)
+				}
+				if err := tx.PutUser("new", models.User{Name: "new"}); !errors.Is(err, ErrReadOnly) {
+					t.Errorf("Tx.PutUser() in View has error: %v, expected ErrReadOnly", err)
+				}
+				return nil
+			})
+
+			// Putting metadata must keep the content, deleting the file removes it
+			err = store.Update(func(tx Tx) error {
+				if err := WriteContent(tx, "dalaoqi", "docs", "todo", []byte("buy milk")); err != nil {
+					return err
+				}
+				if err := tx.PutFile("dalaoqi", "docs", "todo", models.File{Name: "todo", Description: "updated"}); err != nil {
+					return err
+				}
+				if content, _ := ReadContent(tx, "dalaoqi", "docs", "todo"); string(content) != "buy milk" {
+					t.Errorf("ReadContent() after PutFile() = %q, expected buy milk", content)
+				}
+				if err := tx.DeleteFile("dalaoqi", "docs", "todo"); err != nil {
+					return err
+				}
+				if err := tx.PutFile("dalaoqi", "docs", "todo", models.File{Name: "todo"}); err != nil {
+					return err
+				}
+				if content, _ := ReadContent(tx, "dalaoqi", "docs", "todo"); content != nil {
+					t.Errorf("ReadContent() after DeleteFile() = %q, expected none", content)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Store.Update() has error: %s", err)
+			}
+
+			// Deleting a folder removes its sub-folders and files
+			err = store.Update(func(tx Tx) error {
+				if err := tx.DeleteFolder("dalaoqi", "projects"); err != nil {
+					return err
+				}
+				if _, err := tx.GetFolder("dalaoqi", "projects/2024/q1"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tx.GetFolder() after DeleteFolder() has error: %v, expected ErrNotFound", err)
+				}
+				if err := tx.DeleteFolder("dalaoqi", "docs"); err != nil {
+					return err
+				}
+				if err := tx.PutFolder("dalaoqi", "docs", models.Folder{Name: "docs"}); err != nil {
+					return err
+				}
+				files, err := tx.ListFiles("dalaoqi", "docs")
+				if len(files) != 0 {
+					t.Errorf("Tx.ListFiles() after DeleteFolder() = %v, expected none", files)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatalf("Store.Update() has error: %s", err)
+			}
+		})
+	}
+}
+
+func TestStore_Rollback(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			seed(t, store)
+			before, _ := dump(store)
+
+			failure := errors.New("failure")
+			err := store.Update(func(tx Tx) error {
+				tx.PutUser("new", models.User{Name: "new"})
+				tx.PutFolder("dalaoqi", "new", models.Folder{Name: "new"})
+				tx.PutFile("dalaoqi", "docs", "notes", models.File{Name: "notes", Description: "changed"})
+				WriteContent(tx, "dalaoqi", "docs", "notes", []byte("changed"))
+				WriteContent(tx, "dalaoqi", "docs", "todo", []byte("new content"))
+				tx.DeleteFile("dalaoqi", "docs", "todo")
+				tx.PutFolder("dalaoqi", "projects/2024/q2", models.Folder{Name: "q2"})
+				tx.DeleteFolder("dalaoqi", "projects/2024")
+				tx.DeleteFolder("dalaoqi", "docs")
+				tx.DeleteUser("dalaoqi")
+				tx.PutTrash("other", "3", models.TrashItem{File: &models.File{Name: "new"}})
+				tx.PutTrash("other", "2", models.TrashItem{File: &models.File{Name: "changed"}})
+				tx.DeleteTrash("other", "1")
+				return failure
+			})
+			if !errors.Is(err, failure) {
+				t.Fatalf("Store.Update() has error: %v, expected %v", err, failure)
+			}
+
+			after, _ := dump(store)
+			if !reflect.DeepEqual(after, before) {
+				t.Errorf("Store.Update() wasn't rolled back: %v, expected %v", after, before)
+			}
+		})
+	}
+}
+
+func TestStore_Trash(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			users := seed(t, store)
+
+			// Listing returns the metadata of the items only
+			store.View(func(tx Tx) error {
+				items, err := tx.ListTrash("other")
+				if err != nil || len(items) != 2 {
+					t.Fatalf("Tx.ListTrash() = %v, %v, expected 2 items", items, err)
+				}
+				if items[0].ID != "1" || items[0].Folder.Name != "old" || items[0].Folder.Files != nil {
+					t.Errorf("Tx.ListTrash()[0] = %+v, expected the folder old without children", items[0])
+				}
+				if items[1].ID != "2" || items[1].File.Size != 2 || items[1].File.Content != nil {
+					t.Errorf("Tx.ListTrash()[1] = %+v, expected the file memo without content", items[1])
+				}
+				item, err := tx.GetTrash("other", "1")
+				if err != nil || !reflect.DeepEqual(item, users["other"].Trash["1"]) {
+					t.Errorf("Tx.GetTrash() = %+v, %v, expected %+v", item, err, users["other"].Trash["1"])
+				}
+				if items, _ := tx.ListTrash("dalaoqi"); len(items) != 0 {
+					t.Errorf("Tx.ListTrash() of an empty trash = %v, expected none", items)
+				}
+				return nil
+			})
+
+			// Changing a returned item leaves the stored one as it was
+			err := store.Update(func(tx Tx) error {
+				item, err := tx.GetTrash("other", "2")
+				if err != nil {
+					return err
+				}
+				item.File.Name = "changed"
+				if item, _ := tx.GetTrash("other", "2"); item.File.Name != "memo" {
+					t.Errorf("Tx.GetTrash() after a change = %+v, expected memo", item)
+				}
+				return tx.DeleteTrash("other", "1")
+			})
+			if err != nil {
+				t.Fatalf("Store.Update() has error: %s", err)
+			}
+
+			store.Update(func(tx Tx) error {
+				if _, err := tx.GetTrash("other", "1"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tx.GetTrash() after DeleteTrash() has error: %v, expected ErrNotFound", err)
+				}
+				if err := tx.DeleteTrash("other", "1"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tx.DeleteTrash() has error: %v, expected ErrNotFound", err)
+				}
+				if _, err := tx.ListTrash("nobody"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tx.ListTrash() has error: %v, expected ErrNotFound", err)
+				}
+				if err := tx.PutTrash("nobody", "1", models.TrashItem{File: &models.File{Name: "memo"}}); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tx.PutTrash() has error: %v, expected ErrNotFound", err)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestStore_NotFound(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			seed(t, store)
+			store.Update(func(tx Tx) error {
+				if _, err := tx.GetUser("nobody"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tx.GetUser() has error: %v, expected ErrNotFound", err)
+				}
+				if _, err := tx.GetFolder("dalaoqi", "nothing"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tx.GetFolder() has error: %v, expected ErrNotFound", err)
+				}
+				if _, err := tx.GetFile("dalaoqi", "docs", "nothing"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tx.GetFile() has error: %v, expected ErrNotFound", err)
+				}
+				if err := tx.PutFile("dalaoqi", "nothing", "notes", models.File{Name: "notes"}); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tx.PutFile() has error: %v, expected ErrNotFound", err)
+				}
+				if err := tx.PutFolder("dalaoqi", "nothing/docs", models.Folder{Name: "docs"}); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tx.PutFolder() under a missing parent has error: %v, expected ErrNotFound", err)
+				}
+				if _, err := tx.ListFolders("dalaoqi", "nothing"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tx.ListFolders() has error: %v, expected ErrNotFound", err)
+				}
+				if err := tx.PutFolder("nobody", "docs", models.Folder{Name: "docs"}); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tx.PutFolder() has error: %v, expected ErrNotFound", err)
+				}
+				if _, err := ReadContent(tx, "dalaoqi", "docs", "nothing"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("ReadContent() has error: %v, expected ErrNotFound", err)
+				}
+				if err := WriteContent(tx, "dalaoqi", "docs", "nothing", []byte("hello")); !errors.Is(err, ErrNotFound) {
+					t.Errorf("WriteContent() has error: %v, expected ErrNotFound", err)
+				}
+				if err := tx.DeleteFile("dalaoqi", "docs", "nothing"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tx.DeleteFile() has error: %v, expected ErrNotFound", err)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestStore_Chunks(t *testing.T) {
+	// pattern returns n bytes that differ from one chunk to the next
+	pattern := func(from, n int) []byte {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte((from + i) % 251)
+		}
+		return data
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			seed(t, store)
+
+			testCases := []struct {
+				name     string
+				update   func(tx Tx) error
+				expected []byte
+			}{
+				{
+					name: "Write several chunks",
+					update: func(tx Tx) error {
+						return WriteContent(tx, "dalaoqi", "docs", "todo", pattern(0, 2*ChunkSize+100))
+					},
+					expected: pattern(0, 2*ChunkSize+100),
+				},
+				{
+					name: "Append across a chunk boundary",
+					update: func(tx Tx) error {
+						return AppendContent(tx, "dalaoqi", "docs", "todo", 2*ChunkSize+100, pattern(2*ChunkSize+100, ChunkSize))
+					},
+					expected: pattern(0, 3*ChunkSize+100),
+				},
+				{
+					name: "Truncate inside a chunk",
+					update: func(tx Tx) error {
+						return TruncateContent(tx, "dalaoqi", "docs", "todo", 3*ChunkSize+100, ChunkSize+10)
+					},
+					expected: pattern(0, ChunkSize+10),
+				},
+				{
+					name: "Truncate at a chunk boundary",
+					update: func(tx Tx) error {
+						return TruncateContent(tx, "dalaoqi", "docs", "todo", ChunkSize+10, ChunkSize)
+					},
+					expected: pattern(0, ChunkSize),
+				},
+				{
+					name: "Grow with zero bytes",
+					update: func(tx Tx) error {
+						return TruncateContent(tx, "dalaoqi", "docs", "todo", ChunkSize, 2*ChunkSize+1)
+					},
+					expected: append(pattern(0, ChunkSize), make([]byte, ChunkSize+1)...),
+				},
+				{
+					name: "Copy to another file",
+					update: func(tx Tx) error {
+						if err := WriteContent(tx, "dalaoqi", "docs", "todo", pattern(7, ChunkSize+3)); err != nil {
+							return err
+						}
+						if err := CopyContent(tx, "dalaoqi", "docs", "todo", "dalaoqi", "projects/2024/q1", "report"); err != nil {
+							return err
+						}
+						return WriteContent(tx, "dalaoqi", "docs", "todo", nil)
+					},
+					expected: nil,
+				},
+			}
+
+			for _, test := range testCases {
+				if err := store.Update(test.update); err != nil {
+					t.Fatalf("%s has error: %s", test.name, err)
+				}
+				store.View(func(tx Tx) error {
+					content, err := ReadContent(tx, "dalaoqi", "docs", "todo")
+					if err != nil || !bytes.Equal(content, test.expected) {
+						t.Errorf("%s: ReadContent() = %d bytes, %v, expected %d bytes", test.name, len(content), err, len(test.expected))
+					}
+					index := int64(len(test.expected)+ChunkSize-1) / ChunkSize
+					if chunk, err := tx.GetChunk("dalaoqi", "docs", "todo", index); chunk != nil || err != nil {
+						t.Errorf("%s: Tx.GetChunk() past the end = %d bytes, %v, expected none", test.name, len(chunk), err)
+					}
+					return nil
+				})
+			}
+
+			store.View(func(tx Tx) error {
+				content, err := ReadContent(tx, "dalaoqi", "projects/2024/q1", "report")
+				if err != nil || !bytes.Equal(content, pattern(7, ChunkSize+3)) {
+					t.Errorf("ReadContent() of the copy = %d bytes, %v, expected %d bytes", len(content), err, ChunkSize+3)
+				}
+				return nil
+			})
+
+			err := store.Update(func(tx Tx) error {
+				return tx.PutChunk("dalaoqi", "docs", "todo", 2, []byte("hole"))
+			})
+			if err == nil {
+				t.Errorf("Tx.PutChunk() past the end of the content has no error")
+			}
+		})
+	}
+}
+
+func TestMemoryStore_UnderlyingMap(t *testing.T) {
+	users := map[string]models.User{}
+	store := NewMemoryStore(users)
+	err := store.Update(func(tx Tx) error {
+		if err := tx.PutUser("dalaoqi", models.User{Name: "dalaoqi"}); err != nil {
+			return err
+		}
+		return tx.PutFolder("dalaoqi", "docs", models.Folder{Name: "docs"})
+	})
+	if err != nil {
+		t.Fatalf("MemoryStore.Update() has error: %s", err)
+	}
+	if _, exist := users["dalaoqi"].Folders["docs"]; !exist {
+		t.Errorf("MemoryStore.Update() didn't modify the underlying map: %v", users)
+	}
+}
+
+func TestPersistentStores_Reopen(t *testing.T) {
+	testCases := []struct {
+		name string
+		open func(path string) (Store, error)
+	}{
+		{
+			name: "file",
+			open: func(path string) (Store, error) { return OpenFileStore(path) },
+		},
+		{
+			name: "bolt",
+			open: func(path string) (Store, error) { return OpenBoltStore(path) },
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "vfs")
+			store, err := test.open(path)
+			if err != nil {
+				t.Fatalf("Opening the store has error: %s", err)
+			}
+			users := seed(t, store)
+			store.Close()
+
+			reopened, err := test.open(path)
+			if err != nil {
+				t.Fatalf("Reopening the store has error: %s", err)
+			}
+			defer reopened.Close()
+			got, _ := dump(reopened)
+			if !reflect.DeepEqual(got, users) {
+				t.Errorf("Reopened store = %v, expected %v", got, users)
+			}
+		})
+	}
+}
+
+func TestRekey(t *testing.T) {
+	// Older versions stored every entity under its lower-cased name, which
+	// isn't the key of names like "straße", or under its case folding, which
+	// isn't the key of decomposed names
+	legacy := map[string]models.User{
+		"cafe\u0301": {Name: "Cafe\u0301"},
+		"straße": {Name: "straße", Folders: map[string]models.Folder{
+			"übersicht": {Name: "übersicht", Folders: map[string]models.Folder{
+				"σοφος": {Name: "σοφος"},
+			}, Files: map[string]models.File{
+				"maß": {Name: "maß", Size: 5, Content: []byte("hello")},
+			}},
+		}},
+		"other": {Name: "other"},
+	}
+	expected := map[string]models.User{
+		"café": {Name: "Cafe\u0301"},
+		"strasse": {Name: "straße", Folders: map[string]models.Folder{
+			"übersicht": {Name: "übersicht", Folders: map[string]models.Folder{
+				"σοφοσ": {Name: "σοφος"},
+			}, Files: map[string]models.File{
+				"mass": {Name: "maß", Size: 5, Content: []byte("hello")},
+			}},
+		}},
+		"other": {Name: "other"},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			err := store.Update(func(tx Tx) error {
+				if err := Restore(tx, legacy); err != nil {
+					return err
+				}
+				// Re-keying twice is the same as once
+				if err := Rekey(tx); err != nil {
+					return err
+				}
+				return Rekey(tx)
+			})
+			if err != nil {
+				t.Fatalf("Rekey() has error: %s", err)
+			}
+			got, err := dump(store)
+			if err != nil || !reflect.DeepEqual(got, expected) {
+				t.Errorf("Rekeyed tree = %v, %v, expected %v", got, err, expected)
+			}
+		})
+	}
+
+	// Names which only differ by their case can't be re-keyed
+	store := NewMemoryStore(map[string]models.User{
+		"strasse": {Name: "strasse"},
+		"straße":  {Name: "straße"},
+	})
+	err := store.Update(Rekey)
+	if !errors.Is(err, ErrSameKey) {
+		t.Errorf("Rekey() has error: %v, expected: %v", err, ErrSameKey)
+	}
+}
+
+// dump reads the whole tree of the store
+func dump(store Store) (map[string]models.User, error) {
+	var users map[string]models.User
+	err := store.View(func(tx Tx) error {
+		var err error
+		users, err = Dump(tx)
+		return err
+	})
+	return users, err
+}
@@ -0,0 +1,623 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"virtual-file-system/internal/models"
+	"virtual-file-system/internal/utils"
+)
+
+// The kinds of TreeChange
+const (
+	TreeAdded    = "added"
+	TreeRemoved  = "removed"
+	TreeModified = "modified"
+)
+
+// TreeChange is a folder or file that differs between two frozen trees.
+// Path is the slash-separated path of its name and the names of its parents.
+type TreeChange struct {
+	Change string
+	Path   string
+	Folder bool
+}
+
+// treeFolder is a folder frozen into an object, the root of the user having
+// no metadata. Its sub-folders are referred to by the hash of their object
+// and the content of its files by the hashes of their chunks, so that frozen
+// trees share every folder and chunk that didn't change between them.
+type treeFolder struct {
+	Name        string              `json:"name,omitempty"`
+	Description string              `json:"description,omitempty"`
+	CreatedAt   time.Time           `json:"createdAt"`
+	ModifiedAt  time.Time           `json:"modifiedAt"`
+	Folders     map[string]string   `json:"folders,omitempty"`
+	Files       map[string]treeFile `json:"files,omitempty"`
+}
+
+type treeFile struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ModifiedAt  time.Time `json:"modifiedAt"`
+	Chunks      []string  `json:"chunks,omitempty"`
+}
+
+func (f treeFolder) folder() models.Folder {
+	return models.Folder{Name: f.Name, Description: f.Description, CreatedAt: f.CreatedAt, ModifiedAt: f.ModifiedAt}
+}
+
+func (f treeFile) file() models.File {
+	return models.File{
+		Name:        f.Name,
+		Description: f.Description,
+		Size:        f.Size,
+		CreatedAt:   f.CreatedAt,
+		ModifiedAt:  f.ModifiedAt,
+	}
+}
+
+// FreezeTree stores the folders and files of the user as objects and returns
+// the hash of the root object. Every folder and chunk of content is an
+// object, written only if no object has its data yet, so freezing a tree
+// again only writes what changed since. base is the root of a tree frozen
+// before, or empty. The files whose metadata and chunk hashes are the ones
+// frozen in base keep them without their chunks being stored again, and the
+// folders whose entries all did keep their hash. Their content is still read
+// to be hashed, since a write of the same size within the same tick of the
+// clock leaves the metadata as it was.
+func FreezeTree(tx Tx, userKey, base string) (string, error) {
+	var baseNode treeFolder
+	if base != "" {
+		var err error
+		if baseNode, err = getFolderObject(tx, userKey, base); err != nil {
+			return "", err
+		}
+	}
+	return freezeFolder(tx, userKey, "", treeFolder{}, base, baseNode)
+}
+
+// freezeFolder stores node with the children of the folder at folderKey,
+// reusing the ones of base, the same folder frozen under baseHash before
+func freezeFolder(tx Tx, userKey, folderKey string, node treeFolder, baseHash string, base treeFolder) (string, error) {
+	folders, err := tx.ListFolders(userKey, folderKey)
+	if err != nil {
+		return "", err
+	}
+	for _, folder := range folders {
+		key := utils.NameKey(folder.Name)
+		child := treeFolder{
+			Name:        folder.Name,
+			Description: folder.Description,
+			CreatedAt:   folder.CreatedAt,
+			ModifiedAt:  folder.ModifiedAt,
+		}
+		childBaseHash, inBase := base.Folders[key]
+		var childBase treeFolder
+		if inBase {
+			if childBase, err = getFolderObject(tx, userKey, childBaseHash); err != nil {
+				return "", err
+			}
+		}
+		hash, err := freezeFolder(tx, userKey, joinKey(folderKey, key), child, childBaseHash, childBase)
+		if err != nil {
+			return "", err
+		}
+		if node.Folders == nil {
+			node.Folders = make(map[string]string)
+		}
+		node.Folders[key] = hash
+	}
+
+	// The root of the user holds no files
+	if folderKey != "" {
+		files, err := tx.ListFiles(userKey, folderKey)
+		if err != nil {
+			return "", err
+		}
+		for _, file := range files {
+			key := utils.NameKey(file.Name)
+			frozen, inBase := base.Files[key]
+			same := inBase && sameFile(frozen, file)
+			if same {
+				if same, err = sameContent(tx, userKey, folderKey, key, frozen.Chunks); err != nil {
+					return "", err
+				}
+			}
+			if !same {
+				if frozen, err = freezeFile(tx, userKey, folderKey, key, file); err != nil {
+					return "", err
+				}
+			}
+			if node.Files == nil {
+				node.Files = make(map[string]treeFile)
+			}
+			node.Files[key] = frozen
+		}
+	}
+
+	if baseHash != "" && sameFolder(node, base) {
+		return baseHash, nil
+	}
+	data, err := json.Marshal(node)
+	if err != nil {
+		return "", err
+	}
+	return putObject(tx, userKey, data)
+}
+
+// freezeFile stores the chunks of the file as objects
+func freezeFile(tx Tx, userKey, folderKey, fileKey string, file models.File) (treeFile, error) {
+	frozen := treeFile{
+		Name:        file.Name,
+		Description: file.Description,
+		Size:        file.Size,
+		CreatedAt:   file.CreatedAt,
+		ModifiedAt:  file.ModifiedAt,
+	}
+	for index := int64(0); ; index++ {
+		chunk, err := tx.GetChunk(userKey, folderKey, fileKey, index)
+		if err != nil {
+			return treeFile{}, err
+		}
+		if chunk == nil {
+			return frozen, nil
+		}
+		hash, err := putObject(tx, userKey, chunk)
+		if err != nil {
+			return treeFile{}, err
+		}
+		frozen.Chunks = append(frozen.Chunks, hash)
+	}
+}
+
+// sameFile reports whether the file has the metadata frozen in frozen
+func sameFile(frozen treeFile, file models.File) bool {
+	return frozen.Name == file.Name && frozen.Description == file.Description && frozen.Size == file.Size &&
+		frozen.CreatedAt.Equal(file.CreatedAt) && frozen.ModifiedAt.Equal(file.ModifiedAt)
+}
+
+// sameContent reports whether the chunks of the file stored at fileKey have
+// the hashes of chunks, without storing them
+func sameContent(tx Tx, userKey, folderKey, fileKey string, chunks []string) (bool, error) {
+	for index := int64(0); ; index++ {
+		chunk, err := tx.GetChunk(userKey, folderKey, fileKey, index)
+		if err != nil {
+			return false, err
+		}
+		if chunk == nil {
+			return index == int64(len(chunks)), nil
+		}
+		if index >= int64(len(chunks)) || ObjectHash(chunk) != chunks[index] {
+			return false, nil
+		}
+	}
+}
+
+// sameFolder reports whether the frozen folders a and b have the same
+// metadata and entries
+func sameFolder(a, b treeFolder) bool {
+	if a.Name != b.Name || a.Description != b.Description ||
+		!a.CreatedAt.Equal(b.CreatedAt) || !a.ModifiedAt.Equal(b.ModifiedAt) ||
+		len(a.Folders) != len(b.Folders) || len(a.Files) != len(b.Files) {
+		return false
+	}
+	for key, hash := range a.Folders {
+		if b.Folders[key] != hash {
+			return false
+		}
+	}
+	for key, file := range a.Files {
+		other, exist := b.Files[key]
+		if !exist || !sameHashes(file.Chunks, other.Chunks) || !sameFile(file, other.file()) {
+			return false
+		}
+	}
+	return true
+}
+
+// putObject stores data under its hash unless an object has it already
+func putObject(tx Tx, userKey string, data []byte) (string, error) {
+	hash := ObjectHash(data)
+	_, err := tx.GetObject(userKey, hash)
+	if err == nil || !errors.Is(err, ErrNotFound) {
+		return hash, err
+	}
+	return hash, tx.PutObject(userKey, hash, data)
+}
+
+// ObjectHash returns the hash an object holding data is stored under
+func ObjectHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// getFolderObject reads the frozen folder stored under hash
+func getFolderObject(tx Tx, userKey, hash string) (treeFolder, error) {
+	data, err := tx.GetObject(userKey, hash)
+	if err != nil {
+		return treeFolder{}, err
+	}
+	var node treeFolder
+	if err := json.Unmarshal(data, &node); err != nil {
+		return treeFolder{}, fmt.Errorf("object %s/%s: %v", userKey, hash, err)
+	}
+	return node, nil
+}
+
+// CollectObjects deletes the objects of the user that no tree snapshot of the
+// user refers to, through its root or the folders under it. The chunks are
+// only referred to by their hash, so they aren't read.
+func CollectObjects(tx Tx, userKey string) error {
+	snapshots, err := tx.ListTreeSnapshots(userKey)
+	if err != nil {
+		return err
+	}
+	referred, walked := make(map[string]bool), make(map[string]bool)
+	for _, snapshot := range snapshots {
+		if err := referObjects(tx, userKey, snapshot.Root, referred, walked); err != nil {
+			return err
+		}
+	}
+
+	hashes, err := tx.ListObjects(userKey)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if referred[hash] {
+			continue
+		}
+		if err := tx.DeleteObject(userKey, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// referObjects adds the frozen folder stored under hash and the objects it
+// refers to to referred, skipping the folders already walked. A chunk may
+// hold the data of a folder, so the folders are walked even if referred.
+func referObjects(tx Tx, userKey, hash string, referred, walked map[string]bool) error {
+	if walked[hash] {
+		return nil
+	}
+	referred[hash], walked[hash] = true, true
+	node, err := getFolderObject(tx, userKey, hash)
+	if err != nil {
+		return err
+	}
+	for _, child := range node.Folders {
+		if err := referObjects(tx, userKey, child, referred, walked); err != nil {
+			return err
+		}
+	}
+	for _, file := range node.Files {
+		for _, chunk := range file.Chunks {
+			referred[chunk] = true
+		}
+	}
+	return nil
+}
+
+// ThawTree replaces the folders and files of the user with the tree frozen
+// under root
+func ThawTree(tx Tx, userKey, root string) error {
+	node, err := getFolderObject(tx, userKey, root)
+	if err != nil {
+		return err
+	}
+	folders, err := tx.ListFolders(userKey, "")
+	if err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		if err := tx.DeleteFolder(userKey, utils.NameKey(folder.Name)); err != nil {
+			return err
+		}
+	}
+	return thawFolders(tx, userKey, "", node)
+}
+
+// thawFolders writes the sub-folders of node under parentKey with all of
+// their children
+func thawFolders(tx Tx, userKey, parentKey string, node treeFolder) error {
+	for key, hash := range node.Folders {
+		child, err := getFolderObject(tx, userKey, hash)
+		if err != nil {
+			return err
+		}
+		folderKey := joinKey(parentKey, key)
+		if err := tx.PutFolder(userKey, folderKey, child.folder()); err != nil {
+			return err
+		}
+		for fileKey, file := range child.Files {
+			if err := tx.PutFile(userKey, folderKey, fileKey, file.file()); err != nil {
+				return err
+			}
+			for index, hash := range file.Chunks {
+				chunk, err := tx.GetObject(userKey, hash)
+				if err != nil {
+					return err
+				}
+				if err := tx.PutChunk(userKey, folderKey, fileKey, int64(index), chunk); err != nil {
+					return err
+				}
+			}
+		}
+		if err := thawFolders(tx, userKey, folderKey, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TreeView returns a transaction reading the folders and files of the user
+// from the tree frozen under root instead of tx. The folders, files and
+// content of every user are read-only through it, and the other entities
+// are left to tx.
+func TreeView(tx Tx, userKey, root string) Tx {
+	return &treeTx{Tx: tx, userKey: userKey, root: root, nodes: make(map[string]treeFolder)}
+}
+
+// treeTx reads the frozen tree of a user, caching the folders it decoded by
+// their hash
+type treeTx struct {
+	Tx
+	userKey, root string
+	nodes         map[string]treeFolder
+}
+
+func (tx *treeTx) GetFolder(userKey, folderKey string) (models.Folder, error) {
+	if userKey != tx.userKey {
+		return tx.Tx.GetFolder(userKey, folderKey)
+	}
+	node, err := tx.node(folderKey)
+	if err != nil {
+		return models.Folder{}, err
+	}
+	return node.folder(), nil
+}
+
+func (tx *treeTx) PutFolder(string, string, models.Folder) error {
+	return ErrReadOnly
+}
+
+func (tx *treeTx) DeleteFolder(string, string) error {
+	return ErrReadOnly
+}
+
+func (tx *treeTx) ListFolders(userKey, parentKey string) ([]models.Folder, error) {
+	if userKey != tx.userKey {
+		return tx.Tx.ListFolders(userKey, parentKey)
+	}
+	node, err := tx.node(parentKey)
+	if err != nil {
+		return nil, err
+	}
+	folders := make([]models.Folder, 0, len(node.Folders))
+	for _, key := range sortedKeys(node.Folders) {
+		child, err := tx.object(node.Folders[key])
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, child.folder())
+	}
+	return folders, nil
+}
+
+func (tx *treeTx) GetFile(userKey, folderKey, fileKey string) (models.File, error) {
+	if userKey != tx.userKey {
+		return tx.Tx.GetFile(userKey, folderKey, fileKey)
+	}
+	file, err := tx.file(folderKey, fileKey)
+	if err != nil {
+		return models.File{}, err
+	}
+	return file.file(), nil
+}
+
+func (tx *treeTx) PutFile(string, string, string, models.File) error {
+	return ErrReadOnly
+}
+
+func (tx *treeTx) DeleteFile(string, string, string) error {
+	return ErrReadOnly
+}
+
+func (tx *treeTx) ListFiles(userKey, folderKey string) ([]models.File, error) {
+	if userKey != tx.userKey {
+		return tx.Tx.ListFiles(userKey, folderKey)
+	}
+	node, err := tx.node(folderKey)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]models.File, 0, len(node.Files))
+	for _, key := range sortedKeys(node.Files) {
+		files = append(files, node.Files[key].file())
+	}
+	return files, nil
+}
+
+func (tx *treeTx) GetChunk(userKey, folderKey, fileKey string, index int64) ([]byte, error) {
+	if userKey != tx.userKey {
+		return tx.Tx.GetChunk(userKey, folderKey, fileKey, index)
+	}
+	file, err := tx.file(folderKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	if index >= int64(len(file.Chunks)) {
+		return nil, nil
+	}
+	return tx.Tx.GetObject(userKey, file.Chunks[index])
+}
+
+func (tx *treeTx) PutChunk(string, string, string, int64, []byte) error {
+	return ErrReadOnly
+}
+
+func (tx *treeTx) DeleteChunks(string, string, string, int64) error {
+	return ErrReadOnly
+}
+
+// node returns the frozen folder at folderKey, the root if empty
+func (tx *treeTx) node(folderKey string) (treeFolder, error) {
+	node, err := tx.object(tx.root)
+	if err != nil || folderKey == "" {
+		return node, err
+	}
+	walked := ""
+	for _, key := range strings.Split(folderKey, "/") {
+		walked = joinKey(walked, key)
+		hash, exist := node.Folders[key]
+		if !exist {
+			return treeFolder{}, fmt.Errorf("folder %s/%s: %w", tx.userKey, walked, ErrNotFound)
+		}
+		if node, err = tx.object(hash); err != nil {
+			return treeFolder{}, err
+		}
+	}
+	return node, nil
+}
+
+// file returns the frozen file in the folder at folderKey
+func (tx *treeTx) file(folderKey, fileKey string) (treeFile, error) {
+	node, err := tx.node(folderKey)
+	if err != nil {
+		return treeFile{}, err
+	}
+	file, exist := node.Files[fileKey]
+	if !exist {
+		return treeFile{}, fmt.Errorf("file %s/%s/%s: %w", tx.userKey, folderKey, fileKey, ErrNotFound)
+	}
+	return file, nil
+}
+
+// object returns the frozen folder stored under hash
+func (tx *treeTx) object(hash string) (treeFolder, error) {
+	if node, exist := tx.nodes[hash]; exist {
+		return node, nil
+	}
+	node, err := getFolderObject(tx.Tx, tx.userKey, hash)
+	if err != nil {
+		return treeFolder{}, err
+	}
+	tx.nodes[hash] = node
+	return node, nil
+}
+
+// DiffTrees returns the folders and files added, removed or modified from
+// the tree frozen under from to the one frozen under to, sorted by path.
+// The children of an added or removed folder aren't listed, and the folders
+// both trees share are skipped without being read. A folder is modified when
+// its name or description changed, and a file when its content did too.
+func DiffTrees(tx Tx, userKey, from, to string) ([]TreeChange, error) {
+	changes := make([]TreeChange, 0)
+	if from == to {
+		return changes, nil
+	}
+	view := &treeTx{Tx: tx, userKey: userKey, nodes: make(map[string]treeFolder)}
+	before, err := view.object(from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := view.object(to)
+	if err != nil {
+		return nil, err
+	}
+	if err := diffFolders(view, "", before, after, &changes); err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// diffFolders appends the changes between the children of the folders
+// before and after, found at path
+func diffFolders(view *treeTx, path string, before, after treeFolder, changes *[]TreeChange) error {
+	for _, key := range unionKeys(before.Folders, after.Folders) {
+		beforeHash, inBefore := before.Folders[key]
+		afterHash, inAfter := after.Folders[key]
+		if beforeHash == afterHash {
+			continue
+		}
+
+		var beforeChild, afterChild treeFolder
+		var err error
+		if inBefore {
+			if beforeChild, err = view.object(beforeHash); err != nil {
+				return err
+			}
+		}
+		if inAfter {
+			if afterChild, err = view.object(afterHash); err != nil {
+				return err
+			}
+		}
+		switch {
+		case !inAfter:
+			*changes = append(*changes, TreeChange{Change: TreeRemoved, Path: utils.JoinPath(path, beforeChild.Name), Folder: true})
+		case !inBefore:
+			*changes = append(*changes, TreeChange{Change: TreeAdded, Path: utils.JoinPath(path, afterChild.Name), Folder: true})
+		default:
+			childPath := utils.JoinPath(path, afterChild.Name)
+			if beforeChild.Name != afterChild.Name || beforeChild.Description != afterChild.Description {
+				*changes = append(*changes, TreeChange{Change: TreeModified, Path: childPath, Folder: true})
+			}
+			if err := diffFolders(view, childPath, beforeChild, afterChild, changes); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, key := range unionKeys(before.Files, after.Files) {
+		beforeFile, inBefore := before.Files[key]
+		afterFile, inAfter := after.Files[key]
+		switch {
+		case !inAfter:
+			*changes = append(*changes, TreeChange{Change: TreeRemoved, Path: utils.JoinPath(path, beforeFile.Name)})
+		case !inBefore:
+			*changes = append(*changes, TreeChange{Change: TreeAdded, Path: utils.JoinPath(path, afterFile.Name)})
+		case beforeFile.Name != afterFile.Name || beforeFile.Description != afterFile.Description ||
+			!sameHashes(beforeFile.Chunks, afterFile.Chunks):
+			*changes = append(*changes, TreeChange{Change: TreeModified, Path: utils.JoinPath(path, afterFile.Name)})
+		}
+	}
+	return nil
+}
+
+// sameHashes reports whether a and b hold the same hashes in the same order
+func sameHashes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// unionKeys returns the keys of a and b in ascending order
+func unionKeys[V any](a, b map[string]V) []string {
+	union := make(map[string]bool, len(a)+len(b))
+	for key := range a {
+		union[key] = true
+	}
+	for key := range b {
+		union[key] = true
+	}
+	return sortedKeys(union)
+}
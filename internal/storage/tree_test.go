@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+	"virtual-file-system/internal/models"
+)
+
+func TestTree_FreezeThaw(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			users := seed(t, store)
+
+			var before, after string
+			var frozen []string
+			err := store.Update(func(tx Tx) error {
+				var err error
+				if before, err = FreezeTree(tx, "dalaoqi", ""); err != nil {
+					return err
+				}
+				if frozen, err = tx.ListObjects("dalaoqi"); err != nil {
+					return err
+				}
+				// Freezing the same tree again writes nothing
+				if again, err := FreezeTree(tx, "dalaoqi", ""); err != nil || again != before {
+					t.Errorf("FreezeTree() again = %s, %v, expected %s", again, err, before)
+				}
+				if objects, _ := tx.ListObjects("dalaoqi"); len(objects) != len(frozen) {
+					t.Errorf("FreezeTree() again wrote %d objects, expected none", len(objects)-len(frozen))
+				}
+
+				if err := WriteContent(tx, "dalaoqi", "docs", "notes", []byte("changed")); err != nil {
+					return err
+				}
+				if err := tx.PutFolder("dalaoqi", "new", models.Folder{Name: "new"}); err != nil {
+					return err
+				}
+				after, err = FreezeTree(tx, "dalaoqi", "")
+				return err
+			})
+			if err != nil {
+				t.Fatalf("Store.Update() has error: %s", err)
+			}
+
+			if after == before {
+				t.Errorf("FreezeTree() after a change = %s, expected another root", after)
+			}
+			// Only the root, docs, the new folder and the new chunk are
+			// written, projects is shared
+			store.View(func(tx Tx) error {
+				objects, _ := tx.ListObjects("dalaoqi")
+				if written := len(objects) - len(frozen); written != 4 {
+					t.Errorf("FreezeTree() after a change wrote %d objects, expected 4", written)
+				}
+				return nil
+			})
+
+			err = store.Update(func(tx Tx) error {
+				return ThawTree(tx, "dalaoqi", before)
+			})
+			if err != nil {
+				t.Fatalf("ThawTree() has error: %s", err)
+			}
+			got, _ := dump(store)
+			if !reflect.DeepEqual(got["dalaoqi"].Folders, users["dalaoqi"].Folders) {
+				t.Errorf("ThawTree() = %v, expected %v", got["dalaoqi"].Folders, users["dalaoqi"].Folders)
+			}
+			if len(got["dalaoqi"].Objects) != len(frozen)+4 {
+				t.Errorf("ThawTree() kept %d objects, expected %d", len(got["dalaoqi"].Objects), len(frozen)+4)
+			}
+		})
+	}
+}
+
+// objectCountingTx counts the objects stored through it
+type objectCountingTx struct {
+	Tx
+	puts int
+}
+
+func (tx *objectCountingTx) PutObject(userKey, hash string, data []byte) error {
+	tx.puts++
+	return tx.Tx.PutObject(userKey, hash, data)
+}
+
+func TestTree_FreezeBase(t *testing.T) {
+	store := NewMemoryStore(nil)
+	seed(t, store)
+
+	err := store.Update(func(tx Tx) error {
+		base, err := FreezeTree(tx, "dalaoqi", "")
+		if err != nil {
+			return err
+		}
+		// Nothing changed, the base is the tree
+		counting := &objectCountingTx{Tx: tx}
+		if root, err := FreezeTree(counting, "dalaoqi", base); err != nil || root != base || counting.puts != 0 {
+			t.Errorf("FreezeTree() of an unchanged tree = %s, %v, stored %d objects, expected %s without objects", root, err, counting.puts, base)
+		}
+
+		// A content of the same size written without a new modification
+		// date is frozen again, along with its folder and the root
+		if err := WriteContent(tx, "dalaoqi", "docs", "notes", []byte("hallo")); err != nil {
+			return err
+		}
+		counting = &objectCountingTx{Tx: tx}
+		root, err := FreezeTree(counting, "dalaoqi", base)
+		if err != nil {
+			return err
+		}
+		if expected, _ := FreezeTree(tx, "dalaoqi", ""); root == base || root != expected || counting.puts != 3 {
+			t.Errorf("FreezeTree() after a write = %s, stored %d objects, expected %s and 3 objects", root, counting.puts, expected)
+		}
+
+		// Only the changed file is frozen again
+		base = root
+		if err := WriteContent(tx, "dalaoqi", "docs", "todo", []byte("buy milk")); err != nil {
+			return err
+		}
+		modifiedAt := time.Date(2023, 7, 2, 0, 0, 0, 0, time.UTC)
+		err = tx.PutFile("dalaoqi", "docs", "todo", models.File{Name: "todo", Size: 8, ModifiedAt: modifiedAt})
+		if err != nil {
+			return err
+		}
+		counting = &objectCountingTx{Tx: tx}
+		root, err = FreezeTree(counting, "dalaoqi", base)
+		if err != nil {
+			return err
+		}
+		if expected, _ := FreezeTree(tx, "dalaoqi", ""); root != expected || counting.puts != 3 {
+			t.Errorf("FreezeTree() on a base = %s, stored %d objects, expected %s and 3 objects", root, counting.puts, expected)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Store.Update() has error: %s", err)
+	}
+}
+
+func TestTree_CollectObjects(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			seed(t, store)
+
+			var shared []string
+			err := store.Update(func(tx Tx) error {
+				before, err := FreezeTree(tx, "dalaoqi", "")
+				if err != nil {
+					return err
+				}
+				if shared, err = tx.ListObjects("dalaoqi"); err != nil {
+					return err
+				}
+				if err := WriteContent(tx, "dalaoqi", "docs", "todo", []byte("buy milk")); err != nil {
+					return err
+				}
+				after, err := FreezeTree(tx, "dalaoqi", "")
+				if err != nil {
+					return err
+				}
+				if err := tx.PutTreeSnapshot("dalaoqi", "before", models.TreeSnapshot{Label: "before", Root: before}); err != nil {
+					return err
+				}
+				return tx.PutTreeSnapshot("dalaoqi", "after", models.TreeSnapshot{Label: "after", Root: after})
+			})
+			if err != nil {
+				t.Fatalf("Store.Update() has error: %s", err)
+			}
+
+			// Deleting a snapshot frees the root, docs and the chunk only it
+			// refers to, and keeps the ones shared with the other
+			err = store.Update(func(tx Tx) error {
+				if err := tx.DeleteTreeSnapshot("dalaoqi", "after"); err != nil {
+					return err
+				}
+				return CollectObjects(tx, "dalaoqi")
+			})
+			if err != nil {
+				t.Fatalf("CollectObjects() has error: %s", err)
+			}
+			store.View(func(tx Tx) error {
+				if objects, _ := tx.ListObjects("dalaoqi"); !reflect.DeepEqual(objects, shared) {
+					t.Errorf("ListObjects() after CollectObjects() = %v, expected %v", objects, shared)
+				}
+				snapshot, _ := tx.GetTreeSnapshot("dalaoqi", "before")
+				if content, err := ReadContent(TreeView(tx, "dalaoqi", snapshot.Root), "dalaoqi", "docs", "notes"); err != nil || string(content) != "hello" {
+					t.Errorf("ReadContent() of the kept snapshot = %q, %v, expected hello", content, err)
+				}
+				// The objects of the other users are kept
+				if objects, _ := tx.ListObjects("other"); len(objects) != 1 {
+					t.Errorf("ListObjects() of another user = %v, expected its object", objects)
+				}
+				return nil
+			})
+
+			err = store.Update(func(tx Tx) error {
+				if err := tx.DeleteTreeSnapshot("dalaoqi", "before"); err != nil {
+					return err
+				}
+				return CollectObjects(tx, "dalaoqi")
+			})
+			if err != nil {
+				t.Fatalf("CollectObjects() has error: %s", err)
+			}
+			store.View(func(tx Tx) error {
+				if objects, _ := tx.ListObjects("dalaoqi"); len(objects) != 0 {
+					t.Errorf("ListObjects() without snapshots = %v, expected none", objects)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestTree_View(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			seed(t, store)
+			var root string
+			err := store.Update(func(tx Tx) error {
+				var err error
+				if root, err = FreezeTree(tx, "dalaoqi", ""); err != nil {
+					return err
+				}
+				if err := tx.DeleteFolder("dalaoqi", "docs"); err != nil {
+					return err
+				}
+				return tx.PutFolder("dalaoqi", "projects", models.Folder{Name: "projects", Description: "changed"})
+			})
+			if err != nil {
+				t.Fatalf("Store.Update() has error: %s", err)
+			}
+
+			store.View(func(tx Tx) error {
+				view := TreeView(tx, "dalaoqi", root)
+				folders, err := view.ListFolders("dalaoqi", "")
+				if err != nil || len(folders) != 3 || folders[0].Name != "docs" || folders[2].Description != "" {
+					t.Errorf("ListFolders() = %v, %v, expected the frozen docs, empty and projects", folders, err)
+				}
+				folders, _ = view.ListFolders("dalaoqi", "projects/2024")
+				if len(folders) != 1 || folders[0].Name != "q1" {
+					t.Errorf("ListFolders() = %v, expected q1", folders)
+				}
+				files, err := view.ListFiles("dalaoqi", "docs")
+				if err != nil || len(files) != 2 || files[0].Name != "notes" || files[0].Size != 5 {
+					t.Errorf("ListFiles() = %v, %v, expected notes and todo", files, err)
+				}
+				content, err := ReadContent(view, "dalaoqi", "docs", "notes")
+				if err != nil || string(content) != "hello" {
+					t.Errorf("ReadContent() = %q, %v, expected hello", content, err)
+				}
+				if _, err := view.GetFolder("dalaoqi", "docs/missing"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("GetFolder() has error: %v, expected ErrNotFound", err)
+				}
+				if _, err := view.GetFile("dalaoqi", "docs", "missing"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("GetFile() has error: %v, expected ErrNotFound", err)
+				}
+				if err := view.PutFolder("dalaoqi", "docs", models.Folder{Name: "docs"}); !errors.Is(err, ErrReadOnly) {
+					t.Errorf("PutFolder() has error: %v, expected ErrReadOnly", err)
+				}
+				// The other users are read from the store
+				if folders, err := view.ListFolders("other", ""); err != nil || len(folders) != 0 {
+					t.Errorf("ListFolders() of another user = %v, %v, expected none", folders, err)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestTree_Diff(t *testing.T) {
+	store := NewMemoryStore(nil)
+	seed(t, store)
+
+	var before, after string
+	err := store.Update(func(tx Tx) error {
+		var err error
+		if before, err = FreezeTree(tx, "dalaoqi", ""); err != nil {
+			return err
+		}
+		for _, write := range []func() error{
+			func() error {
+				return tx.PutFolder("dalaoqi", "docs", models.Folder{Name: "Docs", Description: "the docs"})
+			},
+			func() error { return AppendContent(tx, "dalaoqi", "docs", "notes", 5, []byte("!")) },
+			func() error {
+				return tx.PutFile("dalaoqi", "docs", "todo", models.File{Name: "todo", Description: "changed"})
+			},
+			func() error {
+				return tx.PutFile("dalaoqi", "projects/2024/q1", "summary", models.File{Name: "summary"})
+			},
+			func() error { return tx.DeleteFolder("dalaoqi", "empty") },
+			func() error { return tx.PutFolder("dalaoqi", "new", models.Folder{Name: "new"}) },
+			func() error { return tx.PutFolder("dalaoqi", "new/child", models.Folder{Name: "child"}) },
+		} {
+			if err := write(); err != nil {
+				return err
+			}
+		}
+		after, err = FreezeTree(tx, "dalaoqi", "")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Store.Update() has error: %s", err)
+	}
+
+	store.View(func(tx Tx) error {
+		changes, err := DiffTrees(tx, "dalaoqi", before, after)
+		expected := []TreeChange{
+			{Change: TreeModified, Path: "Docs", Folder: true},
+			{Change: TreeModified, Path: "Docs/notes"},
+			{Change: TreeModified, Path: "Docs/todo"},
+			{Change: TreeRemoved, Path: "empty", Folder: true},
+			{Change: TreeAdded, Path: "new", Folder: true},
+			{Change: TreeAdded, Path: "projects/2024/q1/summary"},
+		}
+		if err != nil || !reflect.DeepEqual(changes, expected) {
+			t.Errorf("DiffTrees() = %v, %v, expected %v", changes, err, expected)
+		}
+		if changes, err := DiffTrees(tx, "dalaoqi", after, after); err != nil || len(changes) != 0 {
+			t.Errorf("DiffTrees() of the same tree = %v, %v, expected none", changes, err)
+		}
+		return nil
+	})
+}
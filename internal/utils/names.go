@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/unicode/runenames"
+)
+
+// NameKey returns the key a user, folder or file name is looked up by.
+// Names keep the case they are given, while two names with the same key,
+// like "Q3 Report" and "q3 report" or "Straße" and "STRASSE", are the same
+// name. The key is the Unicode case folding of the name, in NFC so that the
+// composed and decomposed forms of a name have the same key too.
+func NameKey(name string) string {
+	return norm.NFC.String(cases.Fold().String(norm.NFD.String(name)))
+}
+
+// NamePolicy decides which names of users, folders and files are valid.
+//
+// Every policy normalizes names to NFC and rejects names which are empty,
+// aren't valid UTF-8, contain one of the chars * / > < ? " | :, a control
+// character, a bidirectional control character or another invisible
+// character like a zero width joiner, don't start with a letter or a digit,
+// or end with a space. The zero value has no other limit.
+type NamePolicy struct {
+	// MaxBytes limits the length of a name in bytes, and MaxRunes in
+	// characters, once normalized. Zero means no limit.
+	MaxBytes int
+	MaxRunes int
+	// Windows also rejects the names Windows reserves for devices, like CON
+	// or nul.txt, and the names ending with a dot
+	Windows bool
+}
+
+// DefaultNamePolicy limits names to 255 bytes like most file systems
+var DefaultNamePolicy = NamePolicy{MaxBytes: 255}
+
+// NameError is returned for a name rejected by a NamePolicy. Reason
+// completes a sentence about the name, e.g. "contains the invalid char '?'
+// at position 3".
+type NameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("Error: The %s %s.", QuoteName(e.Name), e.Reason)
+}
+
+// invalidChars can't be used in names
+const invalidChars = `*/><?"|:`
+
+// windowsDevices are the names Windows reserves, with or without an extension
+var windowsDevices = []string{"CON", "PRN", "AUX", "NUL"}
+
+// Normalize returns the NFC form of the name if the policy accepts it, and
+// a *NameError telling the first rule it breaks otherwise. Positions count
+// the characters of the normalized name from 1.
+func (p NamePolicy) Normalize(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		for i := 0; i < len(name); {
+			r, size := utf8.DecodeRuneInString(name[i:])
+			if r == utf8.RuneError && size == 1 {
+				return "", &NameError{Name: name, Reason: fmt.Sprintf("contains invalid UTF-8 at byte %d", i+1)}
+			}
+			i += size
+		}
+	}
+	name = norm.NFC.String(name)
+	if name == "" {
+		return "", &NameError{Name: name, Reason: "is empty"}
+	}
+
+	runes := 0
+	var last rune
+	for _, r := range name {
+		runes++
+		if reason := invalidRune(r); reason != "" {
+			return "", &NameError{Name: name, Reason: fmt.Sprintf("contains %s at position %d", reason, runes)}
+		}
+		if runes == 1 && !unicode.IsLetter(r) && !unicode.IsNumber(r) {
+			return "", &NameError{Name: name, Reason: fmt.Sprintf("starts with %s, which is not a letter or a digit", describeRune(r))}
+		}
+		last = r
+	}
+	if unicode.IsSpace(last) {
+		return "", &NameError{Name: name, Reason: fmt.Sprintf("ends with %s at position %d", describeRune(last), runes)}
+	}
+
+	if p.MaxBytes > 0 && len(name) > p.MaxBytes {
+		return "", &NameError{Name: name, Reason: fmt.Sprintf("is %d bytes long, more than %d", len(name), p.MaxBytes)}
+	}
+	if p.MaxRunes > 0 && runes > p.MaxRunes {
+		return "", &NameError{Name: name, Reason: fmt.Sprintf("is %d characters long, more than %d", runes, p.MaxRunes)}
+	}
+
+	if p.Windows {
+		if windowsDevice(name) {
+			return "", &NameError{Name: name, Reason: "is reserved by Windows"}
+		}
+		if last == '.' {
+			return "", &NameError{Name: name, Reason: fmt.Sprintf("ends with a dot at position %d, which Windows drops", runes)}
+		}
+	}
+	return name, nil
+}
+
+// Fits reports whether the name is within the MaxBytes and MaxRunes of the
+// policy, without checking anything else
+func (p NamePolicy) Fits(name string) bool {
+	return (p.MaxBytes <= 0 || len(name) <= p.MaxBytes) &&
+		(p.MaxRunes <= 0 || utf8.RuneCountInString(name) <= p.MaxRunes)
+}
+
+// invalidRune describes the rune if names can't contain it, and returns ""
+// otherwise
+func invalidRune(r rune) string {
+	switch {
+	case strings.ContainsRune(invalidChars, r):
+		return "the invalid char " + describeRune(r)
+	case bidiControl(r):
+		return "the bidirectional control character " + describeRune(r)
+	case unicode.IsControl(r):
+		return "the control character " + describeRune(r)
+	case unicode.Is(unicode.Cf, r):
+		return "the invisible character " + describeRune(r)
+	}
+	return ""
+}
+
+// bidiControl reports whether the rune changes the direction of the text
+// around it, which can make a name display as another one
+func bidiControl(r rune) bool {
+	return r == '\u061C' || r == '\u200E' || r == '\u200F' ||
+		('\u202A' <= r && r <= '\u202E') || ('\u2066' <= r && r <= '\u2069')
+}
+
+// windowsDevice reports whether the name, without its extension, is a
+// device name of Windows like CON, COM1 or LPT²
+func windowsDevice(name string) bool {
+	base, _, _ := strings.Cut(name, ".")
+	base = strings.ToUpper(strings.TrimRight(base, " "))
+	for _, device := range windowsDevices {
+		if base == device {
+			return true
+		}
+	}
+	for _, prefix := range []string{"COM", "LPT"} {
+		if digit, ok := strings.CutPrefix(base, prefix); ok && utf8.RuneCountInString(digit) == 1 && strings.ContainsAny(digit, "0123456789¹²³") {
+			return true
+		}
+	}
+	return false
+}
+
+// describeRune returns the rune quoted if it is visible, and its code point
+// with its Unicode name otherwise, e.g. "U+200D ZERO WIDTH JOINER"
+func describeRune(r rune) string {
+	if unicode.IsGraphic(r) && !unicode.IsSpace(r) {
+		return "'" + string(r) + "'"
+	}
+	description := fmt.Sprintf("U+%04X", r)
+	if name := runenames.Name(r); name != "" && !strings.HasPrefix(name, "<") {
+		description += " " + name
+	}
+	return description
+}
+
+// QuoteName returns the name as it is, or quoted with its invisible
+// characters escaped if it is empty, has any or starts or ends with a space
+func QuoteName(name string) string {
+	if name == "" || strings.TrimSpace(name) != name {
+		return strconv.QuoteToGraphic(name)
+	}
+	for _, r := range name {
+		if !unicode.IsGraphic(r) {
+			return strconv.QuoteToGraphic(name)
+		}
+	}
+	return name
+}
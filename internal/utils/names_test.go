@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNameKey(t *testing.T) {
+	testCases := []struct {
+		a, b string
+		same bool
+	}{
+		{a: "Q3 Report", b: "q3 report", same: true},
+		{a: "DALAOQI", b: "dalaoqi", same: true},
+		{a: "Übersicht", b: "übersicht", same: true},
+		{a: "Straße", b: "STRASSE", same: true},
+		{a: "ΣΟΦΟΣ", b: "σοφος", same: true},
+		{a: "notes", b: "notes (1)", same: false},
+		{a: "re\u0301sume\u0301", b: "RÉSUMÉ", same: true},
+		{a: "resume", b: "résumé", same: false},
+	}
+
+	for _, test := range testCases {
+		if same := NameKey(test.a) == NameKey(test.b); same != test.same {
+			t.Errorf("NameKey(%q) == NameKey(%q) is %v, expected: %v", test.a, test.b, same, test.same)
+		}
+	}
+}
+
+func TestNamePolicy_Normalize(t *testing.T) {
+	testCases := []struct {
+		name           string
+		policy         NamePolicy
+		input          string
+		expected       string
+		expectedReason string
+	}{
+		{name: "ASCII", input: "Q3 Report", expected: "Q3 Report"},
+		{name: "Starting with a non-ASCII letter", input: "Übersicht", expected: "Übersicht"},
+		{name: "CJK", input: "資料", expected: "資料"},
+		{name: "Decomposed", input: "U\u0308bersicht", expected: "Übersicht"},
+		{name: "Empty", input: "", expectedReason: "is empty"},
+		{name: "Invalid UTF-8", input: "ab\xffc", expectedReason: "contains invalid UTF-8 at byte 3"},
+		{name: "Invalid char", input: "dalaoqi?", expectedReason: "contains the invalid char '?' at position 8"},
+		{name: "Control character", input: "a\tb", expectedReason: "contains the control character U+0009 at position 2"},
+		{name: "Bidi override", input: "invoice\u202Efdp.exe", expectedReason: "contains the bidirectional control character U+202E RIGHT-TO-LEFT OVERRIDE at position 8"},
+		{name: "Zero width joiner", input: "ab\u200Dc", expectedReason: "contains the invisible character U+200D ZERO WIDTH JOINER at position 3"},
+		{name: "Leading dot", input: ".hidden", expectedReason: "starts with '.', which is not a letter or a digit"},
+		{name: "Trailing space", input: "notes ", expectedReason: "ends with U+0020 SPACE at position 6"},
+		{name: "Too many bytes", policy: NamePolicy{MaxBytes: 8}, input: "Übersicht", expectedReason: "is 10 bytes long, more than 8"},
+		{name: "Too many characters", policy: NamePolicy{MaxRunes: 2}, input: "資料庫", expectedReason: "is 3 characters long, more than 2"},
+		{name: "Long enough", policy: NamePolicy{MaxBytes: 6, MaxRunes: 2}, input: "資料", expected: "資料"},
+		{name: "Windows device", policy: NamePolicy{Windows: true}, input: "nul.txt", expectedReason: "is reserved by Windows"},
+		{name: "Windows port", policy: NamePolicy{Windows: true}, input: "Com1", expectedReason: "is reserved by Windows"},
+		{name: "Windows trailing dot", policy: NamePolicy{Windows: true}, input: "notes.", expectedReason: "ends with a dot at position 6, which Windows drops"},
+		{name: "Not a Windows device", policy: NamePolicy{Windows: true}, input: "console", expected: "console"},
+		{name: "Device names without Windows", input: "CON", expected: "CON"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.policy.Normalize(test.input)
+			var nameErr *NameError
+			if test.expectedReason != "" {
+				if !errors.As(err, &nameErr) || nameErr.Reason != test.expectedReason {
+					t.Errorf("NamePolicy.Normalize(%q) has error: %v, expected: %s", test.input, err, test.expectedReason)
+				}
+				return
+			}
+			if err != nil || got != test.expected {
+				t.Errorf("NamePolicy.Normalize(%q) = %q, %v, expected: %q", test.input, got, err, test.expected)
+			}
+		})
+	}
+}
+
+func TestNameError(t *testing.T) {
+	_, err := NamePolicy{}.Normalize("a\u202Eb")
+	expected := `Error: The "a\u202eb" contains the bidirectional control character U+202E RIGHT-TO-LEFT OVERRIDE at position 2.`
+	if err == nil || err.Error() != expected {
+		t.Errorf("NameError = %v, expected: %s", err, expected)
+	}
+}
+
+func TestNamePolicy_Fits(t *testing.T) {
+	testCases := []struct {
+		policy   NamePolicy
+		input    string
+		expected bool
+	}{
+		{NamePolicy{}, "notes", true},
+		{NamePolicy{MaxBytes: 5}, "notes", true},
+		{NamePolicy{MaxBytes: 4}, "café", false},
+		{NamePolicy{MaxRunes: 4}, "café", true},
+		{NamePolicy{MaxBytes: 255, MaxRunes: 3}, "café", false},
+	}
+
+	for _, test := range testCases {
+		if got := test.policy.Fits(test.input); got != test.expected {
+			t.Errorf("%+v.Fits(%q) = %v, expected: %v", test.policy, test.input, got, test.expected)
+		}
+	}
+}
@@ -1,48 +1,254 @@
 package utils
 
 import (
-	"regexp"
+	"errors"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
-var (
-	re      *regexp.Regexp
-	pattern = `(?m)^([a-zA-Z0-9][^*/><?\"|:]*)$`
-)
+// PathSeparator separates the folder names of a path
+const PathSeparator = "/"
+
+// SplitPath splits a slash-separated folder path into its names.
+// Leading and trailing separators are ignored. It returns nil if the path is
+// empty or if any name is empty. The names themselves are checked by a
+// NamePolicy.
+func SplitPath(path string) []string {
+	path = strings.Trim(path, PathSeparator)
+	if path == "" {
+		return nil
+	}
+	names := strings.Split(path, PathSeparator)
+	for _, name := range names {
+		if name == "" {
+			return nil
+		}
+	}
+	return names
+}
+
+// JoinPath joins folder names into a slash-separated path, skipping empty names
+func JoinPath(names ...string) string {
+	nonEmpty := make([]string, 0, len(names))
+	for _, name := range names {
+		if name != "" {
+			nonEmpty = append(nonEmpty, name)
+		}
+	}
+	return strings.Join(nonEmpty, PathSeparator)
+}
 
-func init() {
-	// Regular expression to match invalid characters
-	re = regexp.MustCompile(pattern)
+// SplitParent splits a path into the path of its parent and its last name
+func SplitParent(path string) (string, string) {
+	path = strings.Trim(path, PathSeparator)
+	i := strings.LastIndex(path, PathSeparator)
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
 }
 
-// Check if the given string contains invalid characters
-func ExistInvalidChars(str string) bool {
-	match := re.FindAllString(str, -1)
-	return len(match) == 0
+// EditDistance returns the Levenshtein distance between a and b, the number
+// of rune insertions, deletions or substitutions turning a into b
+func EditDistance(a, b string) int {
+	source, target := []rune(a), []rune(b)
+	// previous and current are two rows of the distance matrix
+	previous := make([]int, len(target)+1)
+	current := make([]int, len(target)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(source); i++ {
+		current[0] = i
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if source[i-1] == target[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(target)]
 }
 
-// Split the input into individual arguments while preserving quoted strings
-func SplitArguments(line string) []string {
+// JoinChoices joins the choices into "a", "a or b" or "a, b or c"
+func JoinChoices(choices []string) string {
+	if len(choices) <= 1 {
+		return strings.Join(choices, "")
+	}
+	return strings.Join(choices[:len(choices)-1], ", ") + " or " + choices[len(choices)-1]
+}
+
+// ErrUnterminatedQuote is returned by SplitArguments when a quote isn't closed
+var ErrUnterminatedQuote = errors.New("Error: The arguments have an unterminated quote.")
+
+// SplitArguments splits a command line into its arguments like a shell.
+// Arguments are separated by whitespace, which is kept inside single or
+// double quotes. A backslash outside of quotes escapes the next character,
+// inside double quotes it only escapes a double quote or a backslash, and
+// inside single quotes it has no special meaning. Quotes may join parts of
+// an argument, e.g. a"b c"'d' is the single argument "ab cd", and an empty
+// pair of quotes is an empty argument.
+func SplitArguments(line string) ([]string, error) {
 	var args []string
-	fields := strings.Fields(line)
-	quoteOpen := false
-	var currentArg string
-
-	for _, field := range fields {
-		if strings.HasPrefix(field, "\"") && strings.HasSuffix(field, "\"") {
-			args = append(args, strings.TrimSuffix(strings.TrimPrefix(field, "\""), "\""))
-		} else if strings.HasPrefix(field, "\"") && !quoteOpen {
-			quoteOpen = true
-			currentArg = strings.TrimPrefix(field, "\"")
-		} else if strings.HasSuffix(field, "\"") && quoteOpen {
-			quoteOpen = false
-			currentArg += " " + strings.TrimSuffix(field, "\"")
-			args = append(args, currentArg)
-		} else if quoteOpen {
-			currentArg += " " + field
-		} else {
-			args = append(args, field)
-		}
-	}
-	return args
+	var arg strings.Builder
+	// started tells whether an argument, possibly empty, is being read
+	started := false
+
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRuneInString(line[i:])
+		switch {
+		case unicode.IsSpace(r):
+			if started {
+				args = append(args, arg.String())
+				arg.Reset()
+				started = false
+			}
+			i += size
+		case r == '\\':
+			started = true
+			i += size
+			if i == len(line) {
+				// A trailing backslash has nothing to escape
+				arg.WriteByte('\\')
+				break
+			}
+			_, size = utf8.DecodeRuneInString(line[i:])
+			arg.WriteString(line[i : i+size])
+			i += size
+		case r == '\'':
+			started = true
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, ErrUnterminatedQuote
+			}
+			arg.WriteString(line[i+1 : i+1+end])
+			i += end + 2
+		case r == '"':
+			started = true
+			closed := false
+			for i++; i < len(line); i++ {
+				c := line[i]
+				if c == '"' {
+					closed = true
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\') {
+					i++
+					c = line[i]
+				}
+				arg.WriteByte(c)
+			}
+			if !closed {
+				return nil, ErrUnterminatedQuote
+			}
+		default:
+			started = true
+			arg.WriteString(line[i : i+size])
+			i += size
+		}
+	}
+	if started {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// StripComment cuts the line before a # starting an argument outside of
+// quotes, which comments out the rest of a script line. A # within an
+// argument, quoted or escaped, like docs#1, "#1" or \#1, is kept. A line
+// with an unterminated quote is returned as it is for SplitArguments to
+// reject it.
+func StripComment(line string) string {
+	// started tells whether an argument is being read
+	started := false
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRuneInString(line[i:])
+		switch {
+		case unicode.IsSpace(r):
+			started = false
+		case r == '#' && !started:
+			return line[:i]
+		case r == '\\':
+			started = true
+			if i+size < len(line) {
+				_, next := utf8.DecodeRuneInString(line[i+size:])
+				size += next
+			}
+		case r == '\'':
+			started = true
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return line
+			}
+			size = end + 2
+		case r == '"':
+			started = true
+			end := i + 1
+			for ; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' && end+1 < len(line) && (line[end+1] == '"' || line[end+1] == '\\') {
+					end++
+				}
+			}
+			if end == len(line) {
+				return line
+			}
+			size = end + 1 - i
+		default:
+			started = true
+		}
+		i += size
+	}
+	return line
+}
+
+// SplitLastArgument splits a command line being typed before the argument
+// under the cursor, which may have an unclosed quote. It returns the line
+// before that argument, the arguments of that part and the beginning of
+// the argument without its quotes. It returns an error if the part before
+// the argument can't be split.
+func SplitLastArgument(line string) (string, []string, string, error) {
+	for i := len(line); i >= 0; i-- {
+		if i > 0 && line[i-1] != ' ' && line[i-1] != '\t' {
+			continue
+		}
+		args, err := SplitArguments(line[:i])
+		if err != nil {
+			continue
+		}
+		// The whitespace must separate the arguments rather than be escaped
+		if next, err := SplitArguments(line[:i] + "x"); err != nil || len(next) != len(args)+1 {
+			continue
+		}
+		// Close the quote of the argument to read its beginning
+		for _, quote := range []string{"", `"`, "'"} {
+			last, err := SplitArguments(line[i:] + quote)
+			if err == nil && len(last) <= 1 {
+				partial := ""
+				if len(last) == 1 {
+					partial = last[0]
+				}
+				return line[:i], args, partial, nil
+			}
+		}
+	}
+	return "", nil, "", ErrUnterminatedQuote
+}
+
+// QuoteArgument quotes the argument for SplitArguments if it is empty or
+// contains whitespace, quotes or backslashes
+func QuoteArgument(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\r\"'\\") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
 }
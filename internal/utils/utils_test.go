@@ -0,0 +1,274 @@
+package utils
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSplitArguments(t *testing.T) {
+	testCases := []struct {
+		name         string
+		line         string
+		expectedArgs []string
+		expectedErr  error
+	}{
+		{
+			name:         "Plain arguments",
+			line:         "create-folder dalaoqi docs",
+			expectedArgs: []string{"create-folder", "dalaoqi", "docs"},
+		},
+		{
+			name:         "Runs of whitespace between arguments",
+			line:         "  register \t dalaoqi  ",
+			expectedArgs: []string{"register", "dalaoqi"},
+		},
+		{
+			name: "Empty line",
+			line: "   ",
+		},
+		{
+			name:         "Whitespace inside double quotes",
+			line:         `create-folder dalaoqi "meeting   docs"`,
+			expectedArgs: []string{"create-folder", "dalaoqi", "meeting   docs"},
+		},
+		{
+			name:         "Whitespace inside single quotes",
+			line:         `register 'dalaoqi is  awesome'`,
+			expectedArgs: []string{"register", "dalaoqi is  awesome"},
+		},
+		{
+			name:         "Quotes joining the parts of an argument",
+			line:         `a"b c"'d'e "x"y"z"`,
+			expectedArgs: []string{"ab cde", "xyz"},
+		},
+		{
+			name:         "Empty arguments",
+			line:         `create-file dalaoqi docs notes "" ''`,
+			expectedArgs: []string{"create-file", "dalaoqi", "docs", "notes", "", ""},
+		},
+		{
+			name:         "Escapes outside of quotes",
+			line:         `a\ b \"c\" \\ \'`,
+			expectedArgs: []string{"a b", `"c"`, `\`, `'`},
+		},
+		{
+			name:         "Escapes inside double quotes",
+			line:         `"say \"hi\" \\ \n"`,
+			expectedArgs: []string{`say "hi" \ \n`},
+		},
+		{
+			name:         "No escapes inside single quotes",
+			line:         `'a\b' 'c"d'`,
+			expectedArgs: []string{`a\b`, `c"d`},
+		},
+		{
+			name:         "Trailing backslash",
+			line:         `a\`,
+			expectedArgs: []string{`a\`},
+		},
+		{
+			name:        "Unterminated double quote",
+			line:        `register "dalaoqi`,
+			expectedErr: ErrUnterminatedQuote,
+		},
+		{
+			name:        "Unterminated single quote",
+			line:        `register 'dalaoqi`,
+			expectedErr: ErrUnterminatedQuote,
+		},
+		{
+			name:        "Escaped closing double quote",
+			line:        `register "dalaoqi\"`,
+			expectedErr: ErrUnterminatedQuote,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args, err := SplitArguments(test.line)
+			if err != test.expectedErr {
+				t.Fatalf("SplitArguments(%q) error = %v, expected: %v", test.line, err, test.expectedErr)
+			}
+			if !reflect.DeepEqual(args, test.expectedArgs) {
+				t.Errorf("SplitArguments(%q) = %q, expected: %q", test.line, args, test.expectedArgs)
+			}
+		})
+	}
+}
+
+// The reference grammar of the arguments, as regular expressions. The
+// whitespace class is the one of unicode.IsSpace.
+const (
+	space    = `\t\n\v\f\r\x{85}\x{2028}\x{2029}\p{Zs}`
+	escape   = `\\(?:.|$)`
+	single   = `'[^']*'`
+	double   = `"(?:[^"\\]|\\.)*"`
+	argument = `(?s)(?:[^` + space + `'"\\]|` + escape + `|` + single + `|` + double + `)+`
+)
+
+var (
+	argumentRe = regexp.MustCompile(argument)
+	partRe     = regexp.MustCompile(`(?s)` + escape + `|` + single + `|` + double + `|[^'"\\]+`)
+	doubleRe   = regexp.MustCompile(`\\(["\\])`)
+	spaceRe    = regexp.MustCompile(`^[` + space + `]*$`)
+)
+
+// referenceSplit splits the line with the reference grammar, without the
+// comment an argument starting with # starts when comments is true
+func referenceSplit(line string, comments bool) ([]string, error) {
+	var args []string
+	last := 0
+	for _, loc := range argumentRe.FindAllStringIndex(line, -1) {
+		// Only whitespace may separate the arguments
+		if !spaceRe.MatchString(line[last:loc[0]]) {
+			return nil, ErrUnterminatedQuote
+		}
+		if comments && line[loc[0]] == '#' {
+			return args, nil
+		}
+		last = loc[1]
+
+		var arg strings.Builder
+		for _, part := range partRe.FindAllString(line[loc[0]:loc[1]], -1) {
+			switch {
+			case part == `\`:
+				arg.WriteString(part)
+			case strings.HasPrefix(part, `\`):
+				arg.WriteString(part[1:])
+			case strings.HasPrefix(part, `'`):
+				arg.WriteString(part[1 : len(part)-1])
+			case strings.HasPrefix(part, `"`):
+				arg.WriteString(doubleRe.ReplaceAllString(part[1:len(part)-1], "$1"))
+			default:
+				arg.WriteString(part)
+			}
+		}
+		args = append(args, arg.String())
+	}
+	if !spaceRe.MatchString(line[last:]) {
+		return nil, ErrUnterminatedQuote
+	}
+	return args, nil
+}
+
+func FuzzSplitArguments(f *testing.F) {
+	for _, seed := range []string{
+		`register dalaoqi`,
+		`create-folder dalaoqi "meeting   docs" 'the docs'`,
+		`a"b c"'d'e "" ''`,
+		`a\ b \"c\" \\ \' "x\"y\\z\n" 'q\'`,
+		`register "dalaoqi`,
+		"a b c　d\x85e",
+		"\xff\"\xfe\" \\\xff",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		args, err := SplitArguments(line)
+		expectedArgs, expectedErr := referenceSplit(line, false)
+		if err != expectedErr {
+			t.Fatalf("SplitArguments(%q) error = %v, expected: %v", line, err, expectedErr)
+		}
+		if !reflect.DeepEqual(args, expectedArgs) {
+			t.Errorf("SplitArguments(%q) = %q, expected: %q", line, args, expectedArgs)
+		}
+	})
+}
+
+func TestStripComment(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected string
+	}{
+		{line: "register dalaoqi", expected: "register dalaoqi"},
+		{line: "register dalaoqi  # the owner", expected: "register dalaoqi  "},
+		{line: "# a whole line", expected: ""},
+		{line: `create-file dalaoqi docs#1 "#notes" '#todo' \#done`, expected: `create-file dalaoqi docs#1 "#notes" '#todo' \#done`},
+		{line: `write-file dalaoqi docs notes "a \" # b" # c`, expected: `write-file dalaoqi docs notes "a \" # b" `},
+		{line: `register "dalaoqi # not a comment`, expected: `register "dalaoqi # not a comment`},
+	}
+
+	for _, test := range testCases {
+		if got := StripComment(test.line); got != test.expected {
+			t.Errorf("StripComment(%q) = %q, expected: %q", test.line, got, test.expected)
+		}
+	}
+}
+
+func FuzzStripComment(f *testing.F) {
+	for _, seed := range []string{
+		`register dalaoqi # the owner`,
+		`a#b "#" '#' \# # c "d`,
+		`"a \" # b" # c`,
+		`register "dalaoqi # x`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		args, err := SplitArguments(StripComment(line))
+		expectedArgs, expectedErr := referenceSplit(line, true)
+		if err != expectedErr {
+			t.Fatalf("SplitArguments(StripComment(%q)) error = %v, expected: %v", line, err, expectedErr)
+		}
+		if !reflect.DeepEqual(args, expectedArgs) {
+			t.Errorf("SplitArguments(StripComment(%q)) = %q, expected: %q", line, args, expectedArgs)
+		}
+	})
+}
+
+func TestEditDistance(t *testing.T) {
+	testCases := []struct {
+		a, b     string
+		expected int
+	}{
+		{a: "", b: "", expected: 0},
+		{a: "", b: "cat", expected: 3},
+		{a: "cat", b: "cat", expected: 0},
+		{a: "cta", b: "cat", expected: 2},
+		{a: "regster", b: "register", expected: 1},
+		{a: "kitten", b: "sitting", expected: 3},
+		{a: "résumé", b: "resume", expected: 2},
+	}
+
+	for _, test := range testCases {
+		if got := EditDistance(test.a, test.b); got != test.expected {
+			t.Errorf("EditDistance(%q, %q) = %d, expected: %d", test.a, test.b, got, test.expected)
+		}
+	}
+}
+
+func TestSplitLastArgument(t *testing.T) {
+	testCases := []struct {
+		line            string
+		expectedHead    string
+		expectedArgs    []string
+		expectedPartial string
+	}{
+		{line: "", expectedHead: "", expectedArgs: nil, expectedPartial: ""},
+		{line: "list-f", expectedHead: "", expectedArgs: nil, expectedPartial: "list-f"},
+		{line: "cat-file ", expectedHead: "cat-file ", expectedArgs: []string{"cat-file"}, expectedPartial: ""},
+		{line: "cat-file dalaoqi do", expectedHead: "cat-file dalaoqi ", expectedArgs: []string{"cat-file", "dalaoqi"}, expectedPartial: "do"},
+		{line: `cat-file dalaoqi "meeting no`, expectedHead: "cat-file dalaoqi ", expectedArgs: []string{"cat-file", "dalaoqi"}, expectedPartial: "meeting no"},
+		{line: `cat-file dalaoqi 'a b' meeting\ no`, expectedHead: "cat-file dalaoqi 'a b' ", expectedArgs: []string{"cat-file", "dalaoqi", "a b"}, expectedPartial: "meeting no"},
+	}
+
+	for _, test := range testCases {
+		head, args, partial, err := SplitLastArgument(test.line)
+		if err != nil {
+			t.Errorf("SplitLastArgument(%q) has error: %s", test.line, err)
+			continue
+		}
+		if head != test.expectedHead || !reflect.DeepEqual(args, test.expectedArgs) || partial != test.expectedPartial {
+			t.Errorf("SplitLastArgument(%q) = %q, %q, %q, expected: %q, %q, %q", test.line, head, args, partial, test.expectedHead, test.expectedArgs, test.expectedPartial)
+		}
+	}
+
+	for _, arg := range []string{"notes", "", "meeting notes", `say "hi"`, `a\b`} {
+		args, err := SplitArguments("cat " + QuoteArgument(arg))
+		if err != nil || len(args) != 2 || args[1] != arg {
+			t.Errorf("QuoteArgument(%q) doesn't round-trip: %q, %v", arg, args, err)
+		}
+	}
+}